@@ -5,8 +5,20 @@ type AddressMode byte
 
 // Known address modes.
 const (
-	ImmediateConstant AddressMode = 0 // x = 123
-	IndirectConstant  AddressMode = 1 // x = mem[123]
-	ImmediateRegister AddressMode = 2 // x = r0
-	IndirectRegister  AddressMode = 3 // x = mem[r0]
+	ImmediateConstant      AddressMode = 0 // x = 123
+	IndirectConstant       AddressMode = 1 // x = mem[123]
+	ImmediateRegister      AddressMode = 2 // x = r0
+	IndirectRegister       AddressMode = 3 // x = mem[r0]
+	IndirectRegisterOffset AddressMode = 4 // x = mem[r0 + 123]
+	IndirectRegisterIndex  AddressMode = 5 // x = mem[r0 + r1]
 )
+
+// ExtendedOperand is the register index which marks an IndirectRegister
+// operand as one of the extended address modes. The operand's attribute
+// byte is followed by a byte holding the base register in the high nibble
+// and the index register in the low nibble. An index of ExtendedOperand
+// means the index is a 16-bit constant, which follows the second byte.
+//
+// The extended modes do not fit in the 2 bits of the operand's address
+// mode field, which is why they are never encoded directly.
+const ExtendedOperand = 0xf
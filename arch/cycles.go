@@ -0,0 +1,40 @@
+package arch
+
+// Cycles returns the base number of cycles it takes to execute the given
+// opcode. This excludes the cost of operand access. See AddressMode.Cycles.
+// Returns -1 if the opcode is not recognized.
+func Cycles(opcode int) int {
+	switch opcode {
+	case NOP, HALT, MOV, WAIT,
+		ADD, SUB, SHL, SHR, AND, OR, XOR, ABS, INC, DEC,
+		CEQ, CNE, CGT, CGE, CLT, CLE, ADC, SBC:
+		return 1
+	case PUSH, POP, SEED, JMP, JEZ, JNZ:
+		return 2
+	case CALL, CLEZ, CLNZ, RET:
+		return 3
+	case MUL, RNG, HWA, IRET, WMUL:
+		return 4
+	case DIV, MOD, INT:
+		return 8
+	case POW:
+		return 16
+	}
+	return -1
+}
+
+// Cycles returns the number of extra cycles it takes to access an operand
+// with this address mode.
+func (m AddressMode) Cycles() int {
+	switch m {
+	case ImmediateConstant:
+		return 1
+	case IndirectConstant:
+		return 2
+	case IndirectRegister:
+		return 1
+	case IndirectRegisterOffset, IndirectRegisterIndex:
+		return 2
+	}
+	return 0
+}
@@ -49,6 +49,10 @@ const (
 	IRET
 	INC
 	DEC
+
+	ADC
+	SBC
+	WMUL
 )
 
 // Opcode returns the opcode for the given instruction name.
@@ -141,6 +145,13 @@ func Opcode(name string) (int, bool) {
 		return INC, true
 	case "DEC":
 		return DEC, true
+
+	case "ADC":
+		return ADC, true
+	case "SBC":
+		return SBC, true
+	case "WMUL":
+		return WMUL, true
 	}
 
 	return 0, false
@@ -231,6 +242,13 @@ func Name(opcode int) (string, bool) {
 		return "INC", true
 	case DEC:
 		return "DEC", true
+
+	case ADC:
+		return "ADC", true
+	case SBC:
+		return "SBC", true
+	case WMUL:
+		return "WMUL", true
 	}
 
 	return "", false
@@ -240,7 +258,7 @@ func Name(opcode int) (string, bool) {
 // Returns -1 if the opcode is not recognized.
 func Argc(opcode int) int {
 	switch opcode {
-	case ADD, SUB, MUL, DIV, MOD, SHL, SHR, AND, OR, XOR, HWA, POW, RNG:
+	case ADD, SUB, MUL, DIV, MOD, SHL, SHR, AND, OR, XOR, HWA, POW, RNG, ADC, SBC, WMUL:
 		return 3
 	case MOV, CEQ, CNE, CGT, CGE, CLT, CLE, ABS:
 		return 2
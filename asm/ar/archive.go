@@ -10,8 +10,17 @@ import (
 
 // Archive defines a complete, compiled archive.
 type Archive struct {
-	Debug        Debug  // Optional debug symbols.
-	Instructions []byte // Compiled code.
+	Debug        Debug     // Optional debug symbols.
+	Instructions []byte    // Compiled code, as it is laid out in memory from address 0.
+	Entry        int       // Address at which execution starts.
+	Sections     []Section // Optional memory layout. Defaults to a single section holding all of Instructions.
+}
+
+// Section defines a contiguous block of program memory.
+type Section struct {
+	Name    string // Section name, like "code".
+	Address int    // Memory address of the first byte.
+	Data    []byte // Section contents.
 }
 
 // New creates a new, empty archive.
@@ -36,6 +45,19 @@ func (a *Archive) String() string {
 		}
 	}
 
+	if len(a.Debug.Names) > 0 {
+		fmt.Fprintf(&sb, "Symbol table (%d):\n", len(a.Debug.Names))
+		for _, v := range a.Debug.Names {
+			fmt.Fprintf(&sb, " %-8s %04x: %s\n", v.Kind, v.Value, v.Name)
+		}
+	}
+
+	fmt.Fprintf(&sb, "Entry point: %04x\n", a.Entry)
+	fmt.Fprintf(&sb, "Sections (%d):\n", len(a.sections()))
+	for _, v := range a.sections() {
+		fmt.Fprintf(&sb, " %04x-%04x: %s\n", v.Address, v.Address+len(v.Data), v.Name)
+	}
+
 	if len(a.Instructions) > 0 {
 		fmt.Fprintf(&sb, "Instructions:\n")
 		fmt.Fprintf(&sb, "%s\n", hex.Dump(a.Instructions))
@@ -0,0 +1,136 @@
+package ar
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	a := New()
+	a.Entry = 0x10
+	a.Sections = []Section{
+		{Name: "code", Address: 0x10, Data: []byte{1, 2, 3}},
+		{Name: "data", Address: 0x20, Data: []byte{4, 5}},
+	}
+	a.Debug.Files = []string{"main.svm"}
+	a.Debug.Symbols = []DebugData{{Address: 0x10, Line: 2, Col: 5, Offset: 12}}
+	a.Debug.AddName("main", Label, 0x10)
+
+	var buf bytes.Buffer
+	if err := a.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsArchive(buf.Bytes()) {
+		t.Fatalf("missing archive header")
+	}
+
+	b := New()
+	if err := b.Load(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	want := make([]byte, 0x22)
+	copy(want[0x10:], []byte{1, 2, 3})
+	copy(want[0x20:], []byte{4, 5})
+
+	if !bytes.Equal(b.Instructions, want) || b.LoadAddress() != 0x10 || b.Entry != 0x10 {
+		t.Fatalf("unexpected archive contents:\n%s", b)
+	}
+
+	if !reflect.DeepEqual(a.Sections, b.Sections) || !reflect.DeepEqual(a.Debug, b.Debug) {
+		t.Fatalf("archive mismatch:\nwant: %+v\nhave: %+v", a, b)
+	}
+
+	data := buf.Bytes()
+	data[len(Magic)] = Version + 1
+	if err := b.Load(bytes.NewReader(data)); err == nil {
+		t.Fatalf("expected error for unsupported version")
+	}
+}
+
+func TestLoadFileLegacy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var debug Debug
+	debug.Files = []string{"main.svm"}
+	debug.Symbols = []DebugData{{Address: 0, Line: 1, Col: 1}}
+
+	file := filepath.Join(dir, "main.a")
+	if err := ioutil.WriteFile(file, []byte{0, 1}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Older debug files have fixed size fields and no symbol table.
+	var legacy bytes.Buffer
+	writeU8(&legacy, 1)
+	writeBytes(&legacy, []byte("main.svm"))
+	writeU16(&legacy, 1)
+	writeU16(&legacy, 0)
+	writeU8(&legacy, 0)
+	writeU16(&legacy, 1)
+	writeU16(&legacy, 1)
+	writeU32(&legacy, 0)
+	writeU8(&legacy, 0)
+
+	if err := ioutil.WriteFile(DebugFile(file), legacy.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := LoadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(a.Instructions, []byte{0, 1}) || a.Entry != 0 || !reflect.DeepEqual(a.Debug, debug) {
+		t.Fatalf("unexpected archive contents:\n%s", a)
+	}
+}
+
+func TestDebugLimits(t *testing.T) {
+	var debug Debug
+	for i := 0; i < 300; i++ {
+		debug.Files = append(debug.Files, fmt.Sprintf("file%d.svm", i))
+	}
+
+	debug.Symbols = make([]DebugData, 70000)
+	for i := range debug.Symbols {
+		debug.Symbols[i] = DebugData{Address: i & 0xffff, File: i % len(debug.Files), Line: i, Col: 70000, Offset: i * 8}
+	}
+	debug.AddName("far", Constant, -1<<40)
+
+	var buf bytes.Buffer
+	if err := debug.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var loaded Debug
+	if err := loaded.Load(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(loaded, debug) {
+		t.Fatalf("debug data mismatch after round trip")
+	}
+
+	// Values which can not be represented are rejected.
+	for _, sym := range []DebugData{
+		{Address: MemoryCapacity},
+		{File: len(debug.Files)},
+		{Line: -1},
+	} {
+		bad := Debug{Files: debug.Files, Symbols: []DebugData{sym}}
+		if err := bad.Save(ioutil.Discard); err == nil {
+			t.Fatalf("expected error for %+v", sym)
+		}
+	}
+}
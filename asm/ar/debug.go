@@ -1,9 +1,13 @@
 package ar
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"runtime"
+	"sort"
+	"strings"
 
 	"github.com/pkg/errors"
 )
@@ -18,16 +22,75 @@ const (
 	Breakpoint DebugFlags = 1 << iota
 )
 
+// SymbolKind defines the kind of a named symbol.
+type SymbolKind byte
+
+// Known symbol kinds.
+const (
+	Label    SymbolKind = 0
+	Constant SymbolKind = 1
+	Macro    SymbolKind = 2
+)
+
+// String returns the name of the symbol kind.
+func (k SymbolKind) String() string {
+	switch k {
+	case Label:
+		return "label"
+	case Constant:
+		return "constant"
+	case Macro:
+		return "macro"
+	}
+	return fmt.Sprintf("SymbolKind(%02x)", byte(k))
+}
+
+// Symbol defines a named label, constant or macro from the program source.
+type Symbol struct {
+	Name  string     // Fully qualified name. Scopes are separated with a '/'.
+	Kind  SymbolKind // Kind of symbol.
+	Value int        // Address of a label or value of a constant. Zero for macros.
+}
+
 // Debug defines any debug data stored in an archive.
 type Debug struct {
 	Files   []string    // File names associated with the source that makes up this archive. Only set when there are debug symbols.
 	Symbols []DebugData // Per-instruction source context.
+	Names   []Symbol    // Named symbols, sorted by name.
 }
 
 // Clear empties all data.
 func (d *Debug) Clear() {
 	d.Files = nil
 	d.Symbols = nil
+	d.Names = nil
+}
+
+// Empty returns true if there is no debug data.
+func (d *Debug) Empty() bool {
+	return len(d.Files) == 0 && len(d.Symbols) == 0 && len(d.Names) == 0
+}
+
+// AddName adds a named symbol to the symbol table.
+func (d *Debug) AddName(name string, kind SymbolKind, value int) {
+	index := sort.Search(len(d.Names), func(i int) bool {
+		return d.Names[i].Name >= name
+	})
+
+	d.Names = append(d.Names, Symbol{})
+	copy(d.Names[index+1:], d.Names[index:])
+	d.Names[index] = Symbol{Name: name, Kind: kind, Value: value}
+}
+
+// FindName returns the symbol with the given fully qualified name.
+// The name is not case sensitive. Returns nil if there is none.
+func (d *Debug) FindName(name string) *Symbol {
+	for i := range d.Names {
+		if strings.EqualFold(d.Names[i].Name, name) {
+			return &d.Names[i]
+		}
+	}
+	return nil
 }
 
 // Find returns the debug data associated with the given address.
@@ -41,10 +104,111 @@ func (d *Debug) Find(addr int) *DebugData {
 	return nil
 }
 
-// Load reads debug data from the given stream.
+// DebugMagic marks the start of debug data in the current format.
+// Debug data written by older versions has no header at all.
+const DebugMagic = "SVMD"
+
+// DebugVersion is the current version of the debug data format.
+// Version 1 is the headerless format with fixed size fields.
+const DebugVersion = 2
+
+// Debug data has the following layout. Integers marked uvarint and varint
+// use the encoding from encoding/binary, so none of the tables or fields
+// have a size limit beyond what Validate enforces.
+//
+//	magic        [4]byte   "SVMD"
+//	version      uvarint   Format version.
+//	files        uvarint   Number of files, followed by the file names:
+//	  name       uvarint + [n]byte
+//	symbols      uvarint   Number of debug symbols, followed by the symbols:
+//	  address    uvarint
+//	  file       uvarint   Index into the file table.
+//	  line       uvarint
+//	  col        uvarint
+//	  offset     uvarint
+//	  flags      u8
+//	names        uvarint   Number of named symbols, followed by the names:
+//	  name       uvarint + [n]byte
+//	  kind       u8
+//	  value      varint
+
+// maxDebugCount is the largest file, symbol or name count accepted
+// when loading debug data. It guards against allocating huge tables
+// for corrupt input.
+const maxDebugCount = 1 << 24
+
+// Validate returns an error if the debug data holds values which can
+// not be stored, or symbols which refer to unknown files.
+func (d *Debug) Validate() error {
+	for i, sym := range d.Symbols {
+		switch {
+		case sym.Address < 0 || sym.Address >= MemoryCapacity:
+			return errors.Errorf("ar: debug symbol %d: address %x is out of range", i, sym.Address)
+		case sym.File < 0 || sym.File >= len(d.Files):
+			return errors.Errorf("ar: debug symbol %d: file index %d is out of range", i, sym.File)
+		case sym.Line < 0 || sym.Col < 0 || sym.Offset < 0:
+			return errors.Errorf("ar: debug symbol %d: invalid source position %d:%d+%d", i, sym.Line, sym.Col, sym.Offset)
+		}
+	}
+
+	for _, sym := range d.Names {
+		switch {
+		case len(sym.Name) == 0:
+			return errors.Errorf("ar: symbol table holds an unnamed %s", sym.Kind)
+		case sym.Kind > Macro:
+			return errors.Errorf("ar: symbol %q has unknown kind %s", sym.Name, sym.Kind)
+		}
+	}
+
+	return nil
+}
+
+// Load reads debug data from the given stream. Data written by older
+// versions of the assembler is read as well.
 func (d *Debug) Load(r io.Reader) (err error) {
 	defer recoverOnPanic(&err)
+	d.Clear()
+
+	head := make([]byte, len(DebugMagic))
+	n, err := io.ReadFull(r, head)
+	if string(head[:n]) != DebugMagic {
+		d.loadLegacy(io.MultiReader(bytes.NewReader(head[:n]), r))
+		return d.Validate()
+	}
+	check(err)
 
+	if version := readUvarint(r); version != DebugVersion {
+		return errors.Errorf("ar: unsupported debug data version %d", version)
+	}
+
+	// Empty tables are left nil, as they are after Clear.
+	if n := readCount(r); n > 0 {
+		d.Files = make([]string, n)
+		for i := range d.Files {
+			d.Files[i] = readString(r)
+		}
+	}
+
+	if n := readCount(r); n > 0 {
+		d.Symbols = make([]DebugData, n)
+		for i := range d.Symbols {
+			d.Symbols[i].read(r)
+		}
+	}
+
+	if n := readCount(r); n > 0 {
+		d.Names = make([]Symbol, n)
+		for i := range d.Names {
+			d.Names[i].read(r)
+		}
+	}
+
+	return d.Validate()
+}
+
+// loadLegacy reads debug data in the headerless format with 8-bit file
+// and 16-bit symbol counts.
+func (d *Debug) loadLegacy(r io.Reader) {
 	d.Files = make([]string, readU8(r))
 	for i := range d.Files {
 		d.Files[i] = string(readBytes(r))
@@ -52,26 +216,51 @@ func (d *Debug) Load(r io.Reader) (err error) {
 
 	d.Symbols = make([]DebugData, readU16(r))
 	for i := range d.Symbols {
-		d.Symbols[i].read(r)
+		d.Symbols[i].readLegacy(r)
 	}
 
-	return
+	// The symbol table was added later on. Older files end here.
+	var count uint16
+	err := binary.Read(r, endian, &count)
+	if err == io.EOF {
+		return
+	}
+	check(err)
+
+	d.Names = make([]Symbol, count)
+	for i := range d.Names {
+		d.Names[i].readLegacy(r)
+	}
 }
 
-// Save writes debug data to the given stream.
+// Save writes debug data to the given stream. Returns an error if
+// the data does not pass validation.
 func (d *Debug) Save(w io.Writer) (err error) {
+	if err = d.Validate(); err != nil {
+		return
+	}
+
 	defer recoverOnPanic(&err)
 
-	writeU8(w, uint8(len(d.Files)))
+	_, err = io.WriteString(w, DebugMagic)
+	check(err)
+	writeUvarint(w, DebugVersion)
+
+	writeUvarint(w, uint64(len(d.Files)))
 	for i := range d.Files {
-		writeBytes(w, []byte(d.Files[i]))
+		writeString(w, d.Files[i])
 	}
 
-	writeU16(w, uint16(len(d.Symbols)))
+	writeUvarint(w, uint64(len(d.Symbols)))
 	for i := range d.Symbols {
 		d.Symbols[i].write(w)
 	}
 
+	writeUvarint(w, uint64(len(d.Names)))
+	for i := range d.Names {
+		d.Names[i].write(w)
+	}
+
 	return
 }
 
@@ -86,6 +275,15 @@ type DebugData struct {
 }
 
 func (d *DebugData) read(r io.Reader) {
+	d.Address = readInt(r)
+	d.File = readInt(r)
+	d.Line = readInt(r)
+	d.Col = readInt(r)
+	d.Offset = readInt(r)
+	d.Flags = DebugFlags(readU8(r))
+}
+
+func (d *DebugData) readLegacy(r io.Reader) {
 	d.Address = int(readU16(r))
 	d.File = int(readU8(r))
 	d.Line = int(readU16(r))
@@ -95,14 +293,32 @@ func (d *DebugData) read(r io.Reader) {
 }
 
 func (d *DebugData) write(w io.Writer) {
-	writeU16(w, uint16(d.Address))
-	writeU8(w, uint8(d.File))
-	writeU16(w, uint16(d.Line))
-	writeU16(w, uint16(d.Col))
-	writeU32(w, uint32(d.Offset))
+	writeUvarint(w, uint64(d.Address))
+	writeUvarint(w, uint64(d.File))
+	writeUvarint(w, uint64(d.Line))
+	writeUvarint(w, uint64(d.Col))
+	writeUvarint(w, uint64(d.Offset))
 	writeU8(w, uint8(d.Flags))
 }
 
+func (s *Symbol) read(r io.Reader) {
+	s.Name = readString(r)
+	s.Kind = SymbolKind(readU8(r))
+	s.Value = int(readVarint(r))
+}
+
+func (s *Symbol) readLegacy(r io.Reader) {
+	s.Name = string(readBytes(r))
+	s.Kind = SymbolKind(readU8(r))
+	s.Value = int(readI64(r))
+}
+
+func (s *Symbol) write(w io.Writer) {
+	writeString(w, s.Name)
+	writeU8(w, uint8(s.Kind))
+	writeVarint(w, int64(s.Value))
+}
+
 func recoverOnPanic(err *error) {
 	x := recover()
 	if x == nil {
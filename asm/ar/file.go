@@ -0,0 +1,211 @@
+package ar
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Magic identifies archive files. It is followed by the format version.
+const Magic = "SVMA"
+
+// Version is the current version of the archive file format.
+const Version = 1
+
+// MemoryCapacity is the size of the address space a program is loaded into.
+const MemoryCapacity = 0x10000
+
+// Archive header flags.
+const (
+	hasDebug = 1 << iota // An embedded debug block follows the sections.
+)
+
+// Archive files have the following layout. Values are little endian.
+//
+//	magic        [4]byte   "SVMA"
+//	version      u8        Format version.
+//	flags        u8        Bit 0: an embedded debug block follows the sections.
+//	load address u16       Lowest address occupied by any section.
+//	entry        u16       Address at which execution starts.
+//	sections     u16       Number of sections, followed by the sections:
+//	  name       u16 + [n]byte
+//	  address    u16       Memory address of the first byte.
+//	  size       u32       Size of the data.
+//	  data       [size]byte
+//	debug        ...       Optional. In the format written by Debug.Save.
+//
+// Programs built by older versions of the assembler are stored as raw
+// code, with the debug data in a separate file. See LoadFile.
+
+// IsArchive returns true if data starts with an archive header.
+func IsArchive(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(Magic))
+}
+
+// LoadAddress returns the lowest address occupied by any section.
+func (a *Archive) LoadAddress() int {
+	sections := a.sections()
+	if len(sections) == 0 {
+		return 0
+	}
+
+	addr := sections[0].Address
+	for _, s := range sections[1:] {
+		if s.Address < addr {
+			addr = s.Address
+		}
+	}
+	return addr
+}
+
+// sections returns the archive's sections. If none are defined, this is
+// a single code section holding all instructions.
+func (a *Archive) sections() []Section {
+	if len(a.Sections) > 0 || len(a.Instructions) == 0 {
+		return a.Sections
+	}
+	return []Section{{Name: "code", Address: 0, Data: a.Instructions}}
+}
+
+// Save writes the archive to the given stream. Debug data is embedded if there is any.
+func (a *Archive) Save(w io.Writer) (err error) {
+	defer recoverOnPanic(&err)
+
+	sections := a.sections()
+	for _, s := range sections {
+		if s.Address < 0 || s.Address+len(s.Data) > MemoryCapacity {
+			return errors.Errorf("ar: section %q at %04x with size %d does not fit in memory", s.Name, s.Address, len(s.Data))
+		}
+	}
+
+	if a.Entry < 0 || a.Entry >= MemoryCapacity {
+		return errors.Errorf("ar: entry point %04x is out of range", a.Entry)
+	}
+
+	var flags uint8
+	if !a.Debug.Empty() {
+		flags |= hasDebug
+	}
+
+	_, err = io.WriteString(w, Magic)
+	check(err)
+	writeU8(w, Version)
+	writeU8(w, flags)
+	writeU16(w, uint16(a.LoadAddress()))
+	writeU16(w, uint16(a.Entry))
+
+	writeU16(w, uint16(len(sections)))
+	for _, s := range sections {
+		writeBytes(w, []byte(s.Name))
+		writeU16(w, uint16(s.Address))
+		writeU32(w, uint32(len(s.Data)))
+		_, err = w.Write(s.Data)
+		check(err)
+	}
+
+	if flags&hasDebug != 0 {
+		return a.Debug.Save(w)
+	}
+
+	return nil
+}
+
+// Load reads an archive from the given stream. The stream must start with
+// an archive header. Instructions is rebuilt from the sections.
+func (a *Archive) Load(r io.Reader) (err error) {
+	defer recoverOnPanic(&err)
+
+	magic := make([]byte, len(Magic))
+	_, err = io.ReadFull(r, magic)
+	check(err)
+
+	if string(magic) != Magic {
+		return errors.New("ar: not an archive")
+	}
+
+	if v := readU8(r); v != Version {
+		return errors.Errorf("ar: unsupported archive version %d", v)
+	}
+
+	flags := readU8(r)
+	load := int(readU16(r))
+	a.Entry = int(readU16(r))
+
+	a.Sections = make([]Section, readU16(r))
+	size := 0
+	for i := range a.Sections {
+		s := &a.Sections[i]
+		s.Name = string(readBytes(r))
+		s.Address = int(readU16(r))
+
+		n := readU32(r)
+		if int64(s.Address)+int64(n) > MemoryCapacity {
+			return errors.Errorf("ar: section %q at %04x with size %d does not fit in memory", s.Name, s.Address, n)
+		}
+
+		s.Data = make([]byte, n)
+		_, err = io.ReadFull(r, s.Data)
+		check(err)
+
+		if s.Address+len(s.Data) > size {
+			size = s.Address + len(s.Data)
+		}
+	}
+
+	if len(a.Sections) > 0 && a.LoadAddress() != load {
+		return errors.Errorf("ar: load address %04x does not match the sections", load)
+	}
+
+	a.Instructions = make([]byte, size)
+	for _, s := range a.Sections {
+		copy(a.Instructions[s.Address:], s.Data)
+	}
+
+	a.Debug.Clear()
+	if flags&hasDebug != 0 {
+		return a.Debug.Load(r)
+	}
+
+	return nil
+}
+
+// LoadFile reads the program in the given file.
+//
+// This is either an archive, or raw code written by older versions of the
+// assembler. Raw code is loaded at address 0. Its debug data is read from
+// the file returned by DebugFile, if it exists.
+func LoadFile(file string) (*Archive, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	a := New()
+	if IsArchive(data) {
+		return a, a.Load(bytes.NewReader(data))
+	}
+
+	a.Instructions = data
+
+	fd, err := os.Open(DebugFile(file))
+	if os.IsNotExist(err) {
+		return a, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer fd.Close()
+	return a, a.Debug.Load(fd)
+}
+
+// DebugFile returns the name of the file holding the separate debug data
+// for the given program or image file. It has the same name with a .dbg
+// extension.
+func DebugFile(file string) string {
+	return strings.TrimSuffix(file, filepath.Ext(file)) + ".dbg"
+}
@@ -2,7 +2,9 @@ package ar
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
+	"math"
 )
 
 func check(err error) {
@@ -126,3 +128,77 @@ func writeBytes(w io.Writer, p []byte) {
 	_, err := w.Write(p)
 	check(err)
 }
+
+// byteReader adapts an io.Reader to an io.ByteReader without reading
+// past the bytes it is asked for.
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var p [1]byte
+	_, err := io.ReadFull(r.Reader, p[:])
+	return p[0], err
+}
+
+func asByteReader(r io.Reader) io.ByteReader {
+	if br, ok := r.(io.ByteReader); ok {
+		return br
+	}
+	return byteReader{r}
+}
+
+func readUvarint(r io.Reader) uint64 {
+	v, err := binary.ReadUvarint(asByteReader(r))
+	check(err)
+	return v
+}
+
+func readVarint(r io.Reader) int64 {
+	v, err := binary.ReadVarint(asByteReader(r))
+	check(err)
+	return v
+}
+
+// readInt reads an unsigned varint which must fit in an int.
+func readInt(r io.Reader) int {
+	v := readUvarint(r)
+	if v > math.MaxInt32 {
+		panic(fmt.Errorf("value %d is out of range", v))
+	}
+	return int(v)
+}
+
+// readCount reads an unsigned varint table size.
+func readCount(r io.Reader) int {
+	v := readUvarint(r)
+	if v > maxDebugCount {
+		panic(fmt.Errorf("count %d exceeds the limit of %d", v, maxDebugCount))
+	}
+	return int(v)
+}
+
+func readString(r io.Reader) string {
+	p := make([]byte, readCount(r))
+	_, err := io.ReadFull(r, p)
+	check(err)
+	return string(p)
+}
+
+func writeUvarint(w io.Writer, v uint64) {
+	var p [binary.MaxVarintLen64]byte
+	_, err := w.Write(p[:binary.PutUvarint(p[:], v)])
+	check(err)
+}
+
+func writeVarint(w io.Writer, v int64) {
+	var p [binary.MaxVarintLen64]byte
+	_, err := w.Write(p[:binary.PutVarint(p[:], v)])
+	check(err)
+}
+
+func writeString(w io.Writer, s string) {
+	writeUvarint(w, uint64(len(s)))
+	_, err := io.WriteString(w, s)
+	check(err)
+}
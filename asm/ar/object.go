@@ -0,0 +1,255 @@
+package ar
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ObjectMagic marks the start of a relocatable object file.
+const ObjectMagic = "SVMO"
+
+// ObjectVersion is the current version of the object file format.
+const ObjectVersion = 1
+
+// Object defines a relocatable object, as produced by the assembler for a
+// single module. Its code is assembled as if it is loaded at address 0.
+// The linker picks the final address and patches the values listed in
+// the relocation table accordingly.
+type Object struct {
+	Debug       Debug        // Optional debug symbols. Addresses are relative to the start of the code.
+	Code        []byte       // Compiled code.
+	Exports     []Symbol     // Symbols made available to other objects. Label values are relative to the start of the code.
+	Imports     []string     // Names of symbols defined in other objects.
+	Relocations []Relocation // Values which depend on the address the object is loaded at.
+}
+
+// Relocation defines a 16-bit value in an object's code which must be
+// adjusted when the object is linked.
+type Relocation struct {
+	Offset int    // Offset of the big endian value in the code.
+	Symbol string // Imported symbol whose address is added to the value. If empty, the object's own address is added.
+}
+
+// NewObject creates a new, empty object.
+func NewObject() *Object {
+	return &Object{}
+}
+
+// String returns a human-readable dump of the object's contents.
+func (o *Object) String() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "Exports (%d):\n", len(o.Exports))
+	for _, v := range o.Exports {
+		fmt.Fprintf(&sb, " %-8s %04x: %s\n", v.Kind, v.Value, v.Name)
+	}
+
+	fmt.Fprintf(&sb, "Imports (%d):\n", len(o.Imports))
+	for _, v := range o.Imports {
+		fmt.Fprintf(&sb, " %s\n", v)
+	}
+
+	fmt.Fprintf(&sb, "Relocations (%d):\n", len(o.Relocations))
+	for _, v := range o.Relocations {
+		if len(v.Symbol) == 0 {
+			fmt.Fprintf(&sb, " %04x: base\n", v.Offset)
+		} else {
+			fmt.Fprintf(&sb, " %04x: %s\n", v.Offset, v.Symbol)
+		}
+	}
+
+	fmt.Fprintf(&sb, "Code (%d bytes)\n", len(o.Code))
+	return sb.String()
+}
+
+// Object files have the following layout. Integers marked uvarint and
+// varint use the encoding from encoding/binary.
+//
+//	magic        [4]byte   "SVMO"
+//	version      u8        Format version.
+//	flags        u8        Bit 0: an embedded debug block follows the relocations.
+//	code         uvarint + [n]byte
+//	exports      uvarint   Number of exported symbols, followed by the symbols:
+//	  name       uvarint + [n]byte
+//	  kind       u8        Label or Constant.
+//	  value      varint
+//	imports      uvarint   Number of imported symbols, followed by their names:
+//	  name       uvarint + [n]byte
+//	relocations  uvarint   Number of relocations, followed by the relocations:
+//	  offset     uvarint
+//	  symbol     uvarint   Index into the imports, plus one. Zero for the object itself.
+//	debug        ...       Optional. In the format written by Debug.Save.
+
+// IsObject returns true if data starts with an object file header.
+func IsObject(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(ObjectMagic))
+}
+
+// Validate returns an error if the object does not fit in memory, or if
+// its relocations refer to values outside of the code or to symbols which
+// are not imported.
+func (o *Object) Validate() error {
+	if len(o.Code) > MemoryCapacity {
+		return errors.Errorf("ar: object code size %d exceeds the memory capacity", len(o.Code))
+	}
+
+	for _, r := range o.Relocations {
+		if r.Offset < 0 || r.Offset+2 > len(o.Code) {
+			return errors.Errorf("ar: relocation offset %04x is out of range", r.Offset)
+		}
+
+		if len(r.Symbol) > 0 && o.importIndex(r.Symbol) == -1 {
+			return errors.Errorf("ar: relocation at %04x refers to symbol %q, which is not imported", r.Offset, r.Symbol)
+		}
+	}
+
+	for _, s := range o.Exports {
+		if s.Kind != Label && s.Kind != Constant {
+			return errors.Errorf("ar: exported symbol %q has unsupported kind %s", s.Name, s.Kind)
+		}
+	}
+
+	return nil
+}
+
+// importIndex returns the index of the given name in the imports.
+// Returns -1 if it is not there.
+func (o *Object) importIndex(name string) int {
+	for i, v := range o.Imports {
+		if strings.EqualFold(v, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Save writes the object to the given stream. Debug data is embedded if there is any.
+func (o *Object) Save(w io.Writer) (err error) {
+	if err = o.Validate(); err != nil {
+		return
+	}
+
+	defer recoverOnPanic(&err)
+
+	var flags uint8
+	if !o.Debug.Empty() {
+		flags |= hasDebug
+	}
+
+	_, err = io.WriteString(w, ObjectMagic)
+	check(err)
+	writeU8(w, ObjectVersion)
+	writeU8(w, flags)
+
+	writeUvarint(w, uint64(len(o.Code)))
+	_, err = w.Write(o.Code)
+	check(err)
+
+	writeUvarint(w, uint64(len(o.Exports)))
+	for i := range o.Exports {
+		o.Exports[i].write(w)
+	}
+
+	writeUvarint(w, uint64(len(o.Imports)))
+	for _, v := range o.Imports {
+		writeString(w, v)
+	}
+
+	writeUvarint(w, uint64(len(o.Relocations)))
+	for _, r := range o.Relocations {
+		writeUvarint(w, uint64(r.Offset))
+		writeUvarint(w, uint64(o.importIndex(r.Symbol)+1))
+	}
+
+	if flags&hasDebug != 0 {
+		return o.Debug.Save(w)
+	}
+
+	return nil
+}
+
+// Load reads an object from the given stream.
+func (o *Object) Load(r io.Reader) (err error) {
+	defer recoverOnPanic(&err)
+
+	magic := make([]byte, len(ObjectMagic))
+	_, err = io.ReadFull(r, magic)
+	check(err)
+
+	if string(magic) != ObjectMagic {
+		return errors.New("ar: not an object file")
+	}
+
+	if v := readU8(r); v != ObjectVersion {
+		return errors.Errorf("ar: unsupported object file version %d", v)
+	}
+
+	flags := readU8(r)
+
+	o.Code = make([]byte, readCount(r))
+	_, err = io.ReadFull(r, o.Code)
+	check(err)
+
+	// Empty tables are left nil.
+	o.Exports, o.Imports, o.Relocations = nil, nil, nil
+
+	if n := readCount(r); n > 0 {
+		o.Exports = make([]Symbol, n)
+		for i := range o.Exports {
+			o.Exports[i].read(r)
+		}
+	}
+
+	if n := readCount(r); n > 0 {
+		o.Imports = make([]string, n)
+		for i := range o.Imports {
+			o.Imports[i] = readString(r)
+		}
+	}
+
+	if n := readCount(r); n > 0 {
+		o.Relocations = make([]Relocation, n)
+		for i := range o.Relocations {
+			rel := &o.Relocations[i]
+			rel.Offset = readInt(r)
+
+			index := readInt(r)
+			if index > len(o.Imports) {
+				return errors.Errorf("ar: relocation at %04x refers to unknown import %d", rel.Offset, index)
+			}
+
+			if index > 0 {
+				rel.Symbol = o.Imports[index-1]
+			}
+		}
+	}
+
+	o.Debug.Clear()
+	if flags&hasDebug != 0 {
+		if err = o.Debug.Load(r); err != nil {
+			return err
+		}
+	}
+
+	return o.Validate()
+}
+
+// LoadObject reads the object in the given file.
+func LoadObject(file string) (*Object, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	o := NewObject()
+	if err := o.Load(bytes.NewReader(data)); err != nil {
+		return nil, errors.Wrapf(err, "%s", file)
+	}
+
+	return o, nil
+}
@@ -2,6 +2,7 @@ package asm
 
 import (
 	"fmt"
+	"path/filepath"
 	"strings"
 
 	"github.com/hexaflex/svm/arch"
@@ -16,10 +17,20 @@ type assembler struct {
 	ar              *ar.Archive                 // Target archive.
 	symbols         map[string]int              // Table of labels or constants mapped to their respective addresses and values.
 	symbolPositions map[string]*parser.Position // Positions for symbols in the symbols table.
+	symbolTypes     map[string]string           // Type descriptors of typed constants, like struct fields.
 	macros          map[string]*parser.List     // Macro definitions.
 	address         int                         // Address at which next instruction is written.
 	flags           ar.DebugFlags               // Optional one-shot flags to be provided with debug symbols.
 	debug           bool                        // Emit debug symbols?
+	defines         map[string]int              // Constants defined on the command line.
+	includes        []string                    // Include search paths, used to find incbin files.
+	listing         *listing                    // Optional listing of the emitted code.
+	obj             *objectBuilder              // Object state, if a relocatable object is being built.
+	sections        []*section                  // Sections in layout order. Empty if the program has none.
+	sectionStarts   map[*parser.List]*section   // Sections by the address directive they start with.
+	section         *section                    // Section code is currently emitted into.
+	owners          []byte                      // Index of the section each byte of memory belongs to, plus one.
+	indexRegisters  map[*parser.List]int        // Base registers of operands with an extended address mode.
 }
 
 func newAssembler(debug bool) *assembler {
@@ -27,7 +38,9 @@ func newAssembler(debug bool) *assembler {
 		ar:              ar.New(),
 		symbols:         make(map[string]int),
 		symbolPositions: make(map[string]*parser.Position),
+		symbolTypes:     make(map[string]string),
 		macros:          make(map[string]*parser.List),
+		indexRegisters:  make(map[*parser.List]int),
 		debug:           debug,
 	}
 }
@@ -35,6 +48,16 @@ func newAssembler(debug bool) *assembler {
 // assemble compiles the given source AST into an archive.
 // Any provided options dictate custom assembler behaviour.
 func (a *assembler) assemble(ast *parser.AST) (*ar.Archive, error) {
+	insertDefines(ast.Nodes(), a.defines)
+
+	if err := replaceSizeof(ast.Nodes()); err != nil {
+		return nil, err
+	}
+
+	if err := a.preprocess(ast.Nodes(), nil); err != nil {
+		return nil, err
+	}
+
 	if err := syntax.Verify(ast); err != nil {
 		return nil, err
 	}
@@ -47,6 +70,18 @@ func (a *assembler) assemble(ast *parser.AST) (*ar.Archive, error) {
 		return nil, err
 	}
 
+	if err := a.resolveIndexedOperands(ast.Nodes()); err != nil {
+		return nil, err
+	}
+
+	if err := a.resolveLinkage(ast.Nodes(), ""); err != nil {
+		return nil, err
+	}
+
+	if err := a.resolveSections(ast.Nodes()); err != nil {
+		return nil, err
+	}
+
 	if err := a.evaluateAddressDirective(ast.Nodes(), ""); err != nil {
 		return nil, err
 	}
@@ -63,7 +98,12 @@ func (a *assembler) assemble(ast *parser.AST) (*ar.Archive, error) {
 		return nil, err
 	}
 
-	return a.ar, a.compile(ast.Nodes())
+	if err := a.compile(ast.Nodes()); err != nil {
+		return nil, err
+	}
+
+	a.finishSections()
+	return a.ar, nil
 }
 
 // evaluateAddressDirective finds `address` directives and evaluates their operand expressions.
@@ -115,7 +155,7 @@ func (a *assembler) evaluateConstants(nodes *parser.List, scope parser.Scope) er
 
 // evaluateConstant evaluates the given constant expression.
 func (a *assembler) evaluateConstant(instr *parser.List, scope parser.Scope) error {
-	err := eval.Evaluate(instr, a.resolveReference, scope)
+	err := a.evaluate(instr, scope)
 	if err != nil {
 		return err
 	}
@@ -123,12 +163,20 @@ func (a *assembler) evaluateConstant(instr *parser.List, scope parser.Scope) err
 	name := instr.At(0).(*parser.Value).Value
 	expr := instr.At(1).(*parser.List)
 
+	// A typed constant gives its type to memory operands which refer to it.
+	var typ string
+	if expr.Len() == 2 && expr.At(0).Type() == parser.TypeDescriptor {
+		typ = expr.At(0).(*parser.Value).Value
+		expr = expr.Copy().(*parser.List)
+		expr.Remove(0)
+	}
+
 	if expr.Len() != 1 || expr.At(0).Type() != parser.Number {
 		return newError(expr.Position(), "invalid constant expression")
 	}
 
-	key := string(scope.Join(name))
-	key = strings.ToLower(key)
+	qualified := scope.Join(name).String()
+	key := strings.ToLower(qualified)
 
 	if _, ok := a.symbols[key]; ok {
 		return newError(instr.Position(), "duplicate symbol %q", name)
@@ -140,6 +188,16 @@ func (a *assembler) evaluateConstant(instr *parser.List, scope parser.Scope) err
 
 	a.symbols[key] = int(num)
 	a.symbolPositions[key] = &pos
+
+	if len(typ) > 0 {
+		a.symbolTypes[key] = typ
+	}
+
+	if a.obj != nil {
+		a.obj.bases[key] = a.obj.operands[instr][1]
+	}
+
+	a.addName(qualified, ar.Constant, int(num))
 	return nil
 }
 
@@ -155,7 +213,11 @@ func (a *assembler) evaluateInstructions(nodes *parser.List, scope parser.Scope)
 			scope, _ = scope.Split()
 
 		case parser.Instruction:
-			err := eval.Evaluate(n.(*parser.List), a.resolveReference, scope)
+			if err := a.applySymbolTypes(n.(*parser.List), scope); err != nil {
+				return err
+			}
+
+			err := a.evaluate(n.(*parser.List), scope)
 			a.address += encodedLen(n, a.address)
 			return err
 		}
@@ -172,12 +234,22 @@ func (a *assembler) resolveReference(scope parser.Scope, name string) (int, erro
 		return a.address, nil
 	}
 
+	if key, ok := a.findSymbol(scope, name); ok {
+		return a.symbols[key], nil
+	}
+
+	return 0, fmt.Errorf("reference to unresolved value %s", name)
+}
+
+// findSymbol returns the key in the symbol table for the given reference.
+// This will traverse the scope tree upward until a match is found.
+func (a *assembler) findSymbol(scope parser.Scope, name string) (string, bool) {
 	// Check if the entry exists in the current scope.
 	key := scope.Join(name).String()
 	key = strings.ToLower(key)
 
-	if addr, ok := a.symbols[key]; ok {
-		return addr, nil
+	if _, ok := a.symbols[key]; ok {
+		return key, true
 	}
 
 	// If not, traverse the scope tree upwards and search.
@@ -187,12 +259,12 @@ func (a *assembler) resolveReference(scope parser.Scope, name string) (int, erro
 		key = scope.Join(name).String()
 		key = strings.ToLower(key)
 
-		if addr, ok := a.symbols[key]; ok {
-			return addr, nil
+		if _, ok := a.symbols[key]; ok {
+			return key, true
 		}
 	}
 
-	return 0, fmt.Errorf("reference to unresolved value %s", name)
+	return "", false
 }
 
 // resolveMacros finds the macro defintions and adds them to the macro table in the assembler context.
@@ -227,6 +299,7 @@ func (a *assembler) resolveMacros(nodes *parser.List, scope parser.Scope) error
 		pos := n.Position()
 		a.macros[key] = macro
 		a.symbolPositions[key] = &pos
+		a.addName(name.Value, ar.Macro, 0)
 		nodes.Remove(i)
 		i--
 	}
@@ -269,6 +342,10 @@ func (a *assembler) replaceMacroInvocations(nodes *parser.List, scope parser.Sco
 		body := macro.Slice()[len(names)+1:]
 		replaceMacroContents(body, values, names)
 
+		if a.listing != nil {
+			a.listing.expand(instr, body)
+		}
+
 		nodes.ReplaceAt(i, body...)
 	}
 	return nil
@@ -393,6 +470,11 @@ func (a *assembler) resolveLabels(nodes *parser.List, scope parser.Scope) error
 
 		a.symbols[key] = a.address
 		a.symbolPositions[key] = &pos
+		a.addName(lbl.Value, ar.Label, a.address)
+
+		if a.obj != nil {
+			a.obj.bases[key] = baseSelf
+		}
 
 		nodes.Remove(i)
 		i--
@@ -401,6 +483,29 @@ func (a *assembler) resolveLabels(nodes *parser.List, scope parser.Scope) error
 	return nil
 }
 
+// addName adds a symbol to the named symbol table in the debug data, if
+// debug symbols are enabled, and to the listing, if there is one. Names
+// generated by the assembler are skipped.
+func (a *assembler) addName(name string, kind ar.SymbolKind, value int) {
+	if !a.debug && a.listing == nil {
+		return
+	}
+
+	if _, local := parser.Scope(name).Split(); strings.HasPrefix(local.String(), "$") {
+		return
+	}
+
+	name = filepath.ToSlash(name)
+
+	if a.debug {
+		a.ar.Debug.AddName(name, kind, value)
+	}
+
+	if a.listing != nil {
+		a.listing.names = append(a.listing.names, ar.Symbol{Name: name, Kind: kind, Value: value})
+	}
+}
+
 // hasSymbol returns true if the given symbol is defined as either a label, constant or macro.
 // If true, also returns the position of the previous definition.
 func (a *assembler) hasSymbol(name string) (*parser.Position, bool) {
@@ -430,6 +535,19 @@ func (a *assembler) compile(nodes *parser.List) error {
 			if err != nil {
 				return err
 			}
+
+			if s, ok := a.sectionStarts[n.(*parser.List)]; ok {
+				a.enterSection(s)
+			}
+
+			if err := a.placeCode(n.Position(), code); err != nil {
+				return err
+			}
+
+			if a.listing != nil && len(code) > 0 {
+				a.listing.add(n.(*parser.List), a.address, code)
+			}
+
 			a.emit(n.Position(), code)
 		}
 	}
@@ -493,7 +611,11 @@ func (a *assembler) encode(instr *parser.List) ([]byte, error) {
 	}
 
 	if size, ok := isDataDirective(instr); ok {
-		return encodeDataDirective(instr, size), nil
+		return encodeDataDirective(instr, size), a.relocateData(instr, size)
+	}
+
+	if isInstruction(instr, "incbin") {
+		return encodeBinaryInclude(instr)
 	}
 
 	name := instr.At(0).(*parser.Value)
@@ -536,11 +658,26 @@ func (a *assembler) encode(instr *parser.List) ([]byte, error) {
 
 		num, _ := parser.ParseNumber(value.Value)
 
+		// WMUL writes the high word of its result to operand y.
+		if opcode == arch.WMUL && i == 2 && mode == arch.ImmediateConstant {
+			return nil, newError(expr.Position(), "wmul stores the high word in y; expected a register or memory operand")
+		}
+
 		switch arch.AddressMode(mode) {
 		case arch.ImmediateConstant, arch.IndirectConstant:
+			a.relocate(instr, i, a.address+len(out)+1)
 			out = append(out, byte(mode<<6)|byte(atype<<4), byte(num>>8), byte(num))
 		case arch.ImmediateRegister, arch.IndirectRegister:
 			out = append(out, byte(mode<<6)|byte(atype<<4)|byte(num&0x3f))
+		case arch.IndirectRegisterOffset:
+			base := a.indexRegisters[expr]
+			a.relocate(instr, i, a.address+len(out)+2)
+			out = append(out, byte(arch.IndirectRegister<<6)|byte(atype<<4)|arch.ExtendedOperand,
+				byte(base<<4)|arch.ExtendedOperand, byte(num>>8), byte(num))
+		case arch.IndirectRegisterIndex:
+			base := a.indexRegisters[expr]
+			out = append(out, byte(arch.IndirectRegister<<6)|byte(atype<<4)|arch.ExtendedOperand,
+				byte(base<<4)|byte(num&0xf))
 		}
 	}
 
@@ -556,6 +693,10 @@ func encodeAddressMode(node parser.Node) arch.AddressMode {
 		return arch.IndirectRegister
 	case "[":
 		return arch.IndirectConstant
+	case modeRegisterOffset:
+		return arch.IndirectRegisterOffset
+	case modeRegisterIndex:
+		return arch.IndirectRegisterIndex
 	}
 	return arch.ImmediateConstant
 }
@@ -611,6 +752,21 @@ func encodeDataDirective(instr *parser.List, size int) []byte {
 	return out
 }
 
+// encodedDataLen returns the byte size of the given data directive. A string
+// takes up one value for every character.
+func encodedDataLen(instr *parser.List, size int) int {
+	var n int
+	for i := 1; i < instr.Len(); i++ {
+		expr := instr.At(i).(*parser.List)
+		if expr.Len() == 1 && expr.At(0).Type() == parser.String {
+			n += len([]rune(expr.At(0).(*parser.Value).Value)) * size
+		} else {
+			n += size
+		}
+	}
+	return n
+}
+
 // writeData writes the given value to out as a sequence of bytes and returns the resulting byte slice.
 func writeData(out []byte, v int64, size int) []byte {
 	switch size {
@@ -634,7 +790,12 @@ func encodedLen(n parser.Node, address int) int {
 	}
 
 	if size, ok := isDataDirective(n); ok {
-		return (n.(*parser.List).Len() - 1) * size
+		return encodedDataLen(n.(*parser.List), size)
+	}
+
+	if isInstruction(n, "incbin") {
+		_, length := binaryIncludeRange(n.(*parser.List))
+		return length
 	}
 
 	if n.Type() != parser.Instruction {
@@ -678,6 +839,10 @@ func encodedAddressModeLen(am string) int {
 	switch am {
 	case "r", "[r":
 		return 1
+	case modeRegisterIndex:
+		return 2
+	case modeRegisterOffset:
+		return 4
 	}
 	return 3
 }
@@ -4,6 +4,7 @@ package asm
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -21,13 +22,56 @@ type astCache struct {
 // It optionally emits debug symbols. The module and its dependencies are expected
 // to have their sources located in the given import root directory.
 func Build(file string, includeSearchPaths []string, debug bool) (*ar.Archive, error) {
+	return BuildWith(file, includeSearchPaths, Options{Debug: debug})
+}
+
+// BuildListing builds a binary program like Build does and writes an assembler
+// listing for it to w. The listing shows the address, encoded bytes and source
+// text of every line, followed by a table of all named symbols.
+func BuildListing(file string, includeSearchPaths []string, debug bool, w io.Writer) (*ar.Archive, error) {
+	return BuildWith(file, includeSearchPaths, Options{Debug: debug, Listing: w})
+}
+
+// Options defines optional build settings and reports.
+type Options struct {
+	Debug     bool           // Emit debug symbols.
+	Defines   map[string]int // Constants to define before the source, for use in conditional directives.
+	Listing   io.Writer      // Receives an assembler listing, if set.
+	MemoryMap io.Writer      // Receives a table of the memory occupied by each section, if set.
+}
+
+// BuildWith builds a binary program like Build does, with the given options.
+func BuildWith(file string, includeSearchPaths []string, opt Options) (*ar.Archive, error) {
 	ast, err := BuildAST(file, includeSearchPaths)
 	if err != nil {
 		return nil, err
 	}
 
-	asm := newAssembler(debug)
-	return asm.assemble(ast)
+	asm := newAssembler(opt.Debug)
+	asm.defines = opt.Defines
+	asm.includes = includeSearchPaths
+	if opt.Listing != nil {
+		asm.listing = newListing()
+	}
+
+	archive, err := asm.assemble(ast)
+	if err != nil {
+		return nil, err
+	}
+
+	if opt.Listing != nil {
+		if err := asm.listing.write(opt.Listing); err != nil {
+			return nil, err
+		}
+	}
+
+	if opt.MemoryMap != nil {
+		if err := writeMemoryMap(opt.MemoryMap, asm.regions()); err != nil {
+			return nil, err
+		}
+	}
+
+	return archive, nil
 }
 
 // BuildAST builds the full AST for the given file and its dependencies.
@@ -1,6 +1,13 @@
 package asm
 
-import "testing"
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hexaflex/svm/asm/ar"
+)
 
 func TestBuild(t *testing.T) {
 	includes := []string{"../testdata/"}
@@ -10,3 +17,34 @@ func TestBuild(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// buildSource writes the given source to main.svm in a temporary directory
+// and builds it with the given options.
+func buildSource(t *testing.T, includes []string, opt Options, source string) (*ar.Archive, error) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "svm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "main.svm")
+	if err := ioutil.WriteFile(file, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return BuildWith(file, includes, opt)
+}
+
+// buildCode builds the given source like buildSource and returns the code.
+func buildCode(t *testing.T, includes []string, opt Options, source string) ([]byte, error) {
+	t.Helper()
+
+	archive, err := buildSource(t, includes, opt, source)
+	if err != nil {
+		return nil, err
+	}
+
+	return archive.Instructions, nil
+}
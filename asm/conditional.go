@@ -0,0 +1,315 @@
+package asm
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hexaflex/svm/asm/eval"
+	"github.com/hexaflex/svm/asm/parser"
+)
+
+// condBlock defines the state of a conditional block while it is being resolved.
+type condBlock struct {
+	pos     parser.Position // Position of the directive which opened the block.
+	parent  bool            // Code around the block is kept.
+	active  bool            // Code in the current branch is kept.
+	taken   bool            // One of the branches so far has been kept.
+	hasElse bool            // The `.else` branch has been reached.
+	depth   int             // Scope depth at the start of the current branch.
+}
+
+// condSymbol defines a symbol which conditional directives can refer to.
+type condSymbol struct {
+	value int64
+	known bool // The value could be evaluated. It may depend on a label.
+}
+
+// preprocess evaluates conditional assembly directives and removes the
+// code in branches which are not taken:
+//
+//	.if <expr>       Keeps the following code if expr is not zero.
+//	.ifdef <name>    Keeps the following code if name is defined.
+//	.ifndef <name>   Keeps the following code if name is not defined.
+//	.else            Keeps the following code if the previous branch was not kept.
+//	.endif           Ends the block.
+//
+// Repeat blocks in the code which is kept are expanded in place and the
+// result is processed in turn. See expandLoop. Struct and enum definitions
+// are replaced with constants, see expandDefinition. The operands of incbin
+// directives are evaluated as well.
+//
+// Conditions can refer to constants defined earlier in the source, which
+// includes those defined on the command line. This runs before syntax
+// verification, so the code in branches which are not taken only has to
+// be parsable.
+func (a *assembler) preprocess(nodes *parser.List, scopes []map[string]condSymbol) error {
+	scopes = append(scopes[:len(scopes):len(scopes)], make(map[string]condSymbol))
+
+	var blocks []*condBlock
+	var names []string
+	var depth int
+
+	for i := 0; i < nodes.Len(); i++ {
+		n := nodes.At(i)
+		active := len(blocks) == 0 || blocks[len(blocks)-1].active
+
+		if name, ok := conditionalDirective(n); ok {
+			instr := n.(*parser.List)
+
+			switch name {
+			case ".if", ".ifdef", ".ifndef":
+				b := &condBlock{pos: instr.Position(), parent: active, depth: depth}
+				if active {
+					ok, err := evaluateCondition(instr, scopes)
+					if err != nil {
+						return err
+					}
+					b.active, b.taken = ok, ok
+				}
+				blocks = append(blocks, b)
+
+			case ".else", ".endif":
+				if len(blocks) == 0 {
+					return newError(instr.Position(), "%s without matching .if", name)
+				}
+
+				b := blocks[len(blocks)-1]
+				if depth != b.depth {
+					return newError(instr.Position(), "unbalanced scope in conditional block started at %s", &b.pos)
+				}
+
+				if instr.Len() > 1 && instr.At(1).(*parser.List).Len() > 0 {
+					return newError(instr.Position(), "invalid %s directive; unexpected operands", name)
+				}
+
+				if name == ".endif" {
+					blocks = blocks[:len(blocks)-1]
+					break
+				}
+
+				if b.hasElse {
+					return newError(instr.Position(), "duplicate .else in conditional block started at %s", &b.pos)
+				}
+
+				b.hasElse = true
+				b.active = b.parent && !b.taken
+				b.taken = true
+			}
+
+			nodes.Remove(i)
+			i--
+			continue
+		}
+
+		switch n.Type() {
+		case parser.ScopeBegin:
+			depth++
+			if active {
+				scopes = append(scopes, make(map[string]condSymbol))
+				names = append(names, n.(*parser.Value).Value)
+			}
+
+		case parser.ScopeEnd:
+			depth--
+			if active && len(names) > 0 {
+				// Symbols in a named scope remain available by their qualified name.
+				if name := strings.ToLower(names[len(names)-1]); len(name) > 0 {
+					for key, sym := range scopes[len(scopes)-1] {
+						scopes[len(scopes)-2][name+"."+key] = sym
+					}
+				}
+				scopes = scopes[:len(scopes)-1]
+				names = names[:len(names)-1]
+			}
+		}
+
+		if !active {
+			nodes.Remove(i)
+			i--
+			continue
+		}
+
+		switch n.Type() {
+		case parser.Instruction:
+			if isInstruction(n, "struct") || isInstruction(n, "enum") {
+				if err := expandDefinition(nodes, i); err != nil {
+					return err
+				}
+				i--
+				break
+			}
+
+			if isInstruction(n, "incbin") {
+				if err := a.resolveBinaryInclude(n.(*parser.List), scopes); err != nil {
+					return err
+				}
+				break
+			}
+
+			if _, ok := loopDirective(n); !ok {
+				break
+			}
+
+			if err := expandLoop(nodes, i, scopes); err != nil {
+				return err
+			}
+			i--
+
+		case parser.Macro:
+			if err := a.preprocess(n.(*parser.List), scopes); err != nil {
+				return err
+			}
+
+		case parser.Constant:
+			defineCondSymbol(n.(*parser.List), scopes)
+		}
+	}
+
+	if len(blocks) > 0 {
+		b := blocks[len(blocks)-1]
+		return newError(b.pos, "conditional block is missing .endif")
+	}
+
+	return nil
+}
+
+// evaluateCondition returns the outcome of the given .if, .ifdef or .ifndef directive.
+func evaluateCondition(instr *parser.List, scopes []map[string]condSymbol) (bool, error) {
+	name := strings.ToLower(instr.At(0).(*parser.Value).Value)
+
+	if instr.Len() != 2 {
+		if name == ".if" {
+			return false, newError(instr.Position(), "invalid .if directive; expected `.if <expression>`")
+		}
+		return false, newError(instr.Position(), "invalid %s directive; expected `%[1]s <name>`", name)
+	}
+
+	expr := instr.At(1).(*parser.List)
+
+	if name != ".if" {
+		if expr.Len() != 1 || expr.At(0).Type() != parser.Ident {
+			return false, newError(instr.Position(), "invalid %s directive; expected `%[1]s <name>`", name)
+		}
+
+		_, ok := findCondSymbol(scopes, expr.At(0).(*parser.Value).Value)
+		return ok == (name == ".ifdef"), nil
+	}
+
+	value, err := evaluateCondExpression(expr, scopes)
+	if err != nil {
+		return false, err
+	}
+
+	return value != 0, nil
+}
+
+// evaluateCondExpression evaluates a copy of the given expression, with
+// the symbols known to conditional directives.
+func evaluateCondExpression(expr *parser.List, scopes []map[string]condSymbol) (int64, error) {
+	instr := parser.NewList(expr.Position(), parser.Instruction)
+	instr.Append(parser.NewValue(expr.Position(), parser.Ident, "$"), expr.Copy())
+
+	err := eval.Evaluate(instr, func(_ parser.Scope, name string) (int, error) {
+		sym, ok := findCondSymbol(scopes, name)
+		switch {
+		case !ok:
+			return 0, fmt.Errorf("%q is not defined", name)
+		case !sym.known:
+			return 0, fmt.Errorf("value of %q is not known before labels are resolved", name)
+		}
+		return int(sym.value), nil
+	}, "")
+	if err != nil {
+		return 0, err
+	}
+
+	// The type of a typed constant does not matter here.
+	expr = instr.At(1).(*parser.List)
+	if expr.Len() == 2 && expr.At(0).Type() == parser.TypeDescriptor {
+		expr.Remove(0)
+	}
+
+	if expr.Len() != 1 || expr.At(0).Type() != parser.Number {
+		return 0, newError(expr.Position(), "invalid expression; expected a number")
+	}
+
+	return parser.ParseNumber(expr.At(0).(*parser.Value).Value)
+}
+
+// defineCondSymbol adds the given constant definition to the innermost scope.
+// Its value is only known if it does not refer to labels.
+func defineCondSymbol(constant *parser.List, scopes []map[string]condSymbol) {
+	if constant.Len() != 3 {
+		return // Reported by syntax verification.
+	}
+
+	name := constant.At(1).(*parser.List)
+	if name.Len() != 1 || name.At(0).Type() != parser.Ident {
+		return
+	}
+
+	value, err := evaluateCondExpression(constant.At(2).(*parser.List), scopes)
+
+	key := strings.ToLower(name.At(0).(*parser.Value).Value)
+	scopes[len(scopes)-1][key] = condSymbol{value: value, known: err == nil}
+}
+
+// findCondSymbol finds the given symbol, starting in the innermost scope.
+func findCondSymbol(scopes []map[string]condSymbol, name string) (condSymbol, bool) {
+	name = strings.ToLower(name)
+	for i := len(scopes) - 1; i >= 0; i-- {
+		if sym, ok := scopes[i][name]; ok {
+			return sym, true
+		}
+	}
+	return condSymbol{}, false
+}
+
+// conditionalDirective returns the lower case name of n if it is a
+// conditional assembly directive.
+func conditionalDirective(n parser.Node) (string, bool) {
+	if n.Type() != parser.Instruction {
+		return "", false
+	}
+
+	name := strings.ToLower(n.(*parser.List).At(0).(*parser.Value).Value)
+	switch name {
+	case ".if", ".ifdef", ".ifndef", ".else", ".endif":
+		return name, true
+	}
+
+	return "", false
+}
+
+// insertDefines adds a constant definition for each of the given defines to
+// the start of nodes. This makes them available to the program as well.
+func insertDefines(nodes *parser.List, defines map[string]int) {
+	if len(defines) == 0 {
+		return
+	}
+
+	names := make([]string, 0, len(defines))
+	for name := range defines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	consts := make([]parser.Node, len(names))
+	for i, name := range names {
+		pos := parser.Position{File: "<command line>"}
+
+		expr1 := parser.NewList(pos, parser.Expression)
+		expr1.Append(parser.NewValue(pos, parser.Ident, name))
+
+		expr2 := parser.NewList(pos, parser.Expression)
+		expr2.Append(parser.NewValue(pos, parser.Number, strconv.Itoa(defines[name])))
+
+		c := parser.NewList(pos, parser.Constant)
+		c.Append(parser.NewValue(pos, parser.Ident, "const"), expr1, expr2)
+		consts[i] = c
+	}
+
+	nodes.InsertAt(0, consts...)
+}
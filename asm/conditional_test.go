@@ -0,0 +1,66 @@
+package asm
+
+import (
+	"bytes"
+	"testing"
+)
+
+const conditionalTestSource = `
+.ifndef Version
+const Version = 1
+.endif
+
+:main {
+.if Version >= 2
+    mov r0, 2
+    .ifdef DEBUG
+        add r0, r0, DEBUG
+    .endif
+.else
+    mov r0, 1
+    unknown 1, 2, 3
+.endif
+    halt
+}
+`
+
+func TestConditionals(t *testing.T) {
+	build := func(source string, defines map[string]int) ([]byte, error) {
+		return buildCode(t, nil, Options{Debug: true, Defines: defines}, source)
+	}
+
+	for _, v := range []struct {
+		defines map[string]int
+		code    []byte
+	}{
+		{map[string]int{"Version": 2}, []byte{0x02, 0xb0, 0x30, 0x00, 0x02, 0x01}},
+		{map[string]int{"Version": 3, "DEBUG": 1}, []byte{0x02, 0xb0, 0x30, 0x00, 0x02, 0x07, 0xb0, 0xb0, 0x30, 0x00, 0x01, 0x01}},
+	} {
+		code, err := build(conditionalTestSource, v.defines)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(code, v.code) {
+			t.Fatalf("unexpected code for %v:\nwant: % x\nhave: % x", v.defines, v.code, code)
+		}
+	}
+
+	// The else branch is taken and has an unknown instruction.
+	if _, err := build(conditionalTestSource, nil); err == nil {
+		t.Fatal("expected error for unknown instruction")
+	}
+
+	for _, source := range []string{
+		".if 1\nhalt\n",                    // missing .endif
+		".endif\n",                         // missing .if
+		".if 1\n.else\n.else\n.endif\n",    // duplicate .else
+		".if Undefined\n.endif\n",          // undefined symbol
+		":a\nconst b = a\n.if b\n.endif\n", // value depends on a label
+		".if 1\n{\n.endif\n}\n",            // unbalanced scope
+	} {
+		if _, err := build(source, nil); err == nil {
+			t.Fatalf("expected error for:\n%s", source)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package asm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/hexaflex/svm/asm/parser"
+)
+
+func TestDataStrings(t *testing.T) {
+	ast := parser.NewAST()
+	err := ast.Parse(strings.NewReader(`
+    d8 "abc", 1
+:a
+    d16 "hi"
+:b
+    d8 a, b
+`), "main.svm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := newAssembler(false).assemble(ast)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A string takes up one value per character. Labels after it must account for that.
+	want := []byte{'a', 'b', 'c', 1, 0, 'h', 0, 'i', 4, 8}
+	if !bytes.Equal(archive.Instructions, want) {
+		t.Fatalf("unexpected code:\nwant: % x\nhave: % x", want, archive.Instructions)
+	}
+}
@@ -0,0 +1,486 @@
+// Package disasm turns compiled programs back into assembler source.
+//
+// The generated source assembles to the exact bytes it was generated from.
+// Debug symbols, when available, are used to tell instructions apart from
+// data, to name labels and to annotate the output with source locations.
+package disasm
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/hexaflex/svm/arch"
+	"github.com/hexaflex/svm/asm/ar"
+)
+
+// minGap is the number of consecutive zero bytes, outside of code covered by
+// debug symbols, from which an `address` directive is emitted instead of
+// NOP instructions.
+const minGap = 16
+
+// dataPerLine is the number of values written per data directive.
+const dataPerLine = 8
+
+// commentColumn is the column at which source comments start.
+const commentColumn = 40
+
+// Label names an address in the program.
+type Label struct {
+	Name    string // Label name. Scopes may be separated with a '/'.
+	Address int    // Address the label refers to.
+}
+
+// Options defines optional program information used while disassembling.
+type Options struct {
+	Debug    *ar.Debug                           // Debug symbols for the program.
+	Labels   []Label                             // Named addresses. Defaults to the labels in the debug symbol table.
+	Source   func(file, line int) (string, bool) // Returns the source text for a line in one of the debug files.
+	Entry    int                                 // Address at which execution starts.
+	Sections []ar.Section                        // Memory layout of the program, if it has one.
+}
+
+// item defines a single piece of output.
+type item struct {
+	address int
+	size    int
+	instr   *Instruction  // Decoded instruction, if this is code.
+	sym     *ar.DebugData // Debug symbol for this item, if any.
+	gap     bool          // Zero-filled space, skipped with an `address` directive.
+	section string        // Name of the section which starts here, if this is a section change.
+}
+
+// region defines a range of code which is written as a single section.
+type region struct {
+	name  string // Section name. Empty if the program has no sections.
+	start int
+	end   int
+}
+
+// Disassemble writes the given program code to w as assembler source.
+// Opt may be nil.
+//
+// If the options define sections or an entry point other than 0, the
+// output starts with a `layout` directive for every section, followed by
+// the contents of each section. The section which holds the entry point is
+// named "code", as the assembler starts execution at the default section.
+func Disassemble(w io.Writer, code []byte, opt *Options) error {
+	if opt == nil {
+		opt = &Options{}
+	}
+
+	d := disassembler{code: code, opt: opt}
+	d.regions = d.layout()
+
+	for _, r := range d.regions {
+		d.split(r)
+	}
+
+	d.nameLabels()
+	return d.write(w)
+}
+
+// disassembler holds disassembly state.
+type disassembler struct {
+	code    []byte
+	opt     *Options
+	items   []item
+	regions []region
+	end     int            // End of the region being split.
+	labels  map[int]string // Label names by address.
+}
+
+// layout returns the regions of code which are written as separate
+// sections. This is a single unnamed region for programs without sections,
+// which start at address 0.
+func (d *disassembler) layout() []region {
+	entry := d.opt.Entry
+	sections := d.opt.Sections
+
+	if len(sections) == 0 {
+		if entry == 0 {
+			return []region{{start: 0, end: len(d.code)}}
+		}
+		sections = []ar.Section{{Name: "code", Data: d.code}}
+	}
+
+	// Split the section which holds the entry point, if it does not start there.
+	var out []region
+	for _, s := range sections {
+		start, end := s.Address, s.Address+len(s.Data)
+		if end > len(d.code) {
+			end = len(d.code)
+		}
+
+		if start < entry && entry < end {
+			out = append(out, region{name: s.Name, start: start, end: entry})
+			start = entry
+		}
+
+		out = append(out, region{name: s.Name, start: start, end: end})
+	}
+
+	// The default section holds the entry point. It must come first.
+	index := -1
+	for i, r := range out {
+		if r.start == entry {
+			index = i
+			break
+		}
+	}
+
+	first := region{start: entry, end: entry}
+	if index > -1 {
+		first = out[index]
+		out = append(out[:index], out[index+1:]...)
+	}
+	out = append([]region{first}, out...)
+
+	used := map[string]bool{"code": true, "bss": true}
+	out[0].name = "code"
+
+	for i := 1; i < len(out); i++ {
+		name := labelName(out[i].name)
+		unique := name
+		for n := 2; used[strings.ToLower(unique)]; n++ {
+			unique = fmt.Sprintf("%s_%d", name, n)
+		}
+
+		used[strings.ToLower(unique)] = true
+		out[i].name = unique
+	}
+
+	return out
+}
+
+// split divides the code in the given region into instructions, data and gaps.
+func (d *disassembler) split(r region) {
+	d.end = r.end
+
+	if len(r.name) > 0 {
+		d.items = append(d.items, item{address: r.start, section: r.name})
+	}
+
+	symbols := d.symbols(r.start, r.end)
+	if len(symbols) == 0 {
+		d.sweep(r.start, r.end, false)
+		return
+	}
+
+	d.sweep(r.start, symbols[0].Address, true)
+
+	for i := range symbols {
+		sym := &symbols[i]
+		end := r.end
+		if i+1 < len(symbols) {
+			end = symbols[i+1].Address
+		}
+		d.chunk(sym, end)
+	}
+}
+
+// symbols returns the debug symbols which refer to code in the given
+// range, sorted by address. When several symbols share an address, the
+// last one wins. This matches code being overwritten after an `address`
+// directive.
+func (d *disassembler) symbols(start, end int) []ar.DebugData {
+	if d.opt.Debug == nil {
+		return nil
+	}
+
+	symbols := make([]ar.DebugData, 0, len(d.opt.Debug.Symbols))
+	for _, sym := range d.opt.Debug.Symbols {
+		if sym.Address >= start && sym.Address < end {
+			symbols = append(symbols, sym)
+		}
+	}
+
+	sort.SliceStable(symbols, func(i, j int) bool {
+		return symbols[i].Address < symbols[j].Address
+	})
+
+	out := symbols[:0]
+	for _, sym := range symbols {
+		if len(out) > 0 && out[len(out)-1].Address == sym.Address {
+			out[len(out)-1] = sym
+		} else {
+			out = append(out, sym)
+		}
+	}
+
+	return out
+}
+
+// chunk adds the code emitted for a single debug symbol. It ends at the
+// given address. An instruction is only used if it fills the chunk, save
+// for trailing zeros. Anything else is data.
+func (d *disassembler) chunk(sym *ar.DebugData, end int) {
+	if !d.isData(sym) {
+		instr, err := Decode(d.code[:end], sym.Address)
+		if err == nil && d.isPadding(instr.Address+instr.Size, end) {
+			d.items = append(d.items, item{address: sym.Address, size: instr.Size, instr: &instr, sym: sym})
+			if instr.Address+instr.Size < end {
+				d.items = append(d.items, item{address: instr.Address + instr.Size, size: end - instr.Address - instr.Size, gap: true})
+			}
+			return
+		}
+	}
+
+	d.items = append(d.items, item{address: sym.Address, size: end - sym.Address, sym: sym})
+}
+
+// isPadding returns true if the given range is empty, or if it only holds
+// zeros and can be skipped with an `address` directive.
+func (d *disassembler) isPadding(start, end int) bool {
+	return start == end || (end < d.end && isZero(d.code[start:end]))
+}
+
+// isData returns true if the source line for the given symbol is a data directive.
+func (d *disassembler) isData(sym *ar.DebugData) bool {
+	text, ok := d.sourceLine(sym)
+	if !ok {
+		return false
+	}
+
+	// Skip label definitions preceding the directive.
+	fields := strings.Fields(text)
+	for len(fields) > 0 && strings.HasPrefix(fields[0], ":") {
+		fields = fields[1:]
+	}
+
+	if len(fields) == 0 {
+		return false
+	}
+
+	switch strings.ToLower(fields[0]) {
+	case "d8", "d16", "d32", "d64":
+		return true
+	}
+	return false
+}
+
+// sweep decodes the code in the given range one instruction after another.
+// Bytes which do not decode are treated as data. If gap is true, the range
+// is not covered by debug symbols and is skipped if it only holds zeros.
+func (d *disassembler) sweep(start, end int, gap bool) {
+	if start >= end {
+		return
+	}
+
+	if gap && d.isPadding(start, end) {
+		d.items = append(d.items, item{address: start, size: end - start, gap: true})
+		return
+	}
+
+	for pc := start; pc < end; {
+		if n := zeroRun(d.code[pc:end]); n >= minGap && pc+n < d.end {
+			d.items = append(d.items, item{address: pc, size: n, gap: true})
+			pc += n
+			continue
+		}
+
+		instr, err := Decode(d.code[:end], pc)
+		if err != nil {
+			d.appendData(pc)
+			pc++
+			continue
+		}
+
+		d.items = append(d.items, item{address: pc, size: instr.Size, instr: &instr})
+		pc += instr.Size
+	}
+}
+
+// appendData adds the byte at the given address to the output as data.
+// It is merged with any directly preceding data.
+func (d *disassembler) appendData(addr int) {
+	if n := len(d.items); n > 0 {
+		last := &d.items[n-1]
+		if last.instr == nil && !last.gap && last.sym == nil && len(last.section) == 0 && last.address+last.size == addr {
+			last.size++
+			return
+		}
+	}
+	d.items = append(d.items, item{address: addr, size: 1})
+}
+
+// nameLabels picks a label name for every address which needs one. These
+// are the addresses in the Labels option and the targets of branches. Only
+// addresses at the start of an instruction or data item can be labeled.
+func (d *disassembler) nameLabels() {
+	d.labels = make(map[int]string)
+
+	starts := make(map[int]bool, len(d.items))
+	for _, it := range d.items {
+		if !it.gap && len(it.section) == 0 {
+			starts[it.address] = true
+		}
+	}
+
+	used := make(map[string]bool)
+	add := func(addr int, name string) {
+		if _, ok := d.labels[addr]; ok || !starts[addr] {
+			return
+		}
+
+		name = labelName(name)
+		unique := name
+		for n := 2; used[strings.ToLower(unique)]; n++ {
+			unique = fmt.Sprintf("%s_%d", name, n)
+		}
+
+		used[strings.ToLower(unique)] = true
+		d.labels[addr] = unique
+	}
+
+	if d.opt.Labels != nil {
+		for _, lbl := range d.opt.Labels {
+			add(lbl.Address, lbl.Name)
+		}
+	} else if d.opt.Debug != nil {
+		for _, sym := range d.opt.Debug.Names {
+			if sym.Kind == ar.Label {
+				add(sym.Value, sym.Name)
+			}
+		}
+	}
+
+	for _, it := range d.items {
+		if it.instr == nil {
+			continue
+		}
+		if target, ok := it.instr.Target(); ok {
+			add(target, fmt.Sprintf("L_%04x", target))
+		}
+	}
+}
+
+// write writes all items to w.
+func (d *disassembler) write(w io.Writer) error {
+	var sb strings.Builder
+
+	for _, r := range d.regions {
+		if len(r.name) > 0 {
+			fmt.Fprintf(&sb, "    layout %s, %s\n", r.name, formatNumber(r.start))
+		}
+	}
+
+	for _, it := range d.items {
+		if len(it.section) > 0 {
+			fmt.Fprintf(&sb, "\n    section %s\n\n", it.section)
+			continue
+		}
+
+		if it.gap {
+			fmt.Fprintf(&sb, "\n    address %s\n\n", formatNumber(it.address+it.size))
+			continue
+		}
+
+		if name, ok := d.labels[it.address]; ok {
+			fmt.Fprintf(&sb, ":%s\n", name)
+		}
+
+		if it.instr != nil {
+			d.writeLine(&sb, it.instr.format(d.labels), it.address, it.sym)
+			continue
+		}
+
+		data := d.code[it.address : it.address+it.size]
+		for i := 0; i < len(data); i += dataPerLine {
+			end := i + dataPerLine
+			if end > len(data) {
+				end = len(data)
+			}
+
+			values := make([]string, end-i)
+			for j := range values {
+				values[j] = fmt.Sprintf("16#%02x", data[i+j])
+			}
+
+			sym := it.sym
+			if i > 0 {
+				sym = nil
+			}
+			d.writeLine(&sb, "d8 "+strings.Join(values, ", "), it.address+i, sym)
+		}
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// writeLine writes a single line of code, followed by a comment with its
+// address and source location.
+func (d *disassembler) writeLine(sb *strings.Builder, code string, addr int, sym *ar.DebugData) {
+	line := "    " + code
+	if len(line) < commentColumn {
+		line += strings.Repeat(" ", commentColumn-len(line))
+	}
+
+	fmt.Fprintf(sb, "%s ; %04x", line, addr)
+
+	if sym != nil && d.opt.Debug != nil && sym.File >= 0 && sym.File < len(d.opt.Debug.Files) {
+		fmt.Fprintf(sb, " %s:%d", d.opt.Debug.Files[sym.File], sym.Line)
+		if text, ok := d.sourceLine(sym); ok {
+			fmt.Fprintf(sb, ": %s", text)
+		}
+	}
+
+	sb.WriteString("\n")
+}
+
+// sourceLine returns the trimmed source text for the given symbol,
+// without any comment.
+func (d *disassembler) sourceLine(sym *ar.DebugData) (string, bool) {
+	if d.opt.Source == nil {
+		return "", false
+	}
+
+	text, ok := d.opt.Source(sym.File, sym.Line)
+	if !ok {
+		return "", false
+	}
+
+	if index := strings.Index(text, ";"); index > -1 && !strings.ContainsAny(text[:index], "'\"") {
+		text = text[:index]
+	}
+
+	text = strings.TrimSpace(text)
+	return text, len(text) > 0
+}
+
+// labelName turns name into a valid label name. Scope separators and other
+// unsupported characters are replaced with underscores. Names which clash
+// with registers or instructions get an underscore prefix.
+func labelName(name string) string {
+	out := []rune(name)
+	for i, r := range out {
+		if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			out[i] = '_'
+		}
+	}
+
+	name = string(out)
+	if _, ok := arch.Opcode(name); ok || len(name) == 0 || unicode.IsDigit(out[0]) || arch.IsRegister(name) {
+		name = "_" + name
+	}
+
+	return name
+}
+
+// zeroRun returns the number of leading zero bytes in data.
+func zeroRun(data []byte) int {
+	for i, b := range data {
+		if b != 0 {
+			return i
+		}
+	}
+	return len(data)
+}
+
+// isZero returns true if data only holds zeros.
+func isZero(data []byte) bool {
+	return zeroRun(data) == len(data)
+}
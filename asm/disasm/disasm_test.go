@@ -0,0 +1,245 @@
+package disasm_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hexaflex/svm/arch"
+	"github.com/hexaflex/svm/asm"
+	"github.com/hexaflex/svm/asm/ar"
+	"github.com/hexaflex/svm/asm/disasm"
+)
+
+func TestDecode(t *testing.T) {
+	code := []byte{
+		arch.MOV, 0x40, 0x01, 0x02, 0xb1, // mov u8 [16#0102], r1
+		arch.JMP, 0x30, 0xff, 0xfe, // jmp 16#fffe
+		arch.PUSH, 0xff, 0x8f, 0x00, 0x04, // push [rsp + 16#0004]
+		arch.POP, 0xdf, 0x12, // pop u16 [r1 + r2]
+		arch.ADD, 0xb1, // truncated
+	}
+
+	want := []string{"mov u8 [16#0102], r1", "jmp 16#fffe", "push [rsp + 16#0004]", "pop u16 [r1 + r2]"}
+	addr := 0
+	for _, s := range want {
+		instr, err := disasm.Decode(code, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := instr.String(); have != s {
+			t.Fatalf("instruction mismatch at %04x: want %q; have %q", addr, s, have)
+		}
+		addr += instr.Size
+	}
+
+	if _, err := disasm.Decode(code, addr); err == nil {
+		t.Fatalf("expected error for truncated instruction")
+	}
+
+	for _, bad := range [][]byte{
+		{0xff},                  // unknown opcode
+		{arch.PUSH, 0x8c},       // unknown register
+		{arch.PUSH, 0x31, 0, 0}, // stray bits in constant operand
+		{arch.PUSH, 0xff, 0xc1}, // unknown base register
+		{arch.PUSH, 0xff, 0x0f}, // truncated offset
+	} {
+		if instr, err := disasm.Decode(bad, 0); err == nil {
+			t.Fatalf("expected error for % x; have %q", bad, instr)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	includes := []string{"../../testdata/"}
+
+	for _, file := range []string{
+		"examples/address/main.svm",
+		"examples/clock/main.svm",
+		"examples/macros/main.svm",
+		"examples/sprites/main.svm",
+	} {
+		archive, err := asm.Build(file, includes, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		source := func(file, line int) (string, bool) {
+			data, err := ioutil.ReadFile(asmPath(archive.Debug.Files[file], includes))
+			if err != nil {
+				return "", false
+			}
+			lines := bytes.Split(data, []byte("\n"))
+			if line < 1 || line > len(lines) {
+				return "", false
+			}
+			return string(lines[line-1]), true
+		}
+
+		testRoundTrip(t, dir, file, archive, nil)
+		testRoundTrip(t, dir, file, archive, &disasm.Options{Debug: &archive.Debug, Source: source})
+	}
+
+	// The entry point and memory layout survive as well.
+	file := filepath.Join(dir, "sections.svm")
+	if err := ioutil.WriteFile(file, []byte(sectionsSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := asm.Build(file, nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testRoundTrip(t, dir, file, archive, &disasm.Options{Entry: archive.Entry, Sections: archive.Sections})
+
+	// An entry point in the middle of a section, as set by svm-ld.
+	archive.Entry = 0x0105
+	testRoundTrip(t, dir, file, archive, &disasm.Options{Entry: archive.Entry, Sections: archive.Sections})
+}
+
+const sectionsSource = `
+layout code, 16#0100
+layout data, 16#0200
+
+:main
+    mov r0, [value]
+    add r0, r0, 1
+    halt
+
+section data
+:value
+    d16 10
+`
+
+func TestLabelOperands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "labels.svm")
+	if err := ioutil.WriteFile(file, []byte(labelsSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := asm.Build(file, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := disasm.Disassemble(&buf, archive.Instructions, &disasm.Options{Debug: &archive.Debug}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"push [r1 + table]", "mov r0, [table]"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("missing %q in output:\n%s", want, buf.String())
+		}
+	}
+
+	testRoundTrip(t, dir, file, archive, &disasm.Options{Debug: &archive.Debug})
+}
+
+const labelsSource = `
+    push [table + r1]
+    mov r0, [table]
+    halt
+:table
+    d8 1, 2
+`
+
+func TestCarryInstructions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	build := func(source string) (*ar.Archive, error) {
+		file := filepath.Join(dir, "carry.svm")
+		if err := ioutil.WriteFile(file, []byte(source), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return asm.Build(file, nil, false)
+	}
+
+	archive, err := build(`
+    adc r0, r0, r2
+    sbc u8 r1, r1, [r3 + 2]
+    wmul r0, r1, 300
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := disasm.Disassemble(&buf, archive.Instructions, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"adc r0, r0, r2", "sbc u8 r1, r1, [r3 + 16#0002]", "wmul r0, r1, 16#012c"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("missing %q in output:\n%s", want, buf.String())
+		}
+	}
+
+	testRoundTrip(t, dir, "carry.svm", archive, nil)
+
+	// WMUL writes its high word to y, which can not be a constant.
+	if _, err := build(" wmul r0, 300, 400"); err == nil {
+		t.Fatalf("expected error for wmul with a constant y")
+	}
+}
+
+func testRoundTrip(t *testing.T, dir, name string, want *ar.Archive, opt *disasm.Options) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := disasm.Disassemble(&buf, want.Instructions, opt); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, "out.svm")
+	if err := ioutil.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := asm.Build(file, nil, false)
+	if err != nil {
+		t.Fatalf("%s: %v\n%s", name, err, buf.String())
+	}
+
+	if !bytes.Equal(archive.Instructions, want.Instructions) {
+		t.Fatalf("%s: round-trip mismatch\nwant: % x\nhave: % x", name, want.Instructions, archive.Instructions)
+	}
+
+	if archive.Entry != want.Entry {
+		t.Fatalf("%s: entry point mismatch: want %04x; have %04x\n%s", name, want.Entry, archive.Entry, buf.String())
+	}
+}
+
+// asmPath returns the path to a source file referenced by debug data.
+func asmPath(file string, includes []string) string {
+	if _, err := os.Stat(file); err == nil {
+		return file
+	}
+	for _, dir := range includes {
+		path := filepath.Join(dir, file)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return file
+}
@@ -0,0 +1,206 @@
+package disasm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hexaflex/svm/arch"
+)
+
+// Instruction defines a single decoded instruction.
+type Instruction struct {
+	Address int       // Address of the instruction's first byte.
+	Size    int       // Encoded size in bytes.
+	Opcode  int       // Instruction opcode.
+	Args    []Operand // Operands, as many as arch.Argc requires.
+}
+
+// Operand defines a decoded instruction operand.
+type Operand struct {
+	Mode  arch.AddressMode // Address mode.
+	Type  arch.Type        // Operand data type.
+	Value int              // Unsigned 16-bit constant, or register index for the register modes.
+	Base  int              // Base register index for the IndirectRegisterOffset and IndirectRegisterIndex modes.
+}
+
+// Decode decodes the instruction at the given address in code.
+//
+// Only encodings the assembler can produce are accepted. An error is
+// returned for unknown opcodes, truncated instructions, unknown registers
+// and constant operands with stray bits in their attribute byte. Assembling
+// the String form of a decoded instruction yields the original bytes.
+func Decode(code []byte, addr int) (Instruction, error) {
+	if addr < 0 || addr >= len(code) {
+		return Instruction{}, fmt.Errorf("address %04x is out of range", addr)
+	}
+
+	instr := Instruction{Address: addr, Opcode: int(code[addr])}
+	argc := arch.Argc(instr.Opcode)
+	if argc < 0 {
+		return Instruction{}, fmt.Errorf("%04x: unknown opcode %02x", addr, instr.Opcode)
+	}
+
+	pc := addr + 1
+	instr.Args = make([]Operand, argc)
+
+	for i := range instr.Args {
+		if pc >= len(code) {
+			return Instruction{}, fmt.Errorf("%04x: truncated instruction", addr)
+		}
+
+		b := code[pc]
+		pc++
+
+		op := &instr.Args[i]
+		op.Mode = arch.AddressMode(b>>6) & 0x3
+		op.Type = arch.Type(b>>4) & 0x3
+
+		switch op.Mode {
+		case arch.ImmediateConstant, arch.IndirectConstant:
+			if b&0xf != 0 {
+				return Instruction{}, fmt.Errorf("%04x: invalid operand attributes %02x", addr, b)
+			}
+
+			if pc+1 >= len(code) {
+				return Instruction{}, fmt.Errorf("%04x: truncated instruction", addr)
+			}
+
+			op.Value = int(code[pc])<<8 | int(code[pc+1])
+			pc += 2
+
+		case arch.ImmediateRegister, arch.IndirectRegister:
+			op.Value = int(b & 0xf)
+
+			if op.Mode == arch.IndirectRegister && op.Value == arch.ExtendedOperand {
+				n, err := decodeExtended(code, addr, pc, op)
+				if err != nil {
+					return Instruction{}, err
+				}
+				pc += n
+				break
+			}
+
+			if len(arch.RegisterName(op.Value)) == 0 {
+				return Instruction{}, fmt.Errorf("%04x: unknown register %d", addr, op.Value)
+			}
+		}
+	}
+
+	instr.Size = pc - addr
+	return instr, nil
+}
+
+// decodeExtended decodes the remainder of an operand with one of the
+// extended address modes, starting at code[pc]. Returns the number of
+// bytes read. See arch.ExtendedOperand.
+func decodeExtended(code []byte, addr, pc int, op *Operand) (int, error) {
+	if pc >= len(code) {
+		return 0, fmt.Errorf("%04x: truncated instruction", addr)
+	}
+
+	b := code[pc]
+	op.Base = int(b >> 4)
+	op.Value = int(b & 0xf)
+
+	if len(arch.RegisterName(op.Base)) == 0 {
+		return 0, fmt.Errorf("%04x: unknown register %d", addr, op.Base)
+	}
+
+	if op.Value != arch.ExtendedOperand {
+		if len(arch.RegisterName(op.Value)) == 0 {
+			return 0, fmt.Errorf("%04x: unknown register %d", addr, op.Value)
+		}
+		op.Mode = arch.IndirectRegisterIndex
+		return 1, nil
+	}
+
+	if pc+2 >= len(code) {
+		return 0, fmt.Errorf("%04x: truncated instruction", addr)
+	}
+
+	op.Mode = arch.IndirectRegisterOffset
+	op.Value = int(code[pc+1])<<8 | int(code[pc+2])
+	return 3, nil
+}
+
+// String returns the instruction in assembler syntax.
+func (i Instruction) String() string {
+	return i.format(nil)
+}
+
+// format returns the instruction in assembler syntax. Constant operands
+// of branch instructions and the addresses in memory operands are replaced
+// with the label for their address, if labels contains one.
+func (i Instruction) format(labels map[int]string) string {
+	var sb strings.Builder
+
+	name, _ := arch.Name(i.Opcode)
+	sb.WriteString(strings.ToLower(name))
+
+	for j, op := range i.Args {
+		if j == 0 {
+			sb.WriteString(" ")
+		} else {
+			sb.WriteString(", ")
+		}
+
+		if op.Type != arch.I16 {
+			sb.WriteString(strings.ToLower(op.Type.Name()))
+			sb.WriteString(" ")
+		}
+
+		switch op.Mode {
+		case arch.ImmediateConstant:
+			if name, ok := labels[op.Value]; ok && isBranch(i.Opcode) {
+				sb.WriteString(name)
+			} else {
+				sb.WriteString(formatNumber(op.Value))
+			}
+		case arch.IndirectConstant:
+			fmt.Fprintf(&sb, "[%s]", formatAddress(op.Value, labels))
+		case arch.ImmediateRegister:
+			sb.WriteString(strings.ToLower(arch.RegisterName(op.Value)))
+		case arch.IndirectRegister:
+			fmt.Fprintf(&sb, "[%s]", strings.ToLower(arch.RegisterName(op.Value)))
+		case arch.IndirectRegisterOffset:
+			fmt.Fprintf(&sb, "[%s + %s]", strings.ToLower(arch.RegisterName(op.Base)), formatAddress(op.Value, labels))
+		case arch.IndirectRegisterIndex:
+			fmt.Fprintf(&sb, "[%s + %s]", strings.ToLower(arch.RegisterName(op.Base)), strings.ToLower(arch.RegisterName(op.Value)))
+		}
+	}
+
+	return sb.String()
+}
+
+// Target returns the address a branch instruction jumps to.
+// Returns false if the instruction is not a branch, or if its
+// target is not a constant.
+func (i Instruction) Target() (int, bool) {
+	if !isBranch(i.Opcode) || len(i.Args) == 0 || i.Args[0].Mode != arch.ImmediateConstant {
+		return 0, false
+	}
+	return i.Args[0].Value, true
+}
+
+// isBranch returns true if the opcode transfers control to its first operand.
+func isBranch(opcode int) bool {
+	switch opcode {
+	case arch.JMP, arch.JEZ, arch.JNZ, arch.CALL, arch.CLEZ, arch.CLNZ:
+		return true
+	}
+	return false
+}
+
+// formatAddress returns the label for the given address, if labels
+// contains one. Otherwise it returns the address as a number.
+func formatAddress(addr int, labels map[int]string) string {
+	if name, ok := labels[addr]; ok {
+		return name
+	}
+	return formatNumber(addr)
+}
+
+// formatNumber returns v in assembler syntax.
+func formatNumber(v int) string {
+	return fmt.Sprintf("16#%04x", v)
+}
@@ -10,7 +10,7 @@ import (
 // Operands are expected to be of the types int64, bool or string.
 // This function performs implicit type conversions where applicable.
 //
-// Supported operations are: + - * / % << >> & | ^ == < <= > >=
+// Supported operations are: + - * / % << >> & | ^ == != < <= > >=
 // Not all data types are supported by all operations.
 func apply(op string, a, b interface{}) (interface{}, error) {
 	switch op {
@@ -36,6 +36,8 @@ func apply(op string, a, b interface{}) (interface{}, error) {
 		return xor(a, b)
 	case "==":
 		return eq(a, b)
+	case "!=":
+		return ne(a, b)
 	case "<":
 		return lt(a, b)
 	case "<=":
@@ -121,7 +123,7 @@ func lt(a, b interface{}) (interface{}, error) {
 func eq(a, b interface{}) (interface{}, error) {
 	// Short path in case and b are the same object.
 	if a == b {
-		return true, nil
+		return _bool(true), nil
 	}
 
 	switch va := a.(type) {
@@ -139,6 +141,16 @@ func eq(a, b interface{}) (interface{}, error) {
 	return false, fmt.Errorf("can not evaluate %T == %T", a, b)
 }
 
+// ne returns true if a != b
+func ne(a, b interface{}) (interface{}, error) {
+	v, err := eq(a, b)
+	if err != nil {
+		return false, fmt.Errorf("can not evaluate %T != %T", a, b)
+	}
+
+	return ^v.(int64), nil
+}
+
 // xor returns a ^ b
 func xor(a, b interface{}) (interface{}, error) {
 	switch va := a.(type) {
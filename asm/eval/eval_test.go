@@ -43,6 +43,7 @@ func TestApply(t *testing.T) {
 		{"|", makeTests(int64(507), nil, nil, nil)},
 		{"^", makeTests(int64(435), nil, nil, nil)},
 		{"==", makeTests(int64(0), nil, nil, int64(0))},
+		{"!=", makeTests(int64(-1), nil, nil, int64(-1))},
 		{"<", makeTests(int64(-1), nil, nil, int64(-1))},
 		{"<=", makeTests(int64(-1), nil, nil, int64(-1))},
 		{">", makeTests(int64(0), nil, nil, int64(0))},
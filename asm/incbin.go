@@ -0,0 +1,119 @@
+package asm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/hexaflex/svm/asm/ar"
+	"github.com/hexaflex/svm/asm/parser"
+)
+
+// Binary includes take the following form:
+//
+//	incbin "path" [, offset [, length]]
+//
+// The path, offset and length are resolved by resolveBinaryInclude, after
+// which the directive always has all three operands. This lets encodedLen
+// find its size without reading the file.
+
+// resolveBinaryPath replaces the path in the given incbin directive with
+// the location of the file in the include search paths, or in the
+// directory of the source file the directive is defined in.
+func resolveBinaryPath(instr *parser.List, includeSearchPaths []string) error {
+	if instr.Len() < 2 || instr.Len() > 4 {
+		return parser.NewError(instr.Position(), "invalid incbin directive; expected `incbin <path> [, <offset> [, <length>]]`")
+	}
+
+	expr := instr.At(1).(*parser.List)
+	if expr.Len() != 1 || expr.At(0).Type() != parser.String {
+		return parser.NewError(expr.Position(), "invalid incbin path; expected string")
+	}
+
+	path := expr.At(0).(*parser.Value)
+	dir, _ := filepath.Split(instr.Position().File)
+	file := findSourceFile(path.Value, append(includeSearchPaths[:len(includeSearchPaths):len(includeSearchPaths)], dir))
+
+	if stat, err := os.Stat(file); err != nil || stat.IsDir() {
+		return parser.NewError(path.Position(), "incbin file %q not found", path.Value)
+	}
+
+	path.Value = file
+	return nil
+}
+
+// resolveBinaryInclude locates the file in the given incbin directive and
+// replaces its offset and length with numbers. The length defaults to the
+// rest of the file. This runs wherever the directive ends up, including
+// macro bodies and repeat blocks.
+func (a *assembler) resolveBinaryInclude(instr *parser.List, scopes []map[string]condSymbol) error {
+	if err := resolveBinaryPath(instr, a.includes); err != nil {
+		return err
+	}
+
+	file := instr.At(1).(*parser.List).At(0).(*parser.Value).Value
+
+	stat, err := os.Stat(file)
+	if err != nil {
+		return newError(instr.Position(), "incbin: %v", err)
+	}
+
+	values := []int64{0, stat.Size()}
+	for i := 2; i < instr.Len(); i++ {
+		if values[i-2], err = evaluateCondExpression(instr.At(i).(*parser.List), scopes); err != nil {
+			return err
+		}
+	}
+
+	if instr.Len() < 4 {
+		values[1] = stat.Size() - values[0]
+	}
+
+	offset, length := values[0], values[1]
+	switch {
+	case offset < 0 || offset > stat.Size():
+		return newError(instr.Position(), "incbin offset %d is outside of %q, which has %d bytes", offset, file, stat.Size())
+	case length < 0 || offset+length > stat.Size():
+		return newError(instr.Position(), "incbin length %d at offset %d exceeds the size of %q", length, offset, file)
+	case length > ar.MemoryCapacity:
+		return newError(instr.Position(), "incbin length %d exceeds the memory capacity", length)
+	}
+
+	name, path := instr.At(0), instr.At(1)
+	instr.Clear()
+	instr.Append(name, path)
+
+	for _, v := range values {
+		expr := parser.NewList(instr.Position(), parser.Expression)
+		expr.Append(parser.NewValue(instr.Position(), parser.Number, strconv.FormatInt(v, 10)))
+		instr.Append(expr)
+	}
+
+	return nil
+}
+
+// encodeBinaryInclude returns the bytes included by the given incbin directive.
+func encodeBinaryInclude(instr *parser.List) ([]byte, error) {
+	file := instr.At(1).(*parser.List).At(0).(*parser.Value).Value
+	offset, length := binaryIncludeRange(instr)
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, newError(instr.Position(), "incbin: %v", err)
+	}
+
+	if offset+length > len(data) {
+		return nil, newError(instr.Position(), "incbin file %q has changed during assembly", file)
+	}
+
+	return data[offset : offset+length], nil
+}
+
+// binaryIncludeRange returns the offset and length of the data included by
+// the given incbin directive.
+func binaryIncludeRange(instr *parser.List) (int, int) {
+	offset, _ := parser.ParseNumber(instr.At(2).(*parser.List).At(0).(*parser.Value).Value)
+	length, _ := parser.ParseNumber(instr.At(3).(*parser.List).At(0).(*parser.Value).Value)
+	return int(offset), int(length)
+}
@@ -0,0 +1,70 @@
+package asm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIncbin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	assets := filepath.Join(dir, "assets")
+	if err := os.Mkdir(assets, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(assets, "data.bin"), []byte{1, 2, 3, 4, 5, 6, 7, 8}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := buildCode(t, []string{assets}, Options{}, `
+const Skip = 2
+    d8 "ab"
+    incbin "data.bin", Skip, 3
+    incbin "data.bin", 6
+    d16 end
+:end
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{'a', 'b', 3, 4, 5, 7, 8, 0x00, 0x09}
+	if !bytes.Equal(code, want) {
+		t.Fatalf("unexpected code:\nwant: % x\nhave: % x", want, code)
+	}
+
+	// The file is found on the search path from inside a macro as well.
+	code, err = buildCode(t, []string{assets}, Options{}, `
+macro blob
+    incbin "data.bin", 1, 2
+endmacro
+    blob
+    blob
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []byte{2, 3, 2, 3}; !bytes.Equal(code, want) {
+		t.Fatalf("unexpected code:\nwant: % x\nhave: % x", want, code)
+	}
+
+	for _, source := range []string{
+		`incbin "missing.bin"`,
+		`incbin "data.bin", 9`,
+		`incbin "data.bin", 4, 5`,
+		`incbin 1`,
+	} {
+		if _, err := buildCode(t, []string{assets}, Options{}, source); err == nil {
+			t.Fatalf("expected error for:\n%s", source)
+		}
+	}
+}
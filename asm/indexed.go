@@ -0,0 +1,127 @@
+package asm
+
+import (
+	"strconv"
+
+	"github.com/hexaflex/svm/arch"
+	"github.com/hexaflex/svm/asm/parser"
+)
+
+// Address modes for memory operands which add something to a register.
+// They are only known to the assembler. See arch.ExtendedOperand for
+// their encoding.
+const (
+	modeRegisterOffset = "[r+"  // [r0 + 123]
+	modeRegisterIndex  = "[r+r" // [r0 + r1]
+)
+
+// resolveIndexedOperands finds memory operands which add a constant or a
+// second register to a register and gives them the matching extended
+// address mode. The following forms are accepted:
+//
+//	[r0 + x]    Address is r0 plus the value of expression x.
+//	[r0 - x]    Address is r0 minus the value of expression x.
+//	[x + r0]    Same as [r0 + x].
+//	[r0 + r1]   Address is r0 plus r1.
+//
+// The base register is removed from the operand and recorded in
+// a.indexRegisters. What remains is the expression for the offset, or
+// the index register.
+//
+// Registers are not allowed anywhere else in an operand expression. The
+// parser turns `r0 + 1` into a reference to r1, which is never what the
+// programmer meant.
+func (a *assembler) resolveIndexedOperands(nodes *parser.List) error {
+	return nodes.Each(func(_ int, n parser.Node) error {
+		if n.Type() != parser.Instruction {
+			return nil
+		}
+
+		instr := n.(*parser.List)
+		if _, ok := arch.Opcode(instr.At(0).(*parser.Value).Value); !ok {
+			return nil
+		}
+
+		for i := 1; i < instr.Len(); i++ {
+			if err := a.resolveIndexedOperand(instr.At(i).(*parser.List)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// resolveIndexedOperand rewrites the given operand if it adds something to
+// a register. See resolveIndexedOperands.
+func (a *assembler) resolveIndexedOperand(expr *parser.List) error {
+	nodes := expr.Slice()
+
+	var typ []parser.Node
+	if len(nodes) > 0 && nodes[0].Type() == parser.TypeDescriptor {
+		typ, nodes = nodes[:1], nodes[1:]
+	}
+
+	var regs []int
+	for i, n := range nodes {
+		if n.Type() == parser.AddressMode && n.(*parser.Value).Value != "[" {
+			regs = append(regs, i)
+		}
+	}
+
+	if len(regs) == 0 || (len(regs) == 1 && regs[0] == 0 && len(nodes) == 2) {
+		return nil // No registers, or a plain register operand.
+	}
+
+	invalid := newError(expr.Position(), "invalid register operand; expected r, [r], [r + x], [r - x], [x + r] or [r + r]")
+	mode := nodes[0].(*parser.Value).Value
+
+	var base string
+	var out []parser.Node
+
+	switch {
+	case mode == "[r" && len(regs) == 1 && len(nodes) > 3 && isOperatorValue(nodes[2], "+"):
+		// [r0 + x]
+		base = nodes[1].(*parser.Value).Value
+		out = append(out, parser.NewValue(nodes[0].Position(), parser.AddressMode, modeRegisterOffset))
+		out = append(out, nodes[3:]...)
+
+	case mode == "[r" && len(regs) == 1 && len(nodes) > 3 && isOperatorValue(nodes[2], "-"):
+		// [r0 - x]
+		pos := nodes[2].Position()
+		base = nodes[1].(*parser.Value).Value
+		out = append(out, parser.NewValue(nodes[0].Position(), parser.AddressMode, modeRegisterOffset))
+		out = append(out, parser.NewValue(pos, parser.Number, "0"), newOperator(pos, "-"), newOperator(pos, "("))
+		out = append(out, nodes[3:]...)
+		out = append(out, newOperator(pos, ")"))
+
+	case mode == "[r" && len(regs) == 2 && len(nodes) == 5 && regs[1] == 3 && isOperatorValue(nodes[2], "+"):
+		// [r0 + r1]
+		base = nodes[1].(*parser.Value).Value
+		out = append(out, parser.NewValue(nodes[0].Position(), parser.AddressMode, modeRegisterIndex), nodes[4])
+
+	case mode == "[" && len(regs) == 1 && regs[0] == len(nodes)-2 && regs[0] > 2 && isOperatorValue(nodes[regs[0]-1], "+"):
+		// [x + r0]
+		base = nodes[len(nodes)-1].(*parser.Value).Value
+		out = append(out, nodes[0])
+		out = append(out, nodes[1:regs[0]-1]...)
+		out[0] = parser.NewValue(nodes[0].Position(), parser.AddressMode, modeRegisterOffset)
+
+	default:
+		return invalid
+	}
+
+	index, err := strconv.Atoi(base)
+	if err != nil {
+		return invalid
+	}
+
+	expr.Clear()
+	if len(typ) > 0 {
+		expr.Append(typ...)
+	}
+	expr.Append(out...)
+
+	a.indexRegisters[expr] = index
+	return nil
+}
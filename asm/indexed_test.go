@@ -0,0 +1,44 @@
+package asm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestIndexedOperands(t *testing.T) {
+	code, err := buildCode(t, nil, Options{}, `
+    push [r1 + 4]
+    push u8 [rsp - 2]
+    push [table + r3]
+    push [r1 + r2]
+    push [r1]
+:table
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{
+		0x03, 0xff, 0x1f, 0x00, 0x04,
+		0x03, 0xcf, 0x8f, 0xff, 0xfe,
+		0x03, 0xff, 0x3f, 0x00, 0x14,
+		0x03, 0xff, 0x12,
+		0x03, 0xf1,
+	}
+
+	if !bytes.Equal(code, want) {
+		t.Fatalf("unexpected code:\nwant: % x\nhave: % x", want, code)
+	}
+
+	for _, source := range []string{
+		" push r0 + 1",
+		" push [r1 * 2]",
+		" push [r1 + r2 + 1]",
+		" push [r1 - r2]",
+		" push [4 - r1]",
+	} {
+		if _, err := buildCode(t, nil, Options{}, source); err == nil {
+			t.Fatalf("expected error for:\n%s", source)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Package link combines relocatable objects into a program archive.
+package link
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hexaflex/svm/asm/ar"
+	"github.com/pkg/errors"
+)
+
+// Module defines an object to be linked.
+type Module struct {
+	Name    string     // Module name, used in error messages and as the name of its section.
+	Object  *ar.Object // Object to link.
+	Address int        // Base address. If negative, the module directly follows the previous one.
+}
+
+// symbol defines an exported symbol, with its final value.
+type symbol struct {
+	name   string
+	kind   ar.SymbolKind
+	value  int
+	module string
+}
+
+// Link places the given modules at their base addresses and resolves the
+// symbols they import from each other. The result is a complete program.
+// The entry point is the address of the given exported label, or the base
+// address of the first module if entry is empty.
+//
+// All duplicate and unresolved symbols are reported in a single error.
+func Link(modules []Module, entry string) (*ar.Archive, error) {
+	modules, err := place(modules)
+	if err != nil {
+		return nil, err
+	}
+
+	symbols, errs := exports(modules)
+
+	for _, m := range modules {
+		for _, name := range m.Object.Imports {
+			if _, ok := symbols[strings.ToLower(name)]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: unresolved symbol %q", m.Name, name))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "\n"))
+	}
+
+	archive := ar.New()
+
+	for _, m := range modules {
+		code := append([]byte(nil), m.Object.Code...)
+
+		for _, r := range m.Object.Relocations {
+			base := m.Address
+			if len(r.Symbol) > 0 {
+				base = symbols[strings.ToLower(r.Symbol)].value
+			}
+
+			v := int(code[r.Offset])<<8 | int(code[r.Offset+1])
+			v += base
+			code[r.Offset] = byte(v >> 8)
+			code[r.Offset+1] = byte(v)
+		}
+
+		archive.Sections = append(archive.Sections, ar.Section{Name: m.Name, Address: m.Address, Data: code})
+		linkDebug(&archive.Debug, &m.Object.Debug, m.Address)
+	}
+
+	end := 0
+	for _, s := range archive.Sections {
+		if s.Address+len(s.Data) > end {
+			end = s.Address + len(s.Data)
+		}
+	}
+
+	archive.Instructions = make([]byte, end)
+	for _, s := range archive.Sections {
+		copy(archive.Instructions[s.Address:], s.Data)
+	}
+
+	if len(modules) > 0 {
+		archive.Entry = modules[0].Address
+	}
+
+	if len(entry) > 0 {
+		sym, ok := symbols[strings.ToLower(entry)]
+		if !ok || sym.kind != ar.Label {
+			return nil, errors.Errorf("entry point %q is not an exported label", entry)
+		}
+		archive.Entry = sym.value
+	}
+
+	return archive, nil
+}
+
+// place returns a copy of modules with all base addresses assigned.
+// Returns an error if modules overlap or do not fit in memory.
+func place(modules []Module) ([]Module, error) {
+	out := make([]Module, len(modules))
+	copy(out, modules)
+
+	next := 0
+	for i := range out {
+		m := &out[i]
+		if m.Address < 0 {
+			m.Address = next
+		}
+
+		next = m.Address + len(m.Object.Code)
+		if next > ar.MemoryCapacity {
+			return nil, errors.Errorf("%s: module at %04x with size %d does not fit in memory", m.Name, m.Address, len(m.Object.Code))
+		}
+	}
+
+	sorted := make([]Module, len(out))
+	copy(sorted, out)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Address < sorted[j].Address
+	})
+
+	for i := 1; i < len(sorted); i++ {
+		a, b := &sorted[i-1], &sorted[i]
+		if len(a.Object.Code) > 0 && len(b.Object.Code) > 0 && a.Address+len(a.Object.Code) > b.Address {
+			return nil, errors.Errorf("%s at %04x-%04x overlaps %s at %04x-%04x", b.Name, b.Address, b.Address+len(b.Object.Code),
+				a.Name, a.Address, a.Address+len(a.Object.Code))
+		}
+	}
+
+	return out, nil
+}
+
+// exports returns the exported symbols of all modules by lowercase name.
+// Labels are moved to the module's base address. Duplicate exports are
+// returned as errors.
+func exports(modules []Module) (map[string]symbol, []string) {
+	symbols := make(map[string]symbol)
+	var errs []string
+
+	for _, m := range modules {
+		for _, s := range m.Object.Exports {
+			key := strings.ToLower(s.Name)
+			if prev, ok := symbols[key]; ok {
+				errs = append(errs, fmt.Sprintf("%s: duplicate symbol %q; previous definition in %s", m.Name, s.Name, prev.module))
+				continue
+			}
+
+			value := s.Value
+			if s.Kind == ar.Label {
+				value += m.Address
+			}
+
+			symbols[key] = symbol{name: s.Name, kind: s.Kind, value: value, module: m.Name}
+		}
+	}
+
+	return symbols, errs
+}
+
+// linkDebug appends the debug data for a module at the given base address to dst.
+func linkDebug(dst, src *ar.Debug, base int) {
+	files := make([]int, len(src.Files))
+	for i, file := range src.Files {
+		files[i] = -1
+		for j, v := range dst.Files {
+			if v == file {
+				files[i] = j
+			}
+		}
+
+		if files[i] == -1 {
+			files[i] = len(dst.Files)
+			dst.Files = append(dst.Files, file)
+		}
+	}
+
+	for _, sym := range src.Symbols {
+		sym.Address += base
+		sym.File = files[sym.File]
+		dst.Symbols = append(dst.Symbols, sym)
+	}
+
+	for _, sym := range src.Names {
+		if sym.Kind == ar.Label {
+			sym.Value += base
+		}
+		dst.AddName(sym.Name, sym.Kind, sym.Value)
+	}
+}
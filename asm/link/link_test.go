@@ -0,0 +1,127 @@
+package link
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hexaflex/svm/asm"
+	"github.com/hexaflex/svm/asm/ar"
+)
+
+const mainSource = `
+import counter
+import limit
+export main
+
+:main
+    mov r0, 0
+:loop
+    call counter
+    clt r0, limit
+    jnz loop
+    halt
+`
+
+const libSource = `
+export counter
+export limit
+
+const limit = 10
+
+:counter
+    add r0, r0, 1
+    ret
+:table
+    d16 counter, table + 2, table - counter
+`
+
+func TestLink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	main := buildObject(t, dir, "main.svm", mainSource)
+	lib := buildObject(t, dir, "lib.svm", libSource)
+
+	archive, err := Link([]Module{
+		{Name: "main", Object: main, Address: -1},
+		{Name: "lib", Object: lib, Address: 0x100},
+	}, "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same program, built as a whole.
+	want := append([]byte(nil), main.Code...)
+	want = append(want, make([]byte, 0x100-len(want))...)
+	want = append(want, lib.Code...)
+	copy(want[7:], []byte{0x01, 0x00})                 // call counter
+	copy(want[0x0c:], []byte{0x00, 0x0a})              // clt r0, limit
+	copy(want[0x10:], []byte{0x00, 0x05})              // jnz loop
+	copy(want[0x107:], []byte{0x01, 0x00, 0x01, 0x09}) // d16 counter, table + 2
+
+	if !bytes.Equal(archive.Instructions, want) || archive.Entry != 0 {
+		t.Fatalf("unexpected program:\nwant: % x\nhave: % x", want, archive.Instructions)
+	}
+
+	if sym := archive.Debug.FindName("counter"); sym == nil || sym.Value != 0x100 {
+		t.Fatalf("unexpected debug symbol %v", sym)
+	}
+
+	// Objects survive a round trip through the file format.
+	var buf bytes.Buffer
+	if err := lib.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := ar.NewObject()
+	if err := loaded.Load(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(loaded, lib) {
+		t.Fatalf("object mismatch:\nwant: %v\nhave: %v", lib, loaded)
+	}
+
+	// Duplicate and unresolved symbols are reported.
+	if _, err := Link([]Module{{Name: "main", Object: main, Address: -1}}, ""); err == nil {
+		t.Fatalf("expected error for unresolved symbols")
+	}
+
+	if _, err := Link([]Module{
+		{Name: "main", Object: main, Address: -1},
+		{Name: "lib", Object: lib, Address: -1},
+		{Name: "lib2", Object: lib, Address: -1},
+	}, ""); err == nil {
+		t.Fatalf("expected error for duplicate symbols")
+	}
+
+	if _, err := Link([]Module{
+		{Name: "main", Object: main, Address: 0},
+		{Name: "lib", Object: lib, Address: 4},
+	}, ""); err == nil {
+		t.Fatalf("expected error for overlapping modules")
+	}
+}
+
+func buildObject(t *testing.T, dir, name, source string) *ar.Object {
+	t.Helper()
+
+	file := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(file, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	obj, err := asm.BuildObject(file, nil, asm.Options{Debug: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return obj
+}
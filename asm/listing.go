@@ -0,0 +1,253 @@
+package asm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/hexaflex/svm/asm/ar"
+	"github.com/hexaflex/svm/asm/disasm"
+	"github.com/hexaflex/svm/asm/parser"
+)
+
+// bytesPerLine is the number of encoded bytes shown per listing line.
+const bytesPerLine = 8
+
+// listing records the code emitted for each instruction, in order to
+// produce an assembler listing.
+type listing struct {
+	entries []listingEntry
+	origins map[parser.Node]parser.Position // Invocation positions for nodes expanded from a macro.
+	names   []ar.Symbol                     // Named labels, constants and macros.
+}
+
+// listingEntry defines the code emitted for a single instruction.
+type listingEntry struct {
+	address int
+	code    []byte
+	pos     parser.Position  // Source position of the instruction.
+	origin  *parser.Position // Position of the macro invocation the instruction came from, if any.
+	size    int              // Value size of a data directive, or 0 for instructions.
+}
+
+func newListing() *listing {
+	return &listing{
+		origins: make(map[parser.Node]parser.Position),
+	}
+}
+
+// expand records that the given macro body replaces the invocation instr.
+// Nested invocations keep the position of the outermost one.
+func (l *listing) expand(instr parser.Node, body []parser.Node) {
+	pos, ok := l.origins[instr]
+	if !ok {
+		pos = instr.Position()
+	}
+
+	for _, n := range body {
+		l.origins[n] = pos
+	}
+}
+
+// add records the code emitted for instr at the given address.
+func (l *listing) add(instr *parser.List, address int, code []byte) {
+	e := listingEntry{
+		address: address,
+		code:    append([]byte(nil), code...),
+		pos:     instr.Position(),
+	}
+
+	if pos, ok := l.origins[instr]; ok {
+		e.origin = &pos
+	}
+
+	e.size, _ = isDataDirective(instr)
+	if isInstruction(instr, "incbin") {
+		e.size = 1
+	}
+	l.entries = append(l.entries, e)
+}
+
+// write writes the listing to w. Source lines are listed in file order
+// with the address and bytes of the code they produce. Code generated
+// from macro invocations, `if` statements and repeat blocks is listed
+// below the line it came from, marked with a '+'. A table of all named symbols follows.
+func (l *listing) write(w io.Writer) error {
+	lw := listingWriter{
+		w:     bufio.NewWriter(w),
+		files: make(map[string][]string),
+		done:  make(map[string]int),
+	}
+
+	for i := range l.entries {
+		lw.entry(&l.entries[i])
+	}
+
+	lw.finishFile()
+	lw.symbols(l.names)
+	return lw.w.Flush()
+}
+
+// listingWriter holds the state needed to write a listing.
+type listingWriter struct {
+	w     *bufio.Writer
+	files map[string][]string // Source lines by file name.
+	done  map[string]int      // Number of lines listed per file.
+	file  string              // File currently being listed.
+}
+
+// entry writes the given entry, preceded by any source lines leading up to it.
+func (lw *listingWriter) entry(e *listingEntry) {
+	pos := e.pos
+	if e.origin != nil {
+		pos = *e.origin
+	}
+
+	if pos.File != lw.file {
+		lw.finishFile()
+		lw.file = pos.File
+		fmt.Fprintf(lw.w, "%s\n\n", pos.File)
+	}
+
+	if pos.Line <= lw.done[lw.file] {
+		lw.expansion(e)
+		return
+	}
+
+	lw.sourceLines(pos.Line - 1)
+
+	if e.origin != nil {
+		lw.sourceLines(pos.Line)
+		lw.expansion(e)
+		return
+	}
+
+	lw.done[lw.file] = pos.Line
+	lw.code(e.address, e.code, fmt.Sprintf("%5d  %s", pos.Line, lw.source(pos.Line)))
+}
+
+// expansion writes code which does not map to a line of its own.
+func (lw *listingWriter) expansion(e *listingEntry) {
+	var text string
+	if instr, err := disasm.Decode(e.code, 0); err == nil && e.size == 0 {
+		text = instr.String()
+	} else {
+		text = dataText(e.code, e.size)
+	}
+
+	lw.code(e.address, e.code, "    +  "+text)
+}
+
+// dataText returns a data directive which emits the given code as values
+// of the given byte size. Code which is not a data directive is listed as
+// a sequence of bytes.
+func dataText(code []byte, size int) string {
+	if size == 0 || len(code)%size != 0 {
+		size = 1
+	}
+
+	values := make([]string, 0, len(code)/size)
+	for i := 0; i < len(code); i += size {
+		var v uint64
+		for _, b := range code[i : i+size] {
+			v = v<<8 | uint64(b)
+		}
+		values = append(values, fmt.Sprintf("16#%0*x", size*2, v))
+	}
+
+	return fmt.Sprintf("d%d %s", size*8, strings.Join(values, ", "))
+}
+
+// code writes a line with an address, the given code and text. Code which
+// does not fit on one line continues on the next lines, without text.
+func (lw *listingWriter) code(address int, code []byte, text string) {
+	for i := 0; i == 0 || i < len(code); i += bytesPerLine {
+		end := i + bytesPerLine
+		if end > len(code) {
+			end = len(code)
+		}
+
+		hex := make([]string, end-i)
+		for j := range hex {
+			hex[j] = fmt.Sprintf("%02x", code[i+j])
+		}
+
+		line := fmt.Sprintf("%04x  %-*s", address+i, bytesPerLine*3-1, strings.Join(hex, " "))
+		if i == 0 {
+			line += "  " + text
+		}
+
+		fmt.Fprintln(lw.w, strings.TrimRight(line, " "))
+	}
+}
+
+// sourceLines writes the lines of the current file up to and including
+// the given line, if they have not been listed yet.
+func (lw *listingWriter) sourceLines(line int) {
+	for n := lw.done[lw.file] + 1; n <= line; n++ {
+		text := fmt.Sprintf("%*s  %5d  %s", 4+2+bytesPerLine*3-1, "", n, lw.source(n))
+		fmt.Fprintln(lw.w, strings.TrimRight(text, " "))
+	}
+
+	if line > lw.done[lw.file] {
+		lw.done[lw.file] = line
+	}
+}
+
+// finishFile writes the remaining lines of the current file.
+func (lw *listingWriter) finishFile() {
+	if len(lw.file) == 0 {
+		return
+	}
+
+	lw.source(1)
+	lw.sourceLines(len(lw.files[lw.file]))
+	fmt.Fprintln(lw.w)
+}
+
+// source returns the text of the given line in the current file.
+// Returns an empty string if the file can not be read.
+func (lw *listingWriter) source(line int) string {
+	lines, ok := lw.files[lw.file]
+	if !ok {
+		data, err := ioutil.ReadFile(lw.file)
+		if err == nil {
+			lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+			for i := range lines {
+				lines[i] = strings.TrimSuffix(lines[i], "\r")
+			}
+		}
+		lw.files[lw.file] = lines
+	}
+
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+
+	return lines[line-1]
+}
+
+// symbols writes the table of named symbols.
+func (lw *listingWriter) symbols(names []ar.Symbol) {
+	sort.Slice(names, func(i, j int) bool {
+		return strings.ToLower(names[i].Name) < strings.ToLower(names[j].Name)
+	})
+
+	fmt.Fprintf(lw.w, "Symbols:\n\n")
+
+	for _, sym := range names {
+		var value string
+		switch sym.Kind {
+		case ar.Label:
+			value = fmt.Sprintf("%04x", sym.Value)
+		case ar.Constant:
+			value = fmt.Sprintf("%d", sym.Value)
+		}
+
+		text := fmt.Sprintf("%-32s %-8s  %s", sym.Name, sym.Kind, value)
+		fmt.Fprintln(lw.w, strings.TrimRight(text, " "))
+	}
+}
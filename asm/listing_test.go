@@ -0,0 +1,55 @@
+package asm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const listingTestSource = `
+macro inc x
+    add x, x, 1
+endmacro
+
+:main
+    mov r0, 0
+    if r0 < 10
+        inc r0
+    halt
+
+for i = 0 to 3
+    d16 i * i
+endfor
+`
+
+func TestBuildListing(t *testing.T) {
+	var buf bytes.Buffer
+	archive, err := buildSource(t, nil, Options{Listing: &buf}, listingTestSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !archive.Debug.Empty() {
+		t.Fatalf("unexpected debug data")
+	}
+
+	want := []string{
+		"0000  02 b0 30 00 00               7      mov r0, 0",
+		"0005  17 b0 30 00 0a               8      if r0 < 10",
+		"000a  1a 30 00 14                  +  jez 16#0014",
+		"                                   9          inc r0",
+		"000e  07 b0 b0 30 00 01            +  add r0, r0, 16#0001",
+		"0014  01                          10      halt",
+		"0017  00 01                        +  d16 16#0001",
+		"001b  00 09                        +  d16 16#0009",
+		"inc                              macro",
+		"main                             label     0000",
+	}
+
+	lines := strings.Split(buf.String(), "\n")
+	for _, line := range want {
+		if !containsString(lines, line) {
+			t.Fatalf("missing line %q in listing:\n%s", line, buf.String())
+		}
+	}
+}
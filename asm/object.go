@@ -0,0 +1,338 @@
+package asm
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/hexaflex/svm/asm/ar"
+	"github.com/hexaflex/svm/asm/eval"
+	"github.com/hexaflex/svm/asm/parser"
+)
+
+// baseSelf is the relocation base for values relative to the start of
+// the object being built.
+const baseSelf = "."
+
+// relocDelta is the offset by which relocatable symbols are moved to find
+// out if an expression depends on them. It is odd and has bits above the
+// 16-bit range, so that most expressions which can not be relocated by
+// simple addition yield a different offset.
+const relocDelta = 0x12345
+
+// objectBuilder holds the state needed to build a relocatable object.
+//
+// Every symbol and operand has a relocation base. This is an empty string
+// for absolute values, baseSelf for values relative to the start of the
+// object, or the name of an imported symbol. Values with a base are added
+// to the relocation table.
+type objectBuilder struct {
+	bases       map[string]string         // Relocation bases for symbols, by symbol key.
+	operands    map[*parser.List][]string // Relocation bases for instruction operands, by operand index.
+	exports     []*parser.List            // Export directives.
+	scopes      []parser.Scope            // Scopes in which the export directives occur.
+	imports     []string                  // Names of imported symbols.
+	relocations []ar.Relocation
+}
+
+func newObjectBuilder() *objectBuilder {
+	return &objectBuilder{
+		bases:    make(map[string]string),
+		operands: make(map[*parser.List][]string),
+	}
+}
+
+// BuildObject builds a relocatable object from the given module and its
+// dependencies. Debug symbols and defines are taken from opt. Listings and
+// memory maps are not supported for objects. Symbols named in `export`
+// directives are made available to other objects. Symbols named in
+// `import` directives are expected to be exported by another object.
+// See Link for combining objects into a program.
+func BuildObject(file string, includeSearchPaths []string, opt Options) (*ar.Object, error) {
+	ast, err := BuildAST(file, includeSearchPaths)
+	if err != nil {
+		return nil, err
+	}
+
+	asm := newAssembler(opt.Debug)
+	asm.defines = opt.Defines
+	asm.includes = includeSearchPaths
+	asm.obj = newObjectBuilder()
+
+	archive, err := asm.assemble(ast)
+	if err != nil {
+		return nil, err
+	}
+
+	exports, err := asm.resolveExports()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ar.Object{
+		Debug:       archive.Debug,
+		Code:        archive.Instructions,
+		Exports:     exports,
+		Imports:     asm.obj.imports,
+		Relocations: asm.obj.relocations,
+	}, nil
+}
+
+// resolveLinkage finds `import` and `export` directives and removes them.
+// When building an object, imported names are added to the symbol table
+// and the exports are kept for later. Otherwise the directives are ignored,
+// which allows the same source to be built as a whole program.
+func (a *assembler) resolveLinkage(nodes *parser.List, scope parser.Scope) error {
+	for i := 0; i < nodes.Len(); i++ {
+		n := nodes.At(i)
+
+		if n.Type() == parser.ScopeBegin {
+			scope = scope.Join(n.(*parser.Value).Value)
+			continue
+		}
+
+		if n.Type() == parser.ScopeEnd {
+			scope, _ = scope.Split()
+			continue
+		}
+
+		instr, ok := n.(*parser.List)
+		if !ok || n.Type() != parser.Instruction {
+			continue
+		}
+
+		isImport := isIdent(instr.At(0), "import")
+		if !isImport && !isIdent(instr.At(0), "export") {
+			continue
+		}
+
+		if instr.Len() != 2 || instr.At(1).(*parser.List).Len() != 1 || instr.At(1).(*parser.List).At(0).Type() != parser.Ident {
+			return newError(instr.Position(), "invalid %s directive; expected `%[1]s <name>`", instr.At(0).(*parser.Value).Value)
+		}
+
+		nodes.Remove(i)
+		i--
+
+		if a.obj == nil {
+			continue
+		}
+
+		if !isImport {
+			a.obj.exports = append(a.obj.exports, instr)
+			a.obj.scopes = append(a.obj.scopes, scope)
+			continue
+		}
+
+		name := instr.At(1).(*parser.List).At(0).(*parser.Value)
+		if pos, ok := a.hasSymbol(name.Value); ok {
+			return newError(name.Position(), "duplicate symbol %q; previous definition at %s", name.Value, pos)
+		}
+
+		key := strings.ToLower(name.Value)
+		pos := name.Position()
+		a.symbols[key] = 0
+		a.symbolPositions[key] = &pos
+		a.obj.bases[key] = filepath.ToSlash(name.Value)
+		a.obj.imports = append(a.obj.imports, filepath.ToSlash(name.Value))
+	}
+
+	return nil
+}
+
+// resolveExports returns the symbols named in export directives.
+func (a *assembler) resolveExports() ([]ar.Symbol, error) {
+	var out []ar.Symbol
+
+	for i, instr := range a.obj.exports {
+		name := instr.At(1).(*parser.List).At(0).(*parser.Value)
+
+		key, ok := a.findSymbol(a.obj.scopes[i], strings.ToLower(name.Value))
+		if !ok {
+			return nil, newError(name.Position(), "export of undefined symbol %q", name.Value)
+		}
+
+		sym := ar.Symbol{Name: filepath.ToSlash(name.Value), Value: a.symbols[key]}
+
+		switch a.obj.bases[key] {
+		case "":
+			sym.Kind = ar.Constant
+		case baseSelf:
+			sym.Kind = ar.Label
+		default:
+			return nil, newError(name.Position(), "can not export %q; it refers to an imported symbol", name.Value)
+		}
+
+		for _, v := range out {
+			if strings.EqualFold(v.Name, sym.Name) {
+				return nil, newError(name.Position(), "duplicate export of symbol %q", name.Value)
+			}
+		}
+
+		out = append(out, sym)
+	}
+
+	return out, nil
+}
+
+// evaluate evaluates the operand expressions in the given instruction.
+// When building an object, it also records the relocation base for
+// each operand.
+func (a *assembler) evaluate(instr *parser.List, scope parser.Scope) error {
+	if a.obj == nil {
+		return eval.Evaluate(instr, a.resolveReference, scope)
+	}
+
+	orig := instr.Copy().(*parser.List)
+	if err := eval.Evaluate(instr, a.resolveReference, scope); err != nil {
+		return err
+	}
+
+	bases := make([]string, orig.Len())
+	for i := 1; i < orig.Len(); i++ {
+		base, err := a.relocationBase(orig.At(i).(*parser.List), scope)
+		if err != nil {
+			return err
+		}
+		bases[i] = base
+	}
+
+	a.obj.operands[instr] = bases
+	return nil
+}
+
+// relocationBase returns the relocation base for the given unevaluated
+// expression. The expression is evaluated again with the symbols for each
+// base it refers to moved by relocDelta. It is relocatable if the result
+// moves by the same amount for exactly one base, and does not move for the
+// others. Differences between labels, for example, are not relocatable.
+func (a *assembler) relocationBase(expr *parser.List, scope parser.Scope) (string, error) {
+	var candidates []string
+	for _, n := range expr.Slice() {
+		if n.Type() != parser.Ident {
+			continue
+		}
+
+		base := a.referenceBase(scope, strings.ToLower(n.(*parser.Value).Value))
+		if len(base) > 0 && !containsString(candidates, base) {
+			candidates = append(candidates, base)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return "", nil
+	}
+
+	value, err := a.evaluateMoved(expr, scope, "")
+	if err != nil {
+		return "", err
+	}
+
+	var out string
+	for _, base := range candidates {
+		moved, err := a.evaluateMoved(expr, scope, base)
+		if err != nil {
+			return "", err
+		}
+
+		switch moved - value {
+		case 0:
+		case relocDelta:
+			if len(out) > 0 {
+				return "", newError(expr.Position(), "expression refers to more than one relocatable symbol")
+			}
+			out = base
+		default:
+			return "", newError(expr.Position(), "expression can not be relocated")
+		}
+	}
+
+	return out, nil
+}
+
+// evaluateMoved evaluates a copy of the given expression, with the
+// symbols for the given base moved by relocDelta. Returns 0 if the
+// expression does not yield a number.
+func (a *assembler) evaluateMoved(expr *parser.List, scope parser.Scope, base string) (int64, error) {
+	instr := parser.NewList(expr.Position(), parser.Instruction)
+	instr.Append(parser.NewValue(expr.Position(), parser.Ident, "$"), expr.Copy())
+
+	resolve := func(scope parser.Scope, name string) (int, error) {
+		value, err := a.resolveReference(scope, name)
+		if err == nil && len(base) > 0 && a.referenceBase(scope, name) == base {
+			value += relocDelta
+		}
+		return value, err
+	}
+
+	if err := eval.Evaluate(instr, resolve, scope); err != nil {
+		return 0, err
+	}
+
+	for _, n := range instr.At(1).(*parser.List).Slice() {
+		if n.Type() == parser.Number {
+			return parser.ParseNumber(n.(*parser.Value).Value)
+		}
+	}
+
+	return 0, nil
+}
+
+// referenceBase returns the relocation base for the given reference.
+func (a *assembler) referenceBase(scope parser.Scope, name string) string {
+	if name == "$$" {
+		return baseSelf
+	}
+
+	if key, ok := a.findSymbol(scope, name); ok {
+		return a.obj.bases[key]
+	}
+
+	return ""
+}
+
+// relocate adds a relocation for the value of the given operand, if it has
+// a relocation base. Address is the location of the value in the code.
+func (a *assembler) relocate(instr *parser.List, operand, address int) {
+	if a.obj == nil {
+		return
+	}
+
+	bases := a.obj.operands[instr]
+	if operand >= len(bases) || len(bases[operand]) == 0 {
+		return
+	}
+
+	var symbol string
+	if bases[operand] != baseSelf {
+		symbol = bases[operand]
+	}
+
+	a.obj.relocations = append(a.obj.relocations, ar.Relocation{Offset: address, Symbol: symbol})
+}
+
+// relocateData adds relocations for the operands of the given data
+// directive. Only 16-bit values can be relocated.
+func (a *assembler) relocateData(instr *parser.List, size int) error {
+	if a.obj == nil {
+		return nil
+	}
+
+	address := a.address
+	for i := 1; i < instr.Len(); i++ {
+		expr := instr.At(i).(*parser.List)
+		value := expr.At(expr.Len() - 1).(*parser.Value)
+
+		if value.Type() == parser.String {
+			address += len([]rune(value.Value)) * size
+			continue
+		}
+
+		if bases := a.obj.operands[instr]; i < len(bases) && len(bases[i]) > 0 && size != 2 {
+			return newError(expr.Position(), "only d16 values can be relocated")
+		}
+
+		a.relocate(instr, i, address)
+		address += size
+	}
+
+	return nil
+}
@@ -290,6 +290,12 @@ func (t *tokenizer) readExpression() bool {
 			t.emit(tokAddressMode)
 		case t.readWord("]"):
 			t.ignore()
+		case t.readWord("=="):
+			t.emit(tokOperator)
+		case t.readChar('{'):
+			// A scope block follows the instruction, like in a struct definition.
+			t.unread(1)
+			return false
 		case t.readChar(','), t.readChar('='):
 			t.unread(1)
 			return true
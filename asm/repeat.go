@@ -0,0 +1,233 @@
+package asm
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/hexaflex/svm/asm/ar"
+	"github.com/hexaflex/svm/asm/parser"
+	"github.com/hexaflex/svm/asm/syntax"
+)
+
+// maxIterations is the largest number of times a repeat block can be expanded.
+const maxIterations = ar.MemoryCapacity
+
+// expandLoop replaces the repeat block which starts at the given index with
+// one copy of its body for every iteration:
+//
+//	rept <count>                        Repeats the body count times.
+//	endrept
+//	for <name> = <first> to <last>      Repeats the body for every value from
+//	endfor                              first up to and including last.
+//
+// In a for block, the name is replaced with the value for the iteration in
+// all expressions in the body. Each copy is wrapped in a scope with a unique
+// name, so labels and constants defined in the body are local to an iteration.
+func expandLoop(nodes *parser.List, index int, scopes []map[string]condSymbol) error {
+	instr := nodes.At(index).(*parser.List)
+	name, _ := loopDirective(instr)
+
+	if strings.HasPrefix(name, "end") {
+		return newError(instr.Position(), "%s without matching %s", name, strings.TrimPrefix(name, "end"))
+	}
+
+	end, err := findLoopEnd(nodes, index)
+	if err != nil {
+		return err
+	}
+
+	variable, first, last, err := loopRange(instr, scopes)
+	if err != nil {
+		return err
+	}
+
+	if last-first+1 > maxIterations {
+		return newError(instr.Position(), "%s block has more than %d iterations", name, maxIterations)
+	}
+
+	body := nodes.Slice()[index+1 : end]
+	if err := testLoopBody(instr, body); err != nil {
+		return err
+	}
+
+	var out []parser.Node
+	for v := first; v <= last; v++ {
+		out = append(out, parser.NewValue(instr.Position(), parser.ScopeBegin, syntax.UniqueName()))
+		for _, n := range body {
+			n = n.Copy()
+			if len(variable) > 0 {
+				replaceLoopVariable(n, variable, v)
+			}
+			out = append(out, n)
+		}
+		out = append(out, parser.NewValue(nodes.At(end).Position(), parser.ScopeEnd, ""))
+	}
+
+	nodes.RemoveRange(index, end)
+	nodes.InsertAt(index, out...)
+	return nil
+}
+
+// findLoopEnd returns the index of the directive which closes the repeat
+// block starting at the given index.
+func findLoopEnd(nodes *parser.List, index int) (int, error) {
+	var open []string
+
+	for i := index; i < nodes.Len(); i++ {
+		name, ok := loopDirective(nodes.At(i))
+		if !ok {
+			continue
+		}
+
+		if !strings.HasPrefix(name, "end") {
+			open = append(open, name)
+			continue
+		}
+
+		if want := "end" + open[len(open)-1]; name != want {
+			return 0, newError(nodes.At(i).Position(), "unexpected %s; expected %s", name, want)
+		}
+
+		open = open[:len(open)-1]
+		if len(open) == 0 {
+			return i, nil
+		}
+	}
+
+	instr := nodes.At(index).(*parser.List)
+	return 0, newError(instr.Position(), "%s block is missing end%[1]s", open[0])
+}
+
+// loopRange returns the variable name and the first and last iteration
+// values for the given repeat directive. The name is empty for rept blocks,
+// which count from 0.
+func loopRange(instr *parser.List, scopes []map[string]condSymbol) (string, int64, int64, error) {
+	name, _ := loopDirective(instr)
+
+	if name == "rept" {
+		if instr.Len() != 2 {
+			return "", 0, 0, newError(instr.Position(), "invalid rept directive; expected `rept <count>`")
+		}
+
+		count, err := evaluateCondExpression(instr.At(1).(*parser.List), scopes)
+		if err != nil {
+			return "", 0, 0, err
+		}
+
+		if count < 0 {
+			return "", 0, 0, newError(instr.Position(), "invalid repeat count %d", count)
+		}
+
+		return "", 0, count - 1, nil
+	}
+
+	invalid := newError(instr.Position(), "invalid for directive; expected `for <name> = <first> to <last>`")
+	if instr.Len() != 3 {
+		return "", 0, 0, invalid
+	}
+
+	variable := instr.At(1).(*parser.List)
+	if variable.Len() != 1 || variable.At(0).Type() != parser.Ident {
+		return "", 0, 0, invalid
+	}
+
+	expr := instr.At(2).(*parser.List)
+	split := -1
+	for i, n := range expr.Slice() {
+		if isIdent(n, "to") {
+			split = i
+			break
+		}
+	}
+
+	if split < 1 || split == expr.Len()-1 {
+		return "", 0, 0, invalid
+	}
+
+	var values [2]int64
+	for i, set := range [][]parser.Node{expr.Slice()[:split], expr.Slice()[split+1:]} {
+		operand := parser.NewList(set[0].Position(), parser.Expression)
+		operand.Append(set...)
+
+		value, err := evaluateCondExpression(operand, scopes)
+		if err != nil {
+			return "", 0, 0, err
+		}
+		values[i] = value
+	}
+
+	return variable.At(0).(*parser.Value).Value, values[0], values[1], nil
+}
+
+// testLoopBody returns an error if the body of the given repeat directive
+// opens scopes or conditional blocks which it does not close.
+func testLoopBody(instr *parser.List, body []parser.Node) error {
+	name := instr.At(0).(*parser.Value).Value
+	var scopes, blocks int
+
+	for _, n := range body {
+		switch n.Type() {
+		case parser.ScopeBegin:
+			scopes++
+		case parser.ScopeEnd:
+			scopes--
+		}
+
+		switch directive, _ := conditionalDirective(n); directive {
+		case ".if", ".ifdef", ".ifndef":
+			blocks++
+		case ".endif":
+			blocks--
+		}
+
+		if scopes < 0 {
+			return newError(instr.Position(), "unbalanced scope in %s block", name)
+		}
+
+		if blocks < 0 {
+			return newError(instr.Position(), "unbalanced conditional block in %s block", name)
+		}
+	}
+
+	switch {
+	case scopes != 0:
+		return newError(instr.Position(), "unbalanced scope in %s block", name)
+	case blocks != 0:
+		return newError(instr.Position(), "unbalanced conditional block in %s block", name)
+	}
+
+	return nil
+}
+
+// replaceLoopVariable replaces the given variable name with value in all
+// expressions in n.
+func replaceLoopVariable(n parser.Node, name string, value int64) {
+	list, ok := n.(*parser.List)
+	if !ok {
+		return
+	}
+
+	for i := 0; i < list.Len(); i++ {
+		v := list.At(i)
+		if list.Type() == parser.Expression && isIdent(v, name) {
+			list.ReplaceAt(i, parser.NewValue(v.Position(), parser.Number, strconv.FormatInt(value, 10)))
+			continue
+		}
+		replaceLoopVariable(v, name, value)
+	}
+}
+
+// loopDirective returns the lower case name of n if it is a repeat block directive.
+func loopDirective(n parser.Node) (string, bool) {
+	if n.Type() != parser.Instruction {
+		return "", false
+	}
+
+	name := strings.ToLower(n.(*parser.List).At(0).(*parser.Value).Value)
+	switch name {
+	case "rept", "endrept", "for", "endfor":
+		return name, true
+	}
+
+	return "", false
+}
@@ -0,0 +1,46 @@
+package asm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRepeat(t *testing.T) {
+	code, err := buildCode(t, nil, Options{}, `
+const N = 3
+rept N - 1
+    d8 16#aa
+endrept
+for i = 1 to N
+    .if i == 2
+        d8 16#bb
+    .else
+    :skip
+        jmp skip
+    .endif
+    const v = i * 16
+    d8 v
+endfor
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{0xaa, 0xaa, 0x19, 0x30, 0x00, 0x02, 0x10, 0xbb, 0x20, 0x19, 0x30, 0x00, 0x09, 0x30}
+	if !bytes.Equal(code, want) {
+		t.Fatalf("unexpected code:\nwant: % x\nhave: % x", want, code)
+	}
+
+	for _, source := range []string{
+		"rept 2\nhalt\n", // missing endrept
+		"endfor\n",       // missing for
+		"rept 2\nfor i = 0 to 1\nendrept\nendfor\n", // mismatched end
+		"rept -1\nendrept\n",                        // negative count
+		"for i = 0, 1\nendfor\n",                    // missing to
+		"rept 2\n{\nendrept\n}\n",                   // unbalanced scope
+	} {
+		if _, err := buildCode(t, nil, Options{}, source); err == nil {
+			t.Fatalf("expected error for:\n%s", source)
+		}
+	}
+}
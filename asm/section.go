@@ -0,0 +1,432 @@
+package asm
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/hexaflex/svm/asm/ar"
+	"github.com/hexaflex/svm/asm/eval"
+	"github.com/hexaflex/svm/asm/parser"
+)
+
+// defaultSection is the section code goes into before the first `section` directive.
+const defaultSection = "code"
+
+// bssSection is the name of the section which only reserves memory. Its
+// contents are not stored in the archive.
+const bssSection = "bss"
+
+// section defines a named region of memory.
+type section struct {
+	name    string
+	address int             // Base address. Negative if the section follows the previous one.
+	limit   int             // Maximum size in bytes. Zero if there is none.
+	fill    byte            // Value for unused bytes between the start and end of the section.
+	pos     parser.Position // Position of the layout directive, if any.
+	nodes   []parser.Node   // Section contents.
+	start   int             // Address of the first byte, once compiled.
+	end     int             // Address past the last byte written, once compiled.
+}
+
+// region defines the memory occupied by a section.
+type region struct {
+	name     string // Section name.
+	address  int    // Address of the first byte.
+	size     int    // Number of bytes used.
+	limit    int    // Maximum size in bytes. Zero if there is none.
+	fill     byte   // Value for unused bytes in the section.
+	reserved bool   // Memory is reserved, but not stored in the archive.
+}
+
+// resolveSections finds `layout` and `section` directives and groups the
+// nodes by section. Sections are placed in the order in which they are
+// first mentioned, with the default section first. Each section starts
+// with an `address` directive for its base address, or for the current
+// address if it follows the previous section. Scope blocks which span a
+// section change are closed and opened again in the new section.
+//
+// Programs without these directives are left alone.
+func (a *assembler) resolveSections(nodes *parser.List) error {
+	if !hasSectionDirectives(nodes) {
+		return nil
+	}
+
+	if a.obj != nil {
+		return newError(nodes.At(0).Position(), "sections are not supported in relocatable objects")
+	}
+
+	a.sections = []*section{{name: defaultSection, address: -1}}
+	a.sectionStarts = make(map[*parser.List]*section)
+	a.owners = make([]byte, ar.MemoryCapacity)
+
+	for i := 0; i < nodes.Len(); i++ {
+		if n := nodes.At(i); isInstruction(n, "layout") {
+			if err := a.defineLayout(n.(*parser.List)); err != nil {
+				return err
+			}
+			nodes.Remove(i)
+			i--
+		}
+	}
+
+	current := a.sections[0]
+	var scopes []parser.Node
+
+	for _, n := range nodes.Slice() {
+		switch {
+		case n.Type() == parser.ScopeBegin:
+			scopes = append(scopes, n)
+
+		case n.Type() == parser.ScopeEnd && len(scopes) > 0:
+			scopes = scopes[:len(scopes)-1]
+
+		case isInstruction(n, "section"):
+			if n.(*parser.List).Len() != 2 {
+				return newError(n.Position(), "invalid section directive; expected `section <name>`")
+			}
+
+			name, err := sectionName(n.(*parser.List))
+			if err != nil {
+				return err
+			}
+
+			next := a.findSection(name)
+			if next == nil {
+				next = &section{name: name, address: -1}
+				a.sections = append(a.sections, next)
+			}
+
+			if next != current {
+				for j := len(scopes) - 1; j >= 0; j-- {
+					current.nodes = append(current.nodes, parser.NewValue(n.Position(), parser.ScopeEnd, ""))
+				}
+				for _, s := range scopes {
+					next.nodes = append(next.nodes, s.Copy())
+				}
+				current = next
+			}
+			continue
+		}
+
+		current.nodes = append(current.nodes, n)
+	}
+
+	if err := a.testRegions(); err != nil {
+		return err
+	}
+
+	nodes.Clear()
+	for _, s := range a.sections {
+		pos := s.pos
+		if len(s.nodes) > 0 {
+			pos = s.nodes[0].Position()
+		}
+
+		value := parser.NewValue(pos, parser.Ident, "$$")
+		if s.address >= 0 {
+			value = parser.NewValue(pos, parser.Number, strconv.Itoa(s.address))
+		}
+
+		expr := parser.NewList(pos, parser.Expression)
+		expr.Append(value)
+
+		addr := parser.NewList(pos, parser.Instruction)
+		addr.Append(parser.NewValue(pos, parser.Ident, "address"), expr)
+
+		a.sectionStarts[addr] = s
+		nodes.Append(addr)
+		if len(s.nodes) > 0 {
+			nodes.Append(s.nodes...)
+		}
+		s.nodes = nil
+	}
+
+	return nil
+}
+
+// defineLayout defines the section described by the given layout directive:
+//
+//	layout name, address [, limit [, fill]]
+func (a *assembler) defineLayout(instr *parser.List) error {
+	if instr.Len() < 3 || instr.Len() > 5 {
+		return newError(instr.Position(), "invalid layout directive; expected `layout <name>, <address> [, <size> [, <fill>]]`")
+	}
+
+	name, err := sectionName(instr)
+	if err != nil {
+		return err
+	}
+
+	if s := a.findSection(name); s != nil && s.address >= 0 {
+		return newError(instr.Position(), "duplicate layout for section %q; previous definition at %s", name, &s.pos)
+	}
+
+	// Layout values can not refer to labels or constants. These depend on the layout.
+	args := instr.Copy().(*parser.List)
+	args.Remove(1)
+
+	err = eval.Evaluate(args, func(_ parser.Scope, name string) (int, error) {
+		return 0, fmt.Errorf("layout values can not refer to %s", name)
+	}, "")
+	if err != nil {
+		return err
+	}
+
+	values := make([]int64, args.Len()-1)
+	for i := range values {
+		expr := args.At(i + 1).(*parser.List)
+		if expr.Len() != 1 || expr.At(0).Type() != parser.Number {
+			return newError(expr.Position(), "invalid layout value; expected a number")
+		}
+		values[i], _ = parser.ParseNumber(expr.At(0).(*parser.Value).Value)
+	}
+
+	s := &section{name: name, address: int(values[0]), pos: instr.Position()}
+	if len(values) > 1 {
+		s.limit = int(values[1])
+	}
+	if len(values) > 2 {
+		s.fill = byte(values[2])
+	}
+
+	switch {
+	case s.address < 0 || s.address >= ar.MemoryCapacity:
+		return newError(instr.Position(), "section %q address %d is out of range", name, s.address)
+	case s.limit < 0 || s.address+s.limit > ar.MemoryCapacity:
+		return newError(instr.Position(), "section %q with size %d does not fit in memory", name, s.limit)
+	case len(values) > 2 && (values[2] < 0 || values[2] > 0xff):
+		return newError(instr.Position(), "section %q fill value %d does not fit in a byte", name, values[2])
+	}
+
+	if prev := a.findSection(name); prev != nil {
+		*prev = *s
+	} else {
+		a.sections = append(a.sections, s)
+	}
+
+	return nil
+}
+
+// testRegions returns an error if the regions of any sections with an
+// address overlap. A section without a size occupies only its start
+// address here. Code which grows past it is checked as it is placed.
+func (a *assembler) testRegions() error {
+	for i, s := range a.sections {
+		if s.address < 0 {
+			continue
+		}
+
+		for _, t := range a.sections[i+1:] {
+			if t.address < 0 || (s.limit == 0 && t.limit == 0) {
+				continue
+			}
+
+			if s.address < t.address+t.extent() && t.address < s.address+s.extent() {
+				return newError(t.pos, "section %q at %s overlaps section %q at %s", t.name, t.region(), s.name, s.region())
+			}
+		}
+	}
+	return nil
+}
+
+// extent returns the number of bytes reserved for the section. A section
+// without a size reserves only its start address.
+func (s *section) extent() int {
+	if s.limit == 0 {
+		return 1
+	}
+	return s.limit
+}
+
+// region returns the reserved address range of the section as text.
+func (s *section) region() string {
+	if s.limit == 0 {
+		return fmt.Sprintf("%04x", s.address)
+	}
+	return fmt.Sprintf("%04x-%04x", s.address, s.address+s.limit)
+}
+
+// findSection returns the section with the given name. Returns nil if there is none.
+func (a *assembler) findSection(name string) *section {
+	for _, s := range a.sections {
+		if strings.EqualFold(s.name, name) {
+			return s
+		}
+	}
+	return nil
+}
+
+// enterSection makes s the section code is emitted into.
+func (a *assembler) enterSection(s *section) {
+	a.section = s
+	s.start = a.address
+	s.end = a.address
+}
+
+// placeCode returns an error if code of the given size can not be
+// written at the current address in the current section.
+func (a *assembler) placeCode(pos parser.Position, code []byte) error {
+	s := a.section
+	if s == nil {
+		return nil
+	}
+
+	end := a.address + len(code)
+
+	switch {
+	case a.address < s.start:
+		return newError(pos, "code at %04x is outside of section %q, which starts at %04x", a.address, s.name, s.start)
+	case s.limit > 0 && end > s.start+s.limit:
+		return newError(pos, "section %q exceeds its size of %d bytes", s.name, s.limit)
+	case end > ar.MemoryCapacity:
+		return newError(pos, "section %q does not fit in memory", s.name)
+	}
+
+	if strings.EqualFold(s.name, bssSection) {
+		for _, b := range code {
+			if b != 0 {
+				return newError(pos, "section %q can only reserve memory; its contents must be zero", s.name)
+			}
+		}
+	}
+
+	index := a.sectionIndex(s)
+	for addr := a.address; addr < end; addr++ {
+		if owner := a.owners[addr]; owner != 0 && owner != index {
+			return newError(pos, "section %q overlaps section %q at %04x", s.name, a.sections[owner-1].name, addr)
+		}
+		a.owners[addr] = index
+	}
+
+	if end > s.end {
+		s.end = end
+	}
+
+	return nil
+}
+
+// sectionIndex returns the index of s in the section list, plus one.
+func (a *assembler) sectionIndex(s *section) byte {
+	for i, v := range a.sections {
+		if v == s {
+			return byte(i + 1)
+		}
+	}
+	return 0
+}
+
+// finishSections fills unused bytes in all sections and adds the sections
+// to the archive. The entry point is moved to the start of the default
+// section.
+func (a *assembler) finishSections() {
+	if len(a.sections) == 0 {
+		return
+	}
+
+	if len(a.ar.Instructions) < a.maxSectionEnd() {
+		a.ar.Instructions = append(a.ar.Instructions, make([]byte, a.maxSectionEnd()-len(a.ar.Instructions))...)
+	}
+
+	for _, s := range a.sections {
+		for addr := s.start; addr < s.end; addr++ {
+			if a.owners[addr] == 0 {
+				a.ar.Instructions[addr] = s.fill
+			}
+		}
+
+		if s.end > s.start && !strings.EqualFold(s.name, bssSection) {
+			a.ar.Sections = append(a.ar.Sections, ar.Section{
+				Name:    s.name,
+				Address: s.start,
+				Data:    a.ar.Instructions[s.start:s.end],
+			})
+		}
+	}
+
+	a.ar.Entry = a.sections[0].start
+}
+
+// maxSectionEnd returns the address past the last byte of all sections.
+func (a *assembler) maxSectionEnd() int {
+	var end int
+	for _, s := range a.sections {
+		if s.end > end {
+			end = s.end
+		}
+	}
+	return end
+}
+
+// regions returns the memory regions of all sections. A program without
+// sections has a single code region.
+func (a *assembler) regions() []region {
+	if len(a.sections) == 0 {
+		return []region{{name: defaultSection, size: len(a.ar.Instructions)}}
+	}
+
+	out := make([]region, len(a.sections))
+	for i, s := range a.sections {
+		out[i] = region{
+			name:     s.name,
+			address:  s.start,
+			size:     s.end - s.start,
+			limit:    s.limit,
+			fill:     s.fill,
+			reserved: strings.EqualFold(s.name, bssSection),
+		}
+	}
+	return out
+}
+
+// writeMemoryMap writes a table of the given regions to w.
+func writeMemoryMap(w io.Writer, regions []region) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%-16s %-5s %-5s %7s %7s %s\n", "Section", "Start", "End", "Size", "Limit", "Fill")
+
+	for _, r := range regions {
+		limit := "-"
+		if r.limit > 0 {
+			limit = strconv.Itoa(r.limit)
+		}
+
+		fill := fmt.Sprintf("%02x", r.fill)
+		if r.reserved {
+			fill = "reserved"
+		}
+
+		start := fmt.Sprintf("%04x", r.address)
+		end := fmt.Sprintf("%04x", r.address+r.size)
+		fmt.Fprintf(&sb, "%-16s %-5s %-5s %7d %7s %s\n", r.name, start, end, r.size, limit, fill)
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// hasSectionDirectives returns true if nodes holds any `section` or `layout` directives.
+func hasSectionDirectives(nodes *parser.List) bool {
+	for _, n := range nodes.Slice() {
+		if isInstruction(n, "section") || isInstruction(n, "layout") {
+			return true
+		}
+	}
+	return false
+}
+
+// sectionName returns the section name operand of the given directive.
+func sectionName(instr *parser.List) (string, error) {
+	if instr.Len() >= 2 {
+		expr := instr.At(1).(*parser.List)
+		if expr.Len() == 1 && expr.At(0).Type() == parser.Ident {
+			return expr.At(0).(*parser.Value).Value, nil
+		}
+	}
+	return "", newError(instr.Position(), "invalid %s directive; expected a section name", instr.At(0).(*parser.Value).Value)
+}
+
+// isInstruction returns true if n is an instruction with the given name.
+func isInstruction(n parser.Node, name string) bool {
+	return n.Type() == parser.Instruction && isIdent(n.(*parser.List).At(0), name)
+}
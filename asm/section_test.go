@@ -0,0 +1,62 @@
+package asm
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const sectionTestSource = `
+layout code, 16#0100, 16#100
+layout data, 16#0200, 16#10, 16#ff
+layout bss,  16#0300, 16#10
+
+:main {
+    mov r0, [counter]
+    section data
+:value
+    d16 10
+    address $$ + 2
+    d8 1
+    section bss
+:counter
+    d16 0
+    section code
+    add r0, r0, [value]
+    halt
+}
+`
+
+func TestSections(t *testing.T) {
+	var mm bytes.Buffer
+	archive, err := buildSource(t, nil, Options{MemoryMap: &mm}, sectionTestSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if archive.Entry != 0x100 || len(archive.Sections) != 2 {
+		t.Fatalf("unexpected archive:\n%s", archive)
+	}
+
+	code := []byte{0x02, 0xb0, 0x70, 0x03, 0x00, 0x07, 0xb0, 0xb0, 0x70, 0x02, 0x00, 0x01}
+	data := []byte{0x00, 0x0a, 0xff, 0xff, 0x01}
+	if !bytes.Equal(archive.Sections[0].Data, code) || !bytes.Equal(archive.Sections[1].Data, data) {
+		t.Fatalf("unexpected sections:\n% x\n% x", archive.Sections[0].Data, archive.Sections[1].Data)
+	}
+
+	if !strings.Contains(mm.String(), "bss              0300  0302        2      16 reserved") {
+		t.Fatalf("unexpected memory map:\n%s", mm.String())
+	}
+
+	for _, source := range []string{
+		"layout code, 0, 16\nlayout data, 8, 16\nhalt\n",                                    // overlapping regions
+		"layout code, 0, 16\nlayout data, 8\nhalt\n",                                        // unsized section inside a region
+		"layout code, 0, 4\nd8 1, 2, 3, 4, 5\n",                                             // section too large
+		"section bss\nd8 1\n",                                                               // data in bss
+		"layout data, 16#10\nhalt\nsection data\nd8 1\nsection code\naddress 16#10\nhalt\n", // code overwrites data
+	} {
+		if _, err := buildSource(t, nil, Options{}, source); err == nil {
+			t.Fatalf("expected error for:\n%s", source)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package asm
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/hexaflex/svm/arch"
+	"github.com/hexaflex/svm/asm/parser"
+)
+
+// sizeofName is the name of the constant which holds the size of a struct.
+const sizeofName = "sizeof"
+
+// expandDefinition replaces the struct or enum definition which starts at
+// the given index with a scope of constants.
+//
+// A struct defines the offset of every field, followed by its total size:
+//
+//	struct Sprite {          :Sprite {
+//	    index u8                 const index = u8 0
+//	    x     u8         =>      const x = u8 index + 1
+//	    y     u8                 const y = u8 x + 1
+//	}                            const sizeof = y + 1
+//	                         }
+//
+// A field type is u8, i8, u16, i16, u32, i32 or the name of another struct.
+// It can be followed by an element count: `palette u16, 16`. Fields with an
+// 8 or 16-bit type are typed constants. Memory operands which refer to them
+// get their type, unless the operand has a type descriptor of its own.
+//
+// An enum defines a constant for every member. A member has the value of
+// the previous member plus one, unless it is given a value: `Green = 5`.
+func expandDefinition(nodes *parser.List, index int) error {
+	instr := nodes.At(index).(*parser.List)
+	kind := strings.ToLower(instr.At(0).(*parser.Value).Value)
+
+	if instr.Len() != 2 || index+1 >= nodes.Len() || nodes.At(index+1).Type() != parser.ScopeBegin {
+		return newError(instr.Position(), "invalid %s definition; expected `%[1]s <name> { ... }`", kind)
+	}
+
+	expr := instr.At(1).(*parser.List)
+	if expr.Len() != 1 || expr.At(0).Type() != parser.Ident || strings.Contains(expr.At(0).(*parser.Value).Value, ".") {
+		return newError(instr.Position(), "invalid %s name; expected ident", kind)
+	}
+
+	end := index + 2
+	for end < nodes.Len() && nodes.At(end).Type() != parser.ScopeEnd {
+		if nodes.At(end).Type() != parser.Instruction {
+			return newError(nodes.At(end).Position(), "unexpected %s in %s definition", nodes.At(end).Type(), kind)
+		}
+		end++
+	}
+
+	if end == nodes.Len() {
+		return newError(instr.Position(), "%s definition is missing its closing brace", kind)
+	}
+
+	members := make([]*parser.List, 0, end-index-2)
+	for _, n := range nodes.Slice()[index+2 : end] {
+		members = append(members, n.(*parser.List))
+	}
+
+	var consts []parser.Node
+	var err error
+
+	if kind == "struct" {
+		consts, err = structFields(members)
+	} else {
+		consts, err = enumMembers(members)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	pos := instr.Position()
+	out := []parser.Node{parser.NewValue(pos, parser.ScopeBegin, expr.At(0).(*parser.Value).Value)}
+	out = append(out, consts...)
+	out = append(out, parser.NewValue(nodes.At(end).Position(), parser.ScopeEnd, ""))
+
+	nodes.RemoveRange(index, end)
+	nodes.InsertAt(index, out...)
+	return nil
+}
+
+// structFields returns the constant definitions for the given struct fields.
+func structFields(fields []*parser.List) ([]parser.Node, error) {
+	var out []parser.Node
+
+	// Offset of the next field, relative to the previous one.
+	offset := []parser.Node{parser.NewValue(parser.Position{}, parser.Number, "0")}
+
+	for _, f := range fields {
+		name := f.At(0).(*parser.Value)
+		pos := f.Position()
+
+		if f.Len() < 2 || f.Len() > 3 {
+			return nil, newError(pos, "invalid struct field; expected `<name> <type> [, <count>]`")
+		}
+
+		size, typ, err := fieldSize(f.At(1).(*parser.List))
+		if err != nil {
+			return nil, err
+		}
+
+		if f.Len() == 3 {
+			count := f.At(2).(*parser.List)
+			if count.Len() == 0 {
+				return nil, newError(pos, "invalid struct field; expected `<name> <type> [, <count>]`")
+			}
+			size = append(append([]parser.Node{newOperator(pos, "(")}, size...), newOperator(pos, ")"), newOperator(pos, "*"), newOperator(pos, "("))
+			size = append(append(size, count.Copy().(*parser.List).Slice()...), newOperator(pos, ")"))
+		}
+
+		var value []parser.Node
+		if len(typ) > 0 {
+			value = append(value, parser.NewValue(pos, parser.TypeDescriptor, typ))
+		}
+
+		out = append(out, newConstant(pos, name.Value, append(value, offset...)))
+
+		offset = append([]parser.Node{parser.NewValue(pos, parser.Ident, name.Value), newOperator(pos, "+")}, size...)
+	}
+
+	pos := parser.Position{}
+	if len(fields) > 0 {
+		pos = fields[len(fields)-1].Position()
+	}
+
+	out = append(out, newConstant(pos, sizeofName, offset))
+	return out, nil
+}
+
+// fieldSize returns the size expression and type descriptor for the given
+// struct field type. The type descriptor is empty if the field has no
+// operand type.
+func fieldSize(expr *parser.List) ([]parser.Node, string, error) {
+	if expr.Len() == 1 {
+		n := expr.At(0)
+		pos := n.Position()
+
+		switch n.Type() {
+		case parser.TypeDescriptor:
+			typ := n.(*parser.Value).Value
+			return []parser.Node{parser.NewValue(pos, parser.Number, strconv.Itoa(typeSize(typ)))}, typ, nil
+
+		case parser.Ident:
+			name := n.(*parser.Value).Value
+			if size := typeSize(name); size > 0 {
+				return []parser.Node{parser.NewValue(pos, parser.Number, strconv.Itoa(size))}, "", nil
+			}
+			return []parser.Node{parser.NewValue(pos, parser.Ident, name+"."+sizeofName)}, "", nil
+		}
+	}
+
+	return nil, "", newError(expr.Position(), "invalid struct field type; expected u8, i8, u16, i16, u32, i32 or a struct name")
+}
+
+// typeSize returns the size in bytes of the given primitive type.
+// Returns 0 if it is not a primitive type.
+func typeSize(name string) int {
+	switch strings.ToLower(name) {
+	case "u8", "i8":
+		return 1
+	case "u16", "i16":
+		return 2
+	case "u32", "i32":
+		return 4
+	}
+	return 0
+}
+
+// enumMembers returns the constant definitions for the given enum members.
+func enumMembers(members []*parser.List) ([]parser.Node, error) {
+	var out []parser.Node
+	var prev string
+
+	for _, m := range members {
+		name := m.At(0).(*parser.Value)
+		pos := m.Position()
+
+		// An explicit value is parsed as an empty operand, followed by the value.
+		var value []parser.Node
+		switch {
+		case m.Len() == 3 && m.At(1).(*parser.List).Len() == 0 && m.At(2).(*parser.List).Len() > 0:
+			value = m.At(2).Copy().(*parser.List).Slice()
+		case m.Len() > 2 || (m.Len() == 2 && m.At(1).(*parser.List).Len() > 0):
+			return nil, newError(pos, "invalid enum member; expected `<name> [= <value>]`")
+		case len(prev) == 0:
+			value = []parser.Node{parser.NewValue(pos, parser.Number, "0")}
+		default:
+			value = []parser.Node{parser.NewValue(pos, parser.Ident, prev), newOperator(pos, "+"), parser.NewValue(pos, parser.Number, "1")}
+		}
+
+		out = append(out, newConstant(pos, name.Value, value))
+		prev = name.Value
+	}
+
+	return out, nil
+}
+
+// newConstant creates a constant definition in the form produced by the parser.
+func newConstant(pos parser.Position, name string, value []parser.Node) *parser.List {
+	expr1 := parser.NewList(pos, parser.Expression)
+	expr1.Append(parser.NewValue(pos, parser.Ident, name))
+
+	expr2 := parser.NewList(pos, parser.Expression)
+	expr2.Append(value...)
+
+	c := parser.NewList(pos, parser.Constant)
+	c.Append(parser.NewValue(pos, parser.Ident, "const"), expr1, expr2)
+	return c
+}
+
+// newOperator creates an operator node.
+func newOperator(pos parser.Position, op string) *parser.Value {
+	return parser.NewValue(pos, parser.Operator, op)
+}
+
+// replaceSizeof replaces `sizeof(name)` in all expressions with a reference
+// to the size constant of the named struct, or the size of a primitive type.
+func replaceSizeof(n parser.Node) error {
+	list, ok := n.(*parser.List)
+	if !ok {
+		return nil
+	}
+
+	for i := 0; i < list.Len(); i++ {
+		v := list.At(i)
+
+		if list.Type() != parser.Expression || !isIdent(v, "sizeof") {
+			if err := replaceSizeof(v); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if i+3 >= list.Len() || !isOperatorValue(list.At(i+1), "(") || !isOperatorValue(list.At(i+3), ")") {
+			return newError(v.Position(), "invalid sizeof expression; expected `sizeof(<type>)`")
+		}
+
+		arg := list.At(i + 2)
+		name := arg.(*parser.Value).Value
+
+		var value parser.Node
+		switch {
+		case arg.Type() == parser.TypeDescriptor || (arg.Type() == parser.Ident && typeSize(name) > 0):
+			value = parser.NewValue(v.Position(), parser.Number, strconv.Itoa(typeSize(name)))
+		case arg.Type() == parser.Ident:
+			value = parser.NewValue(v.Position(), parser.Ident, name+"."+sizeofName)
+		default:
+			return newError(arg.Position(), "invalid sizeof expression; expected `sizeof(<type>)`")
+		}
+
+		list.RemoveRange(i, i+3)
+		list.InsertAt(i, value)
+	}
+
+	return nil
+}
+
+// isOperatorValue returns true if n is the given operator.
+func isOperatorValue(n parser.Node, op string) bool {
+	return n.Type() == parser.Operator && n.(*parser.Value).Value == op
+}
+
+// applySymbolTypes gives memory operands in the given instruction the type
+// of the typed constant they refer to, like a struct field. Operands with a
+// type descriptor of their own are left alone.
+func (a *assembler) applySymbolTypes(instr *parser.List, scope parser.Scope) error {
+	if _, ok := arch.Opcode(instr.At(0).(*parser.Value).Value); !ok {
+		return nil
+	}
+
+	for i := 1; i < instr.Len(); i++ {
+		expr := instr.At(i).(*parser.List)
+		if expr.Len() == 0 || expr.At(0).Type() != parser.AddressMode || !strings.HasPrefix(expr.At(0).(*parser.Value).Value, "[") {
+			continue
+		}
+
+		var typ string
+		for _, n := range expr.Slice() {
+			if n.Type() != parser.Ident {
+				continue
+			}
+
+			key, ok := a.findSymbol(scope, strings.ToLower(n.(*parser.Value).Value))
+			if !ok || len(a.symbolTypes[key]) == 0 {
+				continue
+			}
+
+			if len(typ) > 0 && !strings.EqualFold(typ, a.symbolTypes[key]) {
+				return newError(expr.Position(), "operand refers to fields of different types; add a type descriptor")
+			}
+			typ = a.symbolTypes[key]
+		}
+
+		if len(typ) > 0 {
+			expr.InsertAt(0, parser.NewValue(expr.Position(), parser.TypeDescriptor, typ))
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package asm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestStructs(t *testing.T) {
+	code, err := buildCode(t, nil, Options{}, `
+struct Point {
+    x u8
+    y u16
+}
+
+struct Sprite {
+    index  u8
+    pos    Point
+    frames u16, 4
+}
+
+enum Color {
+    Red
+    Green = 5
+    Blue
+}
+
+    d8 Point.y, Sprite.pos, Sprite.frames, sizeof(Sprite)
+    d8 Color.Red, Color.Green, Color.Blue, sizeof(u16)
+    mov [16#1234 + Point.y], 0
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []byte{
+		1, 1, 4, 12,
+		0, 5, 6, 2,
+		0x02, 0x50, 0x12, 0x35, 0x30, 0x00, 0x00, // The operand has the u16 type of Point.y.
+	}
+
+	if !bytes.Equal(code, want) {
+		t.Fatalf("unexpected code:\nwant: % x\nhave: % x", want, code)
+	}
+
+	for _, source := range []string{
+		"struct {\n x u8\n}",
+		"struct P {\n x\n}",
+		"struct P {\n x u8, 2, 3\n}",
+		"enum E {\n A 1\n}",
+		"struct P {\n x u8\n y u16\n}\n mov [P.x + P.y], 0",
+		" d8 sizeof(Missing)",
+	} {
+		if _, err := buildCode(t, nil, Options{}, source); err == nil {
+			t.Fatalf("expected error for:\n%s", source)
+		}
+	}
+}
@@ -5,16 +5,23 @@ import (
 	"fmt"
 	"os"
 	"strings"
+
+	"github.com/hexaflex/svm/arch"
+	"github.com/hexaflex/svm/asm/parser"
 )
 
 // Config defines program configuration.
 type Config struct {
-	Includes    []string // Include search paths.
-	Input       string   // Input source file to build.
-	Output      string   // Path to store output in.
-	DebugBuild  bool     // Include debug symbols in build?
-	DumpAST     bool     // Print a human-readable dump of the unprocessed AST.
-	DumpArchive bool     // Print a human-readable dump of the compiled archive and exit.
+	Includes    []string       // Include search paths.
+	Defines     map[string]int // Constants defined with -D.
+	Input       string         // Input source file to build.
+	Output      string         // Path to store output in.
+	Listing     string         // Optional path to store an assembler listing in.
+	DebugBuild  bool           // Include debug symbols in build?
+	Object      bool           // Build a relocatable object instead of a program archive.
+	MemoryMap   bool           // Print the memory occupied by each section.
+	DumpAST     bool           // Print a human-readable dump of the unprocessed AST.
+	DumpArchive bool           // Print a human-readable dump of the compiled archive and exit.
 }
 
 // parseArgs parses command line arguments as applicable.
@@ -24,6 +31,7 @@ type Config struct {
 func parseArgs() *Config {
 	var c Config
 	c.Output = "out.a"
+	c.Defines = make(map[string]int)
 
 	flag.Usage = func() {
 		fmt.Printf("%s [options] <input source file>\n", os.Args[0])
@@ -32,7 +40,11 @@ func parseArgs() *Config {
 
 	includes := flag.String("include", "", "Colon-separated list of include search paths.")
 	flag.StringVar(&c.Output, "out", c.Output, "Output file.")
-	flag.BoolVar(&c.DebugBuild, "debug", c.DebugBuild, "Include debug symbols in the build. Creates an extra <out>.dbg file as output.")
+	flag.Var(defineFlag(c.Defines), "D", "Define a constant as `NAME[=value]`. The value defaults to 1. Can be repeated.")
+	flag.StringVar(&c.Listing, "listing", c.Listing, "Write an assembler listing to the given file.")
+	flag.BoolVar(&c.Object, "c", c.Object, "Build a relocatable object for use with svm-ld. The output defaults to out.o.")
+	flag.BoolVar(&c.MemoryMap, "map", c.MemoryMap, "Print a map of the memory occupied by each section to stdout.")
+	flag.BoolVar(&c.DebugBuild, "debug", c.DebugBuild, "Include debug symbols in the build. They are embedded in the output archive.")
 	flag.BoolVar(&c.DumpAST, "dump-ast", c.DumpAST, "Print a human-readable version of the unprocessed AST to stdout.")
 	flag.BoolVar(&c.DumpArchive, "dump-ar", c.DumpArchive, "Print a human-readable version of the compiled binary to stdout.")
 	version := flag.Bool("version", false, "Display version information.")
@@ -48,6 +60,15 @@ func parseArgs() *Config {
 		os.Exit(1)
 	}
 
+	if c.Object && !isFlagSet("out") {
+		c.Output = "out.o"
+	}
+
+	if c.Object && (c.DumpAST || c.DumpArchive || c.MemoryMap || len(c.Listing) > 0) {
+		fmt.Fprintln(os.Stderr, "-c can not be combined with -dump-ast, -dump-ar, -listing or -map")
+		os.Exit(1)
+	}
+
 	if len(*includes) > 0 {
 		c.Includes = filteredSplit(*includes, ":")
 	}
@@ -56,6 +77,47 @@ func parseArgs() *Config {
 	return &c
 }
 
+// defineFlag collects constants defined on the command line.
+type defineFlag map[string]int
+
+func (d defineFlag) String() string {
+	return ""
+}
+
+// Set parses a definition of the form NAME or NAME=value. The value is a
+// numeric literal in assembler syntax, like 16#ff.
+func (d defineFlag) Set(arg string) error {
+	name, value := arg, "1"
+	if index := strings.Index(arg, "="); index > -1 {
+		name, value = arg[:index], arg[index+1:]
+	}
+
+	if !isName(name) || arch.RegisterIndex(name) > -1 {
+		return fmt.Errorf("invalid name %q", name)
+	}
+
+	num, err := parser.ParseNumber(value)
+	if err != nil {
+		return fmt.Errorf("invalid value for %q: %v", name, err)
+	}
+
+	d[name] = int(num)
+	return nil
+}
+
+// isName returns true if v can be used as a constant name.
+func isName(v string) bool {
+	for i, r := range v {
+		switch {
+		case r == '_', r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z':
+		case i > 0 && r >= '0' && r <= '9':
+		default:
+			return false
+		}
+	}
+	return len(v) > 0
+}
+
 // filteredSplit splits value by sep and returns the resulting list, minus empty entries.
 func filteredSplit(value, sep string) []string {
 	out := strings.Split(value, sep)
@@ -68,3 +130,12 @@ func filteredSplit(value, sep string) []string {
 	}
 	return out
 }
+
+// isFlagSet returns true if the named flag was provided on the command line.
+func isFlagSet(name string) bool {
+	var set bool
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
@@ -6,30 +6,29 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/hexaflex/svm/asm"
-	"github.com/hexaflex/svm/asm/ar"
 )
 
 func main() {
 	config := parseArgs()
 
 	switch {
+	case config.Object:
+		buildObject(config)
 	case config.DumpAST:
 		dumpAST(config)
 	case config.DumpArchive:
 		dumpArchive(config)
 	default:
-		ar := buildBinary(config)
-		buildDebug(config, ar)
+		buildBinary(config)
 	}
 }
 
 // dumpArchive builds the final bnary archive and prints a human readable version of it
 // to the requested output.
 func dumpArchive(c *Config) {
-	ar, err := asm.Build(c.Input, c.Includes, c.DebugBuild)
+	ar, err := asm.BuildWith(c.Input, c.Includes, asm.Options{Debug: c.DebugBuild, Defines: c.Defines})
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -50,9 +49,23 @@ func dumpAST(c *Config) {
 	fmt.Fprintln(os.Stdout, ast)
 }
 
-// buildBinary builds a binary program and writes it to the requested output location.
-func buildBinary(c *Config) *ar.Archive {
-	ar, err := asm.Build(c.Input, c.Includes, c.DebugBuild)
+// buildBinary builds a binary archive and writes it to the requested output location.
+// Debug symbols are embedded in the archive if they were requested. A listing is
+// written alongside it and the memory map is printed if they were requested.
+func buildBinary(c *Config) {
+	opt := asm.Options{Debug: c.DebugBuild, Defines: c.Defines}
+
+	if len(c.Listing) > 0 {
+		w, close := makeWriter(c.Listing)
+		defer close()
+		opt.Listing = w
+	}
+
+	if c.MemoryMap {
+		opt.MemoryMap = os.Stdout
+	}
+
+	ar, err := asm.BuildWith(c.Input, c.Includes, opt)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -61,30 +74,24 @@ func buildBinary(c *Config) *ar.Archive {
 	w, close := makeWriter(c.Output)
 	defer close()
 
-	if _, err = w.Write(ar.Instructions); err != nil {
+	if err = ar.Save(w); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-
-	return ar
 }
 
-// buildDebug builds a file with debug symbols.
-func buildDebug(c *Config, ar *ar.Archive) {
-	if !c.DebugBuild {
-		return
-	}
-
-	file := c.Output
-	if index := strings.LastIndex(file, "."); index > -1 {
-		file = file[:index]
+// buildObject builds a relocatable object and writes it to the requested output location.
+func buildObject(c *Config) {
+	obj, err := asm.BuildObject(c.Input, c.Includes, asm.Options{Debug: c.DebugBuild, Defines: c.Defines})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	file += ".dbg"
 
-	w, close := makeWriter(file)
+	w, close := makeWriter(c.Output)
 	defer close()
 
-	if err := ar.Debug.Save(w); err != nil {
+	if err = obj.Save(w); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Config defines program configuration.
+type Config struct {
+	LogFile string // File to write log output to. Empty means stderr.
+}
+
+// parseArgs parses command line arguments as applicable.
+//
+// If an error occurred, this exits the program with an appropriate message.
+// When version information is requested, it is printed to stdout and the program ends cleanly.
+func parseArgs() *Config {
+	var c Config
+
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "%s [options]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.StringVar(&c.LogFile, "log", c.LogFile, "File to write log output to. Defaults to stderr.")
+	version := flag.Bool("version", false, "Display version information.")
+	flag.Parse()
+
+	if *version {
+		fmt.Println(Version())
+		os.Exit(0)
+	}
+
+	return &c
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/hexaflex/svm/vm/dap"
+)
+
+func main() {
+	config := parseArgs()
+
+	// Stdout carries the protocol. Nothing else may be written to it.
+	if len(config.LogFile) > 0 {
+		fd, err := os.Create(config.LogFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fd.Close()
+		log.SetOutput(fd)
+	}
+
+	if err := dap.NewSession(os.Stdin, os.Stdout).Serve(); err != nil {
+		log.Println(err)
+	}
+}
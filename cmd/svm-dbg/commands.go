@@ -0,0 +1,582 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/hexaflex/svm/arch"
+	"github.com/hexaflex/svm/devices/fffe/cpu"
+	"github.com/hexaflex/svm/devices/fffe/sprdi"
+	"github.com/hexaflex/svm/vm"
+)
+
+// Command defines a single debugger command.
+type Command struct {
+	Names []string                       // Command name, followed by optional aliases.
+	Args  string                         // Argument synopsis.
+	Help  string                         // Short description.
+	Run   func(*Session, []string) error // Executes the command with the given arguments.
+}
+
+// Commands lists all known debugger commands.
+var Commands []*Command
+
+func init() {
+	// Defined here to break the initialization loop between Commands and cmdHelp.
+	Commands = []*Command{
+		{[]string{"break", "b"}, "<location> [if cond]", "Set a breakpoint at an address, label or file:line.", cmdBreak},
+		{[]string{"delete", "d"}, "[location]", "Delete the breakpoint at the location, or all breakpoints.", cmdDelete},
+		{[]string{"watch"}, "<location> [size] [r|w|rw] [if cond]", "Stop when memory or a register is accessed.", cmdWatch},
+		{[]string{"unwatch"}, "[location]", "Delete the watchpoints at the location, or all watchpoints.", cmdUnwatch},
+		{[]string{"breakpoints", "bl"}, "", "List all breakpoints and watchpoints.", cmdBreakpoints},
+		{[]string{"step", "s"}, "[count]", "Execute one or more instructions.", cmdStep},
+		{[]string{"next", "n"}, "[count]", "Execute one or more instructions, stepping over calls.", cmdNext},
+		{[]string{"finish", "f"}, "", "Continue until the current function returns.", cmdFinish},
+		{[]string{"continue", "c"}, "", "Continue until a breakpoint is reached or the program halts.", cmdContinue},
+		{[]string{"rstep", "rs"}, "[count]", "Undo one or more executed instructions.", cmdReverseStep},
+		{[]string{"rcontinue", "rc"}, "", "Run backwards until a breakpoint is reached.", cmdReverseContinue},
+		{[]string{"where", "w"}, "", "Show the instruction and source line which are executed next.", cmdWhere},
+		{[]string{"list", "l"}, "[location]", "Show the source code around a location.", cmdList},
+		{[]string{"registers", "r"}, "", "Show register contents and RST flags.", cmdRegisters},
+		{[]string{"set"}, "<register> <value>", "Change the contents of a register.", cmdSet},
+		{[]string{"x"}, "<location> [count]", "Dump memory contents.", cmdDump},
+		{[]string{"write"}, "<location> <byte>...", "Write bytes to memory.", cmdWrite},
+		{[]string{"trace"}, "", "Enable/Disable instruction trace output.", cmdTrace},
+		{[]string{"screenshot"}, "<file>", "Save the display contents to a PNG file.", cmdScreenshot},
+		{[]string{"reset"}, "", "Reload the image and debug data and restart the cpu.", cmdReset},
+		{[]string{"help", "h"}, "", "Display this help.", cmdHelp},
+		{[]string{"quit", "q"}, "", "Exit the debugger.", nil},
+	}
+}
+
+// findCommand returns the command with the given name or alias.
+func findCommand(name string) *Command {
+	name = strings.ToLower(name)
+	for _, cmd := range Commands {
+		for _, v := range cmd.Names {
+			if v == name {
+				return cmd
+			}
+		}
+	}
+	return nil
+}
+
+// Exec executes the given command line.
+// Returns true if the debugger should exit.
+func (s *Session) Exec(line string) (bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false, nil
+	}
+
+	cmd := findCommand(fields[0])
+	if cmd == nil {
+		return false, fmt.Errorf("unknown command %q; type \"help\" for a list of commands", fields[0])
+	}
+
+	if cmd.Run == nil {
+		return true, nil
+	}
+
+	return false, cmd.Run(s, fields[1:])
+}
+
+func cmdHelp(s *Session, _ []string) error {
+	for _, cmd := range Commands {
+		name := strings.Join(cmd.Names, ", ")
+		fmt.Fprintf(s.out, " %-16s %-36s %s\n", name, cmd.Args, cmd.Help)
+	}
+	return nil
+}
+
+func cmdBreak(s *Session, args []string) error {
+	args, expr := splitCondition(args)
+	if len(args) != 1 {
+		return errors.New("expected: break <location> [if <condition>]")
+	}
+
+	addr, err := s.source.Resolve(args[0])
+	if err != nil {
+		return err
+	}
+
+	cond, err := s.condition(expr)
+	if err != nil {
+		return err
+	}
+
+	s.dbg.SetBreakpoint(addr, cond)
+	s.conditions[addr] = expr
+	fmt.Fprintf(s.out, "breakpoint at %s%s\n", s.describe(addr), formatCondition(expr))
+	return nil
+}
+
+func cmdDelete(s *Session, args []string) error {
+	if len(args) == 0 {
+		s.dbg.ClearBreakpoints()
+		s.conditions = make(map[int]string)
+		return nil
+	}
+
+	addr, err := s.source.Resolve(args[0])
+	if err != nil {
+		return err
+	}
+
+	if !s.dbg.ClearBreakpoint(addr) {
+		return fmt.Errorf("no breakpoint at %s", s.describe(addr))
+	}
+
+	delete(s.conditions, addr)
+	return nil
+}
+
+func cmdWatch(s *Session, args []string) error {
+	args, expr := splitCondition(args)
+	if len(args) < 1 || len(args) > 3 {
+		return errors.New("expected: watch <location> [size] [r|w|rw] [if <condition>]")
+	}
+
+	addr, size, err := s.watchLocation(args[0])
+	if err != nil {
+		return err
+	}
+
+	access := cpu.Write
+	for _, arg := range args[1:] {
+		switch strings.ToLower(arg) {
+		case "r":
+			access = cpu.Read
+		case "w":
+			access = cpu.Write
+		case "rw":
+			access = cpu.ReadWrite
+		default:
+			if size, err = vm.ParseNumber(arg); err != nil || size < 1 {
+				return fmt.Errorf("invalid size %q", arg)
+			}
+		}
+	}
+
+	if addr < 0 || addr+size > cpu.MemoryCapacity {
+		return fmt.Errorf("watched range %04x-%04x is out of bounds", addr, addr+size-1)
+	}
+
+	cond, err := s.condition(expr)
+	if err != nil {
+		return err
+	}
+
+	w := &cpu.Watchpoint{Address: addr, Size: size, Access: access, Condition: cond}
+	s.dbg.Controller().AddWatchpoint(w)
+	s.watchConditions[w] = expr
+	fmt.Fprintf(s.out, "watchpoint %s\n", s.describeWatchpoint(w))
+	return nil
+}
+
+func cmdUnwatch(s *Session, args []string) error {
+	ctl := s.dbg.Controller()
+
+	if len(args) == 0 {
+		ctl.ClearWatchpoints()
+		s.watchConditions = make(map[*cpu.Watchpoint]string)
+		return nil
+	}
+
+	addr, _, err := s.watchLocation(args[0])
+	if err != nil {
+		return err
+	}
+
+	var found bool
+	for _, w := range ctl.Watchpoints() {
+		if w.Address == addr {
+			ctl.RemoveWatchpoint(w)
+			delete(s.watchConditions, w)
+			found = true
+		}
+	}
+
+	if !found {
+		return fmt.Errorf("no watchpoint at %04x", addr)
+	}
+	return nil
+}
+
+func cmdBreakpoints(s *Session, _ []string) error {
+	for _, addr := range s.dbg.Breakpoints() {
+		fmt.Fprintf(s.out, " break %s%s\n", s.describe(addr), formatCondition(s.conditions[addr]))
+	}
+	for _, w := range s.dbg.Controller().Watchpoints() {
+		fmt.Fprintf(s.out, " watch %s\n", s.describeWatchpoint(w))
+	}
+	return nil
+}
+
+func cmdStep(s *Session, args []string) error {
+	return s.repeat(args, s.dbg.Step)
+}
+
+func cmdNext(s *Session, args []string) error {
+	return s.repeat(args, s.dbg.Next)
+}
+
+func cmdFinish(s *Session, _ []string) error {
+	return s.stopped(s.dbg.Finish())
+}
+
+func cmdContinue(s *Session, _ []string) error {
+	return s.stopped(s.dbg.Continue())
+}
+
+func cmdReverseStep(s *Session, args []string) error {
+	if s.config.History == 0 {
+		return errors.New("reverse execution is disabled; see -history")
+	}
+	return s.repeat(args, s.dbg.StepBack)
+}
+
+func cmdReverseContinue(s *Session, _ []string) error {
+	if s.config.History == 0 {
+		return errors.New("reverse execution is disabled; see -history")
+	}
+	return s.stopped(s.dbg.ReverseContinue())
+}
+
+func cmdWhere(s *Session, _ []string) error {
+	s.where()
+	return nil
+}
+
+func cmdList(s *Session, args []string) error {
+	addr := s.dbg.Controller().Memory().U16(cpu.RIP)
+	if len(args) > 0 {
+		var err error
+		if addr, err = s.source.Resolve(args[0]); err != nil {
+			return err
+		}
+	}
+
+	sym := s.source.Find(addr)
+	if sym == nil {
+		return fmt.Errorf("no source information for address %04x", addr)
+	}
+
+	const context = 5
+	for line := sym.Line - context; line <= sym.Line+context; line++ {
+		text, err := s.source.Line(sym.File, line)
+		if err != nil {
+			if line <= sym.Line {
+				continue
+			}
+			break
+		}
+
+		marker := "  "
+		if line == sym.Line {
+			marker = "=>"
+		}
+		fmt.Fprintf(s.out, "%s %4d  %s\n", marker, line, text)
+	}
+
+	return nil
+}
+
+func cmdRegisters(s *Session, _ []string) error {
+	mem := s.dbg.Controller().Memory()
+
+	for i := 0; i < 8; i++ {
+		fmt.Fprintf(s.out, "%-3s %04x", arch.RegisterName(i), mem.U16(cpu.R0+i*2))
+		if i%4 == 3 {
+			fmt.Fprintln(s.out)
+		} else {
+			fmt.Fprint(s.out, "  ")
+		}
+	}
+
+	fmt.Fprintf(s.out, "RSP %04x  RIP %04x  RIA %04x  RST %02x (compare: %d, overflow: %d, divide-by-zero: %d, carry: %d)\n",
+		mem.U16(cpu.RSP), mem.U16(cpu.RIP), mem.U16(cpu.RIA), mem.U8(cpu.RST),
+		_bool(mem.RSTCompare()), _bool(mem.RSTOverflow()), _bool(mem.RSTDivideByZero()), _bool(mem.RSTCarry()))
+	fmt.Fprintf(s.out, "call depth: %d, cycles: %d\n", s.dbg.Depth(), s.dbg.Controller().Cycles())
+	return nil
+}
+
+func cmdSet(s *Session, args []string) error {
+	if len(args) != 2 {
+		return errors.New("expected: set <register> <value>")
+	}
+
+	index := arch.RegisterIndex(args[0])
+	if index == -1 {
+		return fmt.Errorf("unknown register %q", args[0])
+	}
+
+	value, err := vm.ParseNumber(args[1])
+	if err != nil || value < -0x8000 || value > 0xffff {
+		return fmt.Errorf("invalid 16-bit value %q", args[1])
+	}
+
+	mem := s.dbg.Controller().Memory()
+	if index == arch.RegisterIndex("rst") {
+		mem.SetU8(cpu.RST, value)
+	} else {
+		mem.SetU16(cpu.R0+index*2, value)
+	}
+
+	return nil
+}
+
+func cmdDump(s *Session, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("expected: x <location> [count]")
+	}
+
+	addr, err := s.source.Resolve(args[0])
+	if err != nil {
+		return err
+	}
+
+	count := 64
+	if len(args) > 1 {
+		if count, err = vm.ParseNumber(args[1]); err != nil || count < 0 {
+			return fmt.Errorf("invalid byte count %q", args[1])
+		}
+	}
+
+	if addr < 0 || addr >= cpu.MemoryCapacity {
+		return fmt.Errorf("address %04x is out of range", addr)
+	}
+
+	if addr+count > cpu.MemoryCapacity {
+		count = cpu.MemoryCapacity - addr
+	}
+
+	data := make([]byte, count)
+	s.dbg.Controller().Memory().Read(addr, data)
+
+	for i := 0; i < len(data); i += 16 {
+		row := data[i:]
+		if len(row) > 16 {
+			row = row[:16]
+		}
+
+		var hex, text strings.Builder
+		for j, b := range row {
+			if j == 8 {
+				hex.WriteByte(' ')
+			}
+			fmt.Fprintf(&hex, " %02x", b)
+
+			if b >= 0x20 && b < 0x7f {
+				text.WriteByte(b)
+			} else {
+				text.WriteByte('.')
+			}
+		}
+
+		fmt.Fprintf(s.out, "%05x %-49s |%s|\n", addr+i, hex.String(), text.String())
+	}
+
+	return nil
+}
+
+func cmdWrite(s *Session, args []string) error {
+	if len(args) < 2 {
+		return errors.New("expected: write <location> <byte>...")
+	}
+
+	addr, err := s.source.Resolve(args[0])
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, len(args)-1)
+	for i, arg := range args[1:] {
+		v, err := vm.ParseNumber(arg)
+		if err != nil || v < -0x80 || v > 0xff {
+			return fmt.Errorf("invalid byte value %q", arg)
+		}
+		data[i] = byte(v)
+	}
+
+	if addr < 0 || addr+len(data) > cpu.MemoryCapacity {
+		return fmt.Errorf("address %04x is out of range", addr)
+	}
+
+	s.dbg.Controller().Memory().Write(addr, data)
+	return nil
+}
+
+func cmdTrace(s *Session, _ []string) error {
+	s.trace = !s.trace
+	if s.trace {
+		fmt.Fprintln(s.out, "trace output enabled")
+	} else {
+		fmt.Fprintln(s.out, "trace output disabled")
+	}
+	return nil
+}
+
+func cmdScreenshot(s *Session, args []string) error {
+	if len(args) != 1 {
+		return errors.New("expected: screenshot <file>")
+	}
+
+	if err := sprdi.SavePNG(args[0], s.screen.Image()); err != nil {
+		return errors.Wrapf(err, "failed to save screenshot")
+	}
+
+	fmt.Fprintln(s.out, "screenshot saved to", args[0])
+	return nil
+}
+
+func cmdReset(s *Session, _ []string) error {
+	if err := s.Load(); err != nil {
+		return err
+	}
+	s.where()
+	return nil
+}
+
+// repeat runs f as often as the optional count argument says, or until
+// execution stops for another reason.
+func (s *Session) repeat(args []string, f func() (vm.StopReason, error)) error {
+	count := 1
+	if len(args) > 0 {
+		var err error
+		if count, err = vm.ParseNumber(args[0]); err != nil || count < 1 {
+			return fmt.Errorf("invalid count %q", args[0])
+		}
+	}
+
+	for i := 0; i < count-1; i++ {
+		reason, err := f()
+		if err != nil || reason != vm.StopStep {
+			return s.stopped(reason, err)
+		}
+	}
+
+	return s.stopped(f())
+}
+
+// stopped reports why execution stopped and where.
+func (s *Session) stopped(reason vm.StopReason, err error) error {
+	if err != nil {
+		return err
+	}
+
+	switch reason {
+	case vm.StopBreakpoint:
+		fmt.Fprintln(s.out, "breakpoint reached")
+	case vm.StopWatchpoint:
+		fmt.Fprintln(s.out, s.dbg.Break())
+	case vm.StopPause:
+		fmt.Fprintln(s.out, "paused")
+	case vm.StopHistory:
+		fmt.Fprintln(s.out, "reached the start of the recorded history")
+	case vm.StopHalt:
+		fmt.Fprintln(s.out, "program halted")
+		return nil
+	}
+
+	s.where()
+	return nil
+}
+
+// where prints the instruction which is executed next, along with its source line.
+func (s *Session) where() {
+	rip := s.dbg.Controller().Memory().U16(cpu.RIP)
+
+	if lbl, offset, ok := s.source.LabelAt(rip); ok {
+		fmt.Fprintf(s.out, "%s+%d:\n", lbl.Name, offset)
+	}
+
+	instr, err := s.dbg.Current()
+	if err != nil {
+		fmt.Fprintf(s.out, "%04x  %v\n", rip, err)
+		return
+	}
+
+	sym := s.source.Find(rip)
+	fmt.Fprintln(s.out, vm.FormatTrace(instr, sym, s.debug.Files))
+
+	if sym != nil {
+		if text, err := s.source.Line(sym.File, sym.Line); err == nil {
+			fmt.Fprintf(s.out, "%4d  %s\n", sym.Line, strings.TrimSpace(text))
+		}
+	}
+}
+
+// describe returns a human-readable description of the given address,
+// including its source location, if known.
+func (s *Session) describe(addr int) string {
+	desc := fmt.Sprintf("%04x", addr)
+
+	if lbl, offset, ok := s.source.LabelAt(addr); ok {
+		desc += fmt.Sprintf(" <%s+%d>", lbl.Name, offset)
+	}
+
+	if sym := s.source.Find(addr); sym != nil {
+		desc += fmt.Sprintf(" %s:%d", s.source.File(sym.File), sym.Line)
+	}
+
+	return desc
+}
+
+// describeWatchpoint returns a human-readable description of the given watchpoint.
+func (s *Session) describeWatchpoint(w *cpu.Watchpoint) string {
+	return fmt.Sprintf("%04x-%04x %s%s", w.Address, w.Address+w.Size-1, w.Access, formatCondition(s.watchConditions[w]))
+}
+
+// watchLocation resolves the location of a watchpoint. This is either a
+// register name or a location accepted by vm.Source.Resolve. Also returns
+// the default size of the watched range.
+func (s *Session) watchLocation(loc string) (int, int, error) {
+	if index := arch.RegisterIndex(loc); index > -1 {
+		if index == arch.RegisterIndex("rst") {
+			return cpu.RST, 1, nil
+		}
+		return cpu.R0 + index*2, 2, nil
+	}
+
+	addr, err := s.source.Resolve(loc)
+	return addr, 2, err
+}
+
+// condition compiles the given breakpoint condition.
+// Returns nil if expr is empty.
+func (s *Session) condition(expr string) (cpu.Condition, error) {
+	if len(expr) == 0 {
+		return nil, nil
+	}
+	return vm.ParseCondition(expr, s.source.Resolve)
+}
+
+// splitCondition splits command arguments at the "if" keyword.
+// Returns the arguments before it and the condition following it.
+func splitCondition(args []string) ([]string, string) {
+	for i, arg := range args {
+		if strings.ToLower(arg) == "if" {
+			return args[:i], strings.Join(args[i+1:], " ")
+		}
+	}
+	return args, ""
+}
+
+// formatCondition returns a suffix describing the given condition, if any.
+func formatCondition(expr string) string {
+	if len(expr) == 0 {
+		return ""
+	}
+	return " if " + expr
+}
+
+func _bool(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hexaflex/svm/devices/fffe/cpu"
+	"github.com/hexaflex/svm/vm"
+)
+
+// Config defines program configuration.
+type Config struct {
+	Image         string       // Path to the image file to load.
+	Includes      []string     // Search paths for source files.
+	PrintTrace    bool         // Print instruction trace data?
+	Readonly      bool         // Is the image read-only?
+	Deterministic bool         // Run in deterministic mode?
+	Seed          int64        // RNG seed for deterministic mode.
+	ClockRate     vm.ClockRate // Target cpu frequency. Zero means unbounded.
+	History       int          // Number of executed instructions which can be undone.
+}
+
+// parseArgs parses command line arguments as applicable.
+//
+// If an error occurred, this exits the program with an appropriate message.
+// When version information is requested, it is printed to stdout and the program ends cleanly.
+func parseArgs() *Config {
+	var c Config
+	c.Seed = cpu.DefaultSeed
+	c.History = vm.DefaultHistory
+
+	flag.Usage = func() {
+		fmt.Printf("%s [options] <image file>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	includes := flag.String("include", "", "Colon-separated list of search paths for source files.")
+	flag.BoolVar(&c.PrintTrace, "trace", c.PrintTrace, "Print instruction trace data to stdout.")
+	flag.BoolVar(&c.Readonly, "readonly", c.Readonly, "Is the loaded image file write protected?")
+	flag.Var(&c.ClockRate, "clock", "Target cpu frequency. E.g.: 1MHz, 250KHz. 0 means unbounded.")
+	flag.BoolVar(&c.Deterministic, "deterministic", c.Deterministic, "Use a virtual clock driven by executed cycles and a fixed RNG seed.")
+	flag.Int64Var(&c.Seed, "seed", c.Seed, "RNG seed used in deterministic mode.")
+	flag.IntVar(&c.History, "history", c.History, "Number of executed instructions which can be undone. 0 disables reverse execution.")
+
+	version := flag.Bool("version", false, "Display version information.")
+	flag.Parse()
+
+	if *version {
+		fmt.Println(Version())
+		os.Exit(0)
+	}
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if len(*includes) > 0 {
+		c.Includes = filteredSplit(*includes, ":")
+	}
+
+	c.Image = flag.Arg(0)
+	return &c
+}
+
+// filteredSplit splits value by sep and returns the resulting list, minus empty entries.
+func filteredSplit(value, sep string) []string {
+	out := strings.Split(value, sep)
+	for i := 0; i < len(out); i++ {
+		out[i] = strings.TrimSpace(out[i])
+		if len(out[i]) == 0 {
+			copy(out[i:], out[i+1:])
+			out = out[:len(out)-1]
+			i--
+		}
+	}
+	return out
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/hexaflex/svm/asm/ar"
+	"github.com/hexaflex/svm/devices/fffe/clock"
+	"github.com/hexaflex/svm/devices/fffe/cpu"
+	"github.com/hexaflex/svm/devices/fffe/fd35"
+	"github.com/hexaflex/svm/devices/fffe/sprdi"
+	"github.com/hexaflex/svm/vm"
+)
+
+// Prompt is printed when the debugger waits for a command.
+const Prompt = "(svm-dbg) "
+
+// Session holds the state of a debugging session.
+type Session struct {
+	config *Config
+	out    io.Writer
+	debug  ar.Debug              // Debug data for the loaded image.
+	source *vm.Source            // Maps addresses to source locations.
+	dbg    *vm.Debugger          // The debugged cpu.
+	floppy *fd35.Device          // Virtual floppy drive holding the image.
+	screen *sprdi.ImagePresenter // Holds the display contents.
+	trace  bool                  // Print instruction trace data?
+
+	conditions      map[int]string             // Breakpoint conditions, by address.
+	watchConditions map[*cpu.Watchpoint]string // Watchpoint conditions.
+}
+
+func main() {
+	s := NewSession(parseArgs(), os.Stdout)
+
+	if err := s.Load(); err != nil {
+		log.Println(err)
+	}
+
+	// Ctrl+C pauses a running program, instead of ending the debugger.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	go func() {
+		for range signals {
+			s.dbg.Pause()
+		}
+	}()
+
+	s.Run(os.Stdin)
+
+	if err := s.dbg.Controller().Shutdown(); err != nil {
+		log.Println(err)
+	}
+}
+
+// NewSession creates a new debugging session using the given configuration.
+// Output is written to w.
+func NewSession(config *Config, w io.Writer) *Session {
+	var s Session
+	s.config = config
+	s.out = w
+	s.trace = config.PrintTrace
+	s.conditions = make(map[int]string)
+	s.watchConditions = make(map[*cpu.Watchpoint]string)
+	s.source = vm.NewSource(&s.debug, config.Includes)
+	s.screen = sprdi.NewImagePresenter()
+	s.floppy = vm.NewFloppy(config.Image, config.Readonly)
+
+	ctl := vm.NewCPUController(s.traceHandler,
+		sprdi.New(s.screen),
+		s.floppy,
+		clock.New())
+	s.dbg = vm.NewDebugger(ctl, &s.debug)
+	s.dbg.SetHistory(config.History)
+
+	ctl.SetFrequency(int(config.ClockRate))
+	if config.Deterministic {
+		ctl.SetDeterministic(config.Seed)
+	}
+
+	return &s
+}
+
+// Load (re)loads the debug data and boots the image.
+func (s *Session) Load() error {
+	err := vm.LoadDebug(s.config.Image, &s.debug)
+	switch {
+	case os.IsNotExist(err):
+		log.Println("no debug data loaded")
+	case err != nil:
+		log.Println("failed to load debug data:", err)
+	}
+
+	s.source = vm.NewSource(&s.debug, s.config.Includes)
+	return s.dbg.BootFile(s.floppy, s.config.Image)
+}
+
+// Run reads commands from r and executes them until the input ends
+// or the quit command is given. An empty line repeats the last command.
+func (s *Session) Run(r io.Reader) {
+	var last string
+
+	s.where()
+
+	scanner := bufio.NewScanner(r)
+	for {
+		fmt.Fprint(s.out, Prompt)
+		if !scanner.Scan() {
+			fmt.Fprintln(s.out)
+			return
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 {
+			line = last
+		}
+
+		if len(line) == 0 {
+			continue
+		}
+
+		last = line
+		quit, err := s.Exec(line)
+		if err != nil {
+			fmt.Fprintln(s.out, "error:", err)
+		}
+
+		if quit {
+			return
+		}
+	}
+}
+
+// traceHandler prints instruction trace data if enabled.
+func (s *Session) traceHandler(i *cpu.Instruction) {
+	if s.trace {
+		fmt.Fprintln(s.out, vm.FormatTrace(i, s.debug.Find(i.IP), s.debug.Files))
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Config defines program configuration.
+type Config struct {
+	Input    string   // Compiled program to disassemble.
+	Output   string   // Path to store output in. Empty means stdout.
+	Includes []string // Search paths for source files.
+	NoDebug  bool     // Ignore debug symbols?
+}
+
+// parseArgs parses command line arguments as applicable.
+//
+// If an error occurred, this exits the program with an appropriate message.
+// When version information is requested, it is printed to stdout and the program ends cleanly.
+func parseArgs() *Config {
+	var c Config
+
+	flag.Usage = func() {
+		fmt.Printf("%s [options] <program file>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	includes := flag.String("include", "", "Colon-separated list of search paths for source files.")
+	flag.StringVar(&c.Output, "out", c.Output, "Output file. Defaults to stdout.")
+	flag.BoolVar(&c.NoDebug, "nodebug", c.NoDebug, "Ignore the program's debug symbols, if there are any.")
+	version := flag.Bool("version", false, "Display version information.")
+	flag.Parse()
+
+	if *version {
+		fmt.Println(Version())
+		os.Exit(0)
+	}
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if len(*includes) > 0 {
+		c.Includes = filteredSplit(*includes, ":")
+	}
+
+	c.Input = flag.Arg(0)
+	return &c
+}
+
+// filteredSplit splits value by sep and returns the resulting list, minus empty entries.
+func filteredSplit(value, sep string) []string {
+	out := strings.Split(value, sep)
+	for i := 0; i < len(out); i++ {
+		out[i] = strings.TrimSpace(out[i])
+		if len(out[i]) == 0 {
+			copy(out[i:], out[i+1:])
+			out = out[:len(out)-1]
+			i--
+		}
+	}
+	return out
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/hexaflex/svm/asm/ar"
+	"github.com/hexaflex/svm/asm/disasm"
+	"github.com/hexaflex/svm/vm"
+)
+
+func main() {
+	config := parseArgs()
+
+	program, err := ar.LoadFile(config.Input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	opt := loadOptions(config, &program.Debug)
+	opt.Entry = program.Entry
+	opt.Sections = program.Sections
+
+	w, close := makeWriter(config.Output)
+	defer close()
+
+	if err := disasm.Disassemble(w, program.Instructions, opt); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// loadOptions uses the program's debug symbols, if there are any,
+// to find label names and source text.
+func loadOptions(c *Config, debug *ar.Debug) *disasm.Options {
+	if c.NoDebug || debug.Empty() {
+		return &disasm.Options{}
+	}
+
+	source := vm.NewSource(debug, c.Includes)
+
+	var labels []disasm.Label
+	for _, lbl := range source.Labels() {
+		labels = append(labels, disasm.Label{Name: lbl.Name, Address: lbl.Address})
+	}
+
+	return &disasm.Options{
+		Debug:  debug,
+		Labels: labels,
+		Source: func(file, line int) (string, bool) {
+			text, err := source.Line(file, line)
+			return text, err == nil
+		},
+	}
+}
+
+// makeWriter creates an output writer and a cleanup function for it.
+// Returns stdout if the name is empty.
+func makeWriter(file string) (io.Writer, func()) {
+	if len(file) == 0 {
+		return os.Stdout, func() {}
+	}
+
+	dir, _ := filepath.Split(file)
+	if len(dir) > 0 {
+		err := os.MkdirAll(dir, 0744)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	fd, err := os.Create(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	return fd, func() { fd.Close() }
+}
@@ -6,6 +6,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+
+	"github.com/hexaflex/svm/asm/ar"
 )
 
 const (
@@ -21,10 +23,36 @@ func main() {
 }
 
 // createImage creates an image file from zero or more input files.
+//
+// Archives are stored as the memory image they describe. The first input
+// is what the bootloader runs. If it is an archive with debug data, that
+// is written to a separate debug file next to the image.
 func createImage(file string, inputs []string) {
 	var buf bytes.Buffer
-	for _, file := range inputs {
-		copyFile(file, &buf)
+	for i, input := range inputs {
+		if !isArchive(input) {
+			copyFile(input, &buf)
+			continue
+		}
+
+		program, err := ar.LoadFile(input)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		if i == 0 {
+			if program.Entry != 0 {
+				fmt.Fprintf(os.Stderr, "%s: boot program must start at address 0; have entry point %04x\n", input, program.Entry)
+				os.Exit(1)
+			}
+
+			if !program.Debug.Empty() {
+				writeDebug(ar.DebugFile(file), &program.Debug)
+			}
+		}
+
+		buf.Write(program.Instructions)
 	}
 
 	diff := FloppySize - buf.Len()
@@ -46,6 +74,34 @@ func createImage(file string, inputs []string) {
 	}
 }
 
+// writeDebug writes the given debug data to file.
+func writeDebug(file string, debug *ar.Debug) {
+	w, close := makeWriter(file)
+	defer close()
+
+	if err := debug.Save(w); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// isArchive returns true if the given file holds an archive.
+func isArchive(file string) bool {
+	fd, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+
+	defer fd.Close()
+
+	magic := make([]byte, len(ar.Magic))
+	if _, err := io.ReadFull(fd, magic); err != nil {
+		return false
+	}
+
+	return ar.IsArchive(magic)
+}
+
 // copyFile copies the contents of file into dst.
 func copyFile(file string, dst io.Writer) {
 	src, err := os.Open(file)
@@ -63,14 +119,14 @@ func copyFile(file string, dst io.Writer) {
 }
 
 // makeWriter opens the given file for writing.
-// Returns stdout if the name is empty.
 func makeWriter(file string) (io.Writer, func()) {
 	dir, _ := filepath.Split(file)
-
-	err := os.MkdirAll(dir, 0744)
-	if err != nil && !os.IsExist(err) {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	if len(dir) > 0 {
+		err := os.MkdirAll(dir, 0744)
+		if err != nil && !os.IsExist(err) {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 	}
 
 	fd, err := os.Create(file)
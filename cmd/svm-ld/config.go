@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hexaflex/svm/asm/parser"
+)
+
+// Input defines an object file to link.
+type Input struct {
+	File    string // Object file.
+	Address int    // Base address. Negative if none was given.
+}
+
+// Config defines program configuration.
+type Config struct {
+	Inputs []Input // Object files to link.
+	Output string  // Path to store output in.
+	Entry  string  // Name of the label at which execution starts.
+}
+
+// parseArgs parses command line arguments as applicable.
+//
+// If an error occurred, this exits the program with an appropriate message.
+// When version information is requested, it is printed to stdout and the program ends cleanly.
+func parseArgs() *Config {
+	var c Config
+	c.Output = "out.a"
+
+	flag.Usage = func() {
+		fmt.Printf("%s [options] <object file>[@address] ...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.StringVar(&c.Output, "out", c.Output, "Output file.")
+	flag.StringVar(&c.Entry, "entry", c.Entry, "Exported label at which execution starts. Defaults to the address of the first object.")
+	version := flag.Bool("version", false, "Display version information.")
+	flag.Parse()
+
+	if *version {
+		fmt.Println(Version())
+		os.Exit(0)
+	}
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	for _, arg := range flag.Args() {
+		in, err := parseInput(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		c.Inputs = append(c.Inputs, in)
+	}
+
+	return &c
+}
+
+// parseInput parses an object file name with an optional base address.
+// The address is a numeric literal in assembler syntax, like 16#4000.
+func parseInput(arg string) (Input, error) {
+	index := strings.LastIndex(arg, "@")
+	if index == -1 {
+		return Input{File: arg, Address: -1}, nil
+	}
+
+	addr, err := parser.ParseNumber(arg[index+1:])
+	if err != nil || addr < 0 || addr > 0xffff {
+		return Input{}, fmt.Errorf("invalid base address in %q", arg)
+	}
+
+	return Input{File: arg[:index], Address: int(addr)}, nil
+}
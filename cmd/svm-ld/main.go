@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hexaflex/svm/asm/ar"
+	"github.com/hexaflex/svm/asm/link"
+)
+
+func main() {
+	config := parseArgs()
+
+	modules := make([]link.Module, len(config.Inputs))
+	for i, in := range config.Inputs {
+		obj, err := ar.LoadObject(in.File)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		name := filepath.Base(in.File)
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+		modules[i] = link.Module{Name: name, Object: obj, Address: in.Address}
+	}
+
+	archive, err := link.Link(modules, config.Entry)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	log.Println("##", config.Output)
+
+	if dir := filepath.Dir(config.Output); dir != "" {
+		if err := os.MkdirAll(dir, 0744); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	fd, err := os.Create(config.Output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	defer fd.Close()
+
+	if err := archive.Save(fd); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
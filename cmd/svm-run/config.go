@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/hexaflex/svm/devices/fffe/cpu"
+	"github.com/hexaflex/svm/vm"
+)
+
+// Config defines program configuration.
+type Config struct {
+	Image         string        // Path to the image file to load.
+	MaxCycles     uint64        // Maximum number of cycles to execute. Zero means no limit.
+	Timeout       time.Duration // Maximum wall-clock running time. Zero means no limit.
+	PrintTrace    bool          // Print instruction trace data?
+	Readonly      bool          // Is the image read-only?
+	ExitR0        bool          // Use R0 as exit status when the program halts?
+	Screenshot    string        // PNG file to which the display contents are written when the run ends.
+	ShotAfter     int           // End the run after this many display swaps. Zero means disabled.
+	DumpFrames    string        // Directory in which every swapped display frame is stored. Empty means disabled.
+	Deterministic bool          // Run in deterministic mode?
+	Seed          int64         // RNG seed for deterministic mode.
+	ClockRate     vm.ClockRate  // Target cpu frequency. Zero means unbounded.
+}
+
+// parseArgs parses command line arguments as applicable.
+//
+// If an error occurred, this exits the program with an appropriate message.
+// When version information is requested, it is printed to stdout and the program ends cleanly.
+func parseArgs() *Config {
+	var c Config
+	c.Seed = cpu.DefaultSeed
+
+	flag.Usage = func() {
+		fmt.Printf("%s [options] <image file>\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Uint64Var(&c.MaxCycles, "max-cycles", c.MaxCycles, "Stop after this many cycles have been executed. 0 means no limit.")
+	flag.DurationVar(&c.Timeout, "timeout", c.Timeout, "Stop after the program has run for this long. 0 means no limit.")
+	flag.BoolVar(&c.PrintTrace, "trace", c.PrintTrace, "Print instruction trace data to stdout.")
+	flag.BoolVar(&c.Readonly, "readonly", c.Readonly, "Is the loaded image file write protected?")
+	flag.BoolVar(&c.ExitR0, "exit-r0", c.ExitR0, "Use the low 8 bits of R0 as the exit status when the program halts.")
+	flag.StringVar(&c.Screenshot, "screenshot", c.Screenshot, "Write the display contents to this PNG file when the run ends.")
+	flag.IntVar(&c.ShotAfter, "screenshot-after", c.ShotAfter, "End the run after the program has swapped the display this many times. 0 means disabled.")
+	flag.Var(&c.ClockRate, "clock", "Target cpu frequency. E.g.: 1MHz, 250KHz. 0 means unbounded.")
+	flag.BoolVar(&c.Deterministic, "deterministic", c.Deterministic, "Use a virtual clock driven by executed cycles and a fixed RNG seed.")
+	flag.Int64Var(&c.Seed, "seed", c.Seed, "RNG seed used in deterministic mode.")
+	flag.StringVar(&c.DumpFrames, "dump-frames", c.DumpFrames, "Write every swapped display frame as a numbered PNG file to this directory.")
+
+	version := flag.Bool("version", false, "Display version information.")
+	flag.Parse()
+
+	if *version {
+		fmt.Println(Version())
+		os.Exit(0)
+	}
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(ExitError)
+	}
+
+	c.Image = flag.Arg(0)
+	return &c
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/hexaflex/svm/asm/ar"
+	"github.com/hexaflex/svm/devices/fffe/clock"
+	"github.com/hexaflex/svm/devices/fffe/cpu"
+	"github.com/hexaflex/svm/devices/fffe/fd35"
+	"github.com/hexaflex/svm/devices/fffe/sprdi"
+	"github.com/hexaflex/svm/vm"
+)
+
+// Known exit codes.
+const (
+	ExitHalt  = 0 // The program halted.
+	ExitError = 1 // The program could not be loaded or crashed.
+	ExitLimit = 2 // The cycle or time limit was reached before the program halted.
+)
+
+func main() {
+	os.Exit(run(parseArgs()))
+}
+
+// run sets up the virtual machine, runs the image in it and writes any
+// requested output files. Returns the appropriate exit code.
+func run(c *Config) int {
+	var debug ar.Debug
+
+	trace := func(*cpu.Instruction) { /* nop */ }
+
+	if c.PrintTrace {
+		if err := vm.LoadDebug(c.Image, &debug); err != nil && !os.IsNotExist(err) {
+			log.Println("failed to load debug data:", err)
+		}
+
+		trace = func(i *cpu.Instruction) {
+			fmt.Println(vm.FormatTrace(i, debug.Find(i.IP), debug.Files))
+		}
+	}
+
+	var ctl *vm.CPUController
+	var swaps int
+
+	screen := sprdi.NewImagePresenter()
+	presenters := []sprdi.Presenter{
+		screen,
+		sprdi.PresenterFunc(func(*sprdi.Frame) {
+			swaps++
+			if c.ShotAfter > 0 && swaps >= c.ShotAfter {
+				ctl.Stop()
+			}
+		}),
+	}
+
+	if len(c.DumpFrames) > 0 {
+		presenters = append(presenters, sprdi.NewFrameDumper(c.DumpFrames))
+	}
+
+	floppy := vm.NewFloppy(c.Image, c.Readonly)
+	ctl = vm.NewCPUController(trace,
+		sprdi.New(sprdi.MultiPresenter(presenters...)),
+		floppy,
+		clock.New())
+
+	ctl.SetFrequency(int(c.ClockRate))
+	if c.Deterministic {
+		ctl.SetDeterministic(c.Seed)
+	}
+
+	code := execute(c, ctl, floppy)
+
+	if err := ctl.Shutdown(); err != nil {
+		log.Println(err)
+		code = ExitError
+	}
+
+	if len(c.Screenshot) > 0 {
+		if err := sprdi.SavePNG(c.Screenshot, screen.Image()); err != nil {
+			log.Println("failed to save screenshot:", err)
+			code = ExitError
+		}
+	}
+
+	return code
+}
+
+// execute boots the program and runs it until it halts, crashes or reaches
+// one of the configured limits. Returns the appropriate exit code.
+func execute(c *Config, ctl *vm.CPUController, floppy *fd35.Device) int {
+	if err := vm.BootFile(ctl, floppy, c.Image); err != nil {
+		log.Println(err)
+		return ExitError
+	}
+
+	start := time.Now()
+	ctl.Start()
+
+	for steps := 0; ctl.Running(); steps++ {
+		if c.MaxCycles > 0 && ctl.Cycles() >= c.MaxCycles {
+			log.Printf("cycle limit of %d reached", c.MaxCycles)
+			return ExitLimit
+		}
+
+		// Checking the time is relatively expensive, so don't do it every step.
+		if steps&0x3ff == 0 {
+			if c.Timeout > 0 && time.Since(start) >= c.Timeout {
+				log.Printf("time limit of %v reached", c.Timeout)
+				return ExitLimit
+			}
+			ctl.Throttle()
+		}
+
+		if err := ctl.Step(); err != nil {
+			log.Println(err)
+			return ExitError
+		}
+	}
+
+	if c.ExitR0 {
+		return ctl.Memory().U16(cpu.R0) & 0xff
+	}
+
+	return ExitHalt
+}
@@ -3,48 +3,72 @@ package main
 import (
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-gl/gl/v4.2-core/gl"
 	"github.com/go-gl/glfw/v3.3/glfw"
 	"github.com/pkg/errors"
 
-	"github.com/hexaflex/svm/arch"
 	"github.com/hexaflex/svm/asm/ar"
 	"github.com/hexaflex/svm/devices/fffe/clock"
 	"github.com/hexaflex/svm/devices/fffe/cpu"
 	"github.com/hexaflex/svm/devices/fffe/fd35"
 	"github.com/hexaflex/svm/devices/fffe/gp14"
 	"github.com/hexaflex/svm/devices/fffe/sprdi"
+	"github.com/hexaflex/svm/devices/fffe/sprdi/opengl"
+	"github.com/hexaflex/svm/vm"
+	"github.com/hexaflex/svm/vm/gdb"
 )
 
 // App defines application context.
 type App struct {
-	config       *Config        // Application configuration.
-	window       *glfw.Window   // OpenGL/GLFW context.
-	cpu          *CPUController // VM with program to be run.
-	display      *sprdi.Device  // Virtual display peripheral.
-	gamepad      *gp14.Device   // Virtual gamepad peripheral.
-	floppy       *fd35.Device   // Virtual floppy drive.
-	debug        ar.Debug       // Debug data stored in an archive.
-	titleUpdated time.Time      // Value used to periodically update window title.
-	lastRendered time.Time      // Last time a frame was rendered.
+	config       *Config           // Application configuration.
+	window       *glfw.Window      // OpenGL/GLFW context.
+	cpu          *vm.CPUController // VM with program to be run.
+	display      *sprdi.Device     // Virtual display peripheral.
+	screen       *opengl.Presenter // Renders display contents to the window.
+	gamepad      *gp14.Device      // Virtual gamepad peripheral.
+	floppy       *fd35.Device      // Virtual floppy drive.
+	debug        atomic.Value      // *ar.Debug: Debug data stored in an archive.
+	debugMode    uint32            // Non-zero in debug mode. Accessed atomically.
+	printTrace   uint32            // Non-zero if trace data is printed. Accessed atomically.
+	gdb          net.Listener      // Accepts GDB clients. Nil if disabled.
+	titleUpdated time.Time         // Value used to periodically update window title.
+	lastRendered time.Time         // Last time a frame was rendered.
 }
 
 // NewApp creates a new application instance using the given configuration.
 func NewApp(config *Config) *App {
 	var a App
 	a.config = config
-	a.display = sprdi.New()
+	a.debug.Store(&ar.Debug{})
+	a.setDebug(config.Debug)
+	a.setPrintTrace(config.PrintTrace)
+	a.screen = opengl.New()
+	if len(config.DumpFrames) > 0 {
+		a.display = sprdi.New(sprdi.MultiPresenter(a.screen, sprdi.NewFrameDumper(config.DumpFrames)))
+	} else {
+		a.display = sprdi.New(a.screen)
+	}
 	a.gamepad = gp14.New()
-	a.floppy = fd35.New(config.Image, config.Readonly)
-	a.cpu = NewCPUController(a.debugHandler,
+	a.floppy = vm.NewFloppy(config.Image, config.Readonly)
+	a.cpu = vm.NewCPUController(a.debugHandler,
 		a.display,
 		a.gamepad,
 		a.floppy,
 		clock.New())
+
+	a.cpu.SetFrequency(int(config.ClockRate))
+	a.cpu.SetHistory(config.History)
+	if config.Deterministic {
+		a.cpu.SetDeterministic(config.Seed)
+	}
+
 	return &a
 }
 
@@ -64,10 +88,18 @@ func (a *App) Run() error {
 
 	if err := a.loadProgram(); err != nil {
 		log.Println(err)
+	} else if len(a.config.LoadState) > 0 {
+		if err := vm.LoadState(a.cpu, a.config.LoadState); err != nil {
+			log.Println(err)
+		}
 	}
 
-	if !a.config.Debug {
-		a.cpu.Start()
+	if len(a.config.GDB) > 0 {
+		if err := a.serveGDB(); err != nil {
+			return err
+		}
+	} else {
+		a.spawnCPU()
 	}
 
 	for !a.window.ShouldClose() {
@@ -77,28 +109,57 @@ func (a *App) Run() error {
 	return nil
 }
 
-// mainLoop performs all main loop operations.
-func (a *App) mainLoop() {
-	a.gamepad.Update()
-
-	if a.cpu.Running() {
-		err := a.cpu.Step()
+// spawnCPU starts running the cpu on its own goroutine, unless we are in
+// debug mode. If the program ends, we want to exit if we're not in debug mode.
+func (a *App) spawnCPU() {
+	a.cpu.SetStopHandler(func(err error) {
 		if err != nil {
 			log.Println(err)
 		}
-
-		// If some part of a program stopped the cpu from running,
-		// we want to exit if we're not in debug mode.
-		if !a.cpu.Running() && !a.config.Debug {
+		if _, ok := err.(*cpu.Break); ok {
+			return
+		}
+		if !a.isDebug() {
 			a.window.SetShouldClose(true)
+			glfw.PostEmptyEvent()
 		}
+	})
+
+	a.cpu.Spawn()
+
+	if !a.isDebug() {
+		a.cpu.Start()
+	}
+}
+
+// serveGDB starts accepting GDB remote serial protocol clients. Program
+// execution is then left to the client.
+func (a *App) serveGDB() error {
+	l, err := gdb.Listen(a.config.GDB)
+	if err != nil {
+		return errors.Wrapf(err, "failed to start gdb server")
 	}
 
+	a.gdb = l
+	log.Println("waiting for gdb clients on", l.Addr())
+
+	dbg := vm.NewDebugger(a.cpu, a.debug.Load().(*ar.Debug))
+	dbg.SetHistory(a.config.History)
+
+	server := gdb.NewServer(dbg)
+	go server.Serve(l)
+	return nil
+}
+
+// mainLoop performs all main loop operations.
+func (a *App) mainLoop() {
+	a.gamepad.Update()
+
 	// Periodically render display contents.
 	if time.Since(a.lastRendered) >= time.Second/60 {
 		a.lastRendered = time.Now()
 		gl.Clear(gl.COLOR_BUFFER_BIT | gl.DEPTH_BUFFER_BIT)
-		a.display.Draw()
+		a.screen.Draw()
 		a.window.SwapBuffers()
 	}
 
@@ -107,19 +168,31 @@ func (a *App) mainLoop() {
 		a.titleUpdated = time.Now()
 		freq := prettyFrequency(a.cpu.Frequency())
 		title := fmt.Sprintf("%s %s", AppName, AppVersion)
-		if a.config.Debug {
+		if a.isDebug() {
 			title += " (debug)"
 		}
 		a.window.SetTitle(fmt.Sprintf("%s - %s", title, freq))
 	}
 
-	glfw.PollEvents()
+	// Wait for input until the next frame is due.
+	if wait := time.Second/60 - time.Since(a.lastRendered); wait > 0 {
+		glfw.WaitEventsTimeout(wait.Seconds())
+	} else {
+		glfw.PollEvents()
+	}
 }
 
 // dispose ensures openGL/GLFW and other resources are cleaned up.
 func (a *App) dispose() {
+	if a.gdb != nil {
+		a.gdb.Close()
+	}
+
+	a.cpu.Close()
 	a.cpu.Stop()
-	a.cpu.Shutdown()
+	if err := a.cpu.Shutdown(); err != nil {
+		log.Println(err)
+	}
 
 	if a.window != nil {
 		a.window.Destroy()
@@ -134,6 +207,15 @@ func (a *App) keyCallback(_ *glfw.Window, key glfw.Key, scancode int, action glf
 		return
 	}
 
+	// Execution is left to the GDB client, if there is one.
+	if a.gdb != nil {
+		switch key {
+		case glfw.KeyF5, glfw.KeyQ, glfw.KeyE, glfw.KeyR:
+			log.Println("execution is controlled by the gdb client")
+			return
+		}
+	}
+
 	var err error
 
 	switch key {
@@ -142,15 +224,30 @@ func (a *App) keyCallback(_ *glfw.Window, key glfw.Key, scancode int, action glf
 	case glfw.KeyF1:
 		printHelp()
 	case glfw.KeyF2:
-		a.config.Debug = !a.config.Debug
+		a.setDebug(!a.isDebug())
 	case glfw.KeyF5:
 		err = a.loadProgram()
 	case glfw.KeyQ:
 		a.cpu.ToggleRun()
 	case glfw.KeyE:
 		err = a.cpu.Step()
+	case glfw.KeyR:
+		if mods&glfw.ModShift != 0 {
+			err = a.rewind(a.config.Rewind)
+		} else {
+			err = a.rewind(1)
+		}
 	case glfw.KeyD:
-		a.config.PrintTrace = !a.config.PrintTrace
+		a.setPrintTrace(!a.isPrintTrace())
+	case glfw.KeyF12:
+		err = a.screenshot()
+	case glfw.Key0, glfw.Key1, glfw.Key2, glfw.Key3, glfw.Key4,
+		glfw.Key5, glfw.Key6, glfw.Key7, glfw.Key8, glfw.Key9:
+		if mods&glfw.ModShift != 0 {
+			err = a.saveState(int(key - glfw.Key0))
+		} else {
+			err = a.loadState(int(key - glfw.Key0))
+		}
 	}
 
 	if err != nil {
@@ -158,6 +255,43 @@ func (a *App) keyCallback(_ *glfw.Window, key glfw.Key, scancode int, action glf
 	}
 }
 
+// saveState writes the machine state to the given save slot.
+func (a *App) saveState(slot int) error {
+	file := vm.StateFile(a.config.Image, slot)
+	if err := vm.SaveState(a.cpu, file); err != nil {
+		return err
+	}
+
+	log.Println("state saved to", file)
+	return nil
+}
+
+// loadState restores the machine state from the given save slot.
+func (a *App) loadState(slot int) error {
+	file := vm.StateFile(a.config.Image, slot)
+	if err := vm.LoadState(a.cpu, file); err != nil {
+		return err
+	}
+
+	log.Println("state loaded from", file)
+	return nil
+}
+
+// screenshot writes the current display contents to a time-stamped PNG file
+// in the screenshot directory.
+func (a *App) screenshot() error {
+	var frame sprdi.Frame
+	a.screen.CopyFrame(&frame)
+
+	file := filepath.Join(a.config.Screenshots, time.Now().Format("svm-20060102-150405.000.png"))
+	if err := frame.SavePNG(file); err != nil {
+		return errors.Wrapf(err, "failed to save screenshot")
+	}
+
+	log.Println("screenshot saved to", file)
+	return nil
+}
+
 // initGL initializes GLFW and openGL.
 func (a *App) initGL() error {
 	err := glfw.Init()
@@ -215,114 +349,114 @@ func (a *App) initGL() error {
 	return nil
 }
 
-// loadProgram loads the current program from disk and restarts the cpu.
-func (a *App) loadProgram() error {
-	// Load debug data if applicable.
-	a.loadDebugData()
-
-	// Unload existing resources before we load new things.
-	if err := a.cpu.Shutdown(); err != nil {
-		return err
+// rewind stops the cpu and undoes up to n executed instructions. It stops
+// early at the start of the recorded history, or at a breakpoint in debug mode.
+func (a *App) rewind(n int) error {
+	if a.config.History == 0 {
+		return errors.New("rewinding is disabled; see -history")
 	}
 
-	if err := a.cpu.Startup(); err != nil {
-		return err
+	a.cpu.Stop()
+
+	var count int
+	for count < n {
+		err := a.cpu.StepBack()
+		if err == cpu.ErrNoHistory {
+			log.Println("reached the start of the recorded history")
+			break
+		}
+
+		if _, ok := err.(*cpu.Break); ok {
+			log.Println(err)
+			count++
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		count++
 	}
 
-	// Load boot sector from external floppy.
-	mem := a.cpu.Memory()
-	mem.SetU16(cpu.R0, fd35.ReadSector)
-	mem.SetU16(cpu.R1, 0)
-	mem.SetU16(cpu.R2, 0)
-	a.floppy.Int(mem)
+	log.Printf("rewound %d instructions to %04x", count, a.cpu.Memory().U16(cpu.RIP))
 	return nil
 }
 
+// loadProgram loads the current program from disk and restarts the cpu.
+func (a *App) loadProgram() error {
+	// Load debug data if applicable.
+	a.loadDebugData()
+	return vm.BootFile(a.cpu, a.floppy, a.config.Image)
+}
+
+// loadDebugData loads the debug data for the current program. The new data
+// replaces the old in one go, as the cpu goroutine may be reading it.
+//
+// Breakpoints defined in the program source are handed to the cpu.
+// They only stop execution while we are in debug mode.
 func (a *App) loadDebugData() {
-	a.debug.Clear()
+	var debug ar.Debug
+	err := vm.LoadDebug(a.config.Image, &debug)
+	a.debug.Store(&debug)
 
-	file := a.config.Image
-	if index := strings.LastIndex(file, "."); index > -1 {
-		file = file[:index]
+	switch {
+	case os.IsNotExist(err):
+		log.Println("no debug data loaded")
+	case err != nil:
+		log.Println("failed to load debug data:", err)
 	}
 
-	file += ".dbg"
+	debugMode := func(cpu.Memory) bool { return a.isDebug() }
 
-	fd, err := os.Open(file)
-	if err != nil {
-		if !os.IsNotExist(err) {
-			log.Println("failed to load debug data:", err)
-		} else {
-			log.Println("no debug data loaded")
+	a.cpu.ClearBreakpoints()
+	for _, sym := range debug.Symbols {
+		if sym.Flags&ar.Breakpoint != 0 {
+			a.cpu.SetBreakpoint(sym.Address, debugMode)
 		}
-		return
-	}
-
-	defer fd.Close()
-
-	if err = a.debug.Load(fd); err != nil {
-		log.Println("failed to load debug data:", err)
 	}
 }
 
 // debugHandler prints instruction trace data. This can be toggled
-// on off through a.config.PrintTrace.
+// on off through a.setPrintTrace.
 //
-// It also ensures execution is stopped if the given instruction has a breakpoint
-// associated with it. This only happens if a.config.Debug is true.
+// It is called on the cpu goroutine.
 func (a *App) debugHandler(i *cpu.Instruction) {
-	var dbg *ar.DebugData
-
-	// Pause execution if we are in debug mode and this instruction has a breakpoint.
-	if a.config.Debug {
-		dbg = a.debug.Find(i.IP)
-		if dbg != nil && dbg.Flags&ar.Breakpoint != 0 {
-			a.cpu.Stop()
-		}
-	}
-
-	// Print instruction trace data if applicable.
-	if !a.config.PrintTrace {
+	if !a.isPrintTrace() {
 		return
 	}
 
-	var sb strings.Builder
-	sb.Grow(120)
-
-	name, _ := arch.Name(i.Opcode)
-	argc := arch.Argc(i.Opcode)
-
-	for j := 0; j < argc; j++ {
-		argv := i.Args[j]
-		_type := argv.Type.Name()
-
-		switch argv.Mode {
-		case arch.ImmediateConstant:
-			fmt.Fprintf(&sb, "%3s %04x", _type, argv.Value)
-		case arch.IndirectConstant:
-			fmt.Fprintf(&sb, "%3s %04x %04x", _type, argv.Address, argv.Value)
-		case arch.ImmediateRegister:
-			index := (argv.Address - cpu.UserMemoryCapacity) / 2
-			fmt.Fprintf(&sb, "%3s %4s %04x", _type, arch.RegisterName(index), argv.Value)
-		case arch.IndirectRegister:
-			fmt.Fprintf(&sb, "%3s %04x %04x", _type, argv.Address, argv.Value)
-		}
+	debug := a.debug.Load().(*ar.Debug)
+	fmt.Println(vm.FormatTrace(i, debug.Find(i.IP), debug.Files))
+}
 
-		if j < argc-1 {
-			fmt.Fprintf(&sb, ", ")
-		}
-	}
+// isDebug returns true if we are in debug mode.
+// It is safe to call from any goroutine.
+func (a *App) isDebug() bool {
+	return atomic.LoadUint32(&a.debugMode) != 0
+}
 
-	// Add source context of it is available.
-	if dbg != nil {
-		pad(&sb, 50)
-		file := a.debug.Files[dbg.File]
-		if len(file) > 0 {
-			fmt.Fprintf(&sb, " %s:%d:%d", file, dbg.Line, dbg.Col)
-		}
-	}
+// setDebug enables or disables debug mode.
+func (a *App) setDebug(v bool) {
+	atomic.StoreUint32(&a.debugMode, boolToUint32(v))
+}
+
+// isPrintTrace returns true if instruction trace data is printed.
+// It is safe to call from any goroutine.
+func (a *App) isPrintTrace() bool {
+	return atomic.LoadUint32(&a.printTrace) != 0
+}
 
-	fmt.Printf("%04x %5s  %s\n", i.IP, name, sb.String())
+// setPrintTrace enables or disables printing of instruction trace data.
+func (a *App) setPrintTrace(v bool) {
+	atomic.StoreUint32(&a.printTrace, boolToUint32(v))
+}
+
+func boolToUint32(v bool) uint32 {
+	if v {
+		return 1
+	}
+	return 0
 }
 
 // printHelp writes a short voerview of supported shortcut keys to stdout.
@@ -335,28 +469,16 @@ func printHelp() {
 	sb.WriteString(" F5       (re)load the program from disk and reset the cpu.\n")
 	sb.WriteString(" Q        Start/Stop program execution.\n")
 	sb.WriteString(" E        Perform a single execution step.\n")
+	sb.WriteString(" R        Undo a single execution step.\n")
+	sb.WriteString(" Shift+R  Rewind execution by the number of steps set with -rewind.\n")
 	sb.WriteString(" D        Enable/Disable debug trace output.\n")
+	sb.WriteString(" F12      Save a screenshot of the display.\n")
+	sb.WriteString(" N        Load the machine state from save slot N (0-9).\n")
+	sb.WriteString(" Shift+N  Save the machine state to save slot N (0-9).\n")
 	sb.WriteString(" V        Enable/Disable VSync.")
 	log.Println(sb.String())
 }
 
-// pad padds sb with spaces until it reaches the given size.
-var pad = func() func(*strings.Builder, int) {
-	set := strings.Repeat(" ", 80)
-	return func(sb *strings.Builder, size int) {
-		if sb.Len() >= size {
-			return
-		}
-		if size > len(set) {
-			size = len(set)
-		}
-		if size < sb.Len() {
-			size = sb.Len()
-		}
-		sb.WriteString(set[:size-sb.Len()])
-	}
-}()
-
 // prettyFrequency returns a human-readable version of the given clock frequency in herz.
 func prettyFrequency(v float64) string {
 	switch {
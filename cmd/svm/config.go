@@ -4,16 +4,28 @@ import (
 	"flag"
 	"fmt"
 	"os"
+
+	"github.com/hexaflex/svm/devices/fffe/cpu"
+	"github.com/hexaflex/svm/vm"
 )
 
 // Config defines program configuration.
 type Config struct {
-	Image       string // Path to the image file to load.
-	ScaleFactor int    // Amount by which each pixel is scaled (virtual resolution)
-	Fullscreen  bool   // Run in fullscreen?
-	Debug       bool   // Enable debug mode? This handles breakpoints if enabled.
-	PrintTrace  bool   // Print instruction trace data?
-	Readonly    bool   // Is the image read-only?
+	Image         string       // Path to the image file to load.
+	ScaleFactor   int          // Amount by which each pixel is scaled (virtual resolution)
+	Fullscreen    bool         // Run in fullscreen?
+	Debug         bool         // Enable debug mode? This handles breakpoints if enabled.
+	PrintTrace    bool         // Print instruction trace data?
+	Readonly      bool         // Is the image read-only?
+	Screenshots   string       // Directory in which screenshots are stored.
+	DumpFrames    string       // Directory in which every swapped display frame is stored. Empty means disabled.
+	LoadState     string       // Save state file to restore after the program has been loaded.
+	Deterministic bool         // Run in deterministic mode?
+	Seed          int64        // RNG seed for deterministic mode.
+	ClockRate     vm.ClockRate // Target cpu frequency. Zero means unbounded.
+	GDB           string       // Address on which GDB remote serial protocol clients are accepted. Empty means disabled.
+	History       int          // Number of executed instructions which can be undone. Zero means disabled.
+	Rewind        int          // Number of instructions undone by a single rewind.
 }
 
 // parseArgs parses command line arguments as applicable.
@@ -26,6 +38,9 @@ func parseArgs() *Config {
 	c.Fullscreen = false
 	c.Debug = false
 	c.PrintTrace = false
+	c.Screenshots = "."
+	c.Seed = cpu.DefaultSeed
+	c.Rewind = 10000
 
 	flag.Usage = func() {
 		fmt.Printf("%s [options] <image file>\n", os.Args[0])
@@ -36,6 +51,15 @@ func parseArgs() *Config {
 	flag.BoolVar(&c.Readonly, "readonly", c.Readonly, "Is the loaded image file write protected?")
 	flag.IntVar(&c.ScaleFactor, "scale-factor", c.ScaleFactor, "Pixel scale factor for the display.")
 	flag.BoolVar(&c.Fullscreen, "fullscreen", c.Fullscreen, "Run the display in fullscreen or windowed mode.")
+	flag.StringVar(&c.Screenshots, "screenshot-dir", c.Screenshots, "Directory in which screenshots are stored.")
+	flag.Var(&c.ClockRate, "clock", "Target cpu frequency. E.g.: 1MHz, 250KHz. 0 means unbounded.")
+	flag.BoolVar(&c.Deterministic, "deterministic", c.Deterministic, "Use a virtual clock driven by executed cycles and a fixed RNG seed.")
+	flag.Int64Var(&c.Seed, "seed", c.Seed, "RNG seed used in deterministic mode.")
+	flag.StringVar(&c.LoadState, "load-state", c.LoadState, "Restore the machine state from this file after loading the program.")
+	flag.StringVar(&c.DumpFrames, "dump-frames", c.DumpFrames, "Write every swapped display frame as a numbered PNG file to this directory.")
+	flag.IntVar(&c.History, "history", c.History, "Number of executed instructions which can be undone. 0 disables rewinding.")
+	flag.IntVar(&c.Rewind, "rewind", c.Rewind, "Number of instructions undone by Shift+R.")
+	flag.StringVar(&c.GDB, "gdb", c.GDB, "Let a GDB client control execution through this address. E.g.: localhost:1234 or unix:/tmp/svm.sock")
 
 	version := flag.Bool("version", false, "Display version information.")
 	flag.Parse()
@@ -0,0 +1,169 @@
+package devices
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for the cpu and its peripherals.
+//
+// RealClock follows the wall clock. VirtualClock only moves forward as the
+// cpu executes instructions. The latter makes program execution fully
+// deterministic.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+
+	// Sleep pauses the caller for the given duration.
+	Sleep(d time.Duration)
+
+	// AfterFunc calls f once the given duration has elapsed.
+	// The returned timer can be used to cancel the call.
+	AfterFunc(d time.Duration, f func()) Timer
+
+	// Tick is called by the cpu after it has executed the given number of cycles.
+	Tick(cycles int)
+}
+
+// Timer represents a single pending call created by Clock.AfterFunc.
+type Timer interface {
+	// Stop prevents the timer from firing. Returns false if the
+	// timer has already fired or has been stopped.
+	Stop() bool
+}
+
+// Clocked is implemented by devices which need access to the system clock.
+// The cpu hands its clock to these devices before starting them up.
+type Clocked interface {
+	SetClock(Clock)
+}
+
+// RealClock is a clock which follows the wall clock.
+type RealClock struct{}
+
+var _ Clock = RealClock{}
+
+// Now returns the current time.
+func (RealClock) Now() time.Time { return time.Now() }
+
+// Sleep pauses the caller for the given duration.
+func (RealClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// AfterFunc calls f in its own goroutine once the given duration has elapsed.
+func (RealClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
+
+// Tick does nothing. Wall clock time passes regardless of what the cpu does.
+func (RealClock) Tick(int) {}
+
+// VirtualClock is a clock which only moves forward when the cpu executes
+// cycles, or when something sleeps on it. Timers fire synchronously, on the
+// goroutine which advances the clock. Timers which are due at the same time
+// fire in the order in which they were created.
+//
+// Its time starts at the Unix epoch.
+type VirtualClock struct {
+	m      sync.Mutex
+	now    time.Duration   // Time elapsed since the epoch.
+	cycle  time.Duration   // Duration of a single cpu cycle.
+	timers []*virtualTimer // Pending timers, ordered by deadline.
+}
+
+var _ Clock = &VirtualClock{}
+
+// NewVirtualClock creates a new virtual clock for a cpu running at the given
+// frequency in herz.
+func NewVirtualClock(frequency int) *VirtualClock {
+	if frequency < 1 {
+		frequency = 1
+	}
+
+	return &VirtualClock{
+		cycle: time.Second / time.Duration(frequency),
+	}
+}
+
+// Now returns the current time.
+func (c *VirtualClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return time.Unix(0, int64(c.now)).UTC()
+}
+
+// Sleep advances the clock by the given duration, firing any timers which
+// fall due in the meantime.
+func (c *VirtualClock) Sleep(d time.Duration) {
+	c.advance(d)
+}
+
+// Tick advances the clock by the duration of the given number of cycles.
+func (c *VirtualClock) Tick(cycles int) {
+	c.advance(time.Duration(cycles) * c.cycle)
+}
+
+// AfterFunc calls f once the clock has advanced by the given duration.
+func (c *VirtualClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	t := &virtualTimer{
+		clock:    c,
+		deadline: c.now + d,
+		f:        f,
+	}
+
+	index := sort.Search(len(c.timers), func(i int) bool {
+		return c.timers[i].deadline > t.deadline
+	})
+
+	c.timers = append(c.timers, nil)
+	copy(c.timers[index+1:], c.timers[index:])
+	c.timers[index] = t
+	return t
+}
+
+// advance moves the clock forward by d and fires all timers which become due.
+func (c *VirtualClock) advance(d time.Duration) {
+	c.m.Lock()
+	target := c.now + d
+
+	for len(c.timers) > 0 && c.timers[0].deadline <= target {
+		t := c.timers[0]
+		c.timers = c.timers[1:]
+		c.now = t.deadline
+
+		// Timer functions may well create new timers.
+		c.m.Unlock()
+		t.f()
+		c.m.Lock()
+	}
+
+	c.now = target
+	c.m.Unlock()
+}
+
+// remove removes t from the pending timers.
+// Returns false if it was not pending.
+func (c *VirtualClock) remove(t *virtualTimer) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for i, v := range c.timers {
+		if v == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+type virtualTimer struct {
+	clock    *VirtualClock
+	deadline time.Duration
+	f        func()
+}
+
+func (t *virtualTimer) Stop() bool {
+	return t.clock.remove(t)
+}
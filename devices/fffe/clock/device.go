@@ -2,6 +2,9 @@
 package clock
 
 import (
+	"encoding/binary"
+	"io"
+	"sync"
 	"time"
 
 	"github.com/hexaflex/svm/devices"
@@ -17,18 +20,26 @@ const (
 
 // Device defines all internal doodads for the display.
 type Device struct {
-	intFunc  devices.IntFunc    // Hardware interrupt handler.
-	start    time.Time          // Startup time.
-	endPoll  chan struct{}      // poll exit signaller.
-	newTimer chan time.Duration // new timer channel.
-	intID    int                // interrupt Id.
+	m        sync.Mutex
+	clock    devices.Clock   // Time source.
+	intFunc  devices.IntFunc // Hardware interrupt handler.
+	start    time.Time       // Startup time.
+	timer    devices.Timer   // Pending timer tick. Nil if no timer is running.
+	intID    int             // interrupt Id.
+	interval time.Duration   // Current timer interval. Zero if no timer is running.
 }
 
-var _ devices.Device = &Device{}
+var (
+	_ devices.Device   = &Device{}
+	_ devices.Clocked  = &Device{}
+	_ devices.Stateful = &Device{}
+)
 
 // New creates a new device instance.
 func New() *Device {
-	return &Device{}
+	return &Device{
+		clock: devices.RealClock{},
+	}
 }
 
 // ID returns the device id.
@@ -36,23 +47,31 @@ func (d *Device) ID() devices.ID {
 	return devices.NewID(0xfffe, 0x0005)
 }
 
+// SetClock sets the time source for the device.
+func (d *Device) SetClock(clock devices.Clock) {
+	d.clock = clock
+}
+
 // Startup initializes device resources.
 func (d *Device) Startup(f devices.IntFunc) error {
+	d.m.Lock()
 	d.intFunc = f
-	d.start = time.Now()
+	d.start = d.clock.Now()
 	d.intID = 0
-	d.endPoll = make(chan struct{}, 1)
-	d.newTimer = make(chan time.Duration, 1)
-	go d.poll()
+	d.m.Unlock()
+
+	d.setTimer(0)
 	return nil
 }
 
 // Shutdown clears device resources.
 func (d *Device) Shutdown() error {
-	close(d.endPoll)
+	d.setTimer(0)
 
+	d.m.Lock()
 	d.intFunc = nil
 	d.intID = 0
+	d.m.Unlock()
 
 	return nil
 }
@@ -61,32 +80,92 @@ func (d *Device) Shutdown() error {
 func (d *Device) Int(mem devices.Memory) {
 	switch mem.U16(cpu.R0) {
 	case SetIntID:
+		d.m.Lock()
 		d.intID = mem.U16(cpu.R1)
+		d.m.Unlock()
 	case Uptime:
-		ms := int(time.Since(d.start).Milliseconds())
+		ms := int(d.clock.Now().Sub(d.start).Milliseconds())
 		addr := mem.U16(cpu.R1)
 		mem.SetU16(addr, (ms>>16)&0xffff)
 		mem.SetU16(addr+2, (ms & 0xffff))
 	case SetTimer:
-		d.newTimer <- time.Millisecond * time.Duration(mem.U16(cpu.R1))
+		d.setTimer(time.Millisecond * time.Duration(mem.U16(cpu.R1)))
+	}
+}
+
+// SaveState writes the interrupt id, timer interval and uptime to w.
+func (d *Device) SaveState(w io.Writer) error {
+	d.m.Lock()
+	s := state{
+		IntID:    uint16(d.intID),
+		Interval: int64(d.interval),
+		Uptime:   int64(d.clock.Now().Sub(d.start)),
 	}
+	d.m.Unlock()
+
+	return binary.Write(w, binary.LittleEndian, &s)
 }
 
-// poll triggers periodic hardware interrupts if a timer is running.
-func (d *Device) poll() {
-	timer := time.NewTicker(time.Minute * 1e6)
-	defer timer.Stop()
+// LoadState restores the interrupt id, timer interval and uptime from r.
+// The timer is restarted with the restored interval, or stopped if there was none.
+func (d *Device) LoadState(r io.Reader) error {
+	var s state
+	if err := binary.Read(r, binary.LittleEndian, &s); err != nil {
+		return err
+	}
+
+	d.m.Lock()
+	d.intID = int(s.IntID)
+	d.start = d.clock.Now().Add(-time.Duration(s.Uptime))
+	d.m.Unlock()
+
+	d.setTimer(time.Duration(s.Interval))
+	return nil
+}
 
-	for {
-		select {
-		case <-d.endPoll:
+// state defines the device state as it is stored in a snapshot.
+type state struct {
+	IntID    uint16
+	Interval int64 // Timer interval in nanoseconds.
+	Uptime   int64 // Time since startup in nanoseconds.
+}
+
+// setTimer replaces the current timer with one which triggers hardware
+// interrupts at the given interval. An interval of zero stops the timer.
+func (d *Device) setTimer(interval time.Duration) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+
+	d.interval = interval
+	if interval > 0 {
+		d.schedule()
+	}
+}
+
+// schedule sets up the next timer tick. The caller must hold the lock.
+func (d *Device) schedule() {
+	var timer devices.Timer
+	timer = d.clock.AfterFunc(d.interval, func() {
+		d.m.Lock()
+
+		// The timer may have been replaced while this call was pending.
+		if d.timer != timer {
+			d.m.Unlock()
 			return
-		case interval := <-d.newTimer:
-			timer = time.NewTicker(interval)
-		case <-timer.C:
-			if d.intID > 0 {
-				d.intFunc(d.intID)
-			}
 		}
-	}
+
+		d.schedule()
+		intFunc, intID := d.intFunc, d.intID
+		d.m.Unlock()
+
+		if intFunc != nil && intID > 0 {
+			intFunc(intID)
+		}
+	})
+	d.timer = timer
 }
@@ -0,0 +1,267 @@
+package cpu
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hexaflex/svm/arch"
+)
+
+// Condition decides if a breakpoint or watchpoint stops execution.
+// It is given the current memory contents, including registers.
+type Condition func(Memory) bool
+
+// Access defines the kinds of memory access a watchpoint reacts to.
+type Access int
+
+// Known access kinds.
+const (
+	Read      Access = 1 << iota // The program reads from memory.
+	Write                        // The program writes to memory.
+	ReadWrite = Read | Write
+)
+
+func (a Access) String() string {
+	switch a {
+	case Read:
+		return "read"
+	case Write:
+		return "write"
+	case ReadWrite:
+		return "read/write"
+	}
+	return "none"
+}
+
+// Watchpoint stops execution when the program accesses a range of memory.
+// Registers can be watched through their addresses (R0, R1, etc).
+type Watchpoint struct {
+	Address   int       // Start of the memory range.
+	Size      int       // Size of the memory range in bytes.
+	Access    Access    // Kinds of access which trigger the watchpoint.
+	Condition Condition // Optional condition. Checked after a write took place.
+}
+
+// Break is returned by Step when execution reaches a breakpoint or
+// triggers a watchpoint.
+//
+// A breakpoint stops execution before the instruction at its address is
+// executed. A watchpoint stops execution after the instruction accessing
+// the memory has been executed.
+type Break struct {
+	IP         int         // Address of the instruction.
+	Watchpoint *Watchpoint // The triggered watchpoint. Nil for breakpoints.
+	Address    int         // Accessed memory address for watchpoints.
+	Access     Access      // Kind of memory access for watchpoints.
+}
+
+func (b *Break) Error() string {
+	if b.Watchpoint == nil {
+		return fmt.Sprintf("breakpoint at %04x", b.IP)
+	}
+	return fmt.Sprintf("watchpoint: %s of %04x by instruction at %04x", b.Access, b.Address, b.IP)
+}
+
+// breakpoint defines an entry in the breakpoint table.
+type breakpoint struct {
+	cond Condition
+}
+
+// SetBreakpoint sets a breakpoint at the given address. If cond is not nil,
+// it only stops execution if cond returns true. This replaces any existing
+// breakpoint at the same address.
+func (c *CPU) SetBreakpoint(addr int, cond Condition) {
+	if addr < 0 || addr >= UserMemoryCapacity {
+		return
+	}
+
+	if c.breakpoints == nil {
+		c.breakpoints = make([]*breakpoint, UserMemoryCapacity)
+	}
+
+	c.breakpoints[addr] = &breakpoint{cond: cond}
+}
+
+// ClearBreakpoint removes the breakpoint at the given address.
+// Returns false if there was none.
+func (c *CPU) ClearBreakpoint(addr int) bool {
+	if c.breakpoints == nil || addr < 0 || addr >= UserMemoryCapacity || c.breakpoints[addr] == nil {
+		return false
+	}
+
+	c.breakpoints[addr] = nil
+	return true
+}
+
+// ClearBreakpoints removes all breakpoints.
+func (c *CPU) ClearBreakpoints() {
+	c.breakpoints = nil
+}
+
+// Breakpoints returns the addresses of all breakpoints in ascending order.
+func (c *CPU) Breakpoints() []int {
+	var out []int
+	for addr, bp := range c.breakpoints {
+		if bp != nil {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// AddWatchpoint adds the given watchpoint.
+func (c *CPU) AddWatchpoint(w *Watchpoint) {
+	c.watchpoints = append(c.watchpoints, w)
+	c.updateWatchTable()
+}
+
+// RemoveWatchpoint removes the given watchpoint.
+// Returns false if it was not added before.
+func (c *CPU) RemoveWatchpoint(w *Watchpoint) bool {
+	for i, v := range c.watchpoints {
+		if v == w {
+			copy(c.watchpoints[i:], c.watchpoints[i+1:])
+			c.watchpoints = c.watchpoints[:len(c.watchpoints)-1]
+			c.updateWatchTable()
+			return true
+		}
+	}
+	return false
+}
+
+// ClearWatchpoints removes all watchpoints.
+func (c *CPU) ClearWatchpoints() {
+	c.watchpoints = nil
+	c.updateWatchTable()
+}
+
+// Watchpoints returns all watchpoints, sorted by address.
+func (c *CPU) Watchpoints() []*Watchpoint {
+	out := append([]*Watchpoint(nil), c.watchpoints...)
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].Address < out[j].Address
+	})
+	return out
+}
+
+// Resume makes the next Step execute the current instruction, even if
+// there is a breakpoint at its address. Step does this by itself after
+// it returned a breakpoint.
+func (c *CPU) Resume() {
+	c.resume = c.memory.U16(RIP)
+}
+
+// updateWatchTable rebuilds the table which holds the kinds of access
+// watched for each address.
+func (c *CPU) updateWatchTable() {
+	if len(c.watchpoints) == 0 {
+		c.watchTable = nil
+		return
+	}
+
+	c.watchTable = make([]Access, MemoryCapacity)
+	for _, w := range c.watchpoints {
+		for addr := w.Address; addr < w.Address+w.Size && addr < MemoryCapacity; addr++ {
+			if addr >= 0 {
+				c.watchTable[addr] |= w.Access
+			}
+		}
+	}
+}
+
+// checkBreakpoint returns a Break if there is a breakpoint at the given
+// instruction address and its condition holds.
+func (c *CPU) checkBreakpoint(ip int) error {
+	resume := c.resume
+	c.resume = -1
+
+	if c.breakpoints == nil || ip == resume {
+		return nil
+	}
+
+	bp := c.breakpoints[ip]
+	if bp == nil || (bp.cond != nil && !bp.cond(c.memory)) {
+		return nil
+	}
+
+	c.resume = ip
+	return &Break{IP: ip}
+}
+
+// watch records a watchpoint hit if the given memory access triggers one.
+// Only the first hit during an instruction is recorded.
+func (c *CPU) watch(addr, size int, access Access) {
+	if c.watchTable == nil || c.hit != nil {
+		return
+	}
+
+	var watched bool
+	for i := addr; i < addr+size && i < MemoryCapacity; i++ {
+		if c.watchTable[i]&access != 0 {
+			watched = true
+			break
+		}
+	}
+
+	if !watched {
+		return
+	}
+
+	for _, w := range c.watchpoints {
+		if w.Access&access == 0 || addr+size <= w.Address || addr >= w.Address+w.Size {
+			continue
+		}
+
+		if w.Condition != nil && !w.Condition(c.memory) {
+			continue
+		}
+
+		c.hit = &Break{
+			IP:         c.instr.IP,
+			Watchpoint: w,
+			Address:    addr,
+			Access:     access,
+		}
+		return
+	}
+}
+
+// watchOperands records watchpoint hits for operands the current
+// instruction reads from.
+func (c *CPU) watchOperands() {
+	if c.watchTable == nil {
+		return
+	}
+
+	instr := &c.instr
+	argc := arch.Argc(instr.Opcode)
+
+	for i := 0; i < argc; i++ {
+		op := &instr.Args[i]
+		if op.Mode == arch.ImmediateConstant || (i == 0 && writesOnly(instr.Opcode)) {
+			continue
+		}
+		c.watch(op.Address, typeSize(op.Type), Read)
+	}
+}
+
+// writesOnly returns true if the given instruction writes to its first
+// operand, without reading it.
+func writesOnly(opcode int) bool {
+	switch opcode {
+	case arch.MOV, arch.POP, arch.ADD, arch.SUB, arch.MUL, arch.DIV, arch.MOD,
+		arch.SHL, arch.SHR, arch.AND, arch.OR, arch.XOR, arch.ABS, arch.POW,
+		arch.RNG, arch.HWA, arch.ADC, arch.SBC, arch.WMUL:
+		return true
+	}
+	return false
+}
+
+// typeSize returns the size in bytes of values with the given type.
+func typeSize(t arch.Type) int {
+	switch t {
+	case arch.U8, arch.I8:
+		return 1
+	}
+	return 2
+}
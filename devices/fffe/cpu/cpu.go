@@ -17,19 +17,33 @@ import (
 // IntQueueCapacity capacity of the CPU interrupt queue.
 const IntQueueCapacity = 32
 
+// DefaultSeed is the RNG seed used in deterministic mode, unless another one is given.
+const DefaultSeed = 0x5356
+
 // TraceFunc represents a callback handler for debug trace output.
 type TraceFunc func(*Instruction)
 
 // CPU implements the runtime.
 type CPU struct {
-	devices      devices.Map // Connected peripherals.
-	trace        TraceFunc   // Handler for debug trace output.
-	memory       Memory      // System memory.
-	instr        Instruction // Decoded instruction data.
-	rng          *rand.Rand  // Random number generator.
-	intQueue     chan int    // Hardware interrupt queue.
-	initialized  uint32      // Is there a valid program loaded?
-	inIntHandler bool        // Is the CPU currently executing an interrupt handler?
+	devices      devices.Map   // Connected peripherals.
+	trace        TraceFunc     // Handler for debug trace output.
+	memory       Memory        // System memory.
+	instr        Instruction   // Decoded instruction data.
+	rng          *rand.Rand    // Random number generator.
+	src          *source       // Source for rng. It tracks the RNG state for snapshots.
+	seed         int64         // RNG seed applied at startup. Zero means a time-based seed.
+	clock        devices.Clock // Time source for the cpu and its peripherals.
+	intQueue     chan int      // Hardware interrupt queue.
+	cycles       uint64        // Number of cycles executed since startup.
+	initialized  uint32        // Is there a valid program loaded?
+	inIntHandler bool          // Is the CPU currently executing an interrupt handler?
+	breakpoints  []*breakpoint // Breakpoints, indexed by address. Nil if there are none.
+	watchpoints  []*Watchpoint // Memory watchpoints.
+	watchTable   []Access      // Watched access kinds, indexed by address. Nil if there are no watchpoints.
+	hit          *Break        // Watchpoint triggered by the current instruction.
+	resume       int           // Address at which a breakpoint is ignored by the next step.
+	history      history       // Undo log for the most recent steps.
+	recording    uint32        // Is the history enabled? 1 if true.
 }
 
 // New creates a new CPU for the given program.
@@ -39,14 +53,42 @@ func New(trace TraceFunc) *CPU {
 		trace = func(*Instruction) { /* nop */ }
 	}
 
+	src := newSource(time.Now().UnixNano())
+
 	return &CPU{
 		trace:    trace,
 		memory:   make(Memory, MemoryCapacity),
-		rng:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		rng:      rand.New(src),
+		src:      src,
+		clock:    devices.RealClock{},
 		intQueue: make(chan int, IntQueueCapacity),
+		resume:   -1,
 	}
 }
 
+// Cycles returns the number of cycles executed since startup.
+func (c *CPU) Cycles() uint64 {
+	return c.cycles
+}
+
+// SetClock sets the clock used by the cpu and the peripherals which
+// implement devices.Clocked. It takes effect at the next Startup.
+func (c *CPU) SetClock(clock devices.Clock) {
+	c.clock = clock
+}
+
+// Clock returns the clock used by the cpu.
+func (c *CPU) Clock() devices.Clock {
+	return c.clock
+}
+
+// SetSeed sets a fixed seed for the random number generator. The generator
+// is reset with it at every Startup. A seed of zero means the time at
+// startup is used instead.
+func (c *CPU) SetSeed(seed int64) {
+	c.seed = seed
+}
+
 // ID returns the cpu's device Id.
 func (c *CPU) ID() devices.ID {
 	return devices.NewID(0xfffe, 0x0001)
@@ -79,6 +121,22 @@ func (c *CPU) Startup() error {
 	c.memory.SetU16(RSP, UserMemoryCapacity-2)
 	c.memory.SetU8(RST, 0)
 	c.inIntHandler = false
+	c.cycles = 0
+	c.resume = -1
+	c.hit = nil
+	c.clearHistory()
+
+	if c.seed != 0 {
+		c.rng.Seed(c.seed)
+	} else {
+		c.rng.Seed(time.Now().UnixNano())
+	}
+
+	for _, dev := range c.devices {
+		if cd, ok := dev.(devices.Clocked); ok {
+			cd.SetClock(c.clock)
+		}
+	}
 
 	return c.devices.Startup(c.queueInterrupt)
 }
@@ -95,6 +153,17 @@ func (c *CPU) Shutdown() error {
 // Step performs a single execution step.
 // Returns io.EOF if the program has reached its end
 // or no program is loaded.
+//
+// If the history is enabled, the step is recorded and can be undone
+// with StepBack. See SetHistory.
+//
+// Returns a *Break if the instruction has a breakpoint, without executing
+// it, or if it triggered a watchpoint. Execution can be resumed by calling
+// Step again.
+//
+// Pending interrupts are handled after the instruction is executed. RIP
+// then always refers to the instruction executed by the next step, which
+// may be the start of an interrupt handler.
 func (c *CPU) Step() error {
 	if atomic.LoadUint32(&c.initialized) == 0 {
 		return io.EOF
@@ -106,60 +175,95 @@ func (c *CPU) Step() error {
 	instr := &c.instr
 	args := instr.Args[:]
 
+	if err := c.checkBreakpoint(mem.U16(RIP)); err != nil {
+		return err
+	}
+
+	c.beginStep()
+
 	if err := instr.Decode(mem); err != nil {
 		return err
 	}
 
+	c.hit = nil
+	c.watchOperands()
+
 	c.trace(instr)
+	c.cycles += uint64(instr.Cycles)
+	c.clock.Tick(instr.Cycles)
 
 	switch instr.Opcode {
 	case arch.MOV:
 		va := args[0].Address
 		vb := args[1].Value
-		setVal(mem, args[0].Type, va, vb)
+		c.setVal(args[0].Type, va, vb)
 
 	case arch.PUSH:
 		c.push(args[0].Value)
 	case arch.POP:
-		setVal(mem, args[0].Type, args[0].Address, c.pop())
+		c.setVal(args[0].Type, args[0].Address, c.pop())
 
 	case arch.INC:
 		va := args[0].Address
 		vb := args[0].Value + 1
 		min, max := args[0].Type.Limits()
 		mem.SetRSTOverflow(vb < min || vb > max)
-		setVal(mem, args[0].Type, va, vb)
+		c.setVal(args[0].Type, va, vb)
 	case arch.DEC:
 		va := args[0].Address
 		vb := args[0].Value - 1
 		min, max := args[0].Type.Limits()
 		mem.SetRSTOverflow(vb < min || vb > max)
-		setVal(mem, args[0].Type, va, vb)
+		c.setVal(args[0].Type, va, vb)
 	case arch.ADD:
 		va := args[0].Address
 		vb := args[1].Value + args[2].Value
 		min, max := args[0].Type.Limits()
 		mem.SetRSTOverflow(vb < min || vb > max)
-		setVal(mem, args[0].Type, va, vb)
+		mem.SetRSTCarry(addCarry(args[0].Type, args[1].Value, args[2].Value, 0))
+		c.setVal(args[0].Type, va, vb)
 	case arch.SUB:
 		va := args[0].Address
 		vb := args[1].Value - args[2].Value
 		min, max := args[0].Type.Limits()
 		mem.SetRSTOverflow(vb < min || vb > max)
-		setVal(mem, args[0].Type, va, vb)
+		mem.SetRSTCarry(subBorrow(args[0].Type, args[1].Value, args[2].Value, 0))
+		c.setVal(args[0].Type, va, vb)
+	case arch.ADC:
+		va := args[0].Address
+		vc := carryValue(mem)
+		vb := args[1].Value + args[2].Value + vc
+		min, max := args[0].Type.Limits()
+		mem.SetRSTOverflow(vb < min || vb > max)
+		mem.SetRSTCarry(addCarry(args[0].Type, args[1].Value, args[2].Value, vc))
+		c.setVal(args[0].Type, va, vb)
+	case arch.SBC:
+		va := args[0].Address
+		vc := carryValue(mem)
+		vb := args[1].Value - args[2].Value - vc
+		min, max := args[0].Type.Limits()
+		mem.SetRSTOverflow(vb < min || vb > max)
+		mem.SetRSTCarry(subBorrow(args[0].Type, args[1].Value, args[2].Value, vc))
+		c.setVal(args[0].Type, va, vb)
 	case arch.MUL:
 		va := args[0].Address
 		vb := args[1].Value * args[2].Value
 		min, max := args[0].Type.Limits()
 		mem.SetRSTOverflow(vb < min || vb > max)
-		setVal(mem, args[0].Type, va, vb)
+		c.setVal(args[0].Type, va, vb)
+	case arch.WMUL:
+		// The high word has the same width as the low word in x.
+		vb := args[1].Value * args[2].Value
+		bits := uint(typeSize(args[0].Type) * 8)
+		c.setVal(args[0].Type, args[0].Address, vb)
+		c.setVal(args[1].Type, args[1].Address, vb>>bits)
 	case arch.DIV:
 		if args[2].Value == 0 {
 			mem.SetRSTDivideByZero(true)
 		} else {
 			va := args[0].Address
 			vb := args[1].Value / args[2].Value
-			setVal(mem, args[0].Type, va, vb)
+			c.setVal(args[0].Type, va, vb)
 			mem.SetRSTDivideByZero(false)
 		}
 	case arch.MOD:
@@ -168,33 +272,33 @@ func (c *CPU) Step() error {
 		} else {
 			va := args[0].Address
 			vb := args[1].Value % args[2].Value
-			setVal(mem, args[0].Type, va, vb)
+			c.setVal(args[0].Type, va, vb)
 			mem.SetRSTDivideByZero(false)
 		}
 	case arch.SHL:
 		va := args[0].Address
 		vb := args[1].Value << uint(args[2].Value)
-		setVal(mem, args[0].Type, va, vb)
+		c.setVal(args[0].Type, va, vb)
 	case arch.SHR:
 		va := args[0].Address
 		vb := args[1].Value >> uint(args[2].Value)
-		setVal(mem, args[0].Type, va, vb)
+		c.setVal(args[0].Type, va, vb)
 	case arch.AND:
 		va := args[0].Address
 		vb := args[1].Value & args[2].Value
-		setVal(mem, args[0].Type, va, vb)
+		c.setVal(args[0].Type, va, vb)
 	case arch.OR:
 		va := args[0].Address
 		vb := args[1].Value | args[2].Value
-		setVal(mem, args[0].Type, va, vb)
+		c.setVal(args[0].Type, va, vb)
 	case arch.XOR:
 		va := args[0].Address
 		vb := args[1].Value ^ args[2].Value
-		setVal(mem, args[0].Type, va, vb)
+		c.setVal(args[0].Type, va, vb)
 	case arch.ABS:
 		va := args[0].Address
 		vb := int(math.Abs(float64(args[1].Value)))
-		setVal(mem, args[0].Type, va, vb)
+		c.setVal(args[0].Type, va, vb)
 	case arch.POW:
 		va := args[0].Address
 		vb := float64(args[1].Value)
@@ -202,7 +306,7 @@ func (c *CPU) Step() error {
 		vd := int(math.Pow(vb, vc))
 		min, max := args[0].Type.Limits()
 		mem.SetRSTOverflow(vd < min || vd > max)
-		setVal(mem, args[0].Type, va, vd)
+		c.setVal(args[0].Type, va, vd)
 
 	case arch.RNG:
 		va := args[0].Address
@@ -212,12 +316,12 @@ func (c *CPU) Step() error {
 			mem.SetRSTOverflow(true)
 		} else {
 			mem.SetRSTOverflow(false)
-			setVal(mem, args[0].Type, va, vb+c.rng.Intn(vc-vb))
+			c.setVal(args[0].Type, va, vb+c.rng.Intn(vc-vb))
 		}
 
 	case arch.SEED:
 		va := args[0].Value
-		c.rng = rand.New(rand.NewSource(int64(va)))
+		c.rng.Seed(int64(va))
 
 	case arch.CEQ:
 		mem.SetRSTCompare(args[0].Value == args[1].Value)
@@ -243,29 +347,23 @@ func (c *CPU) Step() error {
 			mem.SetU16(RIP, args[0].Value)
 		}
 	case arch.CALL:
-		rsp := mem.U16(RSP)
-		mem.SetU16(RSP, rsp-2)
-		mem.SetU16(rsp, mem.U16(RIP))
+		c.push(mem.U16(RIP))
 		mem.SetU16(RIP, args[0].Value)
 	case arch.CLEZ:
 		if !mem.RSTCompare() {
-			rsp := mem.U16(RSP)
-			mem.SetU16(RSP, rsp-2)
-			mem.SetU16(rsp, mem.U16(RIP))
+			c.push(mem.U16(RIP))
 			mem.SetU16(RIP, args[0].Value)
 		}
 	case arch.CLNZ:
 		if mem.RSTCompare() {
-			rsp := mem.U16(RSP)
-			mem.SetU16(RSP, rsp-2)
-			mem.SetU16(rsp, mem.U16(RIP))
+			c.push(mem.U16(RIP))
 			mem.SetU16(RIP, args[0].Value)
 		}
 	case arch.RET:
 		mem.SetU16(RIP, c.pop())
 	case arch.IRET:
 		c.inIntHandler = false
-		setVal(mem, args[0].Type, R0, c.pop())
+		c.setVal(args[0].Type, R0, c.pop())
 		mem.SetU16(RIP, c.pop())
 
 	case arch.HWA:
@@ -274,24 +372,38 @@ func (c *CPU) Step() error {
 			mem.SetRSTCompare(false)
 		} else {
 			mem.SetRSTCompare(true)
-			setVal(mem, args[0].Type, args[0].Address, index)
+			c.setVal(args[0].Type, args[0].Address, index)
 		}
 	case arch.INT:
-		if !c.devices.Int(args[0].Value, mem) {
+		if !c.devices.Int(args[0].Value, recordedMemory{mem, c}) {
 			return NewError(instr, "invalid device index %d", args[0].Value)
 		}
 
 	case arch.WAIT:
-		<-time.After(time.Millisecond * time.Duration(args[0].Value))
+		c.clock.Sleep(time.Millisecond * time.Duration(args[0].Value))
 	case arch.NOP:
 		/* nop */
 	case arch.HALT:
 		return io.EOF
 	}
 
+	if c.hit != nil {
+		return c.hit
+	}
+
 	return nil
 }
 
+// Instruction returns the most recently executed instruction.
+func (c *CPU) Instruction() *Instruction {
+	return &c.instr
+}
+
+// InIntHandler returns true if the cpu is executing an interrupt handler.
+func (c *CPU) InIntHandler() bool {
+	return c.inIntHandler
+}
+
 // checkIntQueue checks if there are pending messages in the interrupt queue.
 // If so, it hands control over to the interrupt handler defined in RIA.
 func (c *CPU) checkIntQueue() {
@@ -333,7 +445,9 @@ func (c *CPU) push(value int) {
 	mem := c.memory[:]
 	rsp := mem.U16(RSP)
 	mem.SetU16(RSP, rsp-2)
+	c.record(rsp, 2)
 	mem.SetU16(rsp, value)
+	c.watch(rsp, 2, Write)
 }
 
 // pop returns the top value from the callstack and updates RSP.
@@ -341,11 +455,15 @@ func (c *CPU) pop() int {
 	mem := c.memory[:]
 	rsp := mem.U16(RSP)
 	mem.SetU16(RSP, rsp+2)
+	c.watch(rsp+2, 2, Read)
 	return mem.U16(rsp + 2)
 }
 
 // setVal sets the value at the given address, using the type-specific storage method.
-func setVal(mem Memory, _type arch.Type, addr, value int) {
+func (c *CPU) setVal(_type arch.Type, addr, value int) {
+	mem := c.memory
+	c.record(addr, typeSize(_type))
+
 	switch _type {
 	case arch.U8:
 		mem.SetU8(addr, value)
@@ -356,4 +474,28 @@ func setVal(mem Memory, _type arch.Type, addr, value int) {
 	case arch.I16:
 		mem.SetI16(addr, value)
 	}
+
+	c.watch(addr, typeSize(_type), Write)
+}
+
+// carryValue returns the state of the RST/carry flag as a number.
+func carryValue(mem Memory) int {
+	if mem.RSTCarry() {
+		return 1
+	}
+	return 0
+}
+
+// addCarry returns true if y + z + carry does not fit in the unsigned range
+// of the given type.
+func addCarry(_type arch.Type, y, z, carry int) bool {
+	mask := 1<<uint(typeSize(_type)*8) - 1
+	return y&mask+z&mask+carry > mask
+}
+
+// subBorrow returns true if y - z - borrow needs a borrow in the unsigned
+// range of the given type.
+func subBorrow(_type arch.Type, y, z, borrow int) bool {
+	mask := 1<<uint(typeSize(_type)*8) - 1
+	return y&mask < z&mask+borrow
 }
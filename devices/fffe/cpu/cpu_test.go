@@ -2,8 +2,10 @@ package cpu
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"math/rand"
+	"reflect"
 	"testing"
 	"time"
 
@@ -48,6 +50,65 @@ func TestWAIT8(t *testing.T) {
 	}
 }
 
+func TestWAITVirtual(t *testing.T) {
+	// With a virtual clock, WAIT advances the clock instead of blocking.
+	//
+	//   WAIT 500
+	//   HALT
+
+	ct := newCodeTest()
+	ct.emit(arch.WAIT, op(arch.ImmediateConstant, 500))
+	ct.emit(arch.HALT)
+
+	clock := devices.NewVirtualClock(1000)
+
+	vm := New(nil)
+	vm.SetClock(clock)
+	if err := vm.Startup(); err != nil {
+		t.Fatalf("Startup failure: %v", err)
+	}
+
+	copy(vm.memory, ct.program.Bytes())
+
+	start := time.Now()
+	for vm.Step() == nil {
+	}
+
+	if diff := time.Since(start); diff >= time.Millisecond*500 {
+		t.Fatalf("expected runtime of < %v; have %v", time.Millisecond*500, diff)
+	}
+
+	// Three cycles at 1ms per cycle, plus the wait itself.
+	want := time.Unix(0, int64(time.Millisecond*503)).UTC()
+	if have := clock.Now(); !have.Equal(want) {
+		t.Fatalf("expected clock at %v; have %v", want, have)
+	}
+}
+
+func TestCycles(t *testing.T) {
+	//   MOV r0, 123       ; 1 + 0 + 1
+	//   ADD r0, r0, [r1]  ; 1 + 0 + 0 + 1
+	//   HALT              ; 1
+
+	ct := newCodeTest()
+	ct.emit(arch.MOV, op(arch.ImmediateRegister, 0), op(arch.ImmediateConstant, 123))
+	ct.emit(arch.ADD, op(arch.ImmediateRegister, 0), op(arch.ImmediateRegister, 0), op(arch.IndirectRegister, 1))
+	ct.emit(arch.HALT)
+
+	vm := New(nil)
+	if err := vm.Startup(); err != nil {
+		t.Fatalf("Startup failure: %v", err)
+	}
+
+	copy(vm.memory, ct.program.Bytes())
+	for vm.Step() == nil {
+	}
+
+	if have := vm.Cycles(); have != 5 {
+		t.Fatalf("expected 5 cycles; have %d", have)
+	}
+}
+
 func TestMOV1(t *testing.T) {
 	//    MOV r0, 123
 	//   HALT
@@ -103,6 +164,45 @@ func TestMOV4(t *testing.T) {
 	runTest(t, ct)
 }
 
+func TestMOVIndexed(t *testing.T) {
+	//    MOV r0, 100
+	//    MOV r1, 4
+	//    MOV [r0 + 2], 321
+	//    MOV [r0 + r1], [r0 + 2]
+	//    MOV r2, [r0 - 96]
+	//   HALT
+
+	ct := newCodeTest()
+	ct.emit(arch.MOV, op(arch.ImmediateRegister, 0), op(arch.ImmediateConstant, 100))
+	ct.emit(arch.MOV, op(arch.ImmediateRegister, 1), op(arch.ImmediateConstant, 4))
+	ct.emit(arch.MOV, op(arch.IndirectRegisterOffset, indexed(0, 2)), op(arch.ImmediateConstant, 321))
+	ct.emit(arch.MOV, op(arch.IndirectRegisterIndex, indexed(0, 1)), op(arch.IndirectRegisterOffset, indexed(0, 2)))
+	ct.emit(arch.MOV, op(arch.ImmediateRegister, 2), op(arch.IndirectRegisterOffset, indexed(0, -96)))
+	ct.emit(arch.HALT)
+
+	ct.want[102] = 321
+	ct.want[104] = 321
+	ct.want[R2] = 0x6402 // Bytes at address 4 and 5.
+	ct.want[RIP] = 0x20
+	runTest(t, ct)
+}
+
+func TestInvalidExtendedOperand(t *testing.T) {
+	vm := New(nil)
+	if err := vm.Startup(); err != nil {
+		t.Fatalf("Startup failure: %v", err)
+	}
+
+	// PUSH [r12 + r0]; r12 does not exist.
+	copy(vm.memory[0x10:], []byte{arch.PUSH, 0xff, 0xc0})
+	vm.memory.SetU16(RIP, 0x10)
+
+	err := vm.Step()
+	if e, ok := err.(*Error); !ok || e.IP != 0x10 || e.Opcode != arch.PUSH {
+		t.Fatalf("expected an error for the instruction at 0010; have %v", err)
+	}
+}
+
 func TestPUSHPOP(t *testing.T) {
 	//    MOV r0, 123
 	//   PUSH r0
@@ -245,7 +345,7 @@ func TestSUB2(t *testing.T) {
 
 	ct.want[R0] = -1
 	ct.want[RIP] = 9
-	ct.want[RST] = 0
+	ct.want[RST] = 8 // Borrow.
 	runTest(t, ct)
 }
 
@@ -259,7 +359,7 @@ func TestSUB82(t *testing.T) {
 
 	ct.want[R0] = -1 << 8
 	ct.want[RIP] = 9
-	ct.want[RST] = 0
+	ct.want[RST] = 8 // Borrow.
 	runTest(t, ct)
 }
 
@@ -291,6 +391,123 @@ func TestSUB8Overflow(t *testing.T) {
 	runTest(t, ct)
 }
 
+func TestADDCarry(t *testing.T) {
+	//   ADD u8 r0, 0xff, 2
+	//   HALT
+
+	ct := newCodeTest()
+	ct.emit(arch.ADD, op(arch.ImmediateRegister, 0, arch.U8), op(arch.ImmediateConstant, 0xff), op(arch.ImmediateConstant, 2))
+	ct.emit(arch.HALT)
+
+	ct.want[R0] = 1 << 8
+	ct.want[RIP] = 9
+	ct.want[RST] = 8 | 2
+	runTest(t, ct)
+}
+
+func TestADC(t *testing.T) {
+	// Adds the 32-bit values 0x0001ffff and 0x00020001.
+	//
+	//    ADD r0, 0xffff, 0x0001
+	//    ADC r1, 0x0001, 0x0002
+	//   HALT
+
+	ct := newCodeTest()
+	ct.emit(arch.ADD, op(arch.ImmediateRegister, 0), op(arch.ImmediateConstant, 0xffff), op(arch.ImmediateConstant, 1))
+	ct.emit(arch.ADC, op(arch.ImmediateRegister, 1), op(arch.ImmediateConstant, 1), op(arch.ImmediateConstant, 2))
+	ct.emit(arch.HALT)
+
+	ct.want[R0] = 0
+	ct.want[R1] = 4
+	ct.want[RIP] = 0x11
+	ct.want[RST] = 0
+	runTest(t, ct)
+}
+
+func TestADCCarry(t *testing.T) {
+	//    ADD r0, 0xffff, 0x0001
+	//    ADC u16 r1, 0xffff, 0
+	//   HALT
+
+	ct := newCodeTest()
+	ct.emit(arch.ADD, op(arch.ImmediateRegister, 0), op(arch.ImmediateConstant, 0xffff), op(arch.ImmediateConstant, 1))
+	ct.emit(arch.ADC, op(arch.ImmediateRegister, 1, arch.U16), op(arch.ImmediateConstant, 0xffff, arch.U16), op(arch.ImmediateConstant, 0))
+	ct.emit(arch.HALT)
+
+	ct.want[R0] = 0
+	ct.want[R1] = 0
+	ct.want[RIP] = 0x11
+	ct.want[RST] = 8 | 2
+	runTest(t, ct)
+}
+
+func TestSBC(t *testing.T) {
+	// Subtracts the 32-bit value 0x00010002 from 0x00030001.
+	//
+	//    SUB r0, 0x0001, 0x0002
+	//    SBC r1, 0x0003, 0x0001
+	//   HALT
+
+	ct := newCodeTest()
+	ct.emit(arch.SUB, op(arch.ImmediateRegister, 0), op(arch.ImmediateConstant, 1), op(arch.ImmediateConstant, 2))
+	ct.emit(arch.SBC, op(arch.ImmediateRegister, 1), op(arch.ImmediateConstant, 3), op(arch.ImmediateConstant, 1))
+	ct.emit(arch.HALT)
+
+	ct.want[R0] = -1
+	ct.want[R1] = 1
+	ct.want[RIP] = 0x11
+	ct.want[RST] = 0
+	runTest(t, ct)
+}
+
+func TestWMUL(t *testing.T) {
+	//    MOV r1, 0x1234
+	//    WMUL u16 r0, u16 r1, 0x1000
+	//   HALT
+
+	ct := newCodeTest()
+	ct.emit(arch.MOV, op(arch.ImmediateRegister, 1), op(arch.ImmediateConstant, 0x1234))
+	ct.emit(arch.WMUL, op(arch.ImmediateRegister, 0, arch.U16), op(arch.ImmediateRegister, 1, arch.U16), op(arch.ImmediateConstant, 0x1000, arch.U16))
+	ct.emit(arch.HALT)
+
+	ct.want[R0] = 0x4000
+	ct.want[R1] = 0x0123
+	ct.want[RIP] = 0xc
+	runTest(t, ct)
+}
+
+func TestWMULSigned(t *testing.T) {
+	//    MOV r1, -2
+	//    WMUL r0, r1, 3
+	//   HALT
+
+	ct := newCodeTest()
+	ct.emit(arch.MOV, op(arch.ImmediateRegister, 1), op(arch.ImmediateConstant, -2))
+	ct.emit(arch.WMUL, op(arch.ImmediateRegister, 0), op(arch.ImmediateRegister, 1), op(arch.ImmediateConstant, 3))
+	ct.emit(arch.HALT)
+
+	ct.want[R0] = -6
+	ct.want[R1] = -1
+	ct.want[RIP] = 0xc
+	runTest(t, ct)
+}
+
+func TestWMUL8(t *testing.T) {
+	//    MOV u8 r1, 200
+	//    WMUL u8 r0, u8 r1, 100
+	//   HALT
+
+	ct := newCodeTest()
+	ct.emit(arch.MOV, op(arch.ImmediateRegister, 1, arch.U8), op(arch.ImmediateConstant, 200))
+	ct.emit(arch.WMUL, op(arch.ImmediateRegister, 0, arch.U8), op(arch.ImmediateRegister, 1, arch.U8), op(arch.ImmediateConstant, 100, arch.U8))
+	ct.emit(arch.HALT)
+
+	ct.want[R0] = 0x20 << 8 // 200 * 100 = 0x4e20
+	ct.want[R1] = 0x4e << 8
+	ct.want[RIP] = 0xc
+	runTest(t, ct)
+}
+
 func TestMUL(t *testing.T) {
 	//    MUL r0, 2, 3
 	//   HALT
@@ -1128,6 +1345,304 @@ func TestSEED8RNG8(t *testing.T) {
 	runTest(t, ct)
 }
 
+func TestInterruptTiming(t *testing.T) {
+	// 0000  MOV r1, 1
+	// 0005  HALT
+	// 0006  MOV r2, 2   ; Interrupt handler.
+
+	ct := newCodeTest()
+	ct.emit(arch.MOV, op(arch.ImmediateRegister, 1), op(arch.ImmediateConstant, 1))
+	ct.emit(arch.HALT)
+	ct.emit(arch.MOV, op(arch.ImmediateRegister, 2), op(arch.ImmediateConstant, 2))
+
+	vm := New(nil)
+	if err := vm.Startup(); err != nil {
+		t.Fatalf("Startup failure: %v", err)
+	}
+
+	copy(vm.memory, ct.program.Bytes())
+	vm.memory.SetU16(RIA, 6)
+	vm.queueInterrupt(7)
+
+	// A pending interrupt is taken before the next instruction executes.
+	if err := vm.Step(); err != nil {
+		t.Fatalf("Step failure: %v", err)
+	}
+
+	if r1, r2, rip := vm.memory.U16(R1), vm.memory.U16(R2), vm.memory.U16(RIP); r1 != 0 || r2 != 2 || rip != 11 {
+		t.Fatalf("unexpected state: r1=%d r2=%d rip=%d", r1, r2, rip)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	//   SEED 99
+	//   RNG r0, 0, 1000
+	//   RNG r1, 0, 1000
+	//   RNG r2, 0, 1000
+	//   HALT
+
+	ct := newCodeTest()
+	ct.emit(arch.SEED, op(arch.ImmediateConstant, 99))
+	ct.emit(arch.RNG, op(arch.ImmediateRegister, 0), op(arch.ImmediateConstant, 0), op(arch.ImmediateConstant, 1000))
+	ct.emit(arch.RNG, op(arch.ImmediateRegister, 1), op(arch.ImmediateConstant, 0), op(arch.ImmediateConstant, 1000))
+	ct.emit(arch.RNG, op(arch.ImmediateRegister, 2), op(arch.ImmediateConstant, 0), op(arch.ImmediateConstant, 1000))
+	ct.emit(arch.HALT)
+
+	start := func() *CPU {
+		vm := New(nil)
+		vm.Connect(&testDevice{})
+		if err := vm.Startup(); err != nil {
+			t.Fatalf("Startup failure: %v", err)
+		}
+		return vm
+	}
+
+	step := func(vm *CPU, n int) {
+		for i := 0; i < n; i++ {
+			if err := vm.Step(); err != nil && err != io.EOF {
+				t.Fatalf("Step failure: %v", err)
+			}
+		}
+	}
+
+	a := start()
+	copy(a.memory, ct.program.Bytes())
+	a.memory.SetU16(RIA, 0x1234)
+	step(a, 2)
+
+	a.queueInterrupt(7)
+	a.queueInterrupt(8)
+
+	var state bytes.Buffer
+	if err := a.Snapshot(&state); err != nil {
+		t.Fatalf("Snapshot failure: %v", err)
+	}
+
+	// Snapshot must not disturb the machine it was taken from.
+	if len(a.intQueue) != 2 {
+		t.Fatalf("interrupt queue: want 2 entries; have %d", len(a.intQueue))
+	}
+
+	b := start()
+	if err := b.Restore(bytes.NewReader(state.Bytes())); err != nil {
+		t.Fatalf("Restore failure: %v", err)
+	}
+
+	if !bytes.Equal(a.memory, b.memory) {
+		t.Fatalf("memory mismatch after restore")
+	}
+
+	// Pending interrupts are restored in order.
+	if qa, qb := a.drainInterrupts(), b.drainInterrupts(); !reflect.DeepEqual(qa, qb) {
+		t.Fatalf("interrupt queue mismatch:\nwant: %v\nhave: %v\n", qa, qb)
+	}
+
+	// With the queues empty, both machines continue the same RNG sequence.
+	step(a, 3)
+	step(b, 3)
+
+	if a.inIntHandler != b.inIntHandler {
+		t.Fatalf("inIntHandler mismatch: want %v; have %v", a.inIntHandler, b.inIntHandler)
+	}
+
+	for _, r := range []int{R0, R1, R2} {
+		if want, have := a.memory.U16(r), b.memory.U16(r); want != have {
+			t.Fatalf("state mismatch at 0x%04x:\nwant: %#x\nhave: %#x\n", r, want, have)
+		}
+	}
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	start := func(a, b *stateDevice) *CPU {
+		vm := New(nil)
+		vm.Connect(a)
+		vm.Connect(b)
+		if err := vm.Startup(); err != nil {
+			t.Fatalf("Startup failure: %v", err)
+		}
+		return vm
+	}
+
+	var state bytes.Buffer
+	if err := start(&stateDevice{id: 1, value: 1}, &stateDevice{id: 2, value: 2}).Snapshot(&state); err != nil {
+		t.Fatalf("Snapshot failure: %v", err)
+	}
+
+	// The second device rejects its state. The first one must keep its own.
+	a, b := &stateDevice{id: 1, value: 5}, &stateDevice{id: 2, value: 6, reject: true}
+	vm := start(a, b)
+	vm.memory.SetU16(R0, 0x1234)
+
+	if err := vm.Restore(bytes.NewReader(state.Bytes())); err == nil {
+		t.Fatalf("expected Restore failure")
+	}
+
+	if a.value != 5 || b.value != 6 || vm.memory.U16(R0) != 0x1234 {
+		t.Fatalf("state changed by failed restore: %d, %d, %#x", a.value, b.value, vm.memory.U16(R0))
+	}
+
+	// A corrupt RNG draw count is rejected, rather than replayed.
+	data := state.Bytes()
+	for i := 13; i < 21; i++ {
+		data[i] = 0xff
+	}
+
+	if err := vm.Restore(bytes.NewReader(data)); err == nil {
+		t.Fatalf("expected Restore failure")
+	}
+}
+
+func TestBreakpoints(t *testing.T) {
+	// 0000  MOV r0, 0
+	// 0005  INC r0
+	// 0007  MOV [0x100], r0
+	// 000c  JMP 5
+
+	ct := newCodeTest()
+	ct.emit(arch.MOV, op(arch.ImmediateRegister, 0), op(arch.ImmediateConstant, 0))
+	ct.emit(arch.INC, op(arch.ImmediateRegister, 0))
+	ct.emit(arch.MOV, op(arch.IndirectConstant, 0x100), op(arch.ImmediateRegister, 0))
+	ct.emit(arch.JMP, op(arch.ImmediateConstant, 5))
+
+	vm := New(nil)
+	if err := vm.Startup(); err != nil {
+		t.Fatalf("Startup failure: %v", err)
+	}
+	copy(vm.memory, ct.program.Bytes())
+
+	// run steps until a break occurs and returns it.
+	run := func() *Break {
+		t.Helper()
+		for i := 0; i < 1000; i++ {
+			err := vm.Step()
+			if err == nil {
+				continue
+			}
+			if brk, ok := err.(*Break); ok {
+				return brk
+			}
+			t.Fatalf("Step failure: %v", err)
+		}
+		t.Fatalf("no break occurred")
+		return nil
+	}
+
+	vm.SetBreakpoint(7, func(m Memory) bool { return m.U16(R0) == 3 })
+	if brk := run(); brk.IP != 7 || brk.Watchpoint != nil || vm.memory.U16(R0) != 3 {
+		t.Fatalf("unexpected break %v with r0=%d", brk, vm.memory.U16(R0))
+	}
+
+	// The breakpoint stopped before the instruction was executed.
+	if have := vm.memory.U16(0x100); have != 2 {
+		t.Fatalf("memory mismatch: want 2; have %d", have)
+	}
+
+	vm.ClearBreakpoints()
+
+	w := &Watchpoint{Address: 0x100, Size: 2, Access: Write, Condition: func(m Memory) bool { return m.U16(0x100) == 5 }}
+	vm.AddWatchpoint(w)
+
+	// The watchpoint stops after the instruction was executed.
+	if brk := run(); brk.Watchpoint != w || brk.IP != 7 || brk.Address != 0x100 || brk.Access != Write || vm.memory.U16(RIP) != 0xc {
+		t.Fatalf("unexpected break %v", brk)
+	}
+
+	vm.RemoveWatchpoint(w)
+	w = &Watchpoint{Address: R0, Size: 2, Access: Read}
+	vm.AddWatchpoint(w)
+
+	// INC reads and writes r0. The MOV writing r0 to memory only reads it.
+	if brk := run(); brk.Watchpoint != w || brk.IP != 5 || brk.Access != Read {
+		t.Fatalf("unexpected break %v", brk)
+	}
+
+	if brk := run(); brk.Watchpoint != w || brk.IP != 7 || brk.Access != Read {
+		t.Fatalf("unexpected break %v", brk)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	// 0000  INC r0
+	// 0002  MOV [0x100], r0
+	// 0007  PUSH r0
+	// 0009  RNG r1, 0, 100
+	// 0011  INT r2
+	// 0013  JMP 0
+
+	ct := newCodeTest()
+	ct.emit(arch.INC, op(arch.ImmediateRegister, 0))
+	ct.emit(arch.MOV, op(arch.IndirectConstant, 0x100), op(arch.ImmediateRegister, 0))
+	ct.emit(arch.PUSH, op(arch.ImmediateRegister, 0))
+	ct.emit(arch.RNG, op(arch.ImmediateRegister, 1), op(arch.ImmediateConstant, 0), op(arch.ImmediateConstant, 100))
+	ct.emit(arch.INT, op(arch.ImmediateRegister, 2))
+	ct.emit(arch.JMP, op(arch.ImmediateConstant, 0))
+
+	vm := New(nil)
+	vm.Connect(&testDevice{})
+	if err := vm.Startup(); err != nil {
+		t.Fatalf("Startup failure: %v", err)
+	}
+	copy(vm.memory, ct.program.Bytes())
+	vm.SetHistory(8)
+
+	// Remember the memory contents and cycle count before every step.
+	var states []Memory
+	var cycles []uint64
+	for i := 0; i < 20; i++ {
+		states = append(states, append(Memory(nil), vm.memory...))
+		cycles = append(cycles, vm.Cycles())
+		if err := vm.Step(); err != nil {
+			t.Fatalf("Step failure: %v", err)
+		}
+	}
+	final := append(Memory(nil), vm.memory...)
+
+	if have := vm.History(); have != 8 {
+		t.Fatalf("history size mismatch: want 8; have %d", have)
+	}
+
+	for i := len(states) - 1; i >= len(states)-8; i-- {
+		if err := vm.StepBack(); err != nil {
+			t.Fatalf("StepBack failure: %v", err)
+		}
+		if !bytes.Equal(vm.memory, states[i]) || vm.Cycles() != cycles[i] {
+			t.Fatalf("state mismatch after undoing step %d", i)
+		}
+	}
+
+	if err := vm.StepBack(); err != ErrNoHistory {
+		t.Fatalf("StepBack error mismatch: want %v; have %v", ErrNoHistory, err)
+	}
+
+	// Replaying the steps yields the same results, including random numbers.
+	for i := 0; i < 8; i++ {
+		if err := vm.Step(); err != nil {
+			t.Fatalf("Step failure: %v", err)
+		}
+	}
+
+	if !bytes.Equal(vm.memory, final) {
+		t.Fatalf("state mismatch after replaying steps")
+	}
+
+	// Stepping back reports breakpoints, which the next step ignores.
+	vm.SetBreakpoint(9, nil)
+	for {
+		err := vm.StepBack()
+		if err == nil {
+			continue
+		}
+		if brk, ok := err.(*Break); !ok || brk.IP != 9 {
+			t.Fatalf("unexpected StepBack error: %v", err)
+		}
+		break
+	}
+
+	if err := vm.Step(); err != nil || vm.memory.U16(RIP) != 0x11 {
+		t.Fatalf("unexpected step result: %v; rip=%04x", err, vm.memory.U16(RIP))
+	}
+}
+
 func runTest(t *testing.T, ct *codeTest) {
 	t.Helper()
 
@@ -1180,6 +1695,35 @@ func (d *testDevice) Startup(devices.IntFunc) error { return nil }
 func (d *testDevice) Shutdown() error               { return nil }
 func (d *testDevice) Int(m devices.Memory)          { m.SetI16(R0, 123) }
 
+// stateDevice is a device with a single byte of state.
+type stateDevice struct {
+	id     devices.ID
+	value  byte
+	reject bool // Fail to load any state.
+}
+
+func (d *stateDevice) ID() devices.ID                { return d.id }
+func (d *stateDevice) Startup(devices.IntFunc) error { return nil }
+func (d *stateDevice) Shutdown() error               { return nil }
+func (d *stateDevice) Int(m devices.Memory)          {}
+
+func (d *stateDevice) SaveState(w io.Writer) error {
+	_, err := w.Write([]byte{d.value})
+	return err
+}
+
+func (d *stateDevice) LoadState(r io.Reader) error {
+	var buf [1]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return err
+	}
+	if d.reject {
+		return errors.New("state rejected")
+	}
+	d.value = buf[0]
+	return nil
+}
+
 type codeTest struct {
 	program bytes.Buffer
 	want    map[int]int
@@ -1206,10 +1750,26 @@ func (ct *codeTest) emit(opcode byte, ops ...[3]int) {
 
 		case arch.ImmediateRegister, arch.IndirectRegister:
 			w.WriteByte(attr | byte(v[2]&0xf))
+
+		case arch.IndirectRegisterOffset:
+			w.WriteByte(byte(arch.IndirectRegister)<<6 | byte(v[1]&0x3)<<4 | arch.ExtendedOperand)
+			w.WriteByte(byte(v[2]>>16)<<4 | arch.ExtendedOperand)
+			w.WriteByte(byte(v[2] >> 8))
+			w.WriteByte(byte(v[2]))
+
+		case arch.IndirectRegisterIndex:
+			w.WriteByte(byte(arch.IndirectRegister)<<6 | byte(v[1]&0x3)<<4 | arch.ExtendedOperand)
+			w.WriteByte(byte(v[2]>>16)<<4 | byte(v[2]&0xf))
 		}
 	}
 }
 
+// indexed returns the operand value for an extended address mode with the
+// given base register and offset or index register.
+func indexed(base, value int) int {
+	return base<<16 | value&0xffff
+}
+
 func op(mode arch.AddressMode, value int, typ ...arch.Type) [3]int {
 	if len(typ) > 0 {
 		return [...]int{int(mode), int(typ[0]), value}
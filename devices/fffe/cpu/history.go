@@ -0,0 +1,256 @@
+package cpu
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hexaflex/svm/devices"
+)
+
+// ErrNoHistory is returned by StepBack if there are no recorded steps left.
+var ErrNoHistory = errors.New("no execution history left")
+
+// step holds everything needed to undo a single execution step.
+type step struct {
+	registers    [RegisterCapacity]byte // Register contents before the step.
+	writes       []write                // Memory writes, in the order they happened.
+	data         []byte                 // Previous contents of the written memory.
+	cycles       uint64                 // Cycle count before the step.
+	seed         int64                  // RNG seed before the step.
+	draws        uint64                 // Values drawn from the RNG before the step.
+	inIntHandler bool
+}
+
+// write identifies a range of memory written during a step.
+type write struct {
+	addr int
+	size int
+}
+
+// history is a ring buffer holding the most recent steps.
+type history struct {
+	m     sync.Mutex // Guards everything below. Devices may write memory from other goroutines.
+	steps []step
+	start int // Index of the oldest step.
+	count int // Number of recorded steps.
+}
+
+// current returns the most recent step.
+func (h *history) current() *step {
+	return &h.steps[(h.start+h.count-1)%len(h.steps)]
+}
+
+// SetHistory enables recording of an undo log for the last n steps.
+// Each step records the register contents and the previous contents of all
+// memory it writes to. This allows execution to be reversed with StepBack.
+// Zero disables recording. Changing the size clears the history.
+//
+// Device state and the passing of time are not recorded. A device keeps
+// whatever state it had, when the steps which talked to it are undone.
+func (c *CPU) SetHistory(n int) {
+	if n < 0 {
+		n = 0
+	}
+
+	h := &c.history
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	h.steps = nil
+	if n > 0 {
+		h.steps = make([]step, n)
+	}
+	h.start = 0
+	h.count = 0
+
+	var v uint32
+	if n > 0 {
+		v = 1
+	}
+	atomic.StoreUint32(&c.recording, v)
+}
+
+// History returns the number of steps which can currently be undone.
+func (c *CPU) History() int {
+	h := &c.history
+	h.m.Lock()
+	defer h.m.Unlock()
+	return h.count
+}
+
+// clearHistory removes all recorded steps.
+func (c *CPU) clearHistory() {
+	h := &c.history
+	h.m.Lock()
+	h.start = 0
+	h.count = 0
+	h.m.Unlock()
+}
+
+// StepBack undoes the most recent step in the history. This restores
+// the registers and memory to what they were before it was executed.
+// Returns ErrNoHistory if there is nothing left to undo.
+//
+// Returns a *Break if the instruction at the restored RIP has a breakpoint
+// whose condition holds. The next Step executes the instruction either way.
+func (c *CPU) StepBack() error {
+	if atomic.LoadUint32(&c.initialized) == 0 {
+		return ErrNoHistory
+	}
+
+	h := &c.history
+	h.m.Lock()
+
+	if h.count == 0 {
+		h.m.Unlock()
+		return ErrNoHistory
+	}
+
+	s := h.current()
+	h.count--
+
+	data := s.data
+	for i := len(s.writes) - 1; i >= 0; i-- {
+		w := s.writes[i]
+		copy(c.memory[w.addr:w.addr+w.size], data[len(data)-w.size:])
+		data = data[:len(data)-w.size]
+	}
+
+	copy(c.memory[R0:], s.registers[:])
+	c.cycles = s.cycles
+	c.inIntHandler = s.inIntHandler
+	if c.src.seed != s.seed || c.src.draws != s.draws {
+		c.src.restore(s.seed, s.draws)
+	}
+
+	h.m.Unlock()
+
+	c.hit = nil
+	ip := c.memory.U16(RIP)
+	c.resume = ip
+
+	if c.breakpoints != nil {
+		if bp := c.breakpoints[ip]; bp != nil && (bp.cond == nil || bp.cond(c.memory)) {
+			return &Break{IP: ip}
+		}
+	}
+
+	return nil
+}
+
+// beginStep starts a new entry in the history, if it is enabled.
+// The oldest entry is replaced if the history is full.
+func (c *CPU) beginStep() {
+	if atomic.LoadUint32(&c.recording) == 0 {
+		return
+	}
+
+	h := &c.history
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if len(h.steps) == 0 {
+		return
+	}
+
+	if h.count < len(h.steps) {
+		h.count++
+	} else {
+		h.start = (h.start + 1) % len(h.steps)
+	}
+
+	s := h.current()
+	copy(s.registers[:], c.memory[R0:])
+	s.writes = s.writes[:0]
+	s.data = s.data[:0]
+	s.cycles = c.cycles
+	s.seed = c.src.seed
+	s.draws = c.src.draws
+	s.inIntHandler = c.inIntHandler
+}
+
+// record saves the current contents of the given memory range in the
+// current history entry, before it is overwritten.
+func (c *CPU) record(addr, size int) {
+	if atomic.LoadUint32(&c.recording) == 0 {
+		return
+	}
+
+	if addr < 0 {
+		size += addr
+		addr = 0
+	}
+	if addr+size > MemoryCapacity {
+		size = MemoryCapacity - addr
+	}
+	if size <= 0 {
+		return
+	}
+
+	h := &c.history
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if h.count == 0 {
+		return
+	}
+
+	s := h.current()
+	s.writes = append(s.writes, write{addr: addr, size: size})
+	s.data = append(s.data, c.memory[addr:addr+size]...)
+}
+
+// recordedMemory is handed to devices. It records their memory writes in
+// the history before passing them on.
+type recordedMemory struct {
+	Memory
+	c *CPU
+}
+
+var _ devices.Memory = recordedMemory{}
+
+func (m recordedMemory) SetI8(addr, value int) {
+	m.c.record(addr, 1)
+	m.Memory.SetI8(addr, value)
+}
+
+func (m recordedMemory) SetU8(addr, value int) {
+	m.c.record(addr, 1)
+	m.Memory.SetU8(addr, value)
+}
+
+func (m recordedMemory) SetI16(addr, value int) {
+	m.c.record(addr, 2)
+	m.Memory.SetI16(addr, value)
+}
+
+func (m recordedMemory) SetU16(addr, value int) {
+	m.c.record(addr, 2)
+	m.Memory.SetU16(addr, value)
+}
+
+func (m recordedMemory) Write(address int, p []byte) {
+	m.c.record(address, len(p))
+	m.Memory.Write(address, p)
+}
+
+func (m recordedMemory) SetRSTCompare(v bool) {
+	m.c.record(RST, 1)
+	m.Memory.SetRSTCompare(v)
+}
+
+func (m recordedMemory) SetRSTOverflow(v bool) {
+	m.c.record(RST, 1)
+	m.Memory.SetRSTOverflow(v)
+}
+
+func (m recordedMemory) SetRSTDivideByZero(v bool) {
+	m.c.record(RST, 1)
+	m.Memory.SetRSTDivideByZero(v)
+}
+
+func (m recordedMemory) SetRSTCarry(v bool) {
+	m.c.record(RST, 1)
+	m.Memory.SetRSTCarry(v)
+}
@@ -1,14 +1,13 @@
 package cpu
 
-import (
-	"github.com/hexaflex/svm/arch"
-)
+import "github.com/hexaflex/svm/arch"
 
 // Instruction defines decoded instruction data.
 type Instruction struct {
 	IP     int        // Instruction address.
 	Opcode int        // Instruction opcode.
 	Args   [3]Operand // Operand A, B and C.
+	Cycles int        // Number of cycles it takes to execute the instruction.
 }
 
 // Decode decodes the next instruction from the given memory bank.
@@ -27,10 +26,17 @@ func (i *Instruction) Decode(m Memory) error {
 		return NewError(i, "unknown opcode %02x", i.Opcode)
 	}
 
+	i.Cycles = arch.Cycles(i.Opcode)
+
 	for j := 0; j < argc; j++ {
 		if err := i.Args[j].Decode(m); err != nil {
+			// An operand does not know which instruction it belongs to.
+			if e, ok := err.(*Error); ok && e.Instruction == nil {
+				e.Instruction = i
+			}
 			return err
 		}
+		i.Cycles += i.Args[j].Mode.Cycles()
 	}
 
 	return nil
@@ -86,6 +92,10 @@ func (op *Operand) Decode(m Memory) error {
 		op.readMem(m)
 
 	case arch.IndirectRegister:
+		if b&0xf == arch.ExtendedOperand {
+			return op.decodeExtended(m)
+		}
+
 		op.Address = m.U16((b&0xf)*2 + UserMemoryCapacity)
 		op.readMem(m)
 	}
@@ -93,6 +103,38 @@ func (op *Operand) Decode(m Memory) error {
 	return nil
 }
 
+// decodeExtended decodes the remainder of an operand with one of the
+// extended address modes. See arch.ExtendedOperand.
+func (op *Operand) decodeExtended(m Memory) error {
+	b, err := m.next8()
+	if err != nil {
+		return err
+	}
+
+	base, index := b>>4, b&0xf
+	if base*2 >= RegisterCapacity || (index != arch.ExtendedOperand && index*2 >= RegisterCapacity) {
+		return NewError(nil, "invalid extended operand %02x", b)
+	}
+
+	addr := m.U16(base*2 + UserMemoryCapacity)
+
+	if index == arch.ExtendedOperand {
+		offset, err := m.next16()
+		if err != nil {
+			return err
+		}
+
+		op.Mode = arch.IndirectRegisterOffset
+		op.Address = (addr + offset) & 0xffff
+	} else {
+		op.Mode = arch.IndirectRegisterIndex
+		op.Address = (addr + m.U16(index*2+UserMemoryCapacity)) & 0xffff
+	}
+
+	op.readMem(m)
+	return nil
+}
+
 func (op *Operand) readMem(m Memory) {
 	switch op.Type {
 	case arch.U8:
@@ -98,6 +98,12 @@ func (m Memory) RSTDivideByZero() bool { return m.rst(4) }
 // SetRSTDivideByZero sets the state of the RST/divide-by-zero flag.
 func (m Memory) SetRSTDivideByZero(v bool) { m.setRST(4, v) }
 
+// RSTCarry defines the state of the RST/carry flag.
+func (m Memory) RSTCarry() bool { return m.rst(8) }
+
+// SetRSTCarry sets the state of the RST/carry flag.
+func (m Memory) SetRSTCarry(v bool) { m.setRST(8, v) }
+
 // RSTCompare returns the state of the given RST flag.
 func (m Memory) rst(flag int) bool {
 	return int(m[RST])&flag == flag
@@ -0,0 +1,293 @@
+package cpu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+
+	"github.com/hexaflex/svm/devices"
+)
+
+// Snapshot format identification.
+var (
+	snapshotMagic   = [4]byte{'S', 'V', 'M', 'S'}
+	snapshotVersion = uint8(1)
+)
+
+// Limits on values read from a snapshot. They keep a corrupt file from
+// hanging the machine or exhausting memory.
+const (
+	// maxSnapshotDraws is the largest number of RNG draws which is replayed
+	// when a snapshot is restored.
+	maxSnapshotDraws = 1 << 28
+
+	// maxDeviceStateSize is the largest state, in bytes, of a single device.
+	maxDeviceStateSize = 1 << 24
+)
+
+// snapshotHeader defines the fixed-size part of a snapshot.
+// It is followed by the interrupt queue, system memory and device states.
+type snapshotHeader struct {
+	Magic        [4]byte
+	Version      uint8
+	Seed         int64  // Current RNG seed.
+	Draws        uint64 // Number of values drawn from the RNG since it was seeded.
+	InIntHandler bool
+	QueueLen     uint8
+	DeviceCount  uint8
+}
+
+// deviceHeader precedes the state data for a single device.
+type deviceHeader struct {
+	ID   uint32
+	Size uint32
+}
+
+// Snapshot writes the complete machine state to w. This includes system
+// memory, the RNG state, pending interrupts and the state of all connected
+// devices which implement devices.Stateful.
+//
+// The cpu must not be stepped while the snapshot is being taken.
+func (c *CPU) Snapshot(w io.Writer) error {
+	if atomic.LoadUint32(&c.initialized) == 0 {
+		return errors.New(c.ID().String() + " no program is loaded")
+	}
+
+	if c.src.draws > maxSnapshotDraws {
+		return errors.Errorf("%s too many random values drawn since the last SEED to take a snapshot", c.ID())
+	}
+
+	// Collect device states first. Devices may have work in progress
+	// which affects system memory. They finish it before saving.
+	var states bytes.Buffer
+	var count int
+
+	for _, dev := range c.devices {
+		sd, ok := dev.(devices.Stateful)
+		if !ok {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := sd.SaveState(&buf); err != nil {
+			return errors.Wrapf(err, "%s", dev.ID())
+		}
+
+		if buf.Len() > maxDeviceStateSize {
+			return errors.Errorf("%s state is too large", dev.ID())
+		}
+
+		binary.Write(&states, binary.LittleEndian, deviceHeader{
+			ID:   uint32(dev.ID()),
+			Size: uint32(buf.Len()),
+		})
+		states.Write(buf.Bytes())
+		count++
+	}
+
+	queue := c.drainInterrupts()
+	for _, msg := range queue {
+		c.intQueue <- msg
+	}
+
+	var out bytes.Buffer
+	binary.Write(&out, binary.LittleEndian, snapshotHeader{
+		Magic:        snapshotMagic,
+		Version:      snapshotVersion,
+		Seed:         c.src.seed,
+		Draws:        c.src.draws,
+		InIntHandler: c.inIntHandler,
+		QueueLen:     uint8(len(queue)),
+		DeviceCount:  uint8(count),
+	})
+
+	for _, msg := range queue {
+		binary.Write(&out, binary.LittleEndian, uint16(msg))
+	}
+
+	out.Write(c.memory)
+	out.Write(states.Bytes())
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// Restore replaces the complete machine state with a snapshot read from r,
+// as it was written by Snapshot. The cpu must have been started and must not
+// be stepped while the state is being restored.
+//
+// The snapshot is read in full before anything is changed. If a device
+// rejects its state, the devices which were already restored are returned
+// to their previous state and the machine is left as it was.
+func (c *CPU) Restore(r io.Reader) error {
+	if atomic.LoadUint32(&c.initialized) == 0 {
+		return errors.New(c.ID().String() + " no program is loaded")
+	}
+
+	var hdr snapshotHeader
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return errors.Wrapf(err, "invalid snapshot")
+	}
+
+	if hdr.Magic != snapshotMagic {
+		return errors.New("invalid snapshot: unrecognized file format")
+	}
+
+	if hdr.Version != snapshotVersion {
+		return errors.Errorf("invalid snapshot: unsupported version %d", hdr.Version)
+	}
+
+	if hdr.Draws > maxSnapshotDraws {
+		return errors.Errorf("invalid snapshot: RNG state is %d draws from its seed", hdr.Draws)
+	}
+
+	if int(hdr.QueueLen) > IntQueueCapacity {
+		return errors.Errorf("invalid snapshot: interrupt queue holds %d entries", hdr.QueueLen)
+	}
+
+	queue := make([]uint16, hdr.QueueLen)
+	if err := binary.Read(r, binary.LittleEndian, queue); err != nil {
+		return errors.Wrapf(err, "invalid snapshot")
+	}
+
+	memory := make(Memory, MemoryCapacity)
+	if _, err := io.ReadFull(r, memory); err != nil {
+		return errors.Wrapf(err, "invalid snapshot")
+	}
+
+	states := make([][]byte, len(c.devices))
+	for i := 0; i < int(hdr.DeviceCount); i++ {
+		var dh deviceHeader
+		if err := binary.Read(r, binary.LittleEndian, &dh); err != nil {
+			return errors.Wrapf(err, "invalid snapshot")
+		}
+
+		id := devices.ID(dh.ID)
+		index := c.devices.Find(id)
+		if index == -1 {
+			return errors.Errorf("invalid snapshot: device %s is not connected", id)
+		}
+
+		if _, ok := c.devices[index].(devices.Stateful); !ok {
+			return errors.Errorf("invalid snapshot: device %s can not restore state", id)
+		}
+
+		if dh.Size > maxDeviceStateSize {
+			return errors.Errorf("invalid snapshot: device %s has a state of %d bytes", id, dh.Size)
+		}
+
+		data := make([]byte, dh.Size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return errors.Wrapf(err, "invalid snapshot")
+		}
+
+		states[index] = data
+	}
+
+	if err := c.loadDeviceStates(states); err != nil {
+		return err
+	}
+
+	copy(c.memory, memory)
+	c.src.restore(hdr.Seed, hdr.Draws)
+	c.inIntHandler = hdr.InIntHandler
+	c.clearHistory()
+
+	c.drainInterrupts()
+	for _, msg := range queue {
+		c.intQueue <- int(msg)
+	}
+
+	return nil
+}
+
+// loadDeviceStates gives every device with an entry in states its new state.
+// states is indexed like c.devices and has nil entries for devices which are
+// not restored. If a device fails to load its state, the devices before it
+// are given back the state they had.
+func (c *CPU) loadDeviceStates(states [][]byte) error {
+	old := make([][]byte, len(states))
+	for index, data := range states {
+		if data == nil {
+			continue
+		}
+
+		var buf bytes.Buffer
+		if err := c.devices[index].(devices.Stateful).SaveState(&buf); err != nil {
+			return errors.Wrapf(err, "%s", c.devices[index].ID())
+		}
+		old[index] = append([]byte{}, buf.Bytes()...)
+	}
+
+	for index, data := range states {
+		if data == nil {
+			continue
+		}
+
+		dev := c.devices[index]
+		if err := dev.(devices.Stateful).LoadState(bytes.NewReader(data)); err != nil {
+			for i := 0; i < index; i++ {
+				if old[i] != nil {
+					c.devices[i].(devices.Stateful).LoadState(bytes.NewReader(old[i]))
+				}
+			}
+			return errors.Wrapf(err, "%s", dev.ID())
+		}
+	}
+
+	return nil
+}
+
+// drainInterrupts empties the interrupt queue and returns its contents.
+func (c *CPU) drainInterrupts() []int {
+	var queue []int
+	for {
+		select {
+		case msg := <-c.intQueue:
+			queue = append(queue, msg)
+		default:
+			return queue
+		}
+	}
+}
+
+// source is a rand.Source which keeps track of its seed and the number of
+// values drawn from it. This is enough to recreate its exact state later on.
+type source struct {
+	src   rand.Source
+	seed  int64
+	draws uint64
+}
+
+var _ rand.Source = &source{}
+
+func newSource(seed int64) *source {
+	var s source
+	s.Seed(seed)
+	return &s
+}
+
+// Seed resets the source to the state defined by the given seed.
+func (s *source) Seed(seed int64) {
+	s.src = rand.NewSource(seed)
+	s.seed = seed
+	s.draws = 0
+}
+
+// Int63 returns the next pseudo-random value.
+func (s *source) Int63() int64 {
+	s.draws++
+	return s.src.Int63()
+}
+
+// restore recreates the state after the given number of draws from the given seed.
+func (s *source) restore(seed int64, draws uint64) {
+	s.Seed(seed)
+	for s.draws < draws {
+		s.Int63()
+	}
+}
@@ -2,7 +2,9 @@
 package fd35
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -53,24 +55,35 @@ const (
 // Device defines all internal doodads for the display.
 type Device struct {
 	m        sync.Mutex
-	file     string // Backing file for disk data.
-	data     []byte // Floppy disk data.
-	state    int    // Current device state.
-	error    int    // Last error that occurred.
-	track    int    // Current track we are at.
-	readonly bool   // Disk is readonly?
+	clock    devices.Clock // Time source.
+	file     string        // Backing file for disk data.
+	data     []byte        // Floppy disk data.
+	state    int           // Current device state.
+	error    int           // Last error that occurred.
+	track    int           // Current track we are at.
+	readonly bool          // Disk is readonly?
 }
 
-var _ devices.Device = &Device{}
+var (
+	_ devices.Device   = &Device{}
+	_ devices.Clocked  = &Device{}
+	_ devices.Stateful = &Device{}
+)
 
 // New creates a new device instance.
 func New(file string, readonly bool) *Device {
 	return &Device{
+		clock:    devices.RealClock{},
 		file:     file,
 		readonly: readonly,
 	}
 }
 
+// SetClock sets the time source for the device.
+func (d *Device) SetClock(clock devices.Clock) {
+	d.clock = clock
+}
+
 // ID returns the device id.
 func (d *Device) ID() devices.ID {
 	return devices.NewID(0xfffe, 0x0004)
@@ -139,6 +152,74 @@ func (d *Device) Shutdown() error {
 	return nil
 }
 
+// State returns the current device state.
+func (d *Device) State() int {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.state
+}
+
+// SaveState writes the disk contents and drive state to w.
+// If a transfer is in progress, this waits for it to complete first.
+func (d *Device) SaveState(w io.Writer) error {
+	for d.State() == StateBusy {
+		d.clock.Sleep(time.Millisecond)
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	err := binary.Write(w, binary.LittleEndian, &state{
+		State:    int32(d.state),
+		Error:    int32(d.error),
+		Track:    int32(d.track),
+		DataSize: uint32(len(d.data)),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(d.data)
+	return err
+}
+
+// LoadState restores the disk contents and drive state from r.
+func (d *Device) LoadState(r io.Reader) error {
+	var s state
+	if err := binary.Read(r, binary.LittleEndian, &s); err != nil {
+		return err
+	}
+
+	if s.DataSize != 0 && s.DataSize != FloppySize {
+		return fmt.Errorf("invalid disk size; expected %d, have %d", FloppySize, s.DataSize)
+	}
+
+	var data []byte
+	if s.DataSize > 0 {
+		data = make([]byte, s.DataSize)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+	}
+
+	d.m.Lock()
+	d.state = int(s.State)
+	d.error = int(s.Error)
+	d.track = int(s.Track)
+	d.data = data
+	d.m.Unlock()
+	return nil
+}
+
+// state defines the device state as it is stored in a snapshot.
+// It is followed by DataSize bytes of disk contents.
+type state struct {
+	State    int32
+	Error    int32
+	Track    int32
+	DataSize uint32
+}
+
 // Int triggers an interrupt on the device. The device can read from- and write to system memory.
 func (d *Device) Int(mem devices.Memory) {
 	switch mem.U16(cpu.R0) {
@@ -167,13 +248,10 @@ func (d *Device) readSector(mem devices.Memory) {
 		return
 	}
 
-	go func() {
+	d.transfer(sector, func() {
 		src := sector * BytesPerSector
-		d.seek(sector % SectorsPerTrack)
 		mem.Write(dst, d.data[src:src+BytesPerSector])
-		<-time.After(SectorTransferTime)
-		d.setReady()
-	}()
+	})
 }
 
 func (d *Device) writeSector(mem devices.Memory) {
@@ -189,27 +267,36 @@ func (d *Device) writeSector(mem devices.Memory) {
 		return
 	}
 
-	go func() {
+	d.transfer(sector, func() {
 		dst := sector * BytesPerSector
-		d.seek(sector % SectorsPerTrack)
 		mem.Read(src, d.data[dst:dst+BytesPerSector])
-		<-time.After(SectorTransferTime)
+	})
+}
+
+// transfer performs the given sector transfer once the time it takes to
+// seek to the sector and to transfer its data has elapsed. The device is
+// ready again after that.
+func (d *Device) transfer(sector int, f func()) {
+	delay := d.seek(sector%SectorsPerTrack) + SectorTransferTime
+
+	d.clock.AfterFunc(delay, func() {
+		f()
 		d.setReady()
-	}()
+	})
 }
 
 // seek fakes moving the read/write head to the given track if needed.
+// It returns the time this takes.
 //
 // Seek time delay is simulated by multiplying the TrackSeekTime with the
 // number of tracks we are shifting.
-func (d *Device) seek(track int) {
-	if d.track == track {
-		return
-	}
+func (d *Device) seek(track int) time.Duration {
+	d.m.Lock()
+	defer d.m.Unlock()
 
 	delta := max(track, d.track) - min(track, d.track)
-	<-time.After(time.Duration(delta) * TrackSeekTime)
 	d.track = track
+	return time.Duration(delta) * TrackSeekTime
 }
 
 // setReady sets the device to its appropriate ready state.
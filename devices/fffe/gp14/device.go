@@ -2,7 +2,10 @@
 package gp14
 
 import (
+	"encoding/binary"
+	"io"
 	"log"
+	"sync"
 
 	"github.com/go-gl/glfw/v3.3/glfw"
 
@@ -36,19 +39,26 @@ const (
 )
 
 type state struct {
-	pressed      bool
-	justPressed  bool
-	justReleased bool
+	Pressed      bool
+	JustPressed  bool
+	JustReleased bool
 }
 
 // Device defines all internal doodads for the display.
+//
+// Update and the joystick callback run on the main thread, while Int runs on
+// the cpu goroutine. Button state is guarded by a mutex for this reason.
 type Device struct {
+	m           sync.Mutex
 	joy         glfw.Joystick
 	state       [16]state
 	initialized bool
 }
 
-var _ devices.Device = &Device{}
+var (
+	_ devices.Device   = &Device{}
+	_ devices.Stateful = &Device{}
+)
 
 // New creates a new device.
 func New() *Device {
@@ -62,19 +72,22 @@ func (d *Device) Update() {
 		return
 	}
 
+	d.m.Lock()
+	defer d.m.Unlock()
+
 	for btn, action := range state.Buttons {
 		bs := d.state[btn]
 		pressed := action == glfw.Press
 
-		if pressed && !bs.pressed {
-			bs.justPressed = true
+		if pressed && !bs.Pressed {
+			bs.JustPressed = true
 		}
 
-		if !pressed && bs.pressed {
-			bs.justReleased = true
+		if !pressed && bs.Pressed {
+			bs.JustReleased = true
 		}
 
-		bs.pressed = pressed
+		bs.Pressed = pressed
 
 		d.state[btn] = bs
 	}
@@ -110,20 +123,38 @@ func (d *Device) Shutdown() error {
 // Int triggers an interrupt on the device. The device can read from- and write to system memory.
 func (d *Device) Int(mem devices.Memory) {
 	btn := mem.U16(cpu.R1) & 0xf
+
+	d.m.Lock()
+	defer d.m.Unlock()
+
 	state := &d.state[btn]
 
 	switch mem.U16(cpu.R0) {
 	case isPressed:
-		mem.SetRSTCompare(state.pressed)
+		mem.SetRSTCompare(state.Pressed)
 	case isJustPressed:
-		mem.SetRSTCompare(state.justPressed)
-		state.justPressed = false
+		mem.SetRSTCompare(state.JustPressed)
+		state.JustPressed = false
 	case isJustReleased:
-		mem.SetRSTCompare(state.justReleased)
-		state.justReleased = false
+		mem.SetRSTCompare(state.JustReleased)
+		state.JustReleased = false
 	}
 }
 
+// SaveState writes the button states to w.
+func (d *Device) SaveState(w io.Writer) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return binary.Write(w, binary.LittleEndian, &d.state)
+}
+
+// LoadState restores the button states from r.
+func (d *Device) LoadState(r io.Reader) error {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return binary.Read(r, binary.LittleEndian, &d.state)
+}
+
 // configure is called whenever a joystick is connected or disconnected from the system.
 func (d *Device) configure(joy glfw.Joystick, event glfw.PeripheralEvent) {
 	d.initialized = event == glfw.Connected && joy.IsGamepad()
@@ -135,10 +166,13 @@ func (d *Device) configure(joy glfw.Joystick, event glfw.PeripheralEvent) {
 		log.Println(d.ID(), "gamepad disconnected")
 	}
 
+	d.m.Lock()
+	defer d.m.Unlock()
+
 	for btn, state := range d.state {
-		state.pressed = false
-		state.justPressed = false
-		state.justReleased = false
+		state.Pressed = false
+		state.JustPressed = false
+		state.JustReleased = false
 		d.state[btn] = state
 	}
 }
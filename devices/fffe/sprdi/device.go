@@ -1,10 +1,16 @@
 // Package sprdi implements the Sprite Display Mk I
+//
+// The device itself only maintains the palette, sprite and scene buffers.
+// Showing the scene is left to a Presenter. This package provides one which
+// renders to an image in memory. Package opengl provides one which renders
+// through OpenGL.
 package sprdi
 
 import (
-	"log"
+	"encoding/binary"
+	"image/color"
+	"io"
 
-	"github.com/go-gl/gl/v4.2-core/gl"
 	"github.com/pkg/errors"
 
 	"github.com/hexaflex/svm/devices"
@@ -33,39 +39,23 @@ const (
 
 // Device defines all internal doodads for the display.
 type Device struct {
-	palette      [PaletteSize * 4]float32
-	sprites      [BufferSize * SpritePixelSize * SpritePixelSize]byte
-	scene        [DisplayWidth * DisplayHeight]byte
-	empty        [DisplayWidth * DisplayHeight]byte
-	shader       uint32
-	vao          uint32
-	vbo          uint32
-	sceneTex     uint32
-	paletteDirty bool
-	sceneDirty   bool
-	initialized  bool
+	presenter Presenter
+	frame     Frame
+	sprites   [BufferSize * SpritePixelSize * SpritePixelSize]byte
+	empty     [DisplayWidth * DisplayHeight]byte
 }
 
-var _ devices.Device = &Device{}
-
-// New creates a new device.
-func New() *Device {
-	return &Device{}
-}
+var (
+	_ devices.Device   = &Device{}
+	_ devices.Stateful = &Device{}
+)
 
-// Draw renders the display contents.
-func (d *Device) Draw() {
-	if !d.initialized {
-		return
+// New creates a new device which shows its contents through the given presenter.
+// The presenter may be nil, in which case the contents are not shown anywhere.
+func New(p Presenter) *Device {
+	return &Device{
+		presenter: p,
 	}
-
-	gl.UseProgram(d.shader)
-	gl.BindVertexArray(d.vao)
-
-	gl.ActiveTexture(gl.TEXTURE0)
-	gl.BindTexture(gl.TEXTURE_2D, d.sceneTex)
-
-	gl.DrawArrays(gl.TRIANGLES, 0, 6)
 }
 
 // ID returns the device identifier.
@@ -75,49 +65,23 @@ func (d *Device) ID() devices.ID {
 
 // Startup initializes device resources.
 func (d *Device) Startup(devices.IntFunc) error {
-	var err error
-
-	d.shader, err = compileProgram(vertex, "", fragment)
-	if err != nil {
-		log.Fatal(err)
-		return errors.Wrapf(err, "failed to compile shaders")
+	if d.presenter == nil {
+		return nil
 	}
 
-	gl.UseProgram(d.shader)
-
-	gl.GenVertexArrays(1, &d.vao)
-	gl.BindVertexArray(d.vao)
-
-	gl.GenBuffers(1, &d.vbo)
-	gl.BindBuffer(gl.ARRAY_BUFFER, d.vbo)
-	gl.BufferData(gl.ARRAY_BUFFER, len(quadVertices)*4, gl.Ptr(quadVertices), gl.STATIC_DRAW)
-
-	vertAttrib := uint32(gl.GetAttribLocation(d.shader, glStr("vertPos")))
-	texCoordAttrib := uint32(gl.GetAttribLocation(d.shader, glStr("vertTexCoord")))
-
-	gl.EnableVertexAttribArray(vertAttrib)
-	gl.VertexAttribPointer(vertAttrib, 3, gl.FLOAT, false, 5*4, gl.PtrOffset(0))
-
-	gl.EnableVertexAttribArray(texCoordAttrib)
-	gl.VertexAttribPointer(texCoordAttrib, 2, gl.FLOAT, false, 5*4, gl.PtrOffset(3*4))
-
-	d.sceneTex = makeTexture()
+	if err := d.presenter.Startup(); err != nil {
+		return errors.Wrapf(err, "failed to start presenter")
+	}
 
-	d.paletteDirty = true
-	d.sceneDirty = true
-	d.initialized = true
-	d.swap()
 	return nil
 }
 
 // Shutdown clears up device resources.
 func (d *Device) Shutdown() error {
-	d.initialized = false
-	gl.DeleteTextures(1, &d.sceneTex)
-	gl.DeleteBuffers(1, &d.vbo)
-	gl.DeleteVertexArrays(1, &d.vao)
-	gl.DeleteProgram(d.shader)
-	return nil
+	if d.presenter == nil {
+		return nil
+	}
+	return d.presenter.Shutdown()
 }
 
 // Int triggers an interrupt on the device. The device can read from- and write to system memory.
@@ -136,17 +100,41 @@ func (d *Device) Int(mem devices.Memory) {
 	}
 }
 
-func (d *Device) swap() {
-	if d.paletteDirty {
-		gl.UseProgram(d.shader)
-		palette := gl.GetUniformLocation(d.shader, glStr("palette"))
-		gl.Uniform4fv(palette, 16, &d.palette[0])
-		d.paletteDirty = false
+// SaveState writes the palette, sprite and scene buffers to w.
+func (d *Device) SaveState(w io.Writer) error {
+	return binary.Write(w, binary.LittleEndian, &state{
+		Palette: d.frame.Palette,
+		Scene:   d.frame.Scene,
+		Sprites: d.sprites,
+	})
+}
+
+// LoadState restores the palette, sprite and scene buffers from r.
+// The restored scene is handed to the presenter right away.
+func (d *Device) LoadState(r io.Reader) error {
+	var s state
+	if err := binary.Read(r, binary.LittleEndian, &s); err != nil {
+		return err
 	}
 
-	if d.sceneDirty {
-		uploadTexture(d.sceneTex, gl.RED, DisplayWidth, DisplayHeight, gl.RED, gl.UNSIGNED_BYTE, d.scene[:])
-		d.sceneDirty = false
+	d.frame.Palette = s.Palette
+	d.frame.Scene = s.Scene
+	d.sprites = s.Sprites
+	d.swap()
+	return nil
+}
+
+// state defines the device state as it is stored in a snapshot.
+type state struct {
+	Palette [PaletteSize]color.RGBA
+	Scene   [DisplayWidth * DisplayHeight]byte
+	Sprites [BufferSize * SpritePixelSize * SpritePixelSize]byte
+}
+
+// swap hands the current scene to the presenter.
+func (d *Device) swap() {
+	if d.presenter != nil {
+		d.presenter.Present(&d.frame)
 	}
 }
 
@@ -161,14 +149,12 @@ func (d *Device) draw(mem devices.Memory) {
 		d.drawSprite(x, y, n)
 		srcAddr += 3
 	}
-
-	d.sceneDirty = true
 }
 
 // drawSprite draws sprite n to the scene buffer at the given address.
 func (d *Device) drawSprite(x, y, n int) {
 	src := d.sprites[n*internalSpriteByteSize:]
-	dst := d.scene[:]
+	dst := d.frame.Scene[:]
 	dstAddr := y*DisplayWidth + x
 
 	for y := 0; y < SpritePixelSize; y++ {
@@ -184,8 +170,7 @@ func (d *Device) drawSprite(x, y, n int) {
 }
 
 func (d *Device) clear() {
-	copy(d.scene[:], d.empty[:])
-	d.sceneDirty = true
+	copy(d.frame.Scene[:], d.empty[:])
 }
 
 func (d *Device) setSprites(mem devices.Memory) {
@@ -205,35 +190,16 @@ func (d *Device) setSprites(mem devices.Memory) {
 }
 
 func (d *Device) setPalette(mem devices.Memory) {
-	pal := d.palette[:PaletteSize*4]
+	pal := d.frame.Palette[:]
 	addr := mem.U16(cpu.R1)
-	pal[3] = 0 // First entry is always transparent.
+	pal[0] = color.RGBA{} // First entry is always transparent.
 
 	for i := 1; i < PaletteSize; i++ {
-		r := mem.U8(addr + i*3 + 0)
-		g := mem.U8(addr + i*3 + 1)
-		b := mem.U8(addr + i*3 + 2)
-		n2f(r, g, b, pal[i*4:])
+		pal[i] = color.RGBA{
+			R: uint8(mem.U8(addr + i*3 + 0)),
+			G: uint8(mem.U8(addr + i*3 + 1)),
+			B: uint8(mem.U8(addr + i*3 + 2)),
+			A: 0xff,
+		}
 	}
-
-	d.paletteDirty = true
-}
-
-// n2f sets converts the given RGB components in the range [0,255] to
-// their floating point equivalents and stores them in p.
-func n2f(r, g, b int, p []float32) {
-	p[0] = float32(r&255) / 255
-	p[1] = float32(g&255) / 255
-	p[2] = float32(b&255) / 255
-	p[3] = 1
-}
-
-var quadVertices = []float32{
-	//  X, Y, Z, U, V
-	-1.0, -1.0, 0.0, 0.0, 1.0,
-	1.0, -1.0, 0.0, 1.0, 1.0,
-	-1.0, 1.0, 0.0, 0.0, 0.0,
-	1.0, -1.0, 0.0, 1.0, 1.0,
-	1.0, 1.0, 0.0, 1.0, 0.0,
-	-1.0, 1.0, 0.0, 0.0, 0.0,
 }
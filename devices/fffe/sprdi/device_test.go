@@ -0,0 +1,146 @@
+package sprdi
+
+import (
+	"fmt"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hexaflex/svm/devices/fffe/cpu"
+)
+
+func TestDrawSprite(t *testing.T) {
+	p := NewImagePresenter()
+	d := New(p)
+
+	if err := d.Startup(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	defer d.Shutdown()
+
+	mem := make(cpu.Memory, cpu.MemoryCapacity)
+
+	// Palette at 0x100: entry 1 is red, entry 2 is green.
+	mem.Write(0x100+3, []byte{0xff, 0x00, 0x00, 0x00, 0xff, 0x00})
+	mem.SetU16(cpu.R0, setPalette)
+	mem.SetU16(cpu.R1, 0x100)
+	d.Int(mem)
+
+	// Sprite 0 at 0x200: left half red, right half transparent, except
+	// for the top row, which is entirely green.
+	sprite := mem[0x200 : 0x200+SpriteByteSize]
+	for i := range sprite {
+		if i < 4 {
+			sprite[i] = 0x22
+		} else if i%4 < 2 {
+			sprite[i] = 0x11
+		}
+	}
+
+	mem.SetU16(cpu.R0, setSprites)
+	mem.SetU16(cpu.R1, 0x200)
+	mem.SetU16(cpu.R2, 0)
+	mem.SetU16(cpu.R3, 1)
+	d.Int(mem)
+
+	// Draw sprite 0 at (16, 8).
+	mem.Write(0x300, []byte{0, 16, 8})
+	mem.SetU16(cpu.R0, draw)
+	mem.SetU16(cpu.R1, 0x300)
+	mem.SetU16(cpu.R2, 1)
+	d.Int(mem)
+
+	// Nothing is presented until the buffers are swapped.
+	if c := p.Image().RGBAAt(16, 9); c != (color.RGBA{}) {
+		t.Fatalf("pixel before swap: want %v; have %v", color.RGBA{}, c)
+	}
+
+	mem.SetU16(cpu.R0, swap)
+	d.Int(mem)
+
+	red := color.RGBA{R: 0xff, A: 0xff}
+	green := color.RGBA{G: 0xff, A: 0xff}
+
+	tests := []struct {
+		x, y int
+		want color.RGBA
+	}{
+		{15, 8, Background},
+		{16, 8, green},
+		{23, 8, green},
+		{16, 9, red},
+		{19, 15, red},
+		{20, 9, Background},
+		{23, 15, Background},
+		{16, 16, Background},
+	}
+
+	img := p.Image()
+	for _, tt := range tests {
+		if c := img.RGBAAt(tt.x, tt.y); c != tt.want {
+			t.Fatalf("pixel (%d, %d): want %v; have %v", tt.x, tt.y, tt.want, c)
+		}
+	}
+
+	mem.SetU16(cpu.R0, clear)
+	d.Int(mem)
+	mem.SetU16(cpu.R0, swap)
+	d.Int(mem)
+
+	if c := p.Image().RGBAAt(16, 9); c != Background {
+		t.Fatalf("pixel after clear: want %v; have %v", Background, c)
+	}
+}
+
+func TestFrameDumper(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sprdi")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	var swaps int
+	fd := NewFrameDumper(filepath.Join(dir, "frames"))
+	d := New(MultiPresenter(fd, PresenterFunc(func(*Frame) { swaps++ })))
+
+	if err := d.Startup(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	mem := make(cpu.Memory, cpu.MemoryCapacity)
+	mem.SetU16(cpu.R0, swap)
+	for i := 0; i < 3; i++ {
+		d.Int(mem)
+	}
+
+	if err := d.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	if swaps != 3 || fd.Count() != 3 {
+		t.Fatalf("expected 3 swaps and frames; have %d and %d", swaps, fd.Count())
+	}
+
+	for i := 0; i < 3; i++ {
+		file := filepath.Join(dir, "frames", fmt.Sprintf("%06d.png", i))
+		r, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		img, err := png.Decode(r)
+		r.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", file, err)
+		}
+
+		if b := img.Bounds(); b.Dx() != DisplayWidth || b.Dy() != DisplayHeight {
+			t.Fatalf("%s: unexpected image size %v", file, b)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package sprdi
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// FrameDumper is a presenter which writes every presented frame to a
+// numbered PNG file in a directory: 000000.png, 000001.png, etc.
+//
+// Numbering continues across restarts of the device, so rebooting a
+// program does not overwrite frames written earlier.
+type FrameDumper struct {
+	dir   string
+	count int
+	err   error
+}
+
+var _ Presenter = &FrameDumper{}
+
+// NewFrameDumper creates a frame dumper which writes to the given directory.
+// The directory is created if it does not exist yet.
+func NewFrameDumper(dir string) *FrameDumper {
+	return &FrameDumper{
+		dir: dir,
+	}
+}
+
+// Startup creates the output directory.
+func (fd *FrameDumper) Startup() error {
+	return os.MkdirAll(fd.dir, 0755)
+}
+
+// Shutdown returns the first error encountered while writing frames, if any.
+func (fd *FrameDumper) Shutdown() error {
+	return fd.err
+}
+
+// Present writes the given frame to the next numbered file.
+// Once a write has failed, all further frames are ignored.
+func (fd *FrameDumper) Present(f *Frame) {
+	if fd.err != nil {
+		return
+	}
+
+	file := filepath.Join(fd.dir, fmt.Sprintf("%06d.png", fd.count))
+	if err := f.SavePNG(file); err != nil {
+		fd.err = errors.Wrapf(err, "failed to dump frame %d", fd.count)
+		return
+	}
+
+	fd.count++
+}
+
+// Count returns the number of frames written so far.
+func (fd *FrameDumper) Count() int {
+	return fd.count
+}
+
+// Err returns the first error encountered while writing frames, if any.
+func (fd *FrameDumper) Err() error {
+	return fd.err
+}
@@ -0,0 +1,47 @@
+package sprdi
+
+import (
+	"image"
+	"image/color"
+)
+
+// Background is the color used for pixels which refer to the transparent
+// palette entry, when a frame is converted to an image.
+var Background = color.RGBA{A: 0xff}
+
+// Frame defines the contents of the display at a given moment.
+type Frame struct {
+	Scene   [DisplayWidth * DisplayHeight]byte // Palette index for each pixel.
+	Palette [PaletteSize]color.RGBA            // Colors referenced by the scene. The first entry is transparent.
+}
+
+// ColorAt returns the color of the pixel at the given coordinates.
+func (f *Frame) ColorAt(x, y int) color.RGBA {
+	c := f.Palette[f.Scene[y*DisplayWidth+x]%PaletteSize]
+	if c.A == 0 {
+		return Background
+	}
+	return c
+}
+
+// Image returns the frame contents as a new RGBA image.
+func (f *Frame) Image() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, DisplayWidth, DisplayHeight))
+	f.Draw(img)
+	return img
+}
+
+// Draw writes the frame contents into the given image.
+// The image is expected to be at least DisplayWidth x DisplayHeight pixels large.
+func (f *Frame) Draw(dst *image.RGBA) {
+	for y := 0; y < DisplayHeight; y++ {
+		row := dst.Pix[y*dst.Stride:]
+		for x := 0; x < DisplayWidth; x++ {
+			c := f.ColorAt(x, y)
+			row[x*4+0] = c.R
+			row[x*4+1] = c.G
+			row[x*4+2] = c.B
+			row[x*4+3] = c.A
+		}
+	}
+}
@@ -1,4 +1,4 @@
-package sprdi
+package opengl
 
 import (
 	"fmt"
@@ -0,0 +1,155 @@
+// Package opengl implements a sprdi presenter which renders the display through OpenGL.
+package opengl
+
+import (
+	"log"
+	"sync"
+
+	"github.com/go-gl/gl/v4.2-core/gl"
+	"github.com/pkg/errors"
+
+	"github.com/hexaflex/svm/devices/fffe/sprdi"
+)
+
+// Presenter renders the display contents through OpenGL.
+//
+// Present is safe to call from any goroutine. All other methods must be
+// called from the goroutine which owns the OpenGL context.
+type Presenter struct {
+	m           sync.Mutex
+	frame       sprdi.Frame                    // Most recently presented frame.
+	palette     [sprdi.PaletteSize * 4]float32 // Frame palette in the form expected by the shader.
+	dirty       bool                           // Has the frame changed since it was last uploaded?
+	shader      uint32
+	vao         uint32
+	vbo         uint32
+	sceneTex    uint32
+	initialized bool
+}
+
+var _ sprdi.Presenter = &Presenter{}
+
+// New creates a new presenter.
+func New() *Presenter {
+	return &Presenter{}
+}
+
+// Startup initializes OpenGL resources.
+func (p *Presenter) Startup() error {
+	var err error
+
+	p.shader, err = compileProgram(vertex, "", fragment)
+	if err != nil {
+		log.Fatal(err)
+		return errors.Wrapf(err, "failed to compile shaders")
+	}
+
+	gl.UseProgram(p.shader)
+
+	gl.GenVertexArrays(1, &p.vao)
+	gl.BindVertexArray(p.vao)
+
+	gl.GenBuffers(1, &p.vbo)
+	gl.BindBuffer(gl.ARRAY_BUFFER, p.vbo)
+	gl.BufferData(gl.ARRAY_BUFFER, len(quadVertices)*4, gl.Ptr(quadVertices), gl.STATIC_DRAW)
+
+	vertAttrib := uint32(gl.GetAttribLocation(p.shader, glStr("vertPos")))
+	texCoordAttrib := uint32(gl.GetAttribLocation(p.shader, glStr("vertTexCoord")))
+
+	gl.EnableVertexAttribArray(vertAttrib)
+	gl.VertexAttribPointer(vertAttrib, 3, gl.FLOAT, false, 5*4, gl.PtrOffset(0))
+
+	gl.EnableVertexAttribArray(texCoordAttrib)
+	gl.VertexAttribPointer(texCoordAttrib, 2, gl.FLOAT, false, 5*4, gl.PtrOffset(3*4))
+
+	p.sceneTex = makeTexture()
+
+	p.m.Lock()
+	p.dirty = true
+	p.m.Unlock()
+
+	p.initialized = true
+	return nil
+}
+
+// Shutdown clears up OpenGL resources.
+func (p *Presenter) Shutdown() error {
+	p.initialized = false
+	gl.DeleteTextures(1, &p.sceneTex)
+	gl.DeleteBuffers(1, &p.vbo)
+	gl.DeleteVertexArrays(1, &p.vao)
+	gl.DeleteProgram(p.shader)
+	return nil
+}
+
+// Present stores a copy of the given frame. It is uploaded to the GPU by the next call to Draw.
+func (p *Presenter) Present(f *sprdi.Frame) {
+	p.m.Lock()
+	p.frame = *f
+	p.dirty = true
+	p.m.Unlock()
+}
+
+// CopyFrame copies the most recently presented frame into f.
+func (p *Presenter) CopyFrame(f *sprdi.Frame) {
+	p.m.Lock()
+	*f = p.frame
+	p.m.Unlock()
+}
+
+// Draw renders the most recently presented frame.
+func (p *Presenter) Draw() {
+	if !p.initialized {
+		return
+	}
+
+	p.upload()
+
+	gl.UseProgram(p.shader)
+	gl.BindVertexArray(p.vao)
+
+	gl.ActiveTexture(gl.TEXTURE0)
+	gl.BindTexture(gl.TEXTURE_2D, p.sceneTex)
+
+	gl.DrawArrays(gl.TRIANGLES, 0, 6)
+}
+
+// upload copies the current frame to the GPU if it has changed.
+func (p *Presenter) upload() {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if !p.dirty {
+		return
+	}
+
+	for i, c := range p.frame.Palette {
+		n2f(c.R, c.G, c.B, c.A, p.palette[i*4:])
+	}
+
+	gl.UseProgram(p.shader)
+	palette := gl.GetUniformLocation(p.shader, glStr("palette"))
+	gl.Uniform4fv(palette, sprdi.PaletteSize, &p.palette[0])
+
+	uploadTexture(p.sceneTex, gl.RED, sprdi.DisplayWidth, sprdi.DisplayHeight, gl.RED, gl.UNSIGNED_BYTE, p.frame.Scene[:])
+	p.dirty = false
+}
+
+// n2f converts the given RGBA components in the range [0,255] to
+// their floating point equivalents and stores them in p.
+func n2f(r, g, b, a uint8, p []float32) {
+	p[0] = float32(r) / 255
+	p[1] = float32(g) / 255
+	p[2] = float32(b) / 255
+	p[3] = float32(a) / 255
+}
+
+var quadVertices = []float32{
+	//  X, Y, Z, U, V
+	-1.0, -1.0, 0.0, 0.0, 1.0,
+	1.0, -1.0, 0.0, 1.0, 1.0,
+	-1.0, 1.0, 0.0, 0.0, 0.0,
+	1.0, -1.0, 0.0, 1.0, 1.0,
+	1.0, 1.0, 0.0, 1.0, 0.0,
+	-1.0, 1.0, 0.0, 0.0, 0.0,
+}
@@ -0,0 +1,33 @@
+package sprdi
+
+import (
+	"image"
+	"image/png"
+	"io"
+	"os"
+)
+
+// WritePNG writes the frame contents to w as a PNG image.
+func (f *Frame) WritePNG(w io.Writer) error {
+	return png.Encode(w, f.Image())
+}
+
+// SavePNG writes the frame contents to the given file as a PNG image.
+func (f *Frame) SavePNG(file string) error {
+	return SavePNG(file, f.Image())
+}
+
+// SavePNG writes the given image to the given file in PNG format.
+func SavePNG(file string, img image.Image) error {
+	fd, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+
+	if err := png.Encode(fd, img); err != nil {
+		fd.Close()
+		return err
+	}
+
+	return fd.Close()
+}
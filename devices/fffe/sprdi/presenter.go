@@ -0,0 +1,108 @@
+package sprdi
+
+import (
+	"image"
+	"sync"
+)
+
+// Presenter shows the contents of the display somewhere.
+type Presenter interface {
+	// Startup initializes presenter resources.
+	Startup() error
+
+	// Shutdown cleans up presenter resources.
+	Shutdown() error
+
+	// Present is called whenever the program swaps the display buffers.
+	// The frame is only valid for the duration of the call. Implementations
+	// must copy whatever they need from it.
+	Present(*Frame)
+}
+
+// ImagePresenter renders the display contents into an image in system memory.
+// It requires no graphics hardware and is safe for concurrent use.
+type ImagePresenter struct {
+	m   sync.Mutex
+	img *image.RGBA
+}
+
+var _ Presenter = &ImagePresenter{}
+
+// NewImagePresenter creates a new image presenter.
+func NewImagePresenter() *ImagePresenter {
+	return &ImagePresenter{
+		img: image.NewRGBA(image.Rect(0, 0, DisplayWidth, DisplayHeight)),
+	}
+}
+
+// Startup initializes presenter resources.
+func (p *ImagePresenter) Startup() error { return nil }
+
+// Shutdown cleans up presenter resources.
+func (p *ImagePresenter) Shutdown() error { return nil }
+
+// Present renders the given frame.
+func (p *ImagePresenter) Present(f *Frame) {
+	p.m.Lock()
+	f.Draw(p.img)
+	p.m.Unlock()
+}
+
+// Image returns a copy of the most recently presented frame.
+func (p *ImagePresenter) Image() *image.RGBA {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	img := image.NewRGBA(p.img.Rect)
+	copy(img.Pix, p.img.Pix)
+	return img
+}
+
+// PresenterFunc adapts an ordinary function to the Presenter interface.
+// This is handy for inspecting frames as they are swapped, for example
+// to capture the display contents after a given number of swaps.
+type PresenterFunc func(*Frame)
+
+var _ Presenter = PresenterFunc(nil)
+
+// Startup initializes presenter resources.
+func (fn PresenterFunc) Startup() error { return nil }
+
+// Shutdown cleans up presenter resources.
+func (fn PresenterFunc) Shutdown() error { return nil }
+
+// Present calls fn(f).
+func (fn PresenterFunc) Present(f *Frame) { fn(f) }
+
+// MultiPresenter returns a presenter which forwards all calls to each of the
+// given presenters, in order.
+func MultiPresenter(p ...Presenter) Presenter {
+	return multiPresenter(p)
+}
+
+type multiPresenter []Presenter
+
+func (mp multiPresenter) Startup() error {
+	for _, p := range mp {
+		if err := p.Startup(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mp multiPresenter) Shutdown() error {
+	var err error
+	for _, p := range mp {
+		if perr := p.Shutdown(); perr != nil && err == nil {
+			err = perr
+		}
+	}
+	return err
+}
+
+func (mp multiPresenter) Present(f *Frame) {
+	for _, p := range mp {
+		p.Present(f)
+	}
+}
@@ -35,4 +35,8 @@ type Memory interface {
 	// RSTOverflow defines the state of the RST/divide-by-zero flag.
 	RSTDivideByZero() bool
 	SetRSTDivideByZero(v bool)
+
+	// RSTCarry defines the state of the RST/carry flag.
+	RSTCarry() bool
+	SetRSTCarry(v bool)
 }
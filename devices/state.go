@@ -0,0 +1,17 @@
+package devices
+
+import "io"
+
+// Stateful is implemented by devices whose internal state can be saved
+// and restored. This is what makes save states possible.
+//
+// Devices which do not implement it are left as they are when a state
+// is restored.
+type Stateful interface {
+	// SaveState writes the device's internal state to w.
+	SaveState(w io.Writer) error
+
+	// LoadState replaces the device's internal state with data
+	// read from r, as it was written by SaveState.
+	LoadState(r io.Reader) error
+}
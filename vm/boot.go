@@ -0,0 +1,154 @@
+package vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/hexaflex/svm/asm/ar"
+	"github.com/hexaflex/svm/devices/fffe/cpu"
+	"github.com/hexaflex/svm/devices/fffe/fd35"
+)
+
+// Boot (re)starts the cpu and loads the boot sector from the given floppy drive
+// into memory at address 0. It does not return until the transfer is complete.
+//
+// The cpu is paused while this happens. If it was running before,
+// it resumes execution of the freshly loaded program once booting succeeds.
+//
+// This mimics the bootloader described in docs/bootloader.txt.
+func Boot(c *CPUController, floppy *fd35.Device) error {
+	running := c.Running()
+	c.Stop()
+
+	// Unload existing resources before we load new things.
+	if err := c.Shutdown(); err != nil {
+		return err
+	}
+
+	if err := c.Startup(); err != nil {
+		return err
+	}
+
+	// Load boot sector from external floppy.
+	mem := c.Memory()
+	mem.SetU16(cpu.R0, fd35.ReadSector)
+	mem.SetU16(cpu.R1, 0)
+	mem.SetU16(cpu.R2, 0)
+	floppy.Int(mem)
+
+	if !mem.RSTCompare() {
+		return errors.New("boot failed: no readable medium in floppy drive")
+	}
+
+	clock := c.Clock()
+	for floppy.State() == fd35.StateBusy {
+		clock.Sleep(time.Millisecond)
+	}
+
+	if running {
+		c.Start()
+	}
+
+	return nil
+}
+
+// Load (re)starts the cpu and copies the given program into memory.
+// This runs a compiled program without a floppy image. The program is
+// either an archive, or raw code which is loaded at address 0.
+//
+// The cpu is paused while this happens. If it was running before,
+// it resumes execution of the freshly loaded program once loading succeeds.
+func Load(c *CPUController, program []byte) error {
+	a := ar.New()
+	if ar.IsArchive(program) {
+		if err := a.Load(bytes.NewReader(program)); err != nil {
+			return err
+		}
+	} else {
+		a.Instructions = program
+	}
+
+	return LoadArchive(c, a)
+}
+
+// LoadArchive (re)starts the cpu and copies the instructions in the given
+// archive into memory. Execution starts at the archive's entry point.
+//
+// The cpu is paused while this happens. If it was running before,
+// it resumes execution of the freshly loaded program once loading succeeds.
+func LoadArchive(c *CPUController, a *ar.Archive) error {
+	if len(a.Instructions) > cpu.UserMemoryCapacity {
+		return fmt.Errorf("program size %d exceeds memory capacity of %d bytes", len(a.Instructions), cpu.UserMemoryCapacity)
+	}
+
+	running := c.Running()
+	c.Stop()
+
+	if err := c.Shutdown(); err != nil {
+		return err
+	}
+
+	if err := c.Startup(); err != nil {
+		return err
+	}
+
+	mem := c.Memory()
+	load := a.LoadAddress()
+	if load < len(a.Instructions) {
+		mem.Write(load, a.Instructions[load:])
+	}
+	mem.SetU16(cpu.RIP, a.Entry)
+
+	if running {
+		c.Start()
+	}
+
+	return nil
+}
+
+// NewFloppy creates a floppy drive with the given image file inserted.
+// Archives are not floppy images. The drive is left empty for those, so
+// they can be run with BootFile.
+func NewFloppy(file string, readonly bool) *fd35.Device {
+	if isArchiveFile(file) {
+		file = ""
+	}
+	return fd35.New(file, readonly)
+}
+
+// BootFile (re)starts the cpu with the program in the given file. An
+// archive is copied into memory directly. Any other file is taken to be
+// the floppy image in the given drive and is booted from it.
+func BootFile(c *CPUController, floppy *fd35.Device, file string) error {
+	if !isArchiveFile(file) {
+		return Boot(c, floppy)
+	}
+
+	a, err := ar.LoadFile(file)
+	if err != nil {
+		return err
+	}
+
+	return LoadArchive(c, a)
+}
+
+// isArchiveFile returns true if the given file starts with an archive header.
+func isArchiveFile(file string) bool {
+	fd, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+
+	defer fd.Close()
+
+	magic := make([]byte, len(ar.Magic))
+	if _, err := io.ReadFull(fd, magic); err != nil {
+		return false
+	}
+
+	return ar.IsArchive(magic)
+}
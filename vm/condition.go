@@ -0,0 +1,368 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/hexaflex/svm/arch"
+	"github.com/hexaflex/svm/devices/fffe/cpu"
+)
+
+// ParseCondition compiles a breakpoint or watchpoint condition, like
+// "r0 == 5" or "[counter] > 10 && rst & 1".
+//
+// Operands are numbers in Go syntax (255, 0xff) or assembler syntax (16#ff),
+// register names and memory contents. Registers are read as unsigned values.
+// "[x]" reads the unsigned 16-bit value at address x. A type descriptor can
+// be used to read other types: "u8[x]", "i8[x]", "u16[x]" and "i16[x]".
+// Any other name is passed to resolve, which may be nil. Use Source.Resolve
+// to support label names.
+//
+// Supported operators, from lowest to highest precedence:
+//
+//	||
+//	&&
+//	==  !=  <  <=  >  >=
+//	|  ^
+//	&
+//	<<  >>
+//	+  -
+//	*
+//	!  -  ~   (unary)
+//
+// The condition holds if the expression yields a non-zero value.
+func ParseCondition(expr string, resolve func(string) (int, error)) (cpu.Condition, error) {
+	tokens, err := tokenizeCondition(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	p := condParser{tokens: tokens, resolve: resolve}
+	f, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in condition", p.tokens[p.pos])
+	}
+
+	return func(m cpu.Memory) bool { return f(m) != 0 }, nil
+}
+
+// condFunc computes the value of a condition sub-expression.
+type condFunc func(cpu.Memory) int
+
+// condOperators lists the binary operators by precedence, lowest first.
+var condOperators = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"|", "^"},
+	{"&"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*"},
+}
+
+// condParser turns condition tokens into a condFunc.
+type condParser struct {
+	tokens  []string
+	pos     int
+	resolve func(string) (int, error)
+}
+
+// peek returns the current token, or "" at the end of the input.
+func (p *condParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+// next returns the current token and moves on to the next one.
+func (p *condParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+// expect consumes the given token or returns an error.
+func (p *condParser) expect(tok string) error {
+	if have := p.next(); have != tok {
+		if len(have) == 0 {
+			return fmt.Errorf("expected %q at end of condition", tok)
+		}
+		return fmt.Errorf("expected %q in condition; have %q", tok, have)
+	}
+	return nil
+}
+
+// parseBinary parses a sequence of operands, joined by binary operators
+// of the given precedence level or higher.
+func (p *condParser) parseBinary(level int) (condFunc, error) {
+	if level >= len(condOperators) {
+		return p.parseUnary()
+	}
+
+	a, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := p.peek()
+		if !hasString(condOperators[level], op) {
+			return a, nil
+		}
+
+		p.next()
+		b, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		a = binaryCondition(op, a, b)
+	}
+}
+
+// parseUnary parses an operand with optional unary operators.
+func (p *condParser) parseUnary() (condFunc, error) {
+	switch p.peek() {
+	case "!", "-", "~":
+		op := p.next()
+		a, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		switch op {
+		case "!":
+			return func(m cpu.Memory) int { return _bool(a(m) == 0) }, nil
+		case "-":
+			return func(m cpu.Memory) int { return -a(m) }, nil
+		default:
+			return func(m cpu.Memory) int { return ^a(m) }, nil
+		}
+	}
+
+	return p.parseOperand()
+}
+
+// parseOperand parses a number, register, memory reference, name or
+// parenthesized expression.
+func (p *condParser) parseOperand() (condFunc, error) {
+	tok := p.next()
+
+	switch {
+	case len(tok) == 0:
+		return nil, fmt.Errorf("unexpected end of condition")
+
+	case tok == "(":
+		a, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		return a, p.expect(")")
+
+	case tok == "[":
+		return p.parseMemory(arch.U16)
+
+	case isTypeName(tok) && p.peek() == "[":
+		p.next()
+		return p.parseMemory(typeByName(tok))
+
+	case unicode.IsDigit(rune(tok[0])):
+		n, err := ParseNumber(tok)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q in condition", tok)
+		}
+		return func(cpu.Memory) int { return n }, nil
+	}
+
+	if !isNameStart(rune(tok[0])) {
+		return nil, fmt.Errorf("unexpected %q in condition", tok)
+	}
+
+	if index := arch.RegisterIndex(tok); index > -1 {
+		if index == arch.RegisterIndex("rst") {
+			return func(m cpu.Memory) int { return m.U8(cpu.RST) }, nil
+		}
+
+		addr := cpu.R0 + index*2
+		return func(m cpu.Memory) int { return m.U16(addr) }, nil
+	}
+
+	if p.resolve == nil {
+		return nil, fmt.Errorf("unknown name %q in condition", tok)
+	}
+
+	n, err := p.resolve(tok)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(cpu.Memory) int { return n }, nil
+}
+
+// parseMemory parses the remainder of a memory reference, following the
+// opening bracket. The value is read with the given type.
+func (p *condParser) parseMemory(t arch.Type) (condFunc, error) {
+	addr, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.expect("]"); err != nil {
+		return nil, err
+	}
+
+	return func(m cpu.Memory) int {
+		a := addr(m)
+		if a < 0 || a+typeSize(t) > cpu.MemoryCapacity {
+			return 0
+		}
+
+		switch t {
+		case arch.U8:
+			return m.U8(a)
+		case arch.I8:
+			return m.I8(a)
+		case arch.I16:
+			return m.I16(a)
+		}
+		return m.U16(a)
+	}, nil
+}
+
+// binaryCondition returns a function which applies the given operator.
+func binaryCondition(op string, a, b condFunc) condFunc {
+	switch op {
+	case "||":
+		return func(m cpu.Memory) int { return _bool(a(m) != 0 || b(m) != 0) }
+	case "&&":
+		return func(m cpu.Memory) int { return _bool(a(m) != 0 && b(m) != 0) }
+	case "==":
+		return func(m cpu.Memory) int { return _bool(a(m) == b(m)) }
+	case "!=":
+		return func(m cpu.Memory) int { return _bool(a(m) != b(m)) }
+	case "<":
+		return func(m cpu.Memory) int { return _bool(a(m) < b(m)) }
+	case "<=":
+		return func(m cpu.Memory) int { return _bool(a(m) <= b(m)) }
+	case ">":
+		return func(m cpu.Memory) int { return _bool(a(m) > b(m)) }
+	case ">=":
+		return func(m cpu.Memory) int { return _bool(a(m) >= b(m)) }
+	case "|":
+		return func(m cpu.Memory) int { return a(m) | b(m) }
+	case "^":
+		return func(m cpu.Memory) int { return a(m) ^ b(m) }
+	case "&":
+		return func(m cpu.Memory) int { return a(m) & b(m) }
+	case "<<":
+		return func(m cpu.Memory) int { return a(m) << uint(b(m)&0x3f) }
+	case ">>":
+		return func(m cpu.Memory) int { return a(m) >> uint(b(m)&0x3f) }
+	case "+":
+		return func(m cpu.Memory) int { return a(m) + b(m) }
+	case "-":
+		return func(m cpu.Memory) int { return a(m) - b(m) }
+	}
+	return func(m cpu.Memory) int { return a(m) * b(m) }
+}
+
+// tokenizeCondition splits a condition into tokens.
+func tokenizeCondition(expr string) ([]string, error) {
+	var tokens []string
+
+	for i := 0; i < len(expr); {
+		r := rune(expr[i])
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case unicode.IsDigit(r) || isNameStart(r):
+			j := i + 1
+			for j < len(expr) && isNamePart(rune(expr[j])) {
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+
+		case i+1 < len(expr) && hasString([]string{"==", "!=", "<=", ">=", "&&", "||", "<<", ">>"}, expr[i:i+2]):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+
+		case strings.ContainsRune("()[]<>+-*&|^!~", r):
+			tokens = append(tokens, expr[i:i+1])
+			i++
+
+		default:
+			return nil, fmt.Errorf("unexpected %q in condition", r)
+		}
+	}
+
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty condition")
+	}
+
+	return tokens, nil
+}
+
+// isNameStart returns true if r can start a name.
+func isNameStart(r rune) bool {
+	return unicode.IsLetter(r) || r == '_' || r == '$'
+}
+
+// isNamePart returns true if r can be part of a name or number.
+// Names may hold scope separators and numbers may use assembler syntax.
+func isNamePart(r rune) bool {
+	return isNameStart(r) || unicode.IsDigit(r) || r == '.' || r == '/' || r == '#'
+}
+
+// isTypeName returns true if name is a type descriptor.
+func isTypeName(name string) bool {
+	return hasString([]string{"u8", "i8", "u16", "i16"}, strings.ToLower(name))
+}
+
+// typeByName returns the type for the given type descriptor.
+func typeByName(name string) arch.Type {
+	switch strings.ToLower(name) {
+	case "u8":
+		return arch.U8
+	case "i8":
+		return arch.I8
+	case "i16":
+		return arch.I16
+	}
+	return arch.U16
+}
+
+// typeSize returns the size in bytes of values with the given type.
+func typeSize(t arch.Type) int {
+	if t == arch.U8 || t == arch.I8 {
+		return 1
+	}
+	return 2
+}
+
+// hasString returns true if set contains v.
+func hasString(set []string, v string) bool {
+	for _, s := range set {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// _bool returns 1 if v is true and 0 otherwise.
+func _bool(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
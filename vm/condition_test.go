@@ -0,0 +1,59 @@
+package vm
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hexaflex/svm/devices/fffe/cpu"
+)
+
+func TestParseCondition(t *testing.T) {
+	mem := make(cpu.Memory, cpu.MemoryCapacity)
+	mem.SetU16(cpu.R0, 5)
+	mem.SetU16(cpu.R1, 0xfffe)
+	mem.SetU8(cpu.RST, 1)
+	mem.SetU16(0x100, 0x1234)
+
+	resolve := func(name string) (int, error) {
+		if name == "main/counter" {
+			return 0x100, nil
+		}
+		return 0, fmt.Errorf("unknown location %q", name)
+	}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"r0 == 5", true},
+		{"R0 != 5", false},
+		{"r0", true},
+		{"!r0", false},
+		{"r0 + 1 == 6 && rst & 1", true},
+		{"r0 < 5 || r0 >= 5", true},
+		{"r1 == 0xfffe", true},
+		{"i16[0x10002] == -2", true},
+		{"[main/counter] == 16#1234", true},
+		{"u8[main/counter + 1] == 0x34", true},
+		{"(r0 - 3) * 2 == 4", true},
+		{"1 << 4 == 16 && -r0 == ~r0 + 1", true},
+		{"[0xffff] == 0", true},
+	}
+
+	for _, tt := range tests {
+		cond, err := ParseCondition(tt.expr, resolve)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.expr, err)
+		}
+
+		if have := cond(mem); have != tt.want {
+			t.Fatalf("%s: want %v; have %v", tt.expr, tt.want, have)
+		}
+	}
+
+	for _, expr := range []string{"", "r0 ==", "(r0", "[r0", "foo == 1", "r0 = 1", "1 2"} {
+		if _, err := ParseCondition(expr, resolve); err == nil {
+			t.Fatalf("%q: expected an error", expr)
+		}
+	}
+}
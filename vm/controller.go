@@ -0,0 +1,440 @@
+// Package vm provides the runtime pieces shared by the SVM front-ends.
+// This covers cpu execution control, loading programs and trace output.
+package vm
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hexaflex/svm/devices"
+	"github.com/hexaflex/svm/devices/fffe/cpu"
+)
+
+// DeterministicFrequency is the frequency in herz of the virtual clock used in
+// deterministic mode, when no target frequency has been set.
+const DeterministicFrequency = 1000000
+
+// batchTime is the amount of time the execution goroutine runs the cpu,
+// before giving other goroutines a chance to access it.
+const batchTime = time.Millisecond * 2
+
+// CPUController controls the execution of a CPU.
+//
+// Execution can be driven directly through Step and Run, or by a dedicated
+// goroutine started with Spawn. All methods are safe for concurrent use.
+// Step, Run, Startup, Shutdown, Snapshot and Restore never overlap with a
+// batch of instructions executed in the background.
+type CPUController struct {
+	m           sync.Mutex // Guards cpu access.
+	cpu         *cpu.CPU
+	start       int64  // Time at which execution was last started or stopped, in Unix nanoseconds.
+	cycleCount  uint64 // Cycles executed since start.
+	frequency   int64  // Target frequency in herz. Zero means unbounded.
+	running     uint32 // Is the cpu running? 1 if true.
+	wake        chan struct{}
+	quit        chan struct{}
+	done        chan struct{}
+	stopHandler func(error)
+}
+
+// NewCPUController creates a new CPU controller.
+func NewCPUController(trace cpu.TraceFunc, devices ...devices.Device) *CPUController {
+	cpu := cpu.New(trace)
+
+	for _, dev := range devices {
+		cpu.Connect(dev)
+	}
+
+	return &CPUController{
+		cpu:  cpu,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// SetDeterministic enables deterministic execution. The cpu and its peripherals
+// then use a virtual clock which only advances as the cpu executes cycles, and
+// the random number generator is reset to the given seed at startup. A seed
+// of zero selects cpu.DefaultSeed. The same image with the same input then
+// always behaves the same way.
+//
+// The virtual clock runs at the target frequency. Call SetFrequency first
+// to change it from DeterministicFrequency. This takes effect at the next Startup.
+func (c *CPUController) SetDeterministic(seed int64) {
+	if seed == 0 {
+		seed = cpu.DefaultSeed
+	}
+
+	frequency := int(atomic.LoadInt64(&c.frequency))
+	if frequency == 0 {
+		frequency = DeterministicFrequency
+	}
+
+	c.m.Lock()
+	c.cpu.SetClock(devices.NewVirtualClock(frequency))
+	c.cpu.SetSeed(seed)
+	c.m.Unlock()
+}
+
+// SetFrequency sets the target clock frequency in herz. Run, Throttle and
+// the execution goroutine keep execution from going any faster than this.
+// Zero means unbounded.
+func (c *CPUController) SetFrequency(hz int) {
+	if hz < 0 {
+		hz = 0
+	}
+	atomic.StoreInt64(&c.frequency, int64(hz))
+	c.setRunning(c.Running())
+}
+
+// SetStopHandler sets a function which is called when the execution goroutine
+// stops because the program halted, crashed or reached a breakpoint or
+// watchpoint. The error is nil if it halted. It is a *cpu.Break for
+// breakpoints and watchpoints. The function is called on the execution
+// goroutine.
+func (c *CPUController) SetStopHandler(f func(error)) {
+	c.m.Lock()
+	c.stopHandler = f
+	c.m.Unlock()
+}
+
+// Clock returns the clock used by the cpu and its peripherals.
+func (c *CPUController) Clock() devices.Clock {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.cpu.Clock()
+}
+
+// Running returns true if the CPU is currently running.
+func (c *CPUController) Running() bool {
+	return atomic.LoadUint32(&c.running) == 1
+}
+
+// Frequency returns the current clock frequency in herz.
+// This is the number of executed cycles per second since execution started.
+func (c *CPUController) Frequency() float64 {
+	if c.Running() {
+		start := time.Unix(0, atomic.LoadInt64(&c.start))
+		return float64(atomic.LoadUint64(&c.cycleCount)) / time.Since(start).Seconds()
+	}
+	return 0
+}
+
+// ToggleRun starts or stops program execution.
+func (c *CPUController) ToggleRun() {
+	c.setRunning(!c.Running())
+}
+
+// Start begins execution of the program.
+func (c *CPUController) Start() {
+	c.setRunning(true)
+}
+
+// Stop pauses execution of the program. The execution goroutine stops
+// after the instruction it is currently executing.
+func (c *CPUController) Stop() {
+	c.setRunning(false)
+}
+
+// Spawn starts the execution goroutine. From then on, the program runs in the
+// background whenever the controller is running. Use Close to end it.
+func (c *CPUController) Spawn() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.quit != nil {
+		return
+	}
+
+	c.quit = make(chan struct{})
+	c.done = make(chan struct{})
+	go c.loop(c.quit, c.done)
+}
+
+// Close ends the execution goroutine, if there is one.
+// It does not return until the goroutine has exited.
+func (c *CPUController) Close() {
+	c.m.Lock()
+	quit, done := c.quit, c.done
+	c.quit, c.done = nil, nil
+	c.m.Unlock()
+
+	if quit != nil {
+		close(quit)
+		<-done
+	}
+}
+
+// loop runs the cpu in batches whenever it is running, until quit is closed.
+func (c *CPUController) loop(quit, done chan struct{}) {
+	defer close(done)
+
+	for {
+		if !c.Running() {
+			select {
+			case <-quit:
+				return
+			case <-c.wake:
+			}
+			continue
+		}
+
+		select {
+		case <-quit:
+			return
+		default:
+		}
+
+		c.m.Lock()
+		ended, err := c.run(batchTime)
+		handler := c.stopHandler
+		c.m.Unlock()
+
+		if ended && handler != nil {
+			handler(err)
+		}
+	}
+}
+
+// Step performs a single exection step.
+// It is not subject to the target frequency.
+func (c *CPUController) Step() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	_, err := c.step()
+	return err
+}
+
+// step performs a single exection step. The caller must hold the lock.
+// Returns true if the program halted, crashed or reached a breakpoint
+// or watchpoint.
+func (c *CPUController) step() (bool, error) {
+	before := c.cpu.Cycles()
+	err := c.cpu.Step()
+	atomic.AddUint64(&c.cycleCount, c.cpu.Cycles()-before)
+
+	if err != nil {
+		c.setRunning(false)
+		if err != io.EOF {
+			return true, err
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// Run executes instructions for the given amount of wall-clock time, or until
+// the cpu stops running. If a target frequency is set, execution is throttled
+// to match it. Errors are handled as described for Step.
+func (c *CPUController) Run(d time.Duration) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	_, err := c.run(d)
+	return err
+}
+
+// run implements Run. The caller must hold the lock.
+// Returns true if the program halted or crashed.
+func (c *CPUController) run(d time.Duration) (bool, error) {
+	deadline := time.Now().Add(d)
+
+	for n := 0; c.Running(); n++ {
+		// Checking the time is relatively expensive, so don't do it every step.
+		if n&0x3f == 0 {
+			if time.Now().After(deadline) {
+				return false, nil
+			}
+			c.throttle(deadline)
+		}
+
+		if ended, err := c.step(); ended {
+			return true, err
+		}
+	}
+
+	return false, nil
+}
+
+// Throttle sleeps for as long as execution is ahead of the target frequency.
+// It returns immediately if no target frequency is set.
+func (c *CPUController) Throttle() {
+	c.throttle(time.Time{})
+}
+
+// throttle sleeps for as long as execution is ahead of the target frequency,
+// but not past the given deadline, unless it is zero.
+func (c *CPUController) throttle(deadline time.Time) {
+	frequency := atomic.LoadInt64(&c.frequency)
+	if frequency == 0 || !c.Running() {
+		return
+	}
+
+	start := time.Unix(0, atomic.LoadInt64(&c.start))
+	elapsed := float64(atomic.LoadUint64(&c.cycleCount)) / float64(frequency)
+	due := start.Add(time.Duration(elapsed * float64(time.Second)))
+	if !deadline.IsZero() && due.After(deadline) {
+		due = deadline
+	}
+
+	if wait := time.Until(due); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// SetBreakpoint sets a breakpoint at the given address. If cond is not nil,
+// it only stops execution if cond returns true. Step and Run return a
+// *cpu.Break when one is reached. See cpu.CPU.SetBreakpoint for details.
+func (c *CPUController) SetBreakpoint(addr int, cond cpu.Condition) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.cpu.SetBreakpoint(addr, cond)
+}
+
+// ClearBreakpoint removes the breakpoint at the given address.
+// Returns false if there was none.
+func (c *CPUController) ClearBreakpoint(addr int) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.cpu.ClearBreakpoint(addr)
+}
+
+// ClearBreakpoints removes all breakpoints.
+func (c *CPUController) ClearBreakpoints() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.cpu.ClearBreakpoints()
+}
+
+// Breakpoints returns the addresses of all breakpoints in ascending order.
+func (c *CPUController) Breakpoints() []int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.cpu.Breakpoints()
+}
+
+// AddWatchpoint adds the given memory watchpoint. Step and Run return
+// a *cpu.Break when it is triggered.
+func (c *CPUController) AddWatchpoint(w *cpu.Watchpoint) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.cpu.AddWatchpoint(w)
+}
+
+// RemoveWatchpoint removes the given watchpoint.
+// Returns false if it was not added before.
+func (c *CPUController) RemoveWatchpoint(w *cpu.Watchpoint) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.cpu.RemoveWatchpoint(w)
+}
+
+// ClearWatchpoints removes all watchpoints.
+func (c *CPUController) ClearWatchpoints() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.cpu.ClearWatchpoints()
+}
+
+// Watchpoints returns all watchpoints, sorted by address.
+func (c *CPUController) Watchpoints() []*cpu.Watchpoint {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.cpu.Watchpoints()
+}
+
+// Resume makes the next step execute the current instruction, even if
+// there is a breakpoint at its address.
+func (c *CPUController) Resume() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.cpu.Resume()
+}
+
+// SetHistory enables recording of the last n steps, so they can be
+// undone with StepBack. Zero disables it. See cpu.CPU.SetHistory.
+func (c *CPUController) SetHistory(n int) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.cpu.SetHistory(n)
+}
+
+// History returns the number of steps which can currently be undone.
+func (c *CPUController) History() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.cpu.History()
+}
+
+// StepBack undoes the most recent step. Returns cpu.ErrNoHistory if there
+// is nothing left to undo, or a *cpu.Break if the instruction executed next
+// has a breakpoint.
+func (c *CPUController) StepBack() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.cpu.StepBack()
+}
+
+// Cycles returns the number of cycles executed since the program was started.
+func (c *CPUController) Cycles() uint64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.cpu.Cycles()
+}
+
+// Memory returns the cpu's internal memory bank.
+//
+// Access to it is not synchronized with the execution goroutine. Stop the cpu
+// first if consistent results are needed.
+func (c *CPUController) Memory() devices.Memory {
+	return c.cpu.Memory()
+}
+
+// Snapshot writes the complete machine state to w.
+// See cpu.CPU.Snapshot for details.
+func (c *CPUController) Snapshot(w io.Writer) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.cpu.Snapshot(w)
+}
+
+// Restore replaces the complete machine state with a snapshot read from r.
+// See cpu.CPU.Restore for details.
+func (c *CPUController) Restore(r io.Reader) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.cpu.Restore(r)
+}
+
+// Startup loads the given program and initializes the cpu and connected peripherals.
+func (c *CPUController) Startup() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.cpu.Startup()
+}
+
+// Shutdown disposes of CPU and peripheral resources.
+func (c *CPUController) Shutdown() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.cpu.Shutdown()
+}
+
+// setRunning determines of the CPU is running or is paused.
+func (c *CPUController) setRunning(v bool) {
+	atomic.StoreInt64(&c.start, time.Now().UnixNano())
+	atomic.StoreUint64(&c.cycleCount, 0)
+
+	if v {
+		atomic.StoreUint32(&c.running, 1)
+
+		// Wake up the execution goroutine if it is waiting.
+		select {
+		case c.wake <- struct{}{}:
+		default:
+		}
+	} else {
+		atomic.StoreUint32(&c.running, 0)
+	}
+}
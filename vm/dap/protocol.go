@@ -0,0 +1,244 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// request defines a request sent by the client.
+type request struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+// response defines the reply to a request.
+type response struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+// event defines a notification sent to the client.
+type event struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+// readMessage reads the next message from r. Each message has a header,
+// followed by an empty line and a JSON body. The header must define the
+// body length in a Content-Length field.
+func readMessage(r *bufio.Reader) ([]byte, error) {
+	size := -1
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			break
+		}
+
+		index := strings.Index(line, ":")
+		if index == -1 {
+			return nil, fmt.Errorf("invalid message header %q", line)
+		}
+
+		if strings.EqualFold(strings.TrimSpace(line[:index]), "Content-Length") {
+			size, err = strconv.Atoi(strings.TrimSpace(line[index+1:]))
+			if err != nil || size < 0 {
+				return nil, fmt.Errorf("invalid content length %q", line[index+1:])
+			}
+		}
+	}
+
+	if size == -1 {
+		return nil, fmt.Errorf("message has no content length")
+	}
+
+	data := make([]byte, size)
+	_, err := io.ReadFull(r, data)
+	return data, err
+}
+
+// writer writes messages to the client. It may be used from multiple
+// goroutines. Each message is assigned a new sequence number.
+type writer struct {
+	m   sync.Mutex
+	w   io.Writer
+	seq int
+}
+
+// respond sends a successful response to the given request.
+func (w *writer) respond(req *request, body interface{}) error {
+	return w.write(&response{
+		Type:       "response",
+		RequestSeq: req.Seq,
+		Success:    true,
+		Command:    req.Command,
+		Body:       body,
+	})
+}
+
+// fail sends an error response to the given request.
+func (w *writer) fail(req *request, err error) error {
+	return w.write(&response{
+		Type:       "response",
+		RequestSeq: req.Seq,
+		Command:    req.Command,
+		Message:    err.Error(),
+		Body:       map[string]interface{}{"error": errorMessage{Format: err.Error()}},
+	})
+}
+
+// event sends an event with the given name and body.
+func (w *writer) event(name string, body interface{}) error {
+	return w.write(&event{
+		Type:  "event",
+		Event: name,
+		Body:  body,
+	})
+}
+
+// write assigns a sequence number to msg and writes it to the client.
+func (w *writer) write(msg interface{}) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	w.seq++
+	switch v := msg.(type) {
+	case *response:
+		v.Seq = w.seq
+	case *event:
+		v.Seq = w.seq
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(w.w, "Content-Length: %d\r\n\r\n", len(data)); err != nil {
+		return err
+	}
+
+	_, err = w.w.Write(data)
+	return err
+}
+
+// errorMessage describes an error in a failed response.
+type errorMessage struct {
+	Format string `json:"format"`
+}
+
+// capabilities lists the optional protocol features the server supports.
+type capabilities struct {
+	SupportsConfigurationDoneRequest bool `json:"supportsConfigurationDoneRequest"`
+	SupportsConditionalBreakpoints   bool `json:"supportsConditionalBreakpoints"`
+	SupportsSetVariable              bool `json:"supportsSetVariable"`
+	SupportsStepBack                 bool `json:"supportsStepBack"`
+	SupportsTerminateRequest         bool `json:"supportsTerminateRequest"`
+}
+
+// launchArguments defines the arguments for the launch request.
+type launchArguments struct {
+	Program       string   `json:"program"`       // Path to the .img or .a file to run.
+	StopOnEntry   bool     `json:"stopOnEntry"`   // Stop before the first instruction?
+	Include       []string `json:"include"`       // Search paths for source files.
+	Readonly      bool     `json:"readonly"`      // Is the image write protected?
+	Clock         string   `json:"clock"`         // Target cpu frequency. E.g.: 1MHz.
+	Deterministic bool     `json:"deterministic"` // Run in deterministic mode?
+	Seed          *int64   `json:"seed"`          // RNG seed for deterministic mode.
+	History       *int     `json:"history"`       // Number of instructions which can be undone.
+}
+
+// source identifies a source file.
+type source struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+// sourceBreakpoint defines a breakpoint requested by the client.
+type sourceBreakpoint struct {
+	Line      int    `json:"line"`
+	Condition string `json:"condition,omitempty"`
+}
+
+// setBreakpointsArguments defines the arguments for the setBreakpoints request.
+type setBreakpointsArguments struct {
+	Source      source             `json:"source"`
+	Breakpoints []sourceBreakpoint `json:"breakpoints"`
+	Lines       []int              `json:"lines"`
+}
+
+// breakpoint describes the result of setting a breakpoint.
+type breakpoint struct {
+	Verified bool    `json:"verified"`
+	Message  string  `json:"message,omitempty"`
+	Source   *source `json:"source,omitempty"`
+	Line     int     `json:"line,omitempty"`
+}
+
+// thread describes a thread of execution.
+type thread struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+// stackTraceArguments defines the arguments for the stackTrace request.
+type stackTraceArguments struct {
+	StartFrame int `json:"startFrame"`
+	Levels     int `json:"levels"`
+}
+
+// stackFrame describes a single call stack entry.
+type stackFrame struct {
+	ID                          int     `json:"id"`
+	Name                        string  `json:"name"`
+	Source                      *source `json:"source,omitempty"`
+	Line                        int     `json:"line"`
+	Column                      int     `json:"column"`
+	InstructionPointerReference string  `json:"instructionPointerReference"`
+}
+
+// scope describes a group of variables.
+type scope struct {
+	Name               string `json:"name"`
+	VariablesReference int    `json:"variablesReference"`
+	Expensive          bool   `json:"expensive"`
+}
+
+// variablesArguments defines the arguments for the variables request.
+type variablesArguments struct {
+	VariablesReference int `json:"variablesReference"`
+}
+
+// setVariableArguments defines the arguments for the setVariable request.
+type setVariableArguments struct {
+	VariablesReference int    `json:"variablesReference"`
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+}
+
+// variable describes a single named value.
+type variable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	Type               string `json:"type,omitempty"`
+	VariablesReference int    `json:"variablesReference"`
+}
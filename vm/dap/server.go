@@ -0,0 +1,631 @@
+// Package dap implements a Debug Adapter Protocol server for the vm.
+// This lets editors which support the protocol launch and debug programs.
+//
+// The protocol is described at https://microsoft.github.io/debug-adapter-protocol/
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hexaflex/svm/arch"
+	"github.com/hexaflex/svm/asm/ar"
+	"github.com/hexaflex/svm/devices/fffe/clock"
+	"github.com/hexaflex/svm/devices/fffe/cpu"
+	"github.com/hexaflex/svm/devices/fffe/fd35"
+	"github.com/hexaflex/svm/devices/fffe/sprdi"
+	"github.com/hexaflex/svm/vm"
+)
+
+// Variable references for the scopes reported to the client.
+const (
+	registersRef = 1
+	flagsRef     = 2
+)
+
+// threadID identifies the cpu. It is the only thread there is.
+const threadID = 1
+
+// Session serves the Debug Adapter Protocol to a single client.
+//
+// Requests are handled one at a time. Programs run on a separate goroutine,
+// so the client can pause them or change breakpoints while they run.
+type Session struct {
+	r       *bufio.Reader
+	w       writer
+	debug   ar.Debug
+	source  *vm.Source
+	dbg     *vm.Debugger
+	floppy  *fd35.Device
+	wg      sync.WaitGroup // Tracks the goroutine running the program.
+	running uint32         // Is the program running? 1 if true.
+	paused  uint32         // Did the client ask to pause? 1 if true.
+	entry   bool           // Stop before the first instruction?
+	owned   map[int][]int  // Addresses of breakpoints set by the client, by file index.
+}
+
+// NewSession creates a new session which reads requests from r and
+// writes responses and events to w.
+func NewSession(r io.Reader, w io.Writer) *Session {
+	return &Session{
+		r:     bufio.NewReader(r),
+		w:     writer{w: w},
+		owned: make(map[int][]int),
+	}
+}
+
+// Serve handles requests until the client disconnects or the input ends.
+// The launched program is shut down before it returns.
+func (s *Session) Serve() error {
+	defer s.shutdown()
+
+	for {
+		data, err := readMessage(s.r)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		var req request
+		if err := json.Unmarshal(data, &req); err != nil {
+			return err
+		}
+
+		if req.Type != "request" {
+			continue
+		}
+
+		done, err := s.handle(&req)
+		if err != nil {
+			if err := s.w.fail(&req, err); err != nil {
+				return err
+			}
+		}
+
+		if done {
+			return nil
+		}
+	}
+}
+
+// handle executes the given request. Returns true if the session should end.
+// Handlers send their own response on success. Returned errors are sent
+// to the client as a failed response.
+func (s *Session) handle(req *request) (bool, error) {
+	switch req.Command {
+	case "initialize":
+		return false, s.w.respond(req, &capabilities{
+			SupportsConfigurationDoneRequest: true,
+			SupportsConditionalBreakpoints:   true,
+			SupportsSetVariable:              true,
+			SupportsStepBack:                 true,
+			SupportsTerminateRequest:         true,
+		})
+
+	case "launch":
+		return false, s.launch(req)
+
+	case "disconnect":
+		s.shutdown()
+		return true, s.w.respond(req, nil)
+
+	case "terminate":
+		s.shutdown()
+		if err := s.w.respond(req, nil); err != nil {
+			return false, err
+		}
+		return false, s.w.event("terminated", nil)
+
+	case "threads":
+		return false, s.w.respond(req, map[string]interface{}{
+			"threads": []thread{{ID: threadID, Name: "cpu"}},
+		})
+
+	case "setExceptionBreakpoints":
+		return false, s.w.respond(req, nil)
+	}
+
+	if s.dbg == nil {
+		return false, fmt.Errorf("%s: no program has been launched", req.Command)
+	}
+
+	switch req.Command {
+	case "setBreakpoints":
+		return false, s.setBreakpoints(req)
+	case "configurationDone":
+		return false, s.configurationDone(req)
+	case "pause":
+		s.pause()
+		return false, s.w.respond(req, nil)
+	case "continue":
+		return false, s.resume(req, map[string]bool{"allThreadsContinued": true}, s.dbg.Continue)
+	case "next":
+		return false, s.resume(req, nil, s.line(s.dbg.Next))
+	case "stepIn":
+		return false, s.resume(req, nil, s.line(s.dbg.Step))
+	case "stepOut":
+		return false, s.resume(req, nil, s.dbg.Finish)
+	case "stepBack":
+		return false, s.resume(req, nil, s.line(s.dbg.StepBack))
+	case "reverseContinue":
+		return false, s.resume(req, nil, s.dbg.ReverseContinue)
+	}
+
+	// The remaining requests inspect or modify the cpu state.
+	// This is only possible while the program is stopped.
+	if atomic.LoadUint32(&s.running) == 1 {
+		return false, fmt.Errorf("%s: the program is running", req.Command)
+	}
+
+	switch req.Command {
+	case "stackTrace":
+		return false, s.stackTrace(req)
+	case "scopes":
+		return false, s.w.respond(req, map[string]interface{}{
+			"scopes": []scope{
+				{Name: "Registers", VariablesReference: registersRef},
+				{Name: "Flags", VariablesReference: flagsRef},
+			},
+		})
+	case "variables":
+		return false, s.variables(req)
+	case "setVariable":
+		return false, s.setVariable(req)
+	}
+
+	return false, fmt.Errorf("unsupported request %q", req.Command)
+}
+
+// launch loads the program and its debug data. Floppy images (.img) are
+// booted like the vm does. Any other file is copied into memory as-is.
+// The program starts running once the client sends configurationDone.
+func (s *Session) launch(req *request) error {
+	var args launchArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return err
+	}
+
+	if len(args.Program) == 0 {
+		return fmt.Errorf("launch: no program specified")
+	}
+
+	if s.dbg != nil {
+		return fmt.Errorf("launch: a program has already been launched")
+	}
+
+	if err := vm.LoadDebug(args.Program, &s.debug); err != nil {
+		return fmt.Errorf("launch: failed to load debug data: %v", err)
+	}
+
+	image := ""
+	isImage := strings.EqualFold(filepath.Ext(args.Program), ".img")
+	if isImage {
+		image = args.Program
+	}
+
+	s.source = vm.NewSource(&s.debug, args.Include)
+	s.floppy = fd35.New(image, args.Readonly)
+	s.entry = args.StopOnEntry
+
+	ctl := vm.NewCPUController(nil,
+		sprdi.New(sprdi.NewImagePresenter()),
+		s.floppy,
+		clock.New())
+	dbg := vm.NewDebugger(ctl, &s.debug)
+
+	if args.History != nil {
+		dbg.SetHistory(*args.History)
+	} else {
+		dbg.SetHistory(vm.DefaultHistory)
+	}
+
+	if len(args.Clock) > 0 {
+		rate, err := vm.ParseClockRate(args.Clock)
+		if err != nil {
+			return fmt.Errorf("launch: %v", err)
+		}
+		ctl.SetFrequency(int(rate))
+	}
+
+	if args.Deterministic {
+		seed := int64(cpu.DefaultSeed)
+		if args.Seed != nil {
+			seed = *args.Seed
+		}
+		ctl.SetDeterministic(seed)
+	}
+
+	if isImage {
+		if err := dbg.Boot(s.floppy); err != nil {
+			return fmt.Errorf("launch: %v", err)
+		}
+	} else {
+		program, err := ioutil.ReadFile(args.Program)
+		if err != nil {
+			return fmt.Errorf("launch: %v", err)
+		}
+
+		if err := dbg.Load(program); err != nil {
+			return fmt.Errorf("launch: %v", err)
+		}
+	}
+
+	s.dbg = dbg
+
+	if err := s.w.respond(req, nil); err != nil {
+		return err
+	}
+
+	// Breakpoints can only be resolved once the debug data is loaded,
+	// so only now tell the client it can send them.
+	return s.w.event("initialized", nil)
+}
+
+// configurationDone starts the program, unless the client asked to
+// stop before the first instruction.
+func (s *Session) configurationDone(req *request) error {
+	if !s.entry {
+		return s.resume(req, nil, s.dbg.Continue)
+	}
+
+	if err := s.w.respond(req, nil); err != nil {
+		return err
+	}
+
+	return s.w.event("stopped", map[string]interface{}{
+		"reason":            "entry",
+		"threadId":          threadID,
+		"allThreadsStopped": true,
+	})
+}
+
+// setBreakpoints replaces the breakpoints in a single source file.
+// Breakpoints defined in the program source with the break directive
+// remain in effect, regardless of what the client sends.
+func (s *Session) setBreakpoints(req *request) error {
+	var args setBreakpointsArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return err
+	}
+
+	bps := args.Breakpoints
+	if bps == nil {
+		for _, line := range args.Lines {
+			bps = append(bps, sourceBreakpoint{Line: line})
+		}
+	}
+
+	path := args.Source.Path
+	if len(path) == 0 {
+		path = args.Source.Name
+	}
+
+	file := s.source.FileIndex(path)
+	out := make([]breakpoint, len(bps))
+
+	s.dbg.Do(func() {
+		for _, addr := range s.owned[file] {
+			s.dbg.ClearBreakpoint(addr)
+		}
+
+		s.owned[file] = nil
+
+		for i, bp := range bps {
+			var sym *ar.DebugData
+			if file > -1 {
+				sym = s.source.LineSymbol(file, bp.Line)
+			}
+
+			if sym == nil {
+				out[i] = breakpoint{Message: fmt.Sprintf("no code at or after line %d", bp.Line)}
+				continue
+			}
+
+			var cond cpu.Condition
+			if len(bp.Condition) > 0 {
+				var err error
+				if cond, err = vm.ParseCondition(bp.Condition, s.source.Resolve); err != nil {
+					out[i] = breakpoint{Message: err.Error()}
+					continue
+				}
+			}
+
+			s.dbg.SetBreakpoint(sym.Address, cond)
+			s.owned[file] = append(s.owned[file], sym.Address)
+			out[i] = breakpoint{Verified: true, Source: s.sourceRef(file), Line: sym.Line}
+		}
+	})
+
+	return s.w.respond(req, map[string]interface{}{"breakpoints": out})
+}
+
+// stackTrace reports the current instruction, followed by the return
+// address of each active call.
+func (s *Session) stackTrace(req *request) error {
+	var args stackTraceArguments
+	if len(req.Arguments) > 0 {
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return err
+		}
+	}
+
+	addrs := append([]int{s.pc()}, s.dbg.CallStack()...)
+	total := len(addrs)
+
+	if args.StartFrame < 0 || args.StartFrame > len(addrs) {
+		args.StartFrame = len(addrs)
+	}
+
+	addrs = addrs[args.StartFrame:]
+	if args.Levels > 0 && args.Levels < len(addrs) {
+		addrs = addrs[:args.Levels]
+	}
+
+	frames := make([]stackFrame, len(addrs))
+	for i, addr := range addrs {
+		id := args.StartFrame + i
+
+		// A return address points past the call instruction,
+		// which is the location reported for the frame.
+		sym := s.source.Find(addr)
+		if id > 0 {
+			sym = s.source.Nearest(addr - 1)
+		}
+
+		frames[i] = stackFrame{
+			ID:                          id,
+			Name:                        s.frameName(addr),
+			InstructionPointerReference: fmt.Sprintf("0x%04x", addr),
+		}
+
+		if sym != nil {
+			frames[i].Source = s.sourceRef(sym.File)
+			frames[i].Line = sym.Line
+			frames[i].Column = sym.Col
+		}
+	}
+
+	return s.w.respond(req, map[string]interface{}{
+		"stackFrames": frames,
+		"totalFrames": total,
+	})
+}
+
+// frameName returns the name displayed for the stack frame at the given address.
+func (s *Session) frameName(addr int) string {
+	if lbl, offset, ok := s.source.LabelAt(addr); ok {
+		if offset == 0 {
+			return lbl.Name
+		}
+		return fmt.Sprintf("%s+%d", lbl.Name, offset)
+	}
+	return fmt.Sprintf("%04x", addr)
+}
+
+// sourceRef returns the protocol description of the given source file.
+func (s *Session) sourceRef(file int) *source {
+	return &source{
+		Name: filepath.Base(s.source.File(file)),
+		Path: s.source.Path(file),
+	}
+}
+
+// variables reports register contents or RST flags.
+func (s *Session) variables(req *request) error {
+	var args variablesArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return err
+	}
+
+	mem := s.dbg.Controller().Memory()
+	var out []variable
+
+	switch args.VariablesReference {
+	case registersRef:
+		for i := 0; i < arch.RegisterIndex("rst"); i++ {
+			out = append(out, variable{
+				Name:  arch.RegisterName(i),
+				Value: fmt.Sprintf("0x%04x", mem.U16(cpu.R0+i*2)),
+				Type:  "u16",
+			})
+		}
+		out = append(out, variable{
+			Name:  "RST",
+			Value: fmt.Sprintf("0x%02x", mem.U8(cpu.RST)),
+			Type:  "u8",
+		})
+
+	case flagsRef:
+		out = []variable{
+			{Name: "compare", Value: fmt.Sprint(mem.RSTCompare()), Type: "bool"},
+			{Name: "overflow", Value: fmt.Sprint(mem.RSTOverflow()), Type: "bool"},
+			{Name: "divide-by-zero", Value: fmt.Sprint(mem.RSTDivideByZero()), Type: "bool"},
+			{Name: "carry", Value: fmt.Sprint(mem.RSTCarry()), Type: "bool"},
+		}
+
+	default:
+		return fmt.Errorf("variables: unknown reference %d", args.VariablesReference)
+	}
+
+	return s.w.respond(req, map[string]interface{}{"variables": out})
+}
+
+// setVariable changes the contents of a register or RST flag.
+func (s *Session) setVariable(req *request) error {
+	var args setVariableArguments
+	if err := json.Unmarshal(req.Arguments, &args); err != nil {
+		return err
+	}
+
+	mem := s.dbg.Controller().Memory()
+	var value string
+
+	switch args.VariablesReference {
+	case registersRef:
+		index := arch.RegisterIndex(args.Name)
+		if index == -1 {
+			return fmt.Errorf("setVariable: unknown register %q", args.Name)
+		}
+
+		n, err := vm.ParseNumber(strings.TrimSpace(args.Value))
+		if err != nil || n < -0x8000 || n > 0xffff {
+			return fmt.Errorf("setVariable: invalid 16-bit value %q", args.Value)
+		}
+
+		if index == arch.RegisterIndex("rst") {
+			mem.SetU8(cpu.RST, n)
+			value = fmt.Sprintf("0x%02x", mem.U8(cpu.RST))
+		} else {
+			mem.SetU16(cpu.R0+index*2, n)
+			value = fmt.Sprintf("0x%04x", mem.U16(cpu.R0+index*2))
+		}
+
+	case flagsRef:
+		var set bool
+		switch strings.ToLower(strings.TrimSpace(args.Value)) {
+		case "true", "1":
+			set = true
+		case "false", "0":
+		default:
+			return fmt.Errorf("setVariable: invalid boolean value %q", args.Value)
+		}
+
+		switch args.Name {
+		case "compare":
+			mem.SetRSTCompare(set)
+		case "overflow":
+			mem.SetRSTOverflow(set)
+		case "divide-by-zero":
+			mem.SetRSTDivideByZero(set)
+		case "carry":
+			mem.SetRSTCarry(set)
+		default:
+			return fmt.Errorf("setVariable: unknown flag %q", args.Name)
+		}
+
+		value = fmt.Sprint(set)
+
+	default:
+		return fmt.Errorf("setVariable: unknown reference %d", args.VariablesReference)
+	}
+
+	return s.w.respond(req, map[string]string{"value": value})
+}
+
+// resume responds to req with the given body and runs f on a separate
+// goroutine. A stopped, exited or terminated event is sent when f returns.
+func (s *Session) resume(req *request, body interface{}, f func() (vm.StopReason, error)) error {
+	if !atomic.CompareAndSwapUint32(&s.running, 0, 1) {
+		return fmt.Errorf("%s: the program is already running", req.Command)
+	}
+
+	atomic.StoreUint32(&s.paused, 0)
+	if err := s.w.respond(req, body); err != nil {
+		atomic.StoreUint32(&s.running, 0)
+		return err
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		reason, err := f()
+		atomic.StoreUint32(&s.running, 0)
+		s.stopped(reason, err)
+	}()
+
+	return nil
+}
+
+// line returns a function which calls f until execution reaches another
+// source line. This turns instruction stepping into line stepping.
+// Instructions without debug data are not considered to be on a line
+// of their own.
+func (s *Session) line(f func() (vm.StopReason, error)) func() (vm.StopReason, error) {
+	return func() (vm.StopReason, error) {
+		start := s.source.Find(s.pc())
+
+		for {
+			reason, err := f()
+			if err != nil || reason != vm.StopStep {
+				return reason, err
+			}
+
+			if atomic.LoadUint32(&s.paused) == 1 {
+				return vm.StopPause, nil
+			}
+
+			sym := s.source.Find(s.pc())
+			if start == nil || (sym != nil && (sym.File != start.File || sym.Line != start.Line)) {
+				return reason, nil
+			}
+		}
+	}
+}
+
+// pause stops the running program.
+func (s *Session) pause() {
+	atomic.StoreUint32(&s.paused, 1)
+	s.dbg.Pause()
+}
+
+// stopped tells the client why the program stopped.
+func (s *Session) stopped(reason vm.StopReason, err error) {
+	body := map[string]interface{}{
+		"threadId":          threadID,
+		"allThreadsStopped": true,
+	}
+
+	switch {
+	case reason == vm.StopHalt:
+		s.w.event("exited", map[string]int{"exitCode": 0})
+		s.w.event("terminated", nil)
+		return
+
+	case err != nil:
+		s.w.event("output", map[string]string{"category": "stderr", "output": err.Error() + "\n"})
+		body["reason"] = "exception"
+		body["text"] = err.Error()
+
+	case reason == vm.StopBreakpoint:
+		body["reason"] = "breakpoint"
+	case reason == vm.StopWatchpoint:
+		body["reason"] = "data breakpoint"
+		body["text"] = s.dbg.Break().Error()
+	case reason == vm.StopPause:
+		body["reason"] = "pause"
+	case reason == vm.StopHistory:
+		body["reason"] = "step"
+		body["description"] = "Reached the start of the recorded history"
+	default:
+		body["reason"] = "step"
+	}
+
+	s.w.event("stopped", body)
+}
+
+// shutdown stops the running program and shuts down the cpu.
+func (s *Session) shutdown() {
+	if s.dbg == nil {
+		return
+	}
+
+	s.pause()
+	s.wg.Wait()
+	s.dbg.Controller().Shutdown()
+	s.dbg = nil
+}
+
+// pc returns the address of the next instruction.
+func (s *Session) pc() int {
+	return s.dbg.Controller().Memory().U16(cpu.RIP)
+}
@@ -0,0 +1,309 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hexaflex/svm/asm"
+)
+
+const sessionTestSource = `
+:main {
+    mov r0, 1
+    call sub
+    halt
+
+:sub
+    add r0, r0, 1
+    ret
+}
+`
+
+func TestSession(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "main.svm")
+	if err := ioutil.WriteFile(file, []byte(sessionTestSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ar, err := asm.Build(file, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	program := filepath.Join(dir, "main.bin")
+	if err := ioutil.WriteFile(program, ar.Instructions, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := os.Create(filepath.Join(dir, "main.dbg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ar.Debug.Save(fd)
+	fd.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newClient(t)
+	defer c.close()
+
+	var caps capabilities
+	c.call("initialize", map[string]string{"adapterID": "svm"}, &caps)
+	if !caps.SupportsConfigurationDoneRequest || !caps.SupportsStepBack {
+		t.Fatalf("unexpected capabilities: %+v", caps)
+	}
+
+	c.call("launch", map[string]interface{}{"program": program}, nil)
+	c.event("initialized")
+
+	var bps struct{ Breakpoints []breakpoint }
+	c.call("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": file},
+		"breakpoints": []map[string]interface{}{{"line": 7, "condition": "r0 == 1"}, {"line": 100}},
+	}, &bps)
+	if len(bps.Breakpoints) != 2 || !bps.Breakpoints[0].Verified || bps.Breakpoints[0].Line != 8 || bps.Breakpoints[1].Verified {
+		t.Fatalf("unexpected breakpoints: %+v", bps.Breakpoints)
+	}
+
+	c.call("configurationDone", nil, nil)
+	c.expectStop("breakpoint")
+	c.expectStack(8, 4)
+
+	var scopes struct{ Scopes []scope }
+	c.call("scopes", map[string]int{"frameId": 0}, &scopes)
+	if len(scopes.Scopes) != 2 {
+		t.Fatalf("unexpected scopes: %+v", scopes.Scopes)
+	}
+
+	var vars struct{ Variables []variable }
+	c.call("variables", map[string]int{"variablesReference": registersRef}, &vars)
+	if len(vars.Variables) != 12 || vars.Variables[0].Name != "R0" || vars.Variables[0].Value != "0x0001" {
+		t.Fatalf("unexpected variables: %+v", vars.Variables)
+	}
+
+	var set struct{ Value string }
+	c.call("setVariable", map[string]interface{}{"variablesReference": registersRef, "name": "r0", "value": "16#10"}, &set)
+	if set.Value != "0x0010" {
+		t.Fatalf("unexpected setVariable value %q", set.Value)
+	}
+
+	c.call("next", map[string]int{"threadId": threadID}, nil)
+	c.expectStop("step")
+	c.expectStack(9, 4)
+
+	c.call("next", map[string]int{"threadId": threadID}, nil)
+	c.expectStop("step")
+	c.expectStack(5)
+
+	c.call("variables", map[string]int{"variablesReference": registersRef}, &vars)
+	if vars.Variables[0].Value != "0x0011" {
+		t.Fatalf("unexpected R0 value %q", vars.Variables[0].Value)
+	}
+
+	c.call("stepBack", map[string]int{"threadId": threadID}, nil)
+	c.expectStop("step")
+	c.expectStack(9, 4)
+
+	c.call("next", map[string]int{"threadId": threadID}, nil)
+	c.expectStop("step")
+	c.expectStack(5)
+
+	c.call("continue", map[string]int{"threadId": threadID}, nil)
+	c.event("exited")
+	c.event("terminated")
+	c.call("disconnect", nil, nil)
+}
+
+// message holds any message sent by the server.
+type message struct {
+	Type       string          `json:"type"`
+	Event      string          `json:"event"`
+	Command    string          `json:"command"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	Body       json.RawMessage `json:"body"`
+}
+
+// client implements the client side of the protocol for tests.
+type client struct {
+	t        *testing.T
+	w        io.WriteCloser
+	seq      int
+	messages chan message
+	events   []message // Events received while waiting for a response.
+	done     chan error
+}
+
+// newClient starts a session and returns a client connected to it.
+func newClient(t *testing.T) *client {
+	rin, win := io.Pipe()
+	rout, wout := io.Pipe()
+
+	c := &client{
+		t:        t,
+		w:        win,
+		messages: make(chan message, 16),
+		done:     make(chan error, 1),
+	}
+
+	go func() {
+		c.done <- NewSession(rin, wout).Serve()
+		wout.Close()
+	}()
+
+	go func() {
+		defer close(c.messages)
+		r := bufio.NewReader(rout)
+		for {
+			data, err := readMessage(r)
+			if err != nil {
+				return
+			}
+
+			var msg message
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Error(err)
+				return
+			}
+			c.messages <- msg
+		}
+	}()
+
+	return c
+}
+
+// close ends the session and waits for it to finish.
+func (c *client) close() {
+	c.w.Close()
+	if err := <-c.done; err != nil {
+		c.t.Error(err)
+	}
+}
+
+// receive returns the next message from the server.
+func (c *client) receive() message {
+	c.t.Helper()
+
+	select {
+	case msg, ok := <-c.messages:
+		if !ok {
+			c.t.Fatal("connection closed")
+		}
+		return msg
+	case <-time.After(10 * time.Second):
+		c.t.Fatal("timeout waiting for a message")
+	}
+	return message{}
+}
+
+// call sends a request and waits for the response. Its body is
+// decoded into v, if v is not nil.
+func (c *client) call(command string, args, v interface{}) {
+	c.t.Helper()
+
+	c.seq++
+	req := map[string]interface{}{"seq": c.seq, "type": "request", "command": command}
+	if args != nil {
+		req["arguments"] = args
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	if _, err := fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(data), data); err != nil {
+		c.t.Fatal(err)
+	}
+
+	for {
+		msg := c.receive()
+		if msg.Type == "event" {
+			c.events = append(c.events, msg)
+			continue
+		}
+
+		if msg.RequestSeq != c.seq || msg.Command != command {
+			c.t.Fatalf("%s: unexpected response %+v", command, msg)
+		}
+
+		if !msg.Success {
+			c.t.Fatalf("%s: request failed: %s", command, msg.Message)
+		}
+
+		if v != nil {
+			if err := json.Unmarshal(msg.Body, v); err != nil {
+				c.t.Fatal(err)
+			}
+		}
+		return
+	}
+}
+
+// event waits for the event with the given name and returns its body.
+// Events received in between are discarded.
+func (c *client) event(name string) json.RawMessage {
+	c.t.Helper()
+
+	for len(c.events) > 0 {
+		msg := c.events[0]
+		c.events = c.events[1:]
+		if msg.Event == name {
+			return msg.Body
+		}
+	}
+
+	for {
+		msg := c.receive()
+		if msg.Type == "event" && msg.Event == name {
+			return msg.Body
+		}
+	}
+}
+
+// expectStop waits for a stopped event and checks its reason.
+func (c *client) expectStop(reason string) {
+	c.t.Helper()
+
+	var body struct{ Reason string }
+	if err := json.Unmarshal(c.event("stopped"), &body); err != nil {
+		c.t.Fatal(err)
+	}
+
+	if body.Reason != reason {
+		c.t.Fatalf("stop reason mismatch: want %q; have %q", reason, body.Reason)
+	}
+}
+
+// expectStack checks the source lines of all stack frames.
+func (c *client) expectStack(lines ...int) {
+	c.t.Helper()
+
+	var body struct{ StackFrames []stackFrame }
+	c.call("stackTrace", map[string]int{"threadId": threadID}, &body)
+
+	if len(body.StackFrames) != len(lines) {
+		c.t.Fatalf("stack size mismatch: want %d; have %+v", len(lines), body.StackFrames)
+	}
+
+	for i, line := range lines {
+		if body.StackFrames[i].Line != line {
+			c.t.Fatalf("frame %d line mismatch: want %d; have %d", i, line, body.StackFrames[i].Line)
+		}
+	}
+}
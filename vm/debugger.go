@@ -0,0 +1,578 @@
+package vm
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hexaflex/svm/arch"
+	"github.com/hexaflex/svm/asm/ar"
+	"github.com/hexaflex/svm/devices/fffe/cpu"
+	"github.com/hexaflex/svm/devices/fffe/fd35"
+)
+
+// StopReason defines why the Debugger stopped execution.
+type StopReason int
+
+// Known stop reasons.
+const (
+	StopStep       StopReason = iota // A step command completed.
+	StopBreakpoint                   // A breakpoint was reached.
+	StopPause                        // Execution was paused through Pause.
+	StopHalt                         // The program halted.
+	StopWatchpoint                   // A watchpoint was triggered.
+	StopHistory                      // The start of the recorded history was reached.
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case StopStep:
+		return "step"
+	case StopBreakpoint:
+		return "breakpoint"
+	case StopPause:
+		return "pause"
+	case StopHalt:
+		return "halt"
+	case StopWatchpoint:
+		return "watchpoint"
+	case StopHistory:
+		return "history"
+	}
+	return "unknown"
+}
+
+// DefaultHistory is the number of executed instructions the debugger front-ends
+// record for reverse execution, unless told otherwise. See Debugger.SetHistory.
+const DefaultHistory = 100000
+
+// ErrHalted is returned when execution is requested after the program halted.
+var ErrHalted = errors.New("the program has halted")
+
+// Debugger drives a cpu on behalf of an interactive debugger. It adds
+// breakpoints and stepping which takes the call depth into account.
+//
+// Execution happens on the goroutine calling Step, Next, Finish and Continue.
+// The controller's execution goroutine must not be used. Only Pause and Do
+// may be called from another goroutine.
+type Debugger struct {
+	m           sync.Mutex // Guards active and calls.
+	active      bool       // Is a goroutine executing the program?
+	calls       []func()   // Functions queued through Do.
+	pending     uint32     // Are there calls queued? 1 if true.
+	ctl         *CPUController
+	debug       *ar.Debug        // Debug data for the program. Provides breakpoints defined in the source.
+	breakpoints map[int]struct{} // Addresses of user-defined breakpoints.
+	sources     map[int]struct{} // Addresses of breakpoints defined in the program source.
+	brk         *cpu.Break       // Breakpoint or watchpoint which stopped execution last.
+	frames      []int            // Stack slots holding the return addresses of active calls.
+	depth       int              // Current call depth.
+	halted      bool             // Did the program halt?
+	paused      uint32           // Was Pause called? 1 if true.
+	undo        []callState      // Ring buffer holding the call stack state before each recorded step.
+	undoStart   int              // Index of the oldest entry in undo.
+	undoCount   int              // Number of entries in undo.
+}
+
+// callState defines the call stack state before a step. It is used to
+// restore the call stack when the step is undone.
+type callState struct {
+	cycles uint64 // Cycle count before the step. This identifies the step.
+	depth  int    // Call depth.
+	frames int    // Number of frames.
+	last   int    // Innermost frame. A step removes at most one.
+}
+
+// NewDebugger creates a new debugger for the cpu driven by the given controller.
+// Breakpoints defined in the program source are read from debug, which may be
+// updated between runs.
+func NewDebugger(ctl *CPUController, debug *ar.Debug) *Debugger {
+	return &Debugger{
+		ctl:         ctl,
+		debug:       debug,
+		breakpoints: make(map[int]struct{}),
+		sources:     make(map[int]struct{}),
+	}
+}
+
+// Controller returns the controller for the debugged cpu.
+func (d *Debugger) Controller() *CPUController {
+	return d.ctl
+}
+
+// Boot (re)starts the cpu and loads the boot sector from the given floppy
+// drive. This resets the call stack. Breakpoints are kept.
+func (d *Debugger) Boot(floppy *fd35.Device) error {
+	d.reset()
+	return Boot(d.ctl, floppy)
+}
+
+// Load (re)starts the cpu and copies the given program into memory.
+// This resets the call stack. Breakpoints are kept.
+func (d *Debugger) Load(program []byte) error {
+	d.reset()
+	return Load(d.ctl, program)
+}
+
+// BootFile (re)starts the cpu with the program in the given file. See
+// the BootFile function. This resets the call stack. Breakpoints are kept.
+func (d *Debugger) BootFile(floppy *fd35.Device, file string) error {
+	d.reset()
+	return BootFile(d.ctl, floppy, file)
+}
+
+// reset clears the execution state and (re)installs the breakpoints
+// defined in the program source.
+func (d *Debugger) reset() {
+	d.frames = d.frames[:0]
+	d.depth = 0
+	d.halted = false
+	d.brk = nil
+	d.undoStart = 0
+	d.undoCount = 0
+
+	for addr := range d.sources {
+		if _, ok := d.breakpoints[addr]; !ok {
+			d.ctl.ClearBreakpoint(addr)
+		}
+	}
+
+	d.sources = make(map[int]struct{})
+	for _, sym := range d.debug.Symbols {
+		if sym.Flags&ar.Breakpoint == 0 {
+			continue
+		}
+
+		d.sources[sym.Address] = struct{}{}
+		if _, ok := d.breakpoints[sym.Address]; !ok {
+			d.ctl.SetBreakpoint(sym.Address, nil)
+		}
+	}
+}
+
+// CallStack returns the return addresses of all active calls, innermost first.
+// They are read from the stack slots in which the calls stored them. Slots
+// the program has since popped off the stack are skipped.
+func (d *Debugger) CallStack() []int {
+	mem := d.ctl.Memory()
+	rsp := mem.U16(cpu.RSP)
+
+	out := make([]int, 0, len(d.frames))
+	for i := len(d.frames) - 1; i >= 0; i-- {
+		if d.frames[i] > rsp {
+			out = append(out, mem.U16(d.frames[i]))
+		}
+	}
+
+	return out
+}
+
+// Depth returns the current call depth. Calls and interrupts increase it.
+// RET and IRET decrease it.
+func (d *Debugger) Depth() int {
+	return d.depth
+}
+
+// Halted returns true if the program has halted.
+func (d *Debugger) Halted() bool {
+	return d.halted
+}
+
+// SetBreakpoint sets a breakpoint at the given address. If cond is not nil,
+// execution only stops there if cond returns true. See ParseCondition.
+func (d *Debugger) SetBreakpoint(addr int, cond cpu.Condition) {
+	d.breakpoints[addr] = struct{}{}
+	d.ctl.SetBreakpoint(addr, cond)
+}
+
+// ClearBreakpoint removes the breakpoint at the given address.
+// Returns false if there was none. Breakpoints defined in the
+// program source can not be removed.
+func (d *Debugger) ClearBreakpoint(addr int) bool {
+	if _, ok := d.breakpoints[addr]; !ok {
+		return false
+	}
+
+	delete(d.breakpoints, addr)
+
+	if _, ok := d.sources[addr]; ok {
+		d.ctl.SetBreakpoint(addr, nil)
+	} else {
+		d.ctl.ClearBreakpoint(addr)
+	}
+
+	return true
+}
+
+// ClearBreakpoints removes all breakpoints, except those defined in
+// the program source.
+func (d *Debugger) ClearBreakpoints() {
+	for addr := range d.breakpoints {
+		d.ClearBreakpoint(addr)
+	}
+}
+
+// Break returns the breakpoint or watchpoint which stopped execution last.
+// Returns nil if execution stopped for another reason.
+func (d *Debugger) Break() *cpu.Break {
+	return d.brk
+}
+
+// Breakpoints returns the addresses of all user-defined breakpoints in ascending order.
+func (d *Debugger) Breakpoints() []int {
+	out := make([]int, 0, len(d.breakpoints))
+	for addr := range d.breakpoints {
+		out = append(out, addr)
+	}
+	sort.Ints(out)
+	return out
+}
+
+// SetHistory enables recording of the last n executed instructions, so
+// they can be undone with StepBack and ReverseContinue. Zero disables it.
+// Changing the size clears the history.
+//
+// Only the cpu state and memory are restored. Devices keep their state.
+func (d *Debugger) SetHistory(n int) {
+	if n < 0 {
+		n = 0
+	}
+
+	d.ctl.SetHistory(n)
+	d.undo = make([]callState, n)
+	d.undoStart = 0
+	d.undoCount = 0
+}
+
+// Current decodes the instruction which is executed next, without executing it.
+func (d *Debugger) Current() (*cpu.Instruction, error) {
+	var instr cpu.Instruction
+
+	mem := d.ctl.Memory().(cpu.Memory)
+	rip := mem.U16(cpu.RIP)
+	err := instr.Decode(mem)
+	mem.SetU16(cpu.RIP, rip)
+
+	return &instr, err
+}
+
+// Step executes a single instruction, even if it has a breakpoint.
+func (d *Debugger) Step() (StopReason, error) {
+	if d.halted {
+		return StopHalt, ErrHalted
+	}
+
+	d.brk = nil
+	d.ctl.Resume()
+
+	if err := d.step(); err != nil {
+		return d.stopped(err)
+	}
+
+	if d.halted {
+		return StopHalt, nil
+	}
+
+	return StopStep, nil
+}
+
+// Next executes a single instruction. If it is a call, execution continues
+// until the call returns. Breakpoints encountered on the way stop it early.
+func (d *Debugger) Next() (StopReason, error) {
+	depth := d.depth
+	return d.run(func() bool { return d.depth <= depth })
+}
+
+// Finish continues execution until the current function returns.
+// Breakpoints encountered on the way stop it early.
+func (d *Debugger) Finish() (StopReason, error) {
+	depth := d.depth
+	return d.run(func() bool { return d.depth < depth })
+}
+
+// Continue continues execution until a breakpoint is reached, the program
+// halts or Pause is called.
+func (d *Debugger) Continue() (StopReason, error) {
+	return d.run(func() bool { return false })
+}
+
+// StepBack undoes the most recently executed instruction. Breakpoints
+// are ignored. Returns StopHistory if there is nothing left to undo.
+func (d *Debugger) StepBack() (StopReason, error) {
+	d.brk = nil
+
+	switch err := d.stepBack(); err.(type) {
+	case nil, *cpu.Break:
+		return StopStep, nil
+	default:
+		if err == cpu.ErrNoHistory {
+			return StopHistory, nil
+		}
+		return StopStep, err
+	}
+}
+
+// ReverseContinue undoes executed instructions until the instruction
+// executed next has a breakpoint, there is nothing left to undo or Pause
+// is called. A breakpoint at the current instruction is ignored.
+// Watchpoints are not checked.
+func (d *Debugger) ReverseContinue() (StopReason, error) {
+	d.brk = nil
+	atomic.StoreUint32(&d.paused, 0)
+	d.setActive(true)
+	defer d.setActive(false)
+
+	for {
+		if atomic.LoadUint32(&d.pending) == 1 {
+			d.doCalls()
+		}
+
+		err := d.stepBack()
+		switch {
+		case err == cpu.ErrNoHistory:
+			return StopHistory, nil
+		case err != nil:
+			return d.stopped(err)
+		case atomic.LoadUint32(&d.paused) == 1:
+			return StopPause, nil
+		}
+	}
+}
+
+// Pause stops Next, Finish or Continue before the next instruction.
+// It is safe to call from another goroutine.
+func (d *Debugger) Pause() {
+	atomic.StoreUint32(&d.paused, 1)
+}
+
+// Do calls f while no instruction is being executed. If Next, Finish or
+// Continue are running on another goroutine, f is called on that goroutine
+// in between two instructions. Otherwise it is called right away. Do does
+// not return until f has been called.
+//
+// This allows things like breakpoints in the debug data to be changed
+// while the program runs.
+func (d *Debugger) Do(f func()) {
+	d.m.Lock()
+	if !d.active {
+		d.m.Unlock()
+		f()
+		return
+	}
+
+	done := make(chan struct{})
+	d.calls = append(d.calls, func() {
+		f()
+		close(done)
+	})
+	atomic.StoreUint32(&d.pending, 1)
+	d.m.Unlock()
+
+	<-done
+}
+
+// setActive marks the program as being executed or not.
+// Calls queued through Do are handled when it is no longer executed.
+func (d *Debugger) setActive(v bool) {
+	d.m.Lock()
+	d.active = v
+	d.m.Unlock()
+
+	if !v {
+		d.doCalls()
+	}
+}
+
+// doCalls calls the functions queued through Do.
+func (d *Debugger) doCalls() {
+	d.m.Lock()
+	calls := d.calls
+	d.calls = nil
+	atomic.StoreUint32(&d.pending, 0)
+	d.m.Unlock()
+
+	for _, f := range calls {
+		f()
+	}
+}
+
+// run executes instructions until done returns true, a breakpoint is
+// reached, a watchpoint is triggered, the program halts or Pause is
+// called. A breakpoint at the current instruction is ignored.
+func (d *Debugger) run(done func() bool) (StopReason, error) {
+	if d.halted {
+		return StopHalt, ErrHalted
+	}
+
+	d.brk = nil
+	d.ctl.Resume()
+	atomic.StoreUint32(&d.paused, 0)
+	d.setActive(true)
+	defer d.setActive(false)
+
+	d.ctl.Start()
+	defer d.ctl.Stop()
+
+	for n := 0; ; n++ {
+		// Sleeping is relatively expensive, so don't check every step.
+		if n&0x3ff == 0 {
+			d.ctl.Throttle()
+		}
+
+		if atomic.LoadUint32(&d.pending) == 1 {
+			d.doCalls()
+		}
+
+		if err := d.step(); err != nil {
+			return d.stopped(err)
+		}
+
+		switch {
+		case d.halted:
+			return StopHalt, nil
+		case done():
+			return StopStep, nil
+		case atomic.LoadUint32(&d.paused) == 1:
+			return StopPause, nil
+		}
+	}
+}
+
+// stopped returns the stop reason for an error returned by step.
+func (d *Debugger) stopped(err error) (StopReason, error) {
+	brk, ok := err.(*cpu.Break)
+	if !ok {
+		return StopStep, err
+	}
+
+	d.brk = brk
+	if brk.Watchpoint != nil {
+		return StopWatchpoint, nil
+	}
+
+	return StopBreakpoint, nil
+}
+
+// step executes a single instruction and updates the call stack.
+//
+// The cpu reports breakpoints before executing the instruction and
+// watchpoints after executing it. Either way, the *cpu.Break is returned.
+func (d *Debugger) step() error {
+	mem := d.ctl.Memory()
+	rsp := mem.U16(cpu.RSP)
+	inInt := d.ctl.cpu.InIntHandler()
+	state := d.callState()
+
+	err := d.ctl.Step()
+	if brk, ok := err.(*cpu.Break); err != nil && (!ok || brk.Watchpoint == nil) {
+		return err
+	}
+
+	d.record(state)
+
+	// If an interrupt was raised, the cpu pushed RIP and R0 and jumped to
+	// the interrupt handler after executing the instruction.
+	opcode := d.ctl.cpu.Instruction().Opcode
+	entered := d.ctl.cpu.InIntHandler() && (!inInt || opcode == arch.IRET)
+
+	after := mem.U16(cpu.RSP)
+	if entered {
+		after += 4
+	}
+
+	switch opcode {
+	case arch.CALL, arch.CLEZ, arch.CLNZ:
+		if after == rsp-2 {
+			d.enter(rsp)
+		}
+	case arch.RET, arch.IRET:
+		d.leave()
+	case arch.HALT:
+		d.halted = true
+	}
+
+	if entered {
+		d.enter(after)
+	}
+
+	return err
+}
+
+// stepBack undoes a single instruction and restores the call stack state
+// from before it was executed.
+func (d *Debugger) stepBack() error {
+	err := d.ctl.StepBack()
+	if _, ok := err.(*cpu.Break); err != nil && !ok {
+		return err
+	}
+
+	d.halted = false
+	cycles := d.ctl.cpu.Cycles()
+
+	// Steps which failed have no entry. Skip the ones they left behind.
+	for d.undoCount > 0 {
+		s := d.undo[(d.undoStart+d.undoCount-1)%len(d.undo)]
+		if s.cycles < cycles {
+			break
+		}
+
+		d.undoCount--
+		if s.cycles > cycles {
+			continue
+		}
+
+		d.depth = s.depth
+		if s.frames > 0 {
+			d.frames = append(d.frames[:s.frames-1], s.last)
+		} else {
+			d.frames = d.frames[:0]
+		}
+		break
+	}
+
+	return err
+}
+
+// callState returns the current call stack state.
+func (d *Debugger) callState() callState {
+	s := callState{
+		cycles: d.ctl.cpu.Cycles(),
+		depth:  d.depth,
+		frames: len(d.frames),
+	}
+	if s.frames > 0 {
+		s.last = d.frames[s.frames-1]
+	}
+	return s
+}
+
+// record adds the given call stack state to the history, if it is enabled.
+// The oldest entry is replaced if the history is full.
+func (d *Debugger) record(s callState) {
+	if len(d.undo) == 0 {
+		return
+	}
+
+	if d.undoCount < len(d.undo) {
+		d.undoCount++
+	} else {
+		d.undoStart = (d.undoStart + 1) % len(d.undo)
+	}
+
+	d.undo[(d.undoStart+d.undoCount-1)%len(d.undo)] = s
+}
+
+// enter records a call which stored its return address in the given stack slot.
+func (d *Debugger) enter(slot int) {
+	d.depth++
+	d.frames = append(d.frames, slot)
+}
+
+// leave records a return from a call.
+func (d *Debugger) leave() {
+	d.depth--
+	if len(d.frames) > 0 {
+		d.frames = d.frames[:len(d.frames)-1]
+	}
+}
@@ -0,0 +1,199 @@
+package vm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hexaflex/svm/asm"
+	"github.com/hexaflex/svm/devices/fffe/cpu"
+	"github.com/hexaflex/svm/devices/fffe/fd35"
+)
+
+const debuggerTestSource = `
+:main {
+    mov r0, 1
+    call inc
+    call inc
+    mov r1, 2
+    halt
+}
+
+:inc {
+    add r0, r0, 1
+    ret
+}
+`
+
+func TestDebugger(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "main.svm")
+	if err := ioutil.WriteFile(file, []byte(debuggerTestSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ar, err := asm.Build(file, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := filepath.Join(dir, "main.img")
+	data := make([]byte, fd35.FloppySize)
+	copy(data, ar.Instructions)
+	if err := ioutil.WriteFile(image, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src := NewSource(&ar.Debug, nil)
+	floppy := fd35.New(image, true)
+	dbg := NewDebugger(NewCPUController(nil, floppy), &ar.Debug)
+	if err := dbg.Boot(floppy); err != nil {
+		t.Fatal(err)
+	}
+	defer dbg.Controller().Shutdown()
+
+	mem := dbg.Controller().Memory()
+	resolve := func(loc string) int {
+		addr, err := src.Resolve(loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr
+	}
+
+	want := func(reason, wantReason StopReason, err error, loc string) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason != wantReason {
+			t.Fatalf("stop reason mismatch: want %v; have %v", wantReason, reason)
+		}
+		if rip := mem.U16(cpu.RIP); rip != resolve(loc) {
+			t.Fatalf("RIP mismatch at %s: want %04x; have %04x", loc, resolve(loc), rip)
+		}
+	}
+
+	if a, b := resolve("inc"), resolve("main.svm:10"); a != b {
+		t.Fatalf("label and line mismatch: %04x != %04x", a, b)
+	}
+
+	reason, err := dbg.Step()
+	want(reason, StopStep, err, "main.svm:4")
+
+	reason, err = dbg.Next()
+	want(reason, StopStep, err, "main.svm:5")
+	if r0 := mem.U16(cpu.R0); r0 != 2 {
+		t.Fatalf("R0 mismatch: want 2; have %d", r0)
+	}
+
+	reason, err = dbg.Step()
+	want(reason, StopStep, err, "inc")
+	if dbg.Depth() != 1 {
+		t.Fatalf("call depth mismatch: want 1; have %d", dbg.Depth())
+	}
+	if cs := dbg.CallStack(); len(cs) != 1 || cs[0] != resolve("main.svm:6") {
+		t.Fatalf("call stack mismatch: want [%04x]; have %04x", resolve("main.svm:6"), cs)
+	}
+
+	reason, err = dbg.Finish()
+	want(reason, StopStep, err, "main.svm:6")
+	if dbg.Depth() != 0 || len(dbg.CallStack()) != 0 {
+		t.Fatalf("call depth mismatch: want 0; have %d", dbg.Depth())
+	}
+
+	dbg.SetBreakpoint(resolve("main.svm:7"), nil)
+	reason, err = dbg.Continue()
+	want(reason, StopBreakpoint, err, "main.svm:7")
+
+	reason, err = dbg.Continue()
+	if err != nil || reason != StopHalt || !dbg.Halted() {
+		t.Fatalf("expected program to halt; have %v, %v", reason, err)
+	}
+
+	if _, err = dbg.Step(); err != ErrHalted {
+		t.Fatalf("expected ErrHalted; have %v", err)
+	}
+
+	// Start over with a conditional breakpoint and a watchpoint.
+	dbg.ClearBreakpoints()
+	if err := dbg.Boot(floppy); err != nil {
+		t.Fatal(err)
+	}
+
+	cond, err := ParseCondition("r0 == 2", src.Resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbg.SetBreakpoint(resolve("inc"), cond)
+	reason, err = dbg.Continue()
+	want(reason, StopBreakpoint, err, "inc")
+	if r0 := mem.U16(cpu.R0); r0 != 2 || dbg.Depth() != 1 {
+		t.Fatalf("R0 mismatch: want 2; have %d", r0)
+	}
+
+	w := &cpu.Watchpoint{Address: cpu.R1, Size: 2, Access: cpu.Write}
+	dbg.Controller().AddWatchpoint(w)
+
+	reason, err = dbg.Continue()
+	want(reason, StopWatchpoint, err, "main.svm:7")
+	if brk := dbg.Break(); brk == nil || brk.Watchpoint != w || brk.IP != resolve("main.svm:6") {
+		t.Fatalf("unexpected break %v", brk)
+	}
+
+	reason, err = dbg.Continue()
+	if err != nil || reason != StopHalt {
+		t.Fatalf("expected program to halt; have %v, %v", reason, err)
+	}
+
+	// Start over with the history enabled and run the program backwards.
+	dbg.ClearBreakpoints()
+	dbg.Controller().RemoveWatchpoint(w)
+	dbg.SetHistory(100)
+	if err := dbg.Boot(floppy); err != nil {
+		t.Fatal(err)
+	}
+
+	if reason, err = dbg.Continue(); err != nil || reason != StopHalt {
+		t.Fatalf("expected program to halt; have %v, %v", reason, err)
+	}
+
+	dbg.SetBreakpoint(resolve("inc"), nil)
+	reason, err = dbg.ReverseContinue()
+	want(reason, StopBreakpoint, err, "inc")
+	if r0 := mem.U16(cpu.R0); r0 != 2 || dbg.Halted() {
+		t.Fatalf("R0 mismatch: want 2; have %d", r0)
+	}
+	if cs := dbg.CallStack(); len(cs) != 1 || cs[0] != resolve("main.svm:6") {
+		t.Fatalf("call stack mismatch: want [%04x]; have %04x", resolve("main.svm:6"), cs)
+	}
+
+	reason, err = dbg.StepBack()
+	want(reason, StopStep, err, "main.svm:5")
+	if dbg.Depth() != 0 || len(dbg.CallStack()) != 0 {
+		t.Fatalf("call depth mismatch: want 0; have %d", dbg.Depth())
+	}
+
+	reason, err = dbg.ReverseContinue()
+	want(reason, StopBreakpoint, err, "inc")
+	if r0 := mem.U16(cpu.R0); r0 != 1 || dbg.Depth() != 1 {
+		t.Fatalf("R0 mismatch: want 1; have %d", r0)
+	}
+
+	reason, err = dbg.ReverseContinue()
+	want(reason, StopHistory, err, "main")
+
+	// Execution picks up from the restored state.
+	dbg.ClearBreakpoints()
+	reason, err = dbg.Continue()
+	if r0 := mem.U16(cpu.R0); err != nil || reason != StopHalt || r0 != 3 {
+		t.Fatalf("expected program to halt with R0 = 3; have %v, %v, %d", reason, err, r0)
+	}
+}
@@ -0,0 +1,71 @@
+package vm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ClockRate is a clock frequency in herz. It implements flag.Value and accepts
+// values like "1MHz", "250KHz", "2.5mhz" or "8000". Zero means unbounded.
+type ClockRate int
+
+// String returns a human-readable version of the clock rate.
+func (cr ClockRate) String() string {
+	v := float64(cr)
+	switch {
+	case v == 0:
+		return "unbounded"
+	case v >= 1e9:
+		return strconv.FormatFloat(v/1e9, 'f', -1, 64) + "GHz"
+	case v >= 1e6:
+		return strconv.FormatFloat(v/1e6, 'f', -1, 64) + "MHz"
+	case v >= 1e3:
+		return strconv.FormatFloat(v/1e3, 'f', -1, 64) + "KHz"
+	default:
+		return strconv.FormatFloat(v, 'f', -1, 64) + "Hz"
+	}
+}
+
+// Set parses the given clock rate.
+func (cr *ClockRate) Set(s string) error {
+	v, err := ParseClockRate(s)
+	if err != nil {
+		return err
+	}
+	*cr = v
+	return nil
+}
+
+// ParseClockRate parses a clock frequency with an optional Hz, KHz, MHz or
+// GHz suffix. The suffix is not case sensitive.
+func ParseClockRate(s string) (ClockRate, error) {
+	str := strings.ToLower(strings.TrimSpace(s))
+	if str == "unbounded" {
+		return 0, nil
+	}
+
+	scale := 1.0
+	for _, u := range []struct {
+		suffix string
+		scale  float64
+	}{
+		{"ghz", 1e9},
+		{"mhz", 1e6},
+		{"khz", 1e3},
+		{"hz", 1},
+	} {
+		if strings.HasSuffix(str, u.suffix) {
+			str = strings.TrimSpace(str[:len(str)-len(u.suffix)])
+			scale = u.scale
+			break
+		}
+	}
+
+	v, err := strconv.ParseFloat(str, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid clock rate %q", s)
+	}
+
+	return ClockRate(v * scale), nil
+}
@@ -0,0 +1,37 @@
+package vm
+
+import "testing"
+
+func TestParseClockRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ClockRate
+	}{
+		{"0", 0},
+		{"unbounded", 0},
+		{"8000", 8000},
+		{"100Hz", 100},
+		{"250KHz", 250000},
+		{"250 khz", 250000},
+		{"1MHz", 1000000},
+		{"2.5mhz", 2500000},
+		{" 1GHz ", 1000000000},
+	}
+
+	for _, tt := range tests {
+		have, err := ParseClockRate(tt.in)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.in, err)
+		}
+
+		if have != tt.want {
+			t.Fatalf("%q: want %d; have %d", tt.in, tt.want, have)
+		}
+	}
+
+	for _, s := range []string{"", "MHz", "-1MHz", "1THz", "fast"} {
+		if _, err := ParseClockRate(s); err == nil {
+			t.Fatalf("%q: expected an error", s)
+		}
+	}
+}
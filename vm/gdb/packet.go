@@ -0,0 +1,110 @@
+package gdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// interrupt is the byte a client sends to interrupt a running program.
+const interrupt = 0x03
+
+// event defines something received from the client.
+type event struct {
+	packet    string // Packet contents, if this is a packet.
+	interrupt bool   // Is this an interrupt request?
+	invalid   bool   // Did the packet have an invalid checksum?
+}
+
+// readEvents reads packets and interrupt requests from r and sends them to
+// events. Acknowledgements sent by the client are skipped. The channel is
+// closed when r returns an error.
+func readEvents(r io.Reader, events chan<- event) {
+	defer close(events)
+
+	br := bufio.NewReader(r)
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return
+		}
+
+		switch b {
+		case interrupt:
+			events <- event{interrupt: true}
+		case '$':
+			ev, err := readPacket(br)
+			if err != nil {
+				return
+			}
+			events <- ev
+		}
+	}
+}
+
+// readPacket reads the remainder of a packet, following the leading '$'.
+// Escaped bytes are decoded.
+func readPacket(br *bufio.Reader) (event, error) {
+	var data []byte
+	var sum byte
+
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return event{}, err
+		}
+
+		if b == '#' {
+			break
+		}
+
+		sum += b
+
+		if b == '}' {
+			if b, err = br.ReadByte(); err != nil {
+				return event{}, err
+			}
+			sum += b
+			b ^= 0x20
+		}
+
+		data = append(data, b)
+	}
+
+	var checksum [2]byte
+	if _, err := io.ReadFull(br, checksum[:]); err != nil {
+		return event{}, err
+	}
+
+	want, err := strconv.ParseUint(string(checksum[:]), 16, 8)
+	if err != nil || byte(want) != sum {
+		return event{invalid: true}, nil
+	}
+
+	return event{packet: string(data)}, nil
+}
+
+// writePacket writes the given data as a packet to w.
+// Bytes with a special meaning in the protocol are escaped.
+func writePacket(w io.Writer, data string) error {
+	buf := make([]byte, 0, len(data)+4)
+	buf = append(buf, '$')
+
+	var sum byte
+	for i := 0; i < len(data); i++ {
+		b := data[i]
+		switch b {
+		case '$', '#', '}', '*':
+			buf = append(buf, '}')
+			sum += '}'
+			b ^= 0x20
+		}
+		buf = append(buf, b)
+		sum += b
+	}
+
+	buf = append(buf, fmt.Sprintf("#%02x", sum)...)
+	_, err := w.Write(buf)
+	return err
+}
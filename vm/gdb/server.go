@@ -0,0 +1,539 @@
+// Package gdb implements a server for the GDB remote serial protocol. It lets
+// standard debugging front-ends inspect and control a program running on
+// the SVM cpu.
+//
+// The register file is presented as R0-R7, RSP, RIP and RIA as 16-bit
+// registers, followed by RST as an 8-bit register. Register and memory
+// contents are transferred in the cpu's big-endian byte order. Memory
+// addresses beyond user memory refer to the registers, as they do for the cpu.
+//
+// Supported are register and memory reads and writes, software breakpoints,
+// single-stepping and continuing. A running program can be interrupted by the
+// client.
+package gdb
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/hexaflex/svm/devices/fffe/cpu"
+	"github.com/hexaflex/svm/vm"
+)
+
+// Signal numbers reported to the client when execution stops.
+const (
+	sigint  = 0x02 // Execution was interrupted by the client.
+	sigill  = 0x04 // The program crashed.
+	sigtrap = 0x05 // A step completed or a breakpoint was reached.
+)
+
+// registerFileSize is the size of the register file as transferred to the
+// client: twelve registers of which the last is only 8 bits wide.
+const registerFileSize = cpu.RegisterCapacity - 1
+
+// targetXML describes the register file to the client.
+const targetXML = `<?xml version="1.0"?>
+<!DOCTYPE target SYSTEM "gdb-target.dtd">
+<target version="1.0">
+  <feature name="org.hexaflex.svm.core">
+    <reg name="r0" bitsize="16" type="int" regnum="0"/>
+    <reg name="r1" bitsize="16" type="int"/>
+    <reg name="r2" bitsize="16" type="int"/>
+    <reg name="r3" bitsize="16" type="int"/>
+    <reg name="r4" bitsize="16" type="int"/>
+    <reg name="r5" bitsize="16" type="int"/>
+    <reg name="r6" bitsize="16" type="int"/>
+    <reg name="r7" bitsize="16" type="int"/>
+    <reg name="rsp" bitsize="16" type="data_ptr"/>
+    <reg name="rip" bitsize="16" type="code_ptr"/>
+    <reg name="ria" bitsize="16" type="code_ptr"/>
+    <reg name="rst" bitsize="8" type="int"/>
+  </feature>
+</target>
+`
+
+// Listen creates a listener for the given address. This is either a TCP
+// address like "localhost:1234" or a unix socket path prefixed with "unix:".
+func Listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		return net.Listen("unix", strings.TrimPrefix(addr, "unix:"))
+	}
+	return net.Listen("tcp", addr)
+}
+
+// Server serves the GDB remote serial protocol for a single cpu.
+type Server struct {
+	dbg *vm.Debugger
+}
+
+// NewServer creates a new server which controls the cpu through the given debugger.
+func NewServer(dbg *vm.Debugger) *Server {
+	return &Server{dbg: dbg}
+}
+
+// Serve accepts connections on l and serves them one at a time.
+// It returns when l fails to accept a connection, for example because it was closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		log.Println("gdb: client connected from", conn.RemoteAddr())
+		if err := s.ServeConn(conn); err != nil {
+			log.Println("gdb:", err)
+		}
+		conn.Close()
+		log.Println("gdb: client disconnected")
+	}
+}
+
+// ServeConn serves a single client session on rw. It returns when the client
+// detaches, kills the program or closes the connection.
+func (s *Server) ServeConn(rw io.ReadWriter) error {
+	events := make(chan event, 16)
+	go readEvents(rw, events)
+
+	sess := session{
+		dbg:         s.dbg,
+		w:           rw,
+		events:      events,
+		watchpoints: make(map[string]*cpu.Watchpoint),
+	}
+
+	// Watchpoints do not outlive the client which set them.
+	defer func() {
+		for _, w := range sess.watchpoints {
+			s.dbg.Controller().RemoveWatchpoint(w)
+		}
+	}()
+
+	return sess.run()
+}
+
+// session holds the state of a single client session.
+type session struct {
+	dbg         *vm.Debugger
+	w           io.Writer
+	events      <-chan event
+	noAck       bool                       // Has the client disabled acknowledgements?
+	watchpoints map[string]*cpu.Watchpoint // Watchpoints set by the client, by Z packet arguments.
+}
+
+// run handles packets until the session ends.
+func (s *session) run() error {
+	for ev := range s.events {
+		if ev.interrupt {
+			// The program is not running. Just report where it is.
+			if err := writePacket(s.w, s.stopReply(sigint)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !s.noAck {
+			ack := "+"
+			if ev.invalid {
+				ack = "-"
+			}
+			if _, err := io.WriteString(s.w, ack); err != nil {
+				return err
+			}
+		}
+
+		if ev.invalid {
+			continue
+		}
+
+		reply, done := s.handle(ev.packet)
+		if done {
+			if len(reply) > 0 {
+				return writePacket(s.w, reply)
+			}
+			return nil
+		}
+
+		if err := writePacket(s.w, reply); err != nil {
+			return err
+		}
+
+		if ev.packet == "QStartNoAckMode" {
+			s.noAck = true
+		}
+	}
+
+	return nil
+}
+
+// handle handles a single packet and returns the reply. An empty reply tells
+// the client the packet is not supported. Returns true if the session ends.
+func (s *session) handle(packet string) (string, bool) {
+	if len(packet) == 0 {
+		return "", false
+	}
+
+	args := packet[1:]
+
+	switch packet[0] {
+	case '?':
+		return s.stopReply(sigtrap), false
+	case 'g':
+		return s.readRegisters(), false
+	case 'G':
+		return s.writeRegisters(args), false
+	case 'p':
+		return s.readRegister(args), false
+	case 'P':
+		return s.writeRegister(args), false
+	case 'm':
+		return s.readMemory(args), false
+	case 'M':
+		return s.writeMemory(args), false
+	case 'Z', 'z':
+		return s.breakpoint(packet[0] == 'Z', args), false
+	case 'c':
+		return s.resume(args, s.dbg.Continue), false
+	case 's':
+		return s.resume(args, s.dbg.Step), false
+	case 'b':
+		return s.reverse(args), false
+	case 'v':
+		return s.handleV(args), false
+	case 'q', 'Q':
+		return s.query(packet), false
+	case 'H', 'T':
+		return "OK", false
+	case 'D':
+		return "OK", true
+	case 'k':
+		return "", true
+	}
+
+	return "", false
+}
+
+// handleV handles the multi-letter 'v' packets.
+func (s *session) handleV(args string) string {
+	switch {
+	case args == "Cont?":
+		return "vCont;c;s"
+	case strings.HasPrefix(args, "Cont;"):
+		// Only a single thread exists, so the first action applies to it.
+		action := strings.TrimPrefix(args, "Cont;") + " "
+		switch action[0] {
+		case 'c':
+			return s.resume("", s.dbg.Continue)
+		case 's':
+			return s.resume("", s.dbg.Step)
+		}
+		return "E01"
+	}
+	return ""
+}
+
+// reverse handles the reverse execution packets: "bs" and "bc".
+func (s *session) reverse(args string) string {
+	switch args {
+	case "s":
+		return s.resume("", s.dbg.StepBack)
+	case "c":
+		return s.resume("", s.dbg.ReverseContinue)
+	}
+	return ""
+}
+
+// query handles general query and set packets.
+func (s *session) query(packet string) string {
+	switch {
+	case strings.HasPrefix(packet, "qSupported"):
+		return "PacketSize=1000;qXfer:features:read+;QStartNoAckMode+;ReverseStep+;ReverseContinue+"
+	case packet == "QStartNoAckMode":
+		return "OK"
+	case packet == "qAttached":
+		return "1"
+	case packet == "qC":
+		return "QC1"
+	case packet == "qfThreadInfo":
+		return "m1"
+	case packet == "qsThreadInfo":
+		return "l"
+	case packet == "qOffsets":
+		return "Text=0;Data=0;Bss=0"
+	case packet == "qSymbol::":
+		return "OK"
+	case strings.HasPrefix(packet, "qXfer:features:read:target.xml:"):
+		return readXfer(targetXML, strings.TrimPrefix(packet, "qXfer:features:read:target.xml:"))
+	}
+	return ""
+}
+
+// readXfer returns the part of data requested by a qXfer read packet
+// with the given "offset,length" arguments.
+func readXfer(data, args string) string {
+	offset, length, ok := parsePair(args, ",")
+	if !ok {
+		return "E01"
+	}
+
+	if offset >= len(data) {
+		return "l"
+	}
+
+	data = data[offset:]
+	if len(data) > length {
+		return "m" + data[:length]
+	}
+	return "l" + data
+}
+
+// resume continues execution using the given function, after optionally
+// moving RIP to the address in args. Returns the stop reply.
+//
+// While the program runs, an interrupt request from the client pauses it.
+func (s *session) resume(args string, f func() (vm.StopReason, error)) string {
+	if len(args) > 0 {
+		addr, err := strconv.ParseUint(args, 16, 16)
+		if err != nil {
+			return "E01"
+		}
+		s.memory().SetU16(cpu.RIP, int(addr))
+	}
+
+	type result struct {
+		reason vm.StopReason
+		err    error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		reason, err := f()
+		done <- result{reason, err}
+	}()
+
+	for {
+		select {
+		case r := <-done:
+			return s.stopped(r.reason, r.err)
+		case ev, ok := <-s.events:
+			if !ok || ev.interrupt {
+				s.dbg.Pause()
+			}
+			if !ok {
+				// Drain the result so the debugger is idle when we return.
+				r := <-done
+				return s.stopped(r.reason, r.err)
+			}
+		}
+	}
+}
+
+// stopped returns the stop reply for the given outcome of a resume.
+func (s *session) stopped(reason vm.StopReason, err error) string {
+	if err != nil {
+		if err != vm.ErrHalted {
+			log.Println("gdb:", err)
+			return s.stopReply(sigill)
+		}
+		return s.stopReply(sigtrap)
+	}
+
+	switch reason {
+	case vm.StopPause:
+		return s.stopReply(sigint)
+	case vm.StopWatchpoint:
+		return s.watchReply(s.dbg.Break())
+	case vm.StopHistory:
+		return fmt.Sprintf("T%02xreplaylog:begin;", sigtrap)
+	default:
+		return s.stopReply(sigtrap)
+	}
+}
+
+// watchReply returns the stop reply for a triggered watchpoint.
+func (s *session) watchReply(brk *cpu.Break) string {
+	kind := "awatch"
+	switch brk.Watchpoint.Access {
+	case cpu.Write:
+		kind = "watch"
+	case cpu.Read:
+		kind = "rwatch"
+	}
+	return fmt.Sprintf("T%02x%s:%x;", sigtrap, kind, brk.Watchpoint.Address)
+}
+
+// stopReply returns the reply describing why execution stopped. A halted
+// program is reported as having exited.
+func (s *session) stopReply(signal int) string {
+	if s.dbg.Halted() {
+		return "W00"
+	}
+	return fmt.Sprintf("S%02x", signal)
+}
+
+// memory returns the cpu memory.
+func (s *session) memory() cpu.Memory {
+	return s.dbg.Controller().Memory().(cpu.Memory)
+}
+
+func (s *session) readRegisters() string {
+	return hex.EncodeToString(s.memory()[cpu.R0 : cpu.R0+registerFileSize])
+}
+
+func (s *session) writeRegisters(args string) string {
+	data, err := hex.DecodeString(args)
+	if err != nil || len(data) != registerFileSize {
+		return "E01"
+	}
+
+	copy(s.memory()[cpu.R0:], data)
+	return "OK"
+}
+
+// register returns the memory occupied by register n.
+func (s *session) register(n string) ([]byte, bool) {
+	index, err := strconv.ParseUint(n, 16, 8)
+	if err != nil || index*2 >= registerFileSize {
+		return nil, false
+	}
+
+	addr := cpu.R0 + int(index)*2
+	if addr == cpu.RST {
+		return s.memory()[addr : addr+1], true
+	}
+	return s.memory()[addr : addr+2], true
+}
+
+func (s *session) readRegister(args string) string {
+	reg, ok := s.register(args)
+	if !ok {
+		return "E01"
+	}
+	return hex.EncodeToString(reg)
+}
+
+func (s *session) writeRegister(args string) string {
+	index := strings.IndexByte(args, '=')
+	if index == -1 {
+		return "E01"
+	}
+
+	reg, ok := s.register(args[:index])
+	if !ok {
+		return "E01"
+	}
+
+	data, err := hex.DecodeString(args[index+1:])
+	if err != nil || len(data) != len(reg) {
+		return "E01"
+	}
+
+	copy(reg, data)
+	return "OK"
+}
+
+func (s *session) readMemory(args string) string {
+	addr, size, ok := parsePair(args, ",")
+	if !ok || addr+size > cpu.MemoryCapacity {
+		return "E01"
+	}
+	return hex.EncodeToString(s.memory()[addr : addr+size])
+}
+
+func (s *session) writeMemory(args string) string {
+	index := strings.IndexByte(args, ':')
+	if index == -1 {
+		return "E01"
+	}
+
+	addr, size, ok := parsePair(args[:index], ",")
+	if !ok || addr+size > cpu.MemoryCapacity {
+		return "E01"
+	}
+
+	data, err := hex.DecodeString(args[index+1:])
+	if err != nil || len(data) != size {
+		return "E01"
+	}
+
+	copy(s.memory()[addr:], data)
+	return "OK"
+}
+
+// breakpoint sets or clears a breakpoint or watchpoint. Hardware breakpoints
+// are treated as software breakpoints. Types 2, 3 and 4 are write, read and
+// access watchpoints.
+func (s *session) breakpoint(set bool, args string) string {
+	fields := strings.Split(args, ",")
+	if len(fields) < 3 {
+		return "E01"
+	}
+
+	addr, err := strconv.ParseUint(fields[1], 16, 32)
+	if err != nil || addr >= cpu.MemoryCapacity {
+		return "E01"
+	}
+
+	var access cpu.Access
+	switch fields[0] {
+	case "0", "1":
+		if set {
+			s.dbg.SetBreakpoint(int(addr), nil)
+		} else {
+			s.dbg.ClearBreakpoint(int(addr))
+		}
+		return "OK"
+	case "2":
+		access = cpu.Write
+	case "3":
+		access = cpu.Read
+	case "4":
+		access = cpu.ReadWrite
+	default:
+		return ""
+	}
+
+	size, err := strconv.ParseUint(fields[2], 16, 32)
+	if err != nil || size == 0 {
+		return "E01"
+	}
+
+	key := strings.Join(fields[:3], ",")
+	if w, ok := s.watchpoints[key]; ok {
+		s.dbg.Controller().RemoveWatchpoint(w)
+		delete(s.watchpoints, key)
+	}
+
+	if set {
+		w := &cpu.Watchpoint{Address: int(addr), Size: int(size), Access: access}
+		s.dbg.Controller().AddWatchpoint(w)
+		s.watchpoints[key] = w
+	}
+
+	return "OK"
+}
+
+// parsePair parses two hexadecimal numbers separated by sep.
+func parsePair(v, sep string) (int, int, bool) {
+	index := strings.Index(v, sep)
+	if index == -1 {
+		return 0, 0, false
+	}
+
+	a, err := strconv.ParseUint(v[:index], 16, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	b, err := strconv.ParseUint(v[index+len(sep):], 16, 32)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return int(a), int(b), true
+}
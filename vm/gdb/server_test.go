@@ -0,0 +1,194 @@
+package gdb
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hexaflex/svm/asm"
+	"github.com/hexaflex/svm/devices/fffe/fd35"
+	"github.com/hexaflex/svm/vm"
+)
+
+const serverTestSource = `
+:main {
+    mov r0, 1
+:loop
+    add r0, r0, 1
+    jmp loop
+:exit
+    halt
+}
+`
+
+func TestServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "main.svm")
+	if err := ioutil.WriteFile(file, []byte(serverTestSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ar, err := asm.Build(file, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := filepath.Join(dir, "main.img")
+	data := make([]byte, fd35.FloppySize)
+	copy(data, ar.Instructions)
+	if err := ioutil.WriteFile(image, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	src := vm.NewSource(&ar.Debug, nil)
+	loop, err := src.Resolve("main/loop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exit, err := src.Resolve("main/exit")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	floppy := fd35.New(image, true)
+	dbg := vm.NewDebugger(vm.NewCPUController(nil, floppy), &ar.Debug)
+	dbg.SetHistory(100)
+	if err := dbg.Boot(floppy); err != nil {
+		t.Fatal(err)
+	}
+	defer dbg.Controller().Shutdown()
+
+	l, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go NewServer(dbg).Serve(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	c := client{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	if reply := c.call("qSupported:swbreak+"); !strings.Contains(reply, "qXfer:features:read+") {
+		t.Fatalf("unexpected qSupported reply %q", reply)
+	}
+
+	if reply := c.call("qXfer:features:read:target.xml:0,1000"); !strings.Contains(reply, `name="rip"`) {
+		t.Fatalf("unexpected target description %q", reply)
+	}
+
+	c.expect("?", "S05")
+	// The boot loader leaves R0 and the compare flag set.
+	c.expect("g", "0001"+strings.Repeat("0", 7*4)+"fffe"+"0000"+"0000"+"01")
+
+	c.expect("s", "S05")
+	c.expect("p9", fmt.Sprintf("%04x", loop))
+	c.expect("p0", "0001")
+	c.expect("pb", "01")
+
+	c.expect(fmt.Sprintf("Z0,%x,1", loop), "OK")
+	c.expect("c", "S05")
+	c.expect("p0", "0002")
+	c.expect("P0=0010", "OK")
+	c.expect("p0", "0010")
+	c.expect(fmt.Sprintf("z0,%x,1", loop), "OK")
+
+	c.expect("Z2,10000,2", "OK")
+	c.expect("c", "T05watch:10000;")
+	c.expect("p0", "0011")
+	c.expect("z2,10000,2", "OK")
+
+	c.expect("bs", "S05")
+	c.expect("p0", "0010")
+	c.expect("p9", fmt.Sprintf("%04x", loop))
+	c.expect("bc", "T05replaylog:begin;")
+	c.expect("p9", "0000")
+	c.expect("P0=0010", "OK")
+
+	c.expect("M100,3:0102ff", "OK")
+	c.expect("m100,4", "0102ff00")
+	c.expect("m10000,2", "0010")
+	c.expect("m10000,100", "E01")
+
+	c.send("c")
+	time.Sleep(50 * time.Millisecond)
+	conn.Write([]byte{interrupt})
+	c.expect("", "S02")
+
+	c.expect(fmt.Sprintf("c%x", exit), "W00")
+	c.expect("?", "W00")
+	c.expect("D", "OK")
+}
+
+// client implements the client side of the protocol for tests.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// send sends a packet and waits for its acknowledgement.
+func (c *client) send(packet string) {
+	c.t.Helper()
+
+	if err := writePacket(c.conn, packet); err != nil {
+		c.t.Fatal(err)
+	}
+
+	if b, err := c.r.ReadByte(); err != nil || b != '+' {
+		c.t.Fatalf("%s: expected acknowledgement; have %q, %v", packet, b, err)
+	}
+}
+
+// receive reads a reply packet and acknowledges it.
+func (c *client) receive() string {
+	c.t.Helper()
+
+	if b, err := c.r.ReadByte(); err != nil || b != '$' {
+		c.t.Fatalf("expected packet; have %q, %v", b, err)
+	}
+
+	ev, err := readPacket(c.r)
+	if err != nil || ev.invalid {
+		c.t.Fatalf("invalid reply packet: %v", err)
+	}
+
+	c.conn.Write([]byte{'+'})
+	return ev.packet
+}
+
+// call sends a packet and returns the reply.
+func (c *client) call(packet string) string {
+	c.t.Helper()
+	c.send(packet)
+	return c.receive()
+}
+
+// expect sends a packet and checks the reply. An empty packet only reads a reply.
+func (c *client) expect(packet, want string) {
+	c.t.Helper()
+
+	if len(packet) > 0 {
+		c.send(packet)
+	}
+
+	if have := c.receive(); have != want {
+		c.t.Fatalf("%s: reply mismatch: want %q; have %q", packet, want, have)
+	}
+}
@@ -0,0 +1,449 @@
+package vm
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hexaflex/svm/asm/ar"
+	"github.com/hexaflex/svm/asm/parser"
+)
+
+// Source maps addresses in a program to source locations and back.
+// It uses the program's debug data and the source files it refers to.
+type Source struct {
+	debug    *ar.Debug
+	includes []string         // Search paths for source files.
+	files    map[int][]string // Cached source file contents, by file index.
+	labels   []Label          // Label definitions, sorted by address. Loaded on demand.
+}
+
+// Label defines a label in the program source.
+type Label struct {
+	Name    string // Fully qualified name. Scopes are separated with a '/'.
+	Address int    // Address the label refers to.
+}
+
+// NewSource creates a new source mapping for the given debug data. Source
+// files which can not be found as-is, are searched for in the given
+// include search paths.
+func NewSource(debug *ar.Debug, includes []string) *Source {
+	return &Source{
+		debug:    debug,
+		includes: includes,
+		files:    make(map[int][]string),
+	}
+}
+
+// Debug returns the underlying debug data.
+func (s *Source) Debug() *ar.Debug {
+	return s.debug
+}
+
+// Find returns the debug data associated with the given address.
+// Returns nil if there is none.
+func (s *Source) Find(addr int) *ar.DebugData {
+	return s.debug.Find(addr)
+}
+
+// File returns the name of the source file with the given index.
+// Returns "" if the index is not valid.
+func (s *Source) File(index int) string {
+	if index < 0 || index >= len(s.debug.Files) {
+		return ""
+	}
+	return s.debug.Files[index]
+}
+
+// Line returns the text at the given 1-based line number in the source file
+// with the given index.
+func (s *Source) Line(file, line int) (string, error) {
+	lines, err := s.readFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	if line < 1 || line > len(lines) {
+		return "", fmt.Errorf("%s has no line %d", s.File(file), line)
+	}
+
+	return lines[line-1], nil
+}
+
+// Resolve returns the address for the given location. This is either
+// an address, a label name or a source location in the form "file:line".
+//
+// Addresses use Go syntax (255, 0xff) or assembler syntax (16#ff).
+// Label names are qualified with their scopes, separated by '/' or '.'.
+// A name which is not fully qualified matches if it is unique. Names which
+// match no label are looked up in the constants of the debug symbol table,
+// so conditions can refer to them. File names
+// match the full path as it was given to the assembler, or any of its
+// trailing path elements. If a line holds no code, the first following
+// line with code is used.
+func (s *Source) Resolve(loc string) (int, error) {
+	loc = strings.TrimSpace(loc)
+	if len(loc) == 0 {
+		return 0, fmt.Errorf("empty location")
+	}
+
+	if addr, err := ParseNumber(loc); err == nil {
+		return addr, nil
+	}
+
+	if index := strings.LastIndex(loc, ":"); index > -1 {
+		if line, err := strconv.Atoi(loc[index+1:]); err == nil {
+			return s.resolveLine(loc[:index], line)
+		}
+	}
+
+	return s.resolveLabel(loc)
+}
+
+// resolveLine returns the address of the first instruction at or after the given line.
+func (s *Source) resolveLine(file string, line int) (int, error) {
+	sym := s.lineSymbol(line, func(index int) bool {
+		return matchFile(s.File(index), file)
+	})
+
+	if sym == nil {
+		return 0, fmt.Errorf("no code at or after %s:%d", file, line)
+	}
+
+	return sym.Address, nil
+}
+
+// LineSymbol returns the debug data for the first instruction at or after
+// the given line in the source file with the given index. Returns nil if
+// there is none.
+func (s *Source) LineSymbol(file, line int) *ar.DebugData {
+	return s.lineSymbol(line, func(index int) bool {
+		return index == file
+	})
+}
+
+// lineSymbol returns the debug data for the first instruction at or after
+// the given line, in files accepted by match.
+func (s *Source) lineSymbol(line int, match func(int) bool) *ar.DebugData {
+	var found *ar.DebugData
+
+	for i := range s.debug.Symbols {
+		sym := &s.debug.Symbols[i]
+		if sym.Line < line || !match(sym.File) {
+			continue
+		}
+
+		if found == nil || sym.Line < found.Line || (sym.Line == found.Line && sym.Address < found.Address) {
+			found = sym
+		}
+	}
+
+	return found
+}
+
+// Nearest returns the debug data for the instruction at the given address
+// or the closest one before it. Returns nil if there is none.
+func (s *Source) Nearest(addr int) *ar.DebugData {
+	var found *ar.DebugData
+
+	for i := range s.debug.Symbols {
+		sym := &s.debug.Symbols[i]
+		if sym.Address <= addr && (found == nil || sym.Address > found.Address) {
+			found = sym
+		}
+	}
+
+	return found
+}
+
+// FileIndex returns the index of the source file at the given path.
+// Returns -1 if it is not part of the program.
+func (s *Source) FileIndex(path string) int {
+	if abs, err := filepath.Abs(path); err == nil {
+		for index := range s.debug.Files {
+			if s.Path(index) == abs {
+				return index
+			}
+		}
+	}
+
+	for index, name := range s.debug.Files {
+		if matchFile(name, path) {
+			return index
+		}
+	}
+
+	return -1
+}
+
+// Path returns the absolute path of the source file with the given index,
+// as it was found on disk. Returns the recorded file name if it can not
+// be found.
+func (s *Source) Path(file int) string {
+	path, ok := s.findFile(file)
+	if !ok {
+		return s.File(file)
+	}
+
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+
+	return path
+}
+
+// matchFile returns true if name refers to the source file path.
+func matchFile(path, name string) bool {
+	path = filepath.ToSlash(filepath.Clean(path))
+	name = filepath.ToSlash(filepath.Clean(name))
+	return path == name || strings.HasSuffix(path, "/"+name)
+}
+
+// resolveLabel returns the address of the given label. If there is no such
+// label, constants from the debug symbol table are tried as well.
+func (s *Source) resolveLabel(name string) (int, error) {
+	addr, err := resolveName(s.Labels(), name)
+	if err == errUnknownName {
+		if addr, err = resolveName(s.constants(), name); err == errUnknownName {
+			err = fmt.Errorf("unknown location %q", name)
+		}
+	}
+	return addr, err
+}
+
+// errUnknownName is returned by resolveName if no name matches.
+var errUnknownName = errors.New("unknown name")
+
+// resolveName returns the value of the given name in set. A name which is
+// not fully qualified matches if it is unique.
+func resolveName(set []Label, name string) (int, error) {
+	name = strings.ToLower(strings.ReplaceAll(name, ".", "/"))
+
+	var matches []Label
+	for _, lbl := range set {
+		lname := strings.ToLower(lbl.Name)
+		if lname == name {
+			return lbl.Address, nil
+		}
+		if strings.HasSuffix(lname, "/"+name) {
+			matches = append(matches, lbl)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return 0, errUnknownName
+	case 1:
+		return matches[0].Address, nil
+	}
+
+	names := make([]string, len(matches))
+	for i, lbl := range matches {
+		names[i] = lbl.Name
+	}
+	return 0, fmt.Errorf("ambiguous name %q; could be any of: %s", name, strings.Join(names, ", "))
+}
+
+// constants returns the constants in the debug symbol table.
+// Their values are stored as addresses.
+func (s *Source) constants() []Label {
+	var out []Label
+	for _, sym := range s.debug.Names {
+		if sym.Kind == ar.Constant {
+			out = append(out, Label{Name: sym.Name, Address: sym.Value})
+		}
+	}
+	return out
+}
+
+// LabelAt returns the closest label at or before the given address, along
+// with the distance between the two. Returns false if there is none.
+func (s *Source) LabelAt(addr int) (Label, int, bool) {
+	labels := s.Labels()
+	index := sort.Search(len(labels), func(i int) bool {
+		return labels[i].Address > addr
+	})
+
+	if index == 0 {
+		return Label{}, 0, false
+	}
+
+	lbl := labels[index-1]
+	return lbl, addr - lbl.Address, true
+}
+
+// Labels returns all labels defined in the program source, sorted by address.
+//
+// Labels are taken from the symbol table in the debug data. Older debug
+// data has no symbol table. The labels are then found by parsing the source
+// files. A label's address is that of the first instruction or data
+// directive defined after it in the same file. Source files which can not
+// be found or parsed are skipped.
+func (s *Source) Labels() []Label {
+	if s.labels != nil {
+		return s.labels
+	}
+
+	s.labels = []Label{}
+	for _, sym := range s.debug.Names {
+		if sym.Kind == ar.Label {
+			s.labels = append(s.labels, Label{Name: sym.Name, Address: sym.Value})
+		}
+	}
+
+	if len(s.labels) == 0 {
+		for index := range s.debug.Files {
+			s.loadLabels(index)
+		}
+	}
+
+	sort.SliceStable(s.labels, func(i, j int) bool {
+		return s.labels[i].Address < s.labels[j].Address
+	})
+
+	return s.labels
+}
+
+// loadLabels parses the given source file and adds its labels to the label list.
+func (s *Source) loadLabels(file int) {
+	path, ok := s.findFile(file)
+	if !ok {
+		return
+	}
+
+	ast := parser.NewAST()
+	if err := ast.ParseFile(path); err != nil {
+		return
+	}
+
+	var scope parser.Scope
+	var anonymous int
+
+	nodes := ast.Nodes()
+	for i := 0; i < nodes.Len(); i++ {
+		n := nodes.At(i)
+
+		switch n.Type() {
+		case parser.ScopeBegin:
+			// Mimic the naming rules in syntax.Verify: scopes take the name
+			// of a label directly preceding them, if there is one.
+			name := n.(*parser.Value).Value
+			if len(name) == 0 {
+				if i > 0 && nodes.At(i-1).Type() == parser.Label {
+					name = nodes.At(i - 1).(*parser.Value).Value
+				} else {
+					anonymous++
+					name = fmt.Sprintf("$%d", anonymous)
+				}
+			}
+			scope = scope.Join(name)
+
+		case parser.ScopeEnd:
+			scope, _ = scope.Split()
+
+		case parser.Label:
+			lbl := n.(*parser.Value)
+			if addr, ok := s.addressAfter(file, lbl.Position().Offset); ok {
+				s.labels = append(s.labels, Label{
+					Name:    filepath.ToSlash(scope.Join(lbl.Value).String()),
+					Address: addr,
+				})
+			}
+		}
+	}
+}
+
+// addressAfter returns the address of the first debug symbol defined
+// at or after the given byte offset in the given file.
+func (s *Source) addressAfter(file, offset int) (int, bool) {
+	var found *ar.DebugData
+
+	for i := range s.debug.Symbols {
+		sym := &s.debug.Symbols[i]
+		if sym.File != file || sym.Offset < offset {
+			continue
+		}
+		if found == nil || sym.Offset < found.Offset {
+			found = sym
+		}
+	}
+
+	if found == nil {
+		return 0, false
+	}
+	return found.Address, true
+}
+
+// readFile returns the contents of the given source file as a list of lines.
+func (s *Source) readFile(file int) ([]string, error) {
+	if lines, ok := s.files[file]; ok {
+		return lines, nil
+	}
+
+	path, ok := s.findFile(file)
+	if !ok {
+		return nil, fmt.Errorf("source file %q not found", s.File(file))
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer fd.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimRight(scanner.Text(), "\r"))
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	s.files[file] = lines
+	return lines, nil
+}
+
+// findFile returns the path to the given source file on disk.
+// Returns false if it can not be found.
+func (s *Source) findFile(file int) (string, bool) {
+	name := s.File(file)
+	if len(name) == 0 {
+		return "", false
+	}
+
+	if stat, err := os.Stat(name); err == nil && !stat.IsDir() {
+		return name, true
+	}
+
+	for _, inc := range s.includes {
+		path := filepath.Join(inc, name)
+		if stat, err := os.Stat(path); err == nil && !stat.IsDir() {
+			return path, true
+		}
+	}
+
+	return "", false
+}
+
+// ParseNumber parses an integer in Go syntax (255, 0xff) or in
+// assembler syntax (16#ff).
+func ParseNumber(v string) (int, error) {
+	var n int64
+	var err error
+
+	if strings.Contains(v, "#") {
+		n, err = parser.ParseNumber(v)
+	} else {
+		n, err = strconv.ParseInt(v, 0, 64)
+	}
+
+	return int(n), err
+}
@@ -0,0 +1,87 @@
+package vm
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hexaflex/svm/asm"
+	"github.com/hexaflex/svm/asm/ar"
+)
+
+const sourceTestSource = `
+const Limit = 10
+
+:main {
+    mov r0, 0
+:loop
+    add r0, r0, 1
+    clt r0, Limit
+    jnz loop
+    halt
+}
+
+:data {
+:value
+    d16 0
+}
+`
+
+func TestSourceNames(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "main.svm")
+	if err := ioutil.WriteFile(file, []byte(sourceTestSource), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := asm.Build(file, nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Labels from the symbol table must match those found in the source.
+	var legacy ar.Debug
+	legacy.Files = archive.Debug.Files
+	legacy.Symbols = archive.Debug.Symbols
+
+	want := NewSource(&legacy, nil).Labels()
+	have := NewSource(&archive.Debug, nil).Labels()
+	if len(want) == 0 || !reflect.DeepEqual(want, have) {
+		t.Fatalf("label mismatch:\nwant: %v\nhave: %v", want, have)
+	}
+
+	src := NewSource(&archive.Debug, nil)
+	if v, err := src.Resolve("limit"); err != nil || v != 10 {
+		t.Fatalf("constant mismatch: want 10; have %d (%v)", v, err)
+	}
+
+	if lbl, offset, ok := src.LabelAt(archive.Debug.Symbols[1].Address + 1); !ok || lbl.Name != "main/loop" || offset != 1 {
+		t.Fatalf("unexpected label %v+%d", lbl, offset)
+	}
+
+	// Names survive a round trip through the file format and
+	// debug data without a symbol table stays that way.
+	for _, dbg := range []*ar.Debug{&archive.Debug, &legacy} {
+		var buf bytes.Buffer
+		if err := dbg.Save(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		var loaded ar.Debug
+		if err := loaded.Load(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(&loaded, dbg) {
+			t.Fatalf("debug data mismatch:\nwant: %+v\nhave: %+v", dbg, &loaded)
+		}
+	}
+}
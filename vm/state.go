@@ -0,0 +1,50 @@
+package vm
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// StateFile returns the name of the save state file for the given image and slot.
+// This is a file with the same name as the image, but with a .stateN extension.
+func StateFile(image string, slot int) string {
+	if index := strings.LastIndex(image, "."); index > -1 {
+		image = image[:index]
+	}
+	return fmt.Sprintf("%s.state%d", image, slot)
+}
+
+// SaveState writes a snapshot of the complete machine state to the given file.
+func SaveState(c *CPUController, file string) error {
+	fd, err := os.Create(file)
+	if err != nil {
+		return errors.Wrapf(err, "failed to save state")
+	}
+
+	w := bufio.NewWriter(fd)
+	if err = c.Snapshot(w); err == nil {
+		err = w.Flush()
+	}
+
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+
+	return errors.Wrapf(err, "failed to save state")
+}
+
+// LoadState restores the complete machine state from the given file.
+// The program must have been booted already.
+func LoadState(c *CPUController, file string) error {
+	fd, err := os.Open(file)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load state")
+	}
+
+	defer fd.Close()
+	return errors.Wrapf(c.Restore(bufio.NewReader(fd)), "failed to load state")
+}
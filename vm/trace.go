@@ -0,0 +1,91 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hexaflex/svm/arch"
+	"github.com/hexaflex/svm/asm/ar"
+	"github.com/hexaflex/svm/devices/fffe/cpu"
+)
+
+// LoadDebug loads the debug data associated with the given image file into dbg.
+// This is the debug data embedded in an archive. For raw programs and floppy
+// images, it is read from a separate file. See ar.LoadFile. Returns an error
+// for which os.IsNotExist holds if there is no debug data.
+func LoadDebug(image string, dbg *ar.Debug) error {
+	dbg.Clear()
+
+	a, err := ar.LoadFile(image)
+	if err != nil {
+		return err
+	}
+
+	if a.Debug.Empty() {
+		return &os.PathError{Op: "load debug data", Path: image, Err: os.ErrNotExist}
+	}
+
+	*dbg = a.Debug
+	return nil
+}
+
+// FormatTrace returns a human-readable line of trace output for the given instruction.
+// Source context is added if dbg is not nil. Files holds the source file names
+// referenced by dbg.
+func FormatTrace(i *cpu.Instruction, dbg *ar.DebugData, files []string) string {
+	var sb strings.Builder
+	sb.Grow(120)
+
+	name, _ := arch.Name(i.Opcode)
+	argc := arch.Argc(i.Opcode)
+
+	for j := 0; j < argc; j++ {
+		argv := i.Args[j]
+		_type := argv.Type.Name()
+
+		switch argv.Mode {
+		case arch.ImmediateConstant:
+			fmt.Fprintf(&sb, "%3s %04x", _type, argv.Value)
+		case arch.IndirectConstant:
+			fmt.Fprintf(&sb, "%3s %04x %04x", _type, argv.Address, argv.Value)
+		case arch.ImmediateRegister:
+			index := (argv.Address - cpu.UserMemoryCapacity) / 2
+			fmt.Fprintf(&sb, "%3s %4s %04x", _type, arch.RegisterName(index), argv.Value)
+		case arch.IndirectRegister, arch.IndirectRegisterOffset, arch.IndirectRegisterIndex:
+			fmt.Fprintf(&sb, "%3s %04x %04x", _type, argv.Address, argv.Value)
+		}
+
+		if j < argc-1 {
+			fmt.Fprintf(&sb, ", ")
+		}
+	}
+
+	// Add source context of it is available.
+	if dbg != nil && dbg.File < len(files) {
+		pad(&sb, 50)
+		file := files[dbg.File]
+		if len(file) > 0 {
+			fmt.Fprintf(&sb, " %s:%d:%d", file, dbg.Line, dbg.Col)
+		}
+	}
+
+	return fmt.Sprintf("%04x %5s  %s", i.IP, name, sb.String())
+}
+
+// pad padds sb with spaces until it reaches the given size.
+var pad = func() func(*strings.Builder, int) {
+	set := strings.Repeat(" ", 80)
+	return func(sb *strings.Builder, size int) {
+		if sb.Len() >= size {
+			return
+		}
+		if size > len(set) {
+			size = len(set)
+		}
+		if size < sb.Len() {
+			size = sb.Len()
+		}
+		sb.WriteString(set[:size-sb.Len()])
+	}
+}()